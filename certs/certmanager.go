@@ -2,24 +2,68 @@ package certs
 
 import (
 	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/notary/trustmanager"
 	"github.com/docker/notary/tuf/data"
 	"github.com/docker/notary/tuf/signed"
+	"github.com/docker/notary/tuf/utils"
 )
 
 // Manager is an abstraction around trusted root CA stores
 type Manager struct {
 	trustedCAStore          trustmanager.X509Store
 	trustedCertificateStore trustmanager.X509Store
+	trustPinning            TrustPinConfig
+	// predecessors maps the ID of a trusted certificate to the certificate
+	// it replaced, whose roots are still accepted during the grace period.
+	// They are persisted in predecessorStore, so that they survive restarts.
+	predecessors     map[string]predecessorLink
+	predecessorStore *trustmanager.SimpleFileStore
 }
 
-const trustDir = "trusted_certificates"
+// predecessorLink is the certificate replaced by a trusted certificate, and
+// the end of the grace period during which its roots are still accepted
+type predecessorLink struct {
+	cert    *x509.Certificate
+	expires time.Time
+}
+
+// predecessorFile is how a predecessorLink is stored next to the trusted
+// certificates, in a file named after the ID of the certificate replacing it
+type predecessorFile struct {
+	Cert    []byte    `json:"cert"`
+	Expires time.Time `json:"expires"`
+}
+
+// TrustPinConfig pins the root certificates that are trusted for a GUN, so
+// that even the first root downloaded for it is validated against a known
+// anchor, instead of being trusted on first use.
+type TrustPinConfig struct {
+	// Certs maps a GUN to the IDs of the only root certificates (which are
+	// also the root key IDs) allowed to sign its root
+	Certs map[string][]string
+
+	// CA, if set, must have issued the root certificates of every GUN that
+	// has no entry in Certs
+	CA *x509.Certificate
+}
+
+const (
+	trustDir           = "trusted_certificates"
+	predecessorFileExt = "predecessor"
+)
+
+// PredecessorGracePeriod is how long after a trusted certificate becomes valid
+// that roots signed by the certificate it replaced are still accepted
+const PredecessorGracePeriod = 30 * 24 * time.Hour
 
 // ErrValidationFail is returned when there is no valid trusted certificates
 // being served inside of the roots.json
@@ -45,9 +89,27 @@ func (err ErrRootRotationFail) Error() string {
 	return fmt.Sprintf("could not rotate trust to a new trusted root: %s", err.Reason)
 }
 
+// ErrTrustPinMismatch is returned when none of the certificates in a root
+// match the trust pinned for its GUN
+type ErrTrustPinMismatch struct {
+	GUN string
+}
+
+// Error returns the GUN whose root failed trust pinning
+func (err ErrTrustPinMismatch) Error() string {
+	return fmt.Sprintf("root for %s is not signed by a pinned certificate", err.GUN)
+}
+
 // NewManager returns an initialized Manager, or an error
 // if it fails to load certificates
 func NewManager(baseDir string) (*Manager, error) {
+	return NewManagerWithTrustPinning(baseDir, TrustPinConfig{})
+}
+
+// NewManagerWithTrustPinning returns an initialized Manager that only trusts
+// the roots allowed by trustPinning for the GUNs it pins, or an error if it
+// fails to load certificates
+func NewManagerWithTrustPinning(baseDir string, trustPinning TrustPinConfig) (*Manager, error) {
 	trustPath := filepath.Join(baseDir, trustDir)
 
 	// Load all CAs that aren't expired and don't use SHA1
@@ -74,12 +136,48 @@ func NewManager(baseDir string) (*Manager, error) {
 		return nil, err
 	}
 
+	// The predecessor links are stored with a different extension than the
+	// certificates, so the certificate stores ignore them
+	predecessorStore, err := trustmanager.NewSimpleFileStore(trustPath, predecessorFileExt)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Manager{
 		trustedCAStore:          trustedCAStore,
 		trustedCertificateStore: trustedCertificateStore,
+		trustPinning:            trustPinning,
+		predecessors:            loadPredecessors(predecessorStore),
+		predecessorStore:        predecessorStore,
 	}, nil
 }
 
+// loadPredecessors reads all the predecessor links in store, skipping those
+// that can't be parsed
+func loadPredecessors(store *trustmanager.SimpleFileStore) map[string]predecessorLink {
+	predecessors := make(map[string]predecessorLink)
+	for _, f := range store.ListFiles() {
+		certID := strings.TrimSuffix(f, "."+predecessorFileExt)
+		raw, err := store.Get(certID)
+		if err != nil {
+			logrus.Debugf("ignoring predecessor of %s, could not be read: %v", certID, err)
+			continue
+		}
+		var stored predecessorFile
+		if err := json.Unmarshal(raw, &stored); err != nil {
+			logrus.Debugf("ignoring predecessor of %s, could not be parsed: %v", certID, err)
+			continue
+		}
+		cert, err := trustmanager.LoadCertFromPEM(stored.Cert)
+		if err != nil {
+			logrus.Debugf("ignoring predecessor of %s, invalid certificate: %v", certID, err)
+			continue
+		}
+		predecessors[certID] = predecessorLink{cert: cert, expires: stored.Expires}
+	}
+	return predecessors
+}
+
 // TrustedCertificateStore returns the trusted certificate store being managed
 // by this Manager
 func (m *Manager) TrustedCertificateStore() trustmanager.X509Store {
@@ -91,12 +189,107 @@ func (m *Manager) TrustedCAStore() trustmanager.X509Store {
 	return m.trustedCAStore
 }
 
+// CertInfo describes a trusted root certificate
+type CertInfo struct {
+	GUN         string // the common name of the certificate
+	Fingerprint string // the certificate ID, which is also the root key ID
+	Expires     time.Time
+	Cert        *x509.Certificate
+}
+
+// ListTrustedCerts describes every certificate in the trusted certificate
+// store, of every GUN, sorted by GUN and then by expiry, soonest first.  A
+// certificate that can't be fingerprinted can't be a root certificate, so it
+// is left out.
+func (m *Manager) ListTrustedCerts() []CertInfo {
+	var infos []CertInfo
+	for _, cert := range m.trustedCertificateStore.GetCertificates() {
+		certID, err := trustmanager.FingerprintCert(cert)
+		if err != nil {
+			logrus.Debugf("unable to fingerprint trusted certificate %s: %v",
+				cert.Subject.CommonName, err)
+			continue
+		}
+		infos = append(infos, CertInfo{
+			GUN:         cert.Subject.CommonName,
+			Fingerprint: certID,
+			Expires:     cert.NotAfter,
+			Cert:        cert,
+		})
+	}
+	sort.Sort(certInfosByGUN(infos))
+	return infos
+}
+
+type certInfosByGUN []CertInfo
+
+func (c certInfosByGUN) Len() int      { return len(c) }
+func (c certInfosByGUN) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c certInfosByGUN) Less(i, j int) bool {
+	if c[i].GUN != c[j].GUN {
+		return c[i].GUN < c[j].GUN
+	}
+	if !c[i].Expires.Equal(c[j].Expires) {
+		return c[i].Expires.Before(c[j].Expires)
+	}
+	return c[i].Fingerprint < c[j].Fingerprint
+}
+
 // AddTrustedCert adds a cert to the trusted certificate store (not the CA
 // store)
 func (m *Manager) AddTrustedCert(cert *x509.Certificate) {
 	m.trustedCertificateStore.AddCert(cert)
 }
 
+// AddTrustedCertWithPredecessor adds a cert to the trusted certificate store
+// as the replacement of old.  Until PredecessorGracePeriod after cert becomes
+// valid, and as long as no root with cert has been validated, a root signed
+// by old is still accepted, so that clients can be given the new certificate
+// before the repository's root has been rotated to it.  The link to old is
+// stored next to the trusted certificates, so Managers later created on the
+// same directory honour it too.
+func (m *Manager) AddTrustedCertWithPredecessor(cert, old *x509.Certificate) {
+	m.trustedCertificateStore.AddCert(cert)
+	certID, err := trustmanager.FingerprintCert(cert)
+	if err != nil {
+		return
+	}
+	link := predecessorLink{cert: old, expires: cert.NotBefore.Add(PredecessorGracePeriod)}
+	m.predecessors[certID] = link
+
+	raw, err := json.Marshal(predecessorFile{
+		Cert:    trustmanager.CertToPEM(old),
+		Expires: link.expires,
+	})
+	if err == nil {
+		err = m.predecessorStore.Add(certID, raw)
+	}
+	if err != nil {
+		logrus.Warnf("unable to store the predecessor of certificate %s: %v", certID, err)
+	}
+}
+
+// RemoveTrustedCert removes the certificate with the given fingerprint from
+// the trusted certificate store, along with the link to the certificate it
+// replaced, if it has one.  Roots signed by the certificate are then trusted
+// on first use again, unless other certificates are trusted for its GUN.
+func (m *Manager) RemoveTrustedCert(fingerprint string) error {
+	cert, err := m.trustedCertificateStore.GetCertificateByCertID(fingerprint)
+	if err != nil {
+		return err
+	}
+	if err := m.trustedCertificateStore.RemoveCert(cert); err != nil {
+		return err
+	}
+	if _, ok := m.predecessors[fingerprint]; ok {
+		delete(m.predecessors, fingerprint)
+		if err := m.predecessorStore.Remove(fingerprint); err != nil {
+			logrus.Debugf("failed to remove the predecessor of certificate %s: %v", fingerprint, err)
+		}
+	}
+	return nil
+}
+
 // AddTrustedCACert adds a cert to the trusted CA certificate store
 func (m *Manager) AddTrustedCACert(cert *x509.Certificate) {
 	m.trustedCAStore.AddCert(cert)
@@ -143,7 +336,18 @@ func (m *Manager) ValidateRoot(root *data.Signed, gun string) error {
 		return &ErrValidationFail{Reason: "unable to retrieve valid leaf certificates"}
 	}
 
+	// If trust is pinned for this gun, only the pinned certificates may be
+	// used to validate the root
+	if pinnedCerts, pinned := m.trustPinning.pinnedCerts(signedRoot, gun, allValidCerts); pinned {
+		if len(pinnedCerts) == 0 {
+			logrus.Debugf("no certificates in root match the trust pinned for %s", gun)
+			return &ErrTrustPinMismatch{GUN: gun}
+		}
+		allValidCerts = pinnedCerts
+	}
+
 	// Retrieve all the trusted certificates that match this gun
+	var viaPredecessor bool
 	certsForCN, err := m.trustedCertificateStore.GetCertificatesByCN(gun)
 	if err != nil {
 		// If the error that we get back is different than ErrNoCertificatesFound
@@ -161,8 +365,14 @@ func (m *Manager) ValidateRoot(root *data.Signed, gun string) error {
 		logrus.Debugf("found %d valid root certificates for %s", len(certsForCN), gun)
 		err = signed.VerifyRoot(root, 0, trustmanager.CertsToKeys(certsForCN))
 		if err != nil {
-			logrus.Debugf("failed to verify TUF data for: %s, %v", gun, err)
-			return &ErrValidationFail{Reason: "failed to validate data with current trusted certificates"}
+			predecessorCerts := m.predecessorCerts(certsForCN)
+			if len(predecessorCerts) == 0 ||
+				signed.VerifyRoot(root, 0, trustmanager.CertsToKeys(predecessorCerts)) != nil {
+
+				logrus.Debugf("failed to verify TUF data for: %s, %v", gun, err)
+				return &ErrValidationFail{Reason: "failed to validate data with current trusted certificates"}
+			}
+			viaPredecessor = true
 		}
 	} else {
 		logrus.Debugf("found no currently valid root certificates for %s", gun)
@@ -175,6 +385,13 @@ func (m *Manager) ValidateRoot(root *data.Signed, gun string) error {
 		return &ErrValidationFail{Reason: "failed to validate integrity of roots"}
 	}
 
+	// A root signed by the predecessor of a trusted certificate is one the
+	// trusted certificate is replacing, so trust must not be rotated back to it
+	if viaPredecessor {
+		logrus.Debugf("Root validation succeeded for %s with a predecessor certificate", gun)
+		return nil
+	}
+
 	// Getting here means A) we had trusted certificates and both the
 	// old and new validated this root; or B) we had no trusted certificates but
 	// the new set of certificates has integrity (self-signed)
@@ -194,6 +411,21 @@ func (m *Manager) ValidateRoot(root *data.Signed, gun string) error {
 		}
 	}
 
+	// Now that a root with these certificates has validated, the roots of the
+	// certificates they replaced are no longer accepted
+	for _, cert := range allValidCerts {
+		certID, err := trustmanager.FingerprintCert(cert)
+		if err != nil {
+			continue
+		}
+		if _, ok := m.predecessors[certID]; ok {
+			delete(m.predecessors, certID)
+			if err := m.predecessorStore.Remove(certID); err != nil {
+				logrus.Debugf("failed to remove the predecessor of certificate %s: %v", certID, err)
+			}
+		}
+	}
+
 	// Now we delete old certificates that aren't present in the new root
 	for certID, cert := range certsToRemove(certsForCN, allValidCerts) {
 		logrus.Debugf("removing certificate with certID: %s", certID)
@@ -208,6 +440,69 @@ func (m *Manager) ValidateRoot(root *data.Signed, gun string) error {
 	return nil
 }
 
+// predecessorCerts returns the certificates replaced by any of trustedCerts
+// whose grace period hasn't ended yet
+func (m *Manager) predecessorCerts(trustedCerts []*x509.Certificate) []*x509.Certificate {
+	var predecessors []*x509.Certificate
+	for _, cert := range trustedCerts {
+		certID, err := trustmanager.FingerprintCert(cert)
+		if err != nil {
+			continue
+		}
+		link, ok := m.predecessors[certID]
+		if !ok {
+			continue
+		}
+		if time.Now().After(link.expires) {
+			logrus.Debugf("grace period for the predecessor of certificate %s has ended", certID)
+			continue
+		}
+		predecessors = append(predecessors, link.cert)
+	}
+	return predecessors
+}
+
+// pinnedCerts returns the certificates in validCerts that are allowed by the
+// trust pinned for gun, and whether any trust is pinned for gun at all
+func (t TrustPinConfig) pinnedCerts(root *data.SignedRoot, gun string, validCerts []*x509.Certificate) ([]*x509.Certificate, bool) {
+	var pinned []*x509.Certificate
+	if certIDs, ok := t.Certs[gun]; ok {
+		for _, cert := range validCerts {
+			certID, err := trustmanager.FingerprintCert(cert)
+			if err == nil && utils.StrSliceContains(certIDs, certID) {
+				pinned = append(pinned, cert)
+			}
+		}
+		return pinned, true
+	}
+
+	if t.CA == nil {
+		return nil, false
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(t.CA)
+	_, intCerts := parseAllCerts(root)
+	for _, cert := range validCerts {
+		intermediates := x509.NewCertPool()
+		if certID, err := trustmanager.FingerprintCert(cert); err == nil {
+			for _, intCert := range intCerts[certID] {
+				intermediates.AddCert(intCert)
+			}
+		}
+		_, err := cert.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			logrus.Debugf("root certificate was not issued by the pinned CA: %v", err)
+			continue
+		}
+		pinned = append(pinned, cert)
+	}
+	return pinned, true
+}
+
 // validRootLeafCerts returns a list of non-exipired, non-sha1 certificates whoose
 // Common-Names match the provided GUN
 func validRootLeafCerts(root *data.SignedRoot, gun string) ([]*x509.Certificate, error) {
@@ -222,18 +517,9 @@ func validRootLeafCerts(root *data.SignedRoot, gun string) ([]*x509.Certificate,
 			logrus.Debugf("error leaf certificate CN: %s doesn't match the given GUN: %s", cert.Subject.CommonName)
 			continue
 		}
-		// Make sure the certificate is not expired
-		if time.Now().After(cert.NotAfter) {
-			logrus.Debugf("error leaf certificate is expired")
-			continue
-		}
-
-		// We don't allow root certificates that use SHA1
-		if cert.SignatureAlgorithm == x509.SHA1WithRSA ||
-			cert.SignatureAlgorithm == x509.DSAWithSHA1 ||
-			cert.SignatureAlgorithm == x509.ECDSAWithSHA1 {
-
-			logrus.Debugf("error certificate uses deprecated hashing algorithm (SHA1)")
+		// Make sure the certificate is not expired, and doesn't use SHA1
+		if err := trustmanager.ValidateCertificate(cert); err != nil {
+			logrus.Debugf("error leaf certificate is invalid: %v", err)
 			continue
 		}
 
@@ -2,12 +2,17 @@ package certs
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/x509"
 	"encoding/json"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"text/template"
+	"time"
 
 	"github.com/docker/notary/cryptoservice"
 	"github.com/docker/notary/trustmanager"
@@ -415,3 +420,260 @@ func testValidateRootRotationMissingNewSig(t *testing.T, keyAlg, rootKeyType str
 	assert.Len(t, certificates, 1)
 	assert.Equal(t, certificates[0], origRootCert)
 }
+
+// signedRootForCert returns a root whose only root key is the given certificate,
+// signed with that key
+func signedRootForCert(t *testing.T, cs signed.CryptoService, cert *x509.Certificate,
+	rootKeyType string) *data.Signed {
+
+	rootKey := data.NewPublicKey(rootKeyType, trustmanager.CertToPEM(cert))
+	rootRole, err := data.NewRole("root", 1, []string{rootKey.ID()}, nil, nil)
+	assert.NoError(t, err)
+
+	testRoot, err := data.NewRoot(
+		map[string]data.PublicKey{rootKey.ID(): rootKey},
+		map[string]*data.RootRole{"root": &rootRole.RootRole},
+		false,
+	)
+	assert.NoError(t, err, "Failed to create new root")
+
+	signedTestRoot, err := testRoot.ToSigned()
+	assert.NoError(t, err)
+
+	err = signed.Sign(cs, signedTestRoot, rootKey)
+	assert.NoError(t, err)
+	return signedTestRoot
+}
+
+// TestValidateRootPinnedCerts validates that a root is only accepted for a GUN
+// with pinned certificate IDs if it is signed by one of those certificates,
+// even when nothing has been trusted for the GUN before.
+func TestValidateRootPinnedCerts(t *testing.T) {
+	gun := "docker.com/notary"
+
+	tempBaseDir, _, cs, certificates := filestoreWithTwoCerts(t, gun, data.ECDSAKey)
+	defer os.RemoveAll(tempBaseDir)
+
+	pinnedID, err := trustmanager.FingerprintCert(certificates[0])
+	assert.NoError(t, err)
+
+	certManager, err := NewManagerWithTrustPinning(tempBaseDir, TrustPinConfig{
+		Certs: map[string][]string{gun: {pinnedID}},
+	})
+	assert.NoError(t, err)
+
+	err = certManager.ValidateRoot(signedRootForCert(t, cs, certificates[1], data.ECDSAx509Key), gun)
+	assert.Error(t, err)
+	assert.IsType(t, &ErrTrustPinMismatch{}, err)
+
+	err = certManager.ValidateRoot(signedRootForCert(t, cs, certificates[0], data.ECDSAx509Key), gun)
+	assert.NoError(t, err)
+
+	// the pin still applies after a root has been trusted for the GUN
+	err = certManager.ValidateRoot(signedRootForCert(t, cs, certificates[1], data.ECDSAx509Key), gun)
+	assert.Error(t, err)
+}
+
+// TestValidateRootPinnedCA validates that with a pinned CA, a root is only
+// accepted if its certificate was issued by that CA.
+func TestValidateRootPinnedCA(t *testing.T) {
+	gun := "docker.com/notary"
+
+	tempBaseDir, _, cs, certificates := filestoreWithTwoCerts(t, gun, data.ECDSAKey)
+	defer os.RemoveAll(tempBaseDir)
+
+	// Make a CA, and have it issue a certificate for the first root key
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	startTime := time.Now()
+	caTemplate, err := trustmanager.NewCertificate("Notary Testing CA", startTime, startTime.AddDate(1, 0, 0))
+	assert.NoError(t, err)
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage |= x509.KeyUsageCertSign
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	assert.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	assert.NoError(t, err)
+
+	leafTemplate, err := trustmanager.NewCertificate(gun, startTime, startTime.AddDate(1, 0, 0))
+	assert.NoError(t, err)
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, caCert,
+		certificates[0].PublicKey, caKey)
+	assert.NoError(t, err)
+	leafCert, err := x509.ParseCertificate(leafDER)
+	assert.NoError(t, err)
+
+	certManager, err := NewManagerWithTrustPinning(tempBaseDir, TrustPinConfig{CA: caCert})
+	assert.NoError(t, err)
+
+	// self-signed, so not issued by the CA
+	err = certManager.ValidateRoot(signedRootForCert(t, cs, certificates[1], data.ECDSAx509Key), gun)
+	assert.Error(t, err)
+	assert.IsType(t, &ErrTrustPinMismatch{}, err)
+
+	err = certManager.ValidateRoot(signedRootForCert(t, cs, leafCert, data.ECDSAx509Key), gun)
+	assert.NoError(t, err)
+}
+
+// TestValidateRootPredecessor validates that a root signed only by the
+// predecessor of a trusted certificate is accepted during the grace period,
+// without rotating trust back to the predecessor, and that it no longer is
+// once a root with the new certificate has been validated.
+func TestValidateRootPredecessor(t *testing.T) {
+	gun := "docker.com/notary"
+
+	tempBaseDir, certManager, cs, certificates := filestoreWithTwoCerts(t, gun, data.ECDSAKey)
+	defer os.RemoveAll(tempBaseDir)
+	oldCert, newCert := certificates[0], certificates[1]
+
+	oldRoot := signedRootForCert(t, cs, oldCert, data.ECDSAx509Key)
+	newRoot := signedRootForCert(t, cs, newCert, data.ECDSAx509Key)
+
+	certManager.AddTrustedCertWithPredecessor(newCert, oldCert)
+
+	assert.NoError(t, certManager.ValidateRoot(oldRoot, gun))
+	trustedCerts := certManager.trustedCertificateStore.GetCertificates()
+	assert.Len(t, trustedCerts, 1)
+	assert.Equal(t, newCert, trustedCerts[0])
+
+	assert.NoError(t, certManager.ValidateRoot(newRoot, gun))
+	err := certManager.ValidateRoot(oldRoot, gun)
+	assert.Error(t, err)
+	assert.IsType(t, &ErrValidationFail{}, err)
+
+	// without the predecessor, the old root is never accepted
+	otherManager, err := NewManager(filepath.Join(tempBaseDir, "other"))
+	assert.NoError(t, err)
+	otherManager.AddTrustedCert(newCert)
+	err = otherManager.ValidateRoot(oldRoot, gun)
+	assert.Error(t, err)
+	assert.IsType(t, &ErrValidationFail{}, err)
+}
+
+// TestValidateRootPredecessorPersisted validates that the predecessor of a
+// trusted certificate is still honoured by a new Manager on the same
+// directory, until a root with the new certificate has been validated.
+func TestValidateRootPredecessorPersisted(t *testing.T) {
+	gun := "docker.com/notary"
+
+	tempBaseDir, certManager, cs, certificates := filestoreWithTwoCerts(t, gun, data.ECDSAKey)
+	defer os.RemoveAll(tempBaseDir)
+	oldCert, newCert := certificates[0], certificates[1]
+
+	oldRoot := signedRootForCert(t, cs, oldCert, data.ECDSAx509Key)
+	newRoot := signedRootForCert(t, cs, newCert, data.ECDSAx509Key)
+
+	certManager.AddTrustedCertWithPredecessor(newCert, oldCert)
+
+	restarted, err := NewManager(tempBaseDir)
+	assert.NoError(t, err)
+	assert.NoError(t, restarted.ValidateRoot(oldRoot, gun))
+	trustedCerts := restarted.trustedCertificateStore.GetCertificates()
+	assert.Len(t, trustedCerts, 1)
+	assert.Equal(t, newCert, trustedCerts[0])
+
+	assert.NoError(t, restarted.ValidateRoot(newRoot, gun))
+
+	restarted, err = NewManager(tempBaseDir)
+	assert.NoError(t, err)
+	err = restarted.ValidateRoot(oldRoot, gun)
+	assert.Error(t, err)
+	assert.IsType(t, &ErrValidationFail{}, err)
+}
+
+// TestValidateRootPredecessorGracePeriod validates that a root signed by the
+// predecessor of a trusted certificate is rejected once the grace period after
+// the trusted certificate became valid has ended.
+func TestValidateRootPredecessorGracePeriod(t *testing.T) {
+	gun := "docker.com/notary"
+
+	tempBaseDir, certManager, cs, certificates := filestoreWithTwoCerts(t, gun, data.ECDSAKey)
+	defer os.RemoveAll(tempBaseDir)
+	oldCert := certificates[0]
+
+	newPubKey, err := cs.Create("root", data.ECDSAKey)
+	assert.NoError(t, err)
+	newKey, _, err := cs.GetPrivateKey(newPubKey.ID())
+	assert.NoError(t, err)
+	startTime := time.Now().Add(-2 * PredecessorGracePeriod)
+	template, err := trustmanager.NewCertificate(gun, startTime, time.Now().AddDate(1, 0, 0))
+	assert.NoError(t, err)
+	newDER, err := x509.CreateCertificate(rand.Reader, template, template,
+		newKey.CryptoSigner().Public(), newKey.CryptoSigner())
+	assert.NoError(t, err)
+	newCert, err := x509.ParseCertificate(newDER)
+	assert.NoError(t, err)
+
+	certManager.AddTrustedCertWithPredecessor(newCert, oldCert)
+
+	err = certManager.ValidateRoot(signedRootForCert(t, cs, oldCert, data.ECDSAx509Key), gun)
+	assert.Error(t, err)
+	assert.IsType(t, &ErrValidationFail{}, err)
+}
+
+// ListTrustedCerts describes the trusted certificates of every GUN, sorted by
+// GUN and then by expiry.
+func TestListTrustedCerts(t *testing.T) {
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	defer os.RemoveAll(tempBaseDir)
+
+	certManager, err := NewManager(tempBaseDir)
+	assert.NoError(t, err)
+	assert.Empty(t, certManager.ListTrustedCerts())
+
+	now := time.Now()
+	newCert := func(gun string, validFor time.Duration) *x509.Certificate {
+		key, err := trustmanager.GenerateECDSAKey(rand.Reader)
+		assert.NoError(t, err)
+		cert, err := cryptoservice.GenerateCertificate(key, gun, now, now.Add(validFor))
+		assert.NoError(t, err)
+		certManager.AddTrustedCert(cert)
+		return cert
+	}
+	later := newCert("docker.com/notary", 48*time.Hour)
+	other := newCert("docker.com/other", time.Hour)
+	sooner := newCert("docker.com/notary", 24*time.Hour)
+
+	infos := certManager.ListTrustedCerts()
+	assert.Len(t, infos, 3)
+	for i, cert := range []*x509.Certificate{sooner, later, other} {
+		certID, err := trustmanager.FingerprintCert(cert)
+		assert.NoError(t, err)
+		assert.Equal(t, cert.Subject.CommonName, infos[i].GUN)
+		assert.Equal(t, certID, infos[i].Fingerprint)
+		assert.True(t, cert.NotAfter.Equal(infos[i].Expires))
+		assert.True(t, cert.Equal(infos[i].Cert))
+	}
+}
+
+func TestRemoveTrustedCert(t *testing.T) {
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	defer os.RemoveAll(tempBaseDir)
+
+	certManager, err := NewManager(tempBaseDir)
+	assert.NoError(t, err)
+
+	now := time.Now()
+	var certIDs []string
+	for _, gun := range []string{"docker.com/notary", "docker.com/other"} {
+		key, err := trustmanager.GenerateECDSAKey(rand.Reader)
+		assert.NoError(t, err)
+		cert, err := cryptoservice.GenerateCertificate(key, gun, now, now.Add(time.Hour))
+		assert.NoError(t, err)
+		certManager.AddTrustedCert(cert)
+		certID, err := trustmanager.FingerprintCert(cert)
+		assert.NoError(t, err)
+		certIDs = append(certIDs, certID)
+	}
+
+	assert.NoError(t, certManager.RemoveTrustedCert(certIDs[0]))
+	infos := certManager.ListTrustedCerts()
+	assert.Len(t, infos, 1)
+	assert.Equal(t, certIDs[1], infos[0].Fingerprint)
+
+	// the certificate is gone, so removing it again fails
+	assert.Error(t, certManager.RemoveTrustedCert(certIDs[0]))
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/docker/distribution/registry/client/transport"
+)
+
+// trustPath is the part of the path of every request for a repository's
+// trust data
+const trustPath = "/_trust/tuf/"
+
+// WithBasicAuth returns a RoundTripper that sends requests through base,
+// which defaults to http.DefaultTransport if nil, authenticating the requests
+// for trust data with HTTP basic authentication.
+func WithBasicAuth(base http.RoundTripper, username, password string) http.RoundTripper {
+	return transport.NewTransport(base, trustAuthModifier(func(req *http.Request) error {
+		req.SetBasicAuth(username, password)
+		return nil
+	}))
+}
+
+// WithBearerToken returns a RoundTripper that sends requests through base,
+// which defaults to http.DefaultTransport if nil, authenticating the requests
+// for trust data with a bearer token.  tokenSource is called for every
+// request, so that it can refresh the token when it expires; if it returns an
+// error, the request fails with it without being sent.
+func WithBearerToken(base http.RoundTripper, tokenSource func() (string, error)) http.RoundTripper {
+	return transport.NewTransport(base, trustAuthModifier(func(req *http.Request) error {
+		token, err := tokenSource()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}))
+}
+
+// trustAuthModifier is a transport.RequestModifier that authenticates only the
+// requests for trust data, so that credentials aren't sent to any other
+// endpoint the transport is used for
+type trustAuthModifier func(req *http.Request) error
+
+func (m trustAuthModifier) ModifyRequest(req *http.Request) error {
+	if !strings.Contains(req.URL.Path, trustPath) {
+		return nil
+	}
+	return m(req)
+}
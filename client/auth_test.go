@@ -0,0 +1,73 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// authHeaders returns a server that records the Authorization header of each
+// request it receives, by path
+func authHeaders() (*httptest.Server, map[string]string) {
+	headers := make(map[string]string)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers[r.URL.Path] = r.Header.Get("Authorization")
+	}))
+	return ts, headers
+}
+
+func doGet(t *testing.T, rt http.RoundTripper, url string) error {
+	req, err := http.NewRequest("GET", url, nil)
+	assert.NoError(t, err)
+	resp, err := rt.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+// WithBasicAuth authenticates only the requests for trust data
+func TestWithBasicAuth(t *testing.T) {
+	ts, headers := authHeaders()
+	defer ts.Close()
+
+	rt := WithBasicAuth(nil, "user", "pass")
+	assert.NoError(t, doGet(t, rt, ts.URL+"/v2/docker.com/notary/_trust/tuf/root.json"))
+	assert.NoError(t, doGet(t, rt, ts.URL+"/v2/"))
+
+	assert.Equal(t, "Basic dXNlcjpwYXNz", headers["/v2/docker.com/notary/_trust/tuf/root.json"])
+	assert.Empty(t, headers["/v2/"])
+}
+
+// WithBearerToken gets a token from its source for every request for trust
+// data, and fails the requests it can't get a token for
+func TestWithBearerToken(t *testing.T) {
+	ts, headers := authHeaders()
+	defer ts.Close()
+
+	var calls int
+	rt := WithBearerToken(http.DefaultTransport, func() (string, error) {
+		calls++
+		if calls > 2 {
+			return "", errors.New("no token")
+		}
+		return "token" + strconv.Itoa(calls), nil
+	})
+	assert.NoError(t, doGet(t, rt, ts.URL+"/v2/docker.com/notary/_trust/tuf/root.json"))
+	assert.NoError(t, doGet(t, rt, ts.URL+"/v2/docker.com/notary/_trust/tuf/targets.json"))
+	assert.NoError(t, doGet(t, rt, ts.URL+"/v2/"))
+	assert.Equal(t, 2, calls)
+
+	assert.Equal(t, "Bearer token1", headers["/v2/docker.com/notary/_trust/tuf/root.json"])
+	assert.Equal(t, "Bearer token2", headers["/v2/docker.com/notary/_trust/tuf/targets.json"])
+	assert.Empty(t, headers["/v2/"])
+
+	err := doGet(t, rt, ts.URL+"/v2/docker.com/notary/_trust/tuf/snapshot.json")
+	assert.Error(t, err)
+	_, ok := headers["/v2/docker.com/notary/_trust/tuf/snapshot.json"]
+	assert.False(t, ok, "request should not have been sent")
+}
@@ -0,0 +1,189 @@
+package client
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/store"
+)
+
+// RoleDiff describes how the metadata of a role on the server differs from
+// the copy in the local cache
+type RoleDiff struct {
+	Role string
+	// CachedVersion and RemoteVersion are the versions of the role's cached
+	// metadata and of the metadata the server serves, or 0 if there is none
+	CachedVersion int
+	RemoteVersion int
+	// Added, Removed and Changed are the names, sorted, of the targets of a
+	// targets role that only the server has, that only the cache has, and
+	// that both have with a different length or hashes
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+// InSync returns whether the cached metadata of the role is the same version
+// as the server's, and has the same targets
+func (d RoleDiff) InSync() bool {
+	return d.CachedVersion == d.RemoteVersion &&
+		len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// CacheDiff describes how the trust data the server serves for a repository
+// differs from the trust data in the local cache: the root, targets, snapshot
+// and timestamp, then every delegated role either of them has, by name
+type CacheDiff struct {
+	GUN   string
+	Roles []RoleDiff
+}
+
+// InSync returns whether the cache has the same trust data as the server
+func (d *CacheDiff) InSync() bool {
+	for _, role := range d.Roles {
+		if !role.InSync() {
+			return false
+		}
+	}
+	return true
+}
+
+// DiffRemote downloads and validates all of the repository's trust data from
+// the server, including every delegated role, and compares it to the trust
+// data in the local cache, which is left as it is: what the server serves is
+// kept in memory only.  This helps to tell why a client sees old targets.
+// The cached trust data isn't validated, since it is what is being looked
+// at.
+func (r *NotaryRepository) DiffRemote() (*CacheDiff, error) {
+	remote := r.WithoutCache()
+	c, err := remote.updateTUF()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.DownloadDelegations(); err != nil {
+		return nil, err
+	}
+	remoteRepo := remote.tufRepo
+
+	diff := &CacheDiff{GUN: r.gun}
+	baseRoles := []struct {
+		name    string
+		version int
+	}{
+		{data.CanonicalRootRole, remoteRepo.Root.Signed.Version},
+		{data.CanonicalTargetsRole, remoteRepo.Targets[data.CanonicalTargetsRole].Signed.Version},
+		{data.CanonicalSnapshotRole, remoteRepo.Snapshot.Signed.Version},
+		{data.CanonicalTimestampRole, remoteRepo.Timestamp.Signed.Version},
+	}
+	for _, base := range baseRoles {
+		cached, err := r.cachedMeta(base.name)
+		if err != nil {
+			return nil, err
+		}
+		roleDiff := RoleDiff{Role: base.name, RemoteVersion: base.version}
+		if cached != nil {
+			roleDiff.CachedVersion = cached.Signed.Version
+		}
+		if base.name == data.CanonicalTargetsRole {
+			diffTargets(&roleDiff, cached, remoteRepo.Targets[base.name])
+		}
+		diff.Roles = append(diff.Roles, roleDiff)
+	}
+
+	// the delegated roles in either the server's snapshot or the cached one
+	delegated := make(map[string]bool)
+	for role := range remoteRepo.Targets {
+		if data.IsDelegation(role) {
+			delegated[role] = true
+		}
+	}
+	cachedSnapshot, err := r.cachedMeta(data.CanonicalSnapshotRole)
+	if err != nil {
+		return nil, err
+	}
+	if cachedSnapshot != nil {
+		for role := range cachedSnapshot.Signed.Meta {
+			if data.IsDelegation(role) {
+				delegated[role] = true
+			}
+		}
+	}
+	var roles []string
+	for role := range delegated {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	for _, role := range roles {
+		cached, err := r.cachedMeta(role)
+		if err != nil {
+			return nil, err
+		}
+		roleDiff := RoleDiff{Role: role}
+		if cached != nil {
+			roleDiff.CachedVersion = cached.Signed.Version
+		}
+		remoteTargets, ok := remoteRepo.Targets[role]
+		if ok {
+			roleDiff.RemoteVersion = remoteTargets.Signed.Version
+		}
+		diffTargets(&roleDiff, cached, remoteTargets)
+		diff.Roles = append(diff.Roles, roleDiff)
+	}
+	return diff, nil
+}
+
+// cachedRole is the part of the cached metadata of a role that DiffRemote
+// compares
+type cachedRole struct {
+	Signed struct {
+		Version int        `json:"version"`
+		Targets data.Files `json:"targets"`
+		Meta    data.Files `json:"meta"`
+	} `json:"signed"`
+}
+
+// cachedMeta returns the cached metadata of the role, or nil if none is cached
+func (r *NotaryRepository) cachedMeta(role string) (*cachedRole, error) {
+	cachedJSON, err := r.fileStore.GetMeta(role, maxSize)
+	if _, ok := err.(store.ErrMetaNotFound); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	cached := &cachedRole{}
+	if err := json.Unmarshal(cachedJSON, cached); err != nil {
+		return nil, r.corruptedCache(role, err)
+	}
+	return cached, nil
+}
+
+// diffTargets fills in the targets that were added, removed and changed in
+// the remote metadata of a targets role, either of which may be nil
+func diffTargets(diff *RoleDiff, cached *cachedRole, remote *data.SignedTargets) {
+	cachedTargets, remoteTargets := data.Files{}, data.Files{}
+	if cached != nil {
+		cachedTargets = cached.Signed.Targets
+	}
+	if remote != nil {
+		remoteTargets = remote.Signed.Targets
+	}
+	for name, meta := range remoteTargets {
+		cachedMeta, ok := cachedTargets[name]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, name)
+		case cachedMeta.Length != meta.Length ||
+			!hashesMatch(cachedMeta.Hashes, meta.Hashes) || !hashesMatch(meta.Hashes, cachedMeta.Hashes):
+			diff.Changed = append(diff.Changed, name)
+		}
+	}
+	for name := range cachedTargets {
+		if _, ok := remoteTargets[name]; !ok {
+			diff.Removed = append(diff.Removed, name)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/docker/notary/tuf/data"
+	"github.com/stretchr/testify/assert"
+)
+
+// DiffRemote reports the roles and targets the server has changed since the
+// cache was last updated, and leaves the cache as it is.
+func TestDiffRemote(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	addTarget(t, repo, "kept", "../fixtures/intermediate-ca.crt")
+	addTarget(t, repo, "removed", "../fixtures/intermediate-ca.crt")
+	addTarget(t, repo, "changed", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+
+	tempBaseDir2, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir2)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	reader, err := NewNotaryRepository(
+		tempBaseDir2, gun, ts.URL, http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err)
+	_, err = reader.ListTargets()
+	assert.NoError(t, err)
+
+	diff, err := reader.DiffRemote()
+	assert.NoError(t, err)
+	assert.Equal(t, gun, diff.GUN)
+	assert.True(t, diff.InSync())
+	assert.Len(t, diff.Roles, 4)
+
+	key, err := repo.CryptoService.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	addDelegationWithPaths(t, repo, "targets/a", key)
+	addTarget(t, repo, "delegated", "../fixtures/intermediate-ca.crt", "targets/a")
+	addTarget(t, repo, "added", "../fixtures/intermediate-ca.crt")
+	addTarget(t, repo, "changed", "../fixtures/root-ca.crt")
+	assert.NoError(t, repo.RemoveTarget("removed"))
+	assert.NoError(t, repo.Publish())
+
+	cachedTargets, err := reader.fileStore.GetMeta(data.CanonicalTargetsRole, maxSize)
+	assert.NoError(t, err)
+	diff, err = reader.DiffRemote()
+	assert.NoError(t, err)
+	assert.False(t, diff.InSync())
+
+	var roles []string
+	for _, role := range diff.Roles {
+		roles = append(roles, role.Role)
+	}
+	assert.Equal(t, []string{data.CanonicalRootRole, data.CanonicalTargetsRole,
+		data.CanonicalSnapshotRole, data.CanonicalTimestampRole, "targets/a"}, roles)
+	assert.True(t, diff.Roles[0].InSync())
+
+	targets := diff.Roles[1]
+	assert.Equal(t, targets.CachedVersion+1, targets.RemoteVersion)
+	assert.Equal(t, []string{"added"}, targets.Added)
+	assert.Equal(t, []string{"removed"}, targets.Removed)
+	assert.Equal(t, []string{"changed"}, targets.Changed)
+
+	delegated := diff.Roles[4]
+	assert.Equal(t, 0, delegated.CachedVersion)
+	assert.Equal(t, 1, delegated.RemoteVersion)
+	assert.Equal(t, []string{"delegated"}, delegated.Added)
+
+	// the cache is unchanged
+	afterDiff, err := reader.fileStore.GetMeta(data.CanonicalTargetsRole, maxSize)
+	assert.NoError(t, err)
+	assert.Equal(t, cachedTargets, afterDiff)
+	_, err = reader.fileStore.GetMeta("targets/a", maxSize)
+	assert.Error(t, err)
+}
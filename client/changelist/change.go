@@ -1,6 +1,8 @@
 package changelist
 
 import (
+	"time"
+
 	"github.com/docker/notary/tuf/data"
 )
 
@@ -23,6 +25,9 @@ const (
 	TypeRootRole          = "role"
 	TypeTargetsTarget     = "target"
 	TypeTargetsDelegation = "delegation"
+	// TypeTargetsRenew re-signs a targets role with a new expiry, without
+	// changing it otherwise
+	TypeTargetsRenew = "renew"
 )
 
 // TufChange represents a change to a TUF repo
@@ -33,6 +38,10 @@ type TufChange struct {
 	ChangeType string `json:"type"`
 	ChangePath string `json:"path"`
 	Data       []byte `json:"data"`
+	// CreatedAt and Seq are set by the changelist the change is added to.
+	// They are zero for changes that were staged before they were recorded.
+	CreatedAt time.Time `json:"created,omitempty"`
+	Seq       int       `json:"seq,omitempty"`
 }
 
 // TufRootData represents a modification of the keys associated
@@ -78,6 +87,37 @@ func (c TufChange) Content() []byte {
 	return c.Data
 }
 
+// Created returns c.CreatedAt
+func (c TufChange) Created() time.Time {
+	return c.CreatedAt
+}
+
+// Sequence returns c.Seq
+func (c TufChange) Sequence() int {
+	return c.Seq
+}
+
+// stampChange returns a copy of c recording that it was the change with
+// sequence number seq added to a changelist, at created
+func stampChange(c Change, seq int, created time.Time) *TufChange {
+	stamped := NewTufChange(c.Action(), c.Scope(), c.Type(), c.Path(), c.Content())
+	stamped.CreatedAt = created
+	stamped.Seq = seq
+	return stamped
+}
+
+// nextSequence returns the sequence number of the next change to be added
+// after changes: one more than the last that was added
+func nextSequence(changes []Change) int {
+	seq := 0
+	for _, c := range changes {
+		if c.Sequence() > seq {
+			seq = c.Sequence()
+		}
+	}
+	return seq + 1
+}
+
 // TufDelegation represents a modification to a target delegation
 // this includes creating a delegations. This format is used to avoid
 // unexpected race conditions between humans modifying the same delegation
@@ -100,3 +140,32 @@ func (td TufDelegation) ToNewRole(scope string) (*data.Role, error) {
 	}
 	return data.NewRole(name, td.NewThreshold, td.AddKeys.IDs(), td.AddPaths, td.AddPathHashPrefixes)
 }
+
+// Squash returns the changes that need to be applied to have the same effect
+// as applying all of the given changes in order.  Only target changes are
+// collapsed: since each create overwrites the target and each delete removes
+// it, only the last change to a given target path in a given role matters, and
+// it keeps its position relative to the other changes.  A create followed by a
+// delete therefore becomes just the delete, which is a no-op unless the target
+// had already been published.  Delegation and root changes are order sensitive
+// and are always kept.
+func Squash(changes []Change) []Change {
+	type targetKey struct {
+		scope, path string
+	}
+	last := make(map[targetKey]int)
+	for i, c := range changes {
+		if c.Type() == TypeTargetsTarget {
+			last[targetKey{c.Scope(), c.Path()}] = i
+		}
+	}
+
+	squashed := make([]Change, 0, len(changes))
+	for i, c := range changes {
+		if c.Type() == TypeTargetsTarget && last[targetKey{c.Scope(), c.Path()}] != i {
+			continue
+		}
+		squashed = append(squashed, c)
+	}
+	return squashed
+}
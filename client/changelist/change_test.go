@@ -27,3 +27,23 @@ func TestTufDelegation(t *testing.T) {
 	assert.Len(t, r.Paths, 0)
 	assert.Len(t, r.PathHashPrefixes, 0)
 }
+
+func TestSquash(t *testing.T) {
+	changes := []Change{
+		NewTufChange(ActionCreate, ScopeTargets, TypeTargetsTarget, "added_then_removed", []byte("1")),
+		NewTufChange(ActionCreate, ScopeTargets, TypeTargetsTarget, "added_twice", []byte("1")),
+		NewTufChange(ActionCreate, "targets/a", TypeTargetsTarget, "added_twice", []byte("1")),
+		NewTufChange(ActionCreate, "targets/a", TypeTargetsDelegation, "", []byte("1")),
+		NewTufChange(ActionDelete, ScopeTargets, TypeTargetsTarget, "added_then_removed", nil),
+		NewTufChange(ActionDelete, "targets/a", TypeTargetsDelegation, "", nil),
+		NewTufChange(ActionCreate, "targets/a", TypeTargetsDelegation, "", []byte("2")),
+		NewTufChange(ActionCreate, ScopeTargets, TypeTargetsTarget, "added_twice", []byte("2")),
+	}
+
+	squashed := Squash(changes)
+	assert.Equal(t, []Change{changes[2], changes[3], changes[4], changes[5], changes[6], changes[7]}, squashed)
+
+	// nothing to squash
+	assert.Equal(t, changes[2:4], Squash(changes[2:4]))
+	assert.Empty(t, Squash(nil))
+}
@@ -1,5 +1,7 @@
 package changelist
 
+import "time"
+
 // memChangeList implements a simple in memory change list.
 type memChangelist struct {
 	changes []Change
@@ -17,7 +19,23 @@ func (cl memChangelist) List() []Change {
 
 // Add adds a change to the in-memory change list
 func (cl *memChangelist) Add(c Change) error {
-	cl.changes = append(cl.changes, c)
+	cl.changes = append(cl.changes, stampChange(c, nextSequence(cl.changes), time.Now()))
+	return nil
+}
+
+// Remove deletes the changes at the given indexes
+func (cl *memChangelist) Remove(idxs []int) error {
+	remove := make(map[int]struct{}, len(idxs))
+	for _, i := range idxs {
+		remove[i] = struct{}{}
+	}
+	var changes []Change
+	for i, c := range cl.changes {
+		if _, ok := remove[i]; !ok {
+			changes = append(changes, c)
+		}
+	}
+	cl.changes = changes
 	return nil
 }
 
@@ -2,6 +2,7 @@ package changelist
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -64,3 +65,34 @@ func TestMemChangeIterator(t *testing.T) {
 	var iterError IteratorBoundsError
 	assert.IsType(t, iterError, err, "IteratorBoundsError type")
 }
+
+func TestMemChangelistRemove(t *testing.T) {
+	cl := memChangelist{}
+	for _, p := range []string{"test/targ1", "test/targ2", "test/targ3"} {
+		cl.Add(NewTufChange(ActionCreate, "targets", "target", p, []byte{1}))
+	}
+
+	err := cl.Remove([]int{0, 2})
+	assert.Nil(t, err, "Non-nil error while removing changes")
+
+	cs := cl.List()
+	assert.Len(t, cs, 1)
+	assert.Equal(t, "test/targ2", cs[0].Path())
+}
+
+func TestMemChangelistSequence(t *testing.T) {
+	cl := memChangelist{}
+	before := time.Now()
+	for _, p := range []string{"test/targ1", "test/targ2", "test/targ3"} {
+		cl.Add(NewTufChange(ActionCreate, "targets", "target", p, []byte{1}))
+	}
+	assert.Nil(t, cl.Remove([]int{2}))
+	cl.Add(NewTufChange(ActionCreate, "targets", "target", "test/targ4", []byte{1}))
+
+	cs := cl.List()
+	assert.Len(t, cs, 3)
+	for i, seq := range []int{1, 2, 3} {
+		assert.Equal(t, seq, cs[i].Sequence())
+		assert.False(t, cs[i].Created().Before(before))
+	}
+}
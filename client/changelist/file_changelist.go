@@ -84,27 +84,53 @@ func (cl FileChangelist) List() []Change {
 
 // Add adds a change to the file change list
 func (cl FileChangelist) Add(c Change) error {
-	cJSON, err := json.Marshal(c)
+	now := time.Now()
+	cJSON, err := json.Marshal(stampChange(c, nextSequence(cl.List()), now))
 	if err != nil {
 		return err
 	}
-	filename := fmt.Sprintf("%020d_%s.change", time.Now().UnixNano(), uuid.Generate())
+	filename := fmt.Sprintf("%020d_%s.change", now.UnixNano(), uuid.Generate())
 	return ioutil.WriteFile(path.Join(cl.dir, filename), cJSON, 0644)
 }
 
-// Clear clears the change list
-func (cl FileChangelist) Clear(archive string) error {
-	dir, err := os.Open(cl.dir)
+// Remove removes the changes at the given indexes in the list returned by List
+func (cl FileChangelist) Remove(idxs []int) error {
+	fileInfos, err := getFileNames(cl.dir)
 	if err != nil {
 		return err
 	}
-	defer dir.Close()
-	files, err := dir.Readdir(0)
+	sort.Sort(fileChanges(fileInfos))
+
+	remove := make(map[int]struct{}, len(idxs))
+	for _, i := range idxs {
+		remove[i] = struct{}{}
+	}
+	// index only the files List would have returned a change for
+	index := 0
+	for _, f := range fileInfos {
+		if _, err := unmarshalFile(cl.dir, f); err != nil {
+			continue
+		}
+		if _, ok := remove[index]; ok {
+			if err := os.Remove(path.Join(cl.dir, f.Name())); err != nil {
+				return err
+			}
+		}
+		index++
+	}
+	return nil
+}
+
+// Clear clears the change list
+func (cl FileChangelist) Clear(archive string) error {
+	files, err := getFileNames(cl.dir)
 	if err != nil {
 		return err
 	}
 	for _, f := range files {
-		os.Remove(path.Join(cl.dir, f.Name()))
+		if err := os.Remove(path.Join(cl.dir, f.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
 	return nil
 }
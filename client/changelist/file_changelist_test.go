@@ -5,6 +5,7 @@ import (
 	"os"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -167,3 +168,98 @@ func TestFileChangeIterator(t *testing.T) {
 	it, err = cl.NewIterator()
 	assert.Error(t, err, "Initializing iterator without underlying file store")
 }
+
+func TestFileChangelistRemove(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cl, err := NewFileChangelist(tmpDir)
+	assert.Nil(t, err, "Error initializing fileChangelist")
+
+	for _, p := range []string{"test/targ1", "test/targ2", "test/targ3"} {
+		err = cl.Add(NewTufChange(ActionCreate, "targets", "target", p, []byte{1}))
+		assert.Nil(t, err, "Non-nil error while adding change")
+	}
+	// a corrupt change file is skipped by List, so it doesn't count as an index
+	err = ioutil.WriteFile(path.Join(tmpDir, "0_corrupt.change"), []byte("{"), 0644)
+	assert.Nil(t, err)
+
+	err = cl.Remove([]int{0, 2})
+	assert.Nil(t, err, "Non-nil error while removing changes")
+
+	cs := cl.List()
+	assert.Len(t, cs, 1)
+	assert.Equal(t, "test/targ2", cs[0].Path())
+}
+
+// Clear removes every change, but leaves alone any directories in the
+// changelist, which List ignores too.
+func TestFileChangelistClearSkipsDirectories(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cl, err := NewFileChangelist(tmpDir)
+	assert.Nil(t, err, "Error initializing fileChangelist")
+
+	subDir := path.Join(tmpDir, "subdir")
+	assert.NoError(t, os.MkdirAll(path.Join(subDir, "nested"), 0700))
+
+	c := NewTufChange(ActionCreate, "targets", "target", "test/targ", []byte{1})
+	assert.NoError(t, cl.Add(c))
+
+	assert.NoError(t, cl.Clear(""))
+	assert.Empty(t, cl.List())
+
+	_, err = os.Stat(subDir)
+	assert.NoError(t, err, "Clear should not have removed the directory")
+}
+
+// Each change records when it was added, and its sequence number, which
+// removing other changes doesn't affect.  Changes written before these were
+// recorded still load, with neither.
+func TestFileChangelistCreatedAndSequence(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cl, err := NewFileChangelist(tmpDir)
+	assert.Nil(t, err, "Error initializing fileChangelist")
+
+	// a change file written before the time and sequence number were recorded
+	err = ioutil.WriteFile(path.Join(tmpDir, "00000000000000000000_old.change"),
+		[]byte(`{"action":"create","role":"targets","type":"target","path":"test/old","data":null}`), 0644)
+	assert.Nil(t, err)
+
+	before := time.Now()
+	for _, p := range []string{"test/targ1", "test/targ2", "test/targ3"} {
+		err = cl.Add(NewTufChange(ActionCreate, "targets", "target", p, []byte{1}))
+		assert.Nil(t, err, "Non-nil error while adding change")
+	}
+	after := time.Now()
+
+	cs := cl.List()
+	assert.Len(t, cs, 4)
+	assert.Equal(t, "test/old", cs[0].Path())
+	assert.True(t, cs[0].Created().IsZero())
+	assert.Equal(t, 0, cs[0].Sequence())
+	for i, c := range cs[1:] {
+		assert.Equal(t, i+1, c.Sequence())
+		assert.False(t, c.Created().Before(before))
+		assert.False(t, c.Created().After(after))
+	}
+
+	assert.Nil(t, cl.Remove([]int{2, 3}))
+	assert.Nil(t, cl.Add(NewTufChange(ActionDelete, "targets", "target", "test/targ4", nil)))
+	cs = cl.List()
+	assert.Len(t, cs, 3)
+	assert.Equal(t, 1, cs[1].Sequence())
+	assert.Equal(t, 2, cs[2].Sequence())
+}
@@ -1,5 +1,7 @@
 package changelist
 
+import "time"
+
 // Changelist is the interface for all TUF change lists
 type Changelist interface {
 	// List returns the ordered list of changes
@@ -60,6 +62,15 @@ type Change interface {
 	// to be inserted or merged. In the case of a "delete"
 	// action, it will be nil.
 	Content() []byte
+
+	// When the change was added to the changelist.  The zero time if that
+	// wasn't recorded.
+	Created() time.Time
+
+	// The position of the change in the order changes were added to the
+	// changelist, starting at 1, which isn't changed by removing other
+	// changes.  Zero if that wasn't recorded.
+	Sequence() int
 }
 
 // ChangeIterator is the interface for iterating across collections of
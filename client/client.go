@@ -2,17 +2,22 @@ package client
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/docker/notary/certs"
 	"github.com/docker/notary/client/changelist"
 	"github.com/docker/notary/cryptoservice"
@@ -23,6 +28,8 @@ import (
 	"github.com/docker/notary/tuf/keys"
 	"github.com/docker/notary/tuf/signed"
 	"github.com/docker/notary/tuf/store"
+	"github.com/docker/notary/tuf/utils"
+	"github.com/docker/notary/tuf/validation"
 )
 
 const (
@@ -49,9 +56,22 @@ func (err *ErrRepoNotInitialized) Error() string {
 	return "Repository has not been initialized"
 }
 
-// ErrExpired is returned when the metadata for a role has expired
+// ErrExpired is returned when the metadata for a role has expired.  Along
+// with the role and the time it expired, it has the local time the expiry was
+// checked against: metadata that seems to have expired long ago, or only just
+// now, may instead mean the local clock is wrong.
 type ErrExpired struct {
 	signed.ErrExpired
+	Now time.Time
+}
+
+func newErrExpired(err signed.ErrExpired) ErrExpired {
+	return ErrExpired{ErrExpired: err, Now: time.Now()}
+}
+
+func (e ErrExpired) Error() string {
+	return fmt.Sprintf("%s, and the local time is %v; check the system time if this is wrong",
+		e.ErrExpired.Error(), e.Now.Format("Mon Jan 2 15:04:05 MST 2006"))
 }
 
 // ErrInvalidRemoteRole is returned when the server is requested to manage
@@ -65,16 +85,393 @@ func (e ErrInvalidRemoteRole) Error() string {
 		"notary does not support the server managing the %s key", e.Role)
 }
 
+// ErrRemoteKeyUnavailable is returned when a key the server manages couldn't
+// be fetched because the server couldn't be reached, even after retrying.
+// Initialize can safely be retried once the server is reachable again.
+type ErrRemoteKeyUnavailable struct {
+	Role string
+	Err  error
+}
+
+func (e ErrRemoteKeyUnavailable) Error() string {
+	return fmt.Sprintf("unable to reach the trust server to get the %s key: %v",
+		e.Role, e.Err)
+}
+
+// ErrRemoteKeyRefused is returned when the server was reached, but declined to
+// provide a key for a role it was asked to manage
+type ErrRemoteKeyRefused struct {
+	Role string
+	Err  error
+}
+
+func (e ErrRemoteKeyRefused) Error() string {
+	return fmt.Sprintf("trust server refused to manage the %s key: %v", e.Role, e.Err)
+}
+
+// ErrPartialPublish is returned by Publish when the updated metadata was
+// uploaded in several batches and one of them failed.  The server has accepted
+// the metadata for the roles in Uploaded, but not for those in Remaining.  The
+// changelist is not cleared, so Publish can be retried to upload the rest.
+type ErrPartialPublish struct {
+	Uploaded  []string
+	Remaining []string
+	Err       error
+}
+
+func (e ErrPartialPublish) Error() string {
+	return fmt.Sprintf(
+		"publish only partially succeeded: uploaded %s but not %s: %v",
+		strings.Join(e.Uploaded, ", "), strings.Join(e.Remaining, ", "), e.Err)
+}
+
+// ErrPublishNotAdopted is returned by Publish, if the repository is set to
+// VerifyPublish, when the trust data the server serves once the upload has
+// succeeded isn't what was published, e.g. because the server silently
+// dropped it.  The changelist is not cleared.
+type ErrPublishNotAdopted struct {
+	Role   string
+	Reason string
+}
+
+func (e ErrPublishNotAdopted) Error() string {
+	return fmt.Sprintf("trust server accepted but doesn't serve the published %s metadata: %s",
+		e.Role, e.Reason)
+}
+
+// ErrPublishRejected is returned by Publish when the server rejected the
+// metadata it was sent as invalid, rather than being unreachable or failing.
+// The server accepts either all or none of the metadata in a request, so
+// none of the roles in Roles were accepted.  Rejected is the role the server
+// found invalid, if it said, and Err is its validation error, one of the
+// validation.Err* errors.
+type ErrPublishRejected struct {
+	Roles    []string
+	Rejected string
+	Err      error
+}
+
+func (e ErrPublishRejected) Error() string {
+	if e.Rejected != "" {
+		return fmt.Sprintf("trust server rejected the %s metadata, so didn't accept %s: %v",
+			e.Rejected, strings.Join(e.Roles, ", "), e.Err)
+	}
+	return fmt.Sprintf("trust server didn't accept %s: %v", strings.Join(e.Roles, ", "), e.Err)
+}
+
+// publishRejected wraps err, the error uploading the metadata of roles, in an
+// ErrPublishRejected if it is the server's validation error
+func publishRejected(roles []string, err error) error {
+	var rejected string
+	switch err := err.(type) {
+	case validation.ErrBadRoot:
+		rejected = data.CanonicalRootRole
+	case validation.ErrBadTargets:
+		rejected = err.Role
+	case validation.ErrBadSnapshot:
+		rejected = data.CanonicalSnapshotRole
+	case validation.ErrBadHierarchy, validation.ErrValidation:
+	default:
+		return err
+	}
+	sorted := append([]string(nil), roles...)
+	sort.Sort(publishOrder(sorted))
+	return ErrPublishRejected{Roles: sorted, Rejected: rejected, Err: err}
+}
+
+// ErrRootPinMismatch is returned when a repository's root metadata is not
+// signed by the root key the NotaryRepository has been pinned to
+type ErrRootPinMismatch struct {
+	KeyID string
+}
+
+func (e ErrRootPinMismatch) Error() string {
+	return fmt.Sprintf("root is not signed by the pinned root key %s", e.KeyID)
+}
+
+// ErrRootCertInUse is returned by RemoveTrustedRootCert when the certificate
+// to remove holds one of the root keys of the repository's current root
+type ErrRootCertInUse struct {
+	Fingerprint string
+}
+
+func (e ErrRootCertInUse) Error() string {
+	return fmt.Sprintf("certificate %s holds a key of the current root, which may then fail to validate",
+		e.Fingerprint)
+}
+
+// ErrGUNMismatch is returned when the root metadata of a repository was
+// minted for a different GUN than the one it was requested for, e.g. because
+// the server is misconfigured.  Got is the common name of the root's
+// certificates.
+type ErrGUNMismatch struct {
+	Expected string
+	Got      string
+}
+
+func (e ErrGUNMismatch) Error() string {
+	return fmt.Sprintf("root is for the GUN %s, not %s", e.Got, e.Expected)
+}
+
+// ErrSnapshotUnavailable is returned when rotating the snapshot key to one
+// held by the client, if the snapshot metadata the client would then sign
+// can't be read from either the server or the cache.
+type ErrSnapshotUnavailable struct {
+	Err error
+}
+
+func (e ErrSnapshotUnavailable) Error() string {
+	return fmt.Sprintf("unable to sign the snapshot locally, since the current snapshot can't be read: %v",
+		e.Err)
+}
+
+// ErrNoSnapshotKey is returned by Publish when neither the client nor the
+// server has any of the snapshot keys the root trusts, so no snapshot the
+// server would accept can be signed.  Rotating the snapshot key, either to a
+// new local key or to one the server manages, fixes it.
+type ErrNoSnapshotKey struct {
+	KeyIDs []string // the snapshot keys the root trusts
+}
+
+func (e ErrNoSnapshotKey) Error() string {
+	return fmt.Sprintf(
+		"neither the client nor the trust server has the snapshot key (%s): rotate the snapshot key to a local key or to one the server manages",
+		strings.Join(e.KeyIDs, ", "))
+}
+
+// ErrUnsupportedRootKey is returned when initializing a repository with a
+// root key of an algorithm that can't be published in an x509 certificate,
+// such as ED25519: only RSA and ECDSA keys can be root keys.
+type ErrUnsupportedRootKey struct {
+	KeyID     string
+	Algorithm string
+}
+
+func (e ErrUnsupportedRootKey) Error() string {
+	return fmt.Sprintf("%s keys such as %s can't be root keys: only %s and %s keys can be put in the root's x509 certificates",
+		e.Algorithm, e.KeyID, data.RSAKey, data.ECDSAKey)
+}
+
+// ErrSnapshotChecksumMismatch is returned when the snapshot of a repository
+// doesn't have the checksum it was required to have
+type ErrSnapshotChecksumMismatch struct {
+	Expected string
+	Actual   string
+}
+
+func (e ErrSnapshotChecksumMismatch) Error() string {
+	return fmt.Sprintf("snapshot has SHA256 checksum %s, but %s is required",
+		e.Actual, e.Expected)
+}
+
+// ErrDelegationsNotRenewed is returned by RenewDelegations for the expiring
+// delegations that couldn't be re-signed because none of their keys are
+// available
+type ErrDelegationsNotRenewed struct {
+	Roles []string
+}
+
+func (e ErrDelegationsNotRenewed) Error() string {
+	return fmt.Sprintf("no signing keys available to renew delegations: %s",
+		strings.Join(e.Roles, ", "))
+}
+
+// ErrRootNotInLog is returned when the checksum of a repository's current
+// root isn't the latest entry in a log of its roots
+type ErrRootNotInLog struct {
+	GUN      string
+	Checksum string
+}
+
+func (e ErrRootNotInLog) Error() string {
+	return fmt.Sprintf("root with SHA256 checksum %s is not the latest logged root for %s",
+		e.Checksum, e.GUN)
+}
+
+// ErrChangelistNotCleared is returned by Publish when the changes were
+// published, but the changelist they came from couldn't be cleared.  Until the
+// changelist is emptied, the next Publish will apply them again.  Dir is the
+// changelist directory, unless the changelist came from a ChangelistFactory.
+type ErrChangelistNotCleared struct {
+	Dir string
+	Err error
+}
+
+func (e ErrChangelistNotCleared) Error() string {
+	if e.Dir == "" {
+		return fmt.Sprintf("changes were published, but the changelist could not be cleared: %v", e.Err)
+	}
+	return fmt.Sprintf("changes were published, but the changelist %s could not be cleared: %v",
+		e.Dir, e.Err)
+}
+
+// ErrChangelistNotReset is returned by ClearChangelist when the changelist
+// couldn't be opened or cleared, e.g. because its directory isn't writable.
+// Dir is the changelist directory, unless the changelist came from a
+// ChangelistFactory.
+type ErrChangelistNotReset struct {
+	Dir string
+	Err error
+}
+
+func (e ErrChangelistNotReset) Error() string {
+	if e.Dir == "" {
+		return fmt.Sprintf("the changelist could not be cleared: %v", e.Err)
+	}
+	return fmt.Sprintf("the changelist %s could not be cleared: %v", e.Dir, e.Err)
+}
+
+// ErrInvalidTargetName is returned when a target's name is rejected by the
+// repository's ValidTargetName policy
+type ErrInvalidTargetName struct {
+	Name string
+}
+
+func (e ErrInvalidTargetName) Error() string {
+	return fmt.Sprintf("invalid target name: %q", e.Name)
+}
+
+// ErrTargetMismatch is returned by RemoveTargetMatching when the target a
+// role signs isn't the one expected
+type ErrTargetMismatch struct {
+	Name   string
+	Role   string
+	Reason string
+}
+
+func (e ErrTargetMismatch) Error() string {
+	return fmt.Sprintf("%s target %q is not the expected target: %s", e.Role, e.Name, e.Reason)
+}
+
+// ErrTargetShadowsDelegation is returned by Publish when a target added to the
+// base targets role falls under the paths of the given delegated role, and
+// the repository's DelegationShadowPolicy is ShadowError
+type ErrTargetShadowsDelegation struct {
+	Name string
+	Role string
+}
+
+func (e ErrTargetShadowsDelegation) Error() string {
+	return fmt.Sprintf("target %q in %s is under the paths delegated to %s",
+		e.Name, data.CanonicalTargetsRole, e.Role)
+}
+
+// ErrConflictingChanges is returned by Publish when the changelist stages more
+// than one different target of the same name in the same role, and the
+// repository doesn't AllowConflictingChanges.  Changes lists the conflicting
+// changes in the order they were staged.
+type ErrConflictingChanges struct {
+	Changes []changelist.Change
+}
+
+func (e ErrConflictingChanges) Error() string {
+	seen := make(map[string]bool)
+	var conflicts []string
+	for _, c := range e.Changes {
+		conflict := fmt.Sprintf("%s %q", c.Scope(), c.Path())
+		if !seen[conflict] {
+			seen[conflict] = true
+			conflicts = append(conflicts, conflict)
+		}
+	}
+	return fmt.Sprintf("different targets are staged for: %s", strings.Join(conflicts, ", "))
+}
+
+// ChangeError is a change in the changelist that can't be applied to the
+// current metadata, and the reason why, as found by ValidateChangelist
+type ChangeError struct {
+	Change changelist.Change
+	Err    error
+}
+
+func (e ChangeError) Error() string {
+	return fmt.Sprintf("change to %s %q in %s: %s",
+		e.Change.Type(), e.Change.Path(), e.Change.Scope(), e.Err.Error())
+}
+
+// ErrInvalidRootCert is returned when a certificate given to represent the
+// root key of a repository can't be used for it
+type ErrInvalidRootCert struct {
+	Reason string
+}
+
+func (e ErrInvalidRootCert) Error() string {
+	return fmt.Sprintf("invalid root certificate: %s", e.Reason)
+}
+
+// ErrTimestampSnapshotMismatch is returned when the snapshot of a repository
+// isn't the one its timestamp refers to
+type ErrTimestampSnapshotMismatch struct {
+	Reason string
+}
+
+func (e ErrTimestampSnapshotMismatch) Error() string {
+	return fmt.Sprintf("snapshot does not match the timestamp: %s", e.Reason)
+}
+
+// ErrCorruptedCache is returned when the locally cached metadata for a role
+// can't be read or parsed
+type ErrCorruptedCache struct {
+	Role string
+	Path string
+	Err  error
+}
+
+func (e ErrCorruptedCache) Error() string {
+	return fmt.Sprintf("cached %s metadata at %s is corrupted: %v", e.Role, e.Path, e.Err)
+}
+
 const (
 	tufDir = "tuf"
 )
 
+// CacheLayout is how the trust data of a repository is laid out in its cache
+// directory: the metadata of each role is cached as
+// <role>.<MetadataExtension> under the MetadataDir subdirectory.  Either
+// field left empty has its default value, "metadata" and "json".
+type CacheLayout struct {
+	MetadataDir       string
+	MetadataExtension string // without the leading dot
+}
+
+// withDefaults returns the layout with the default values of the fields left
+// empty
+func (l CacheLayout) withDefaults() CacheLayout {
+	if l.MetadataDir == "" {
+		l.MetadataDir = "metadata"
+	}
+	if l.MetadataExtension == "" {
+		l.MetadataExtension = "json"
+	}
+	return l
+}
+
 // ErrRepositoryNotExist gets returned when trying to make an action over a repository
 /// that doesn't exist.
 var ErrRepositoryNotExist = errors.New("repository does not exist")
 
+// ErrReadOnly is returned when trying to modify a repository that was created
+// with NewReadOnlyRepository
+var ErrReadOnly = errors.New("repository is read-only")
+
+// ErrOffline is returned instead of contacting the server when the
+// repository is Offline: by Publish, and by reads that the cached trust data
+// isn't enough for, e.g. because it is missing or its timestamp has expired
+var ErrOffline = errors.New("repository is offline, and the trust server is needed")
+
 // NotaryRepository stores all the information needed to operate on a notary
 // repository.
+//
+// Changes to the changelist (AddTarget, RemoveTarget, AddDelegation, etc.) and
+// Publish are serialized across all the NotaryRepositories in a process that
+// share the same repository directory, so concurrent calls never lose a
+// change.  Nothing coordinates separate processes: change files are uniquely
+// named so concurrent writers won't clobber each other, but a Publish in one
+// process may clear changes another process staged while it was publishing.
+//
+// The repositories of different GUNs can publish at the same time, even if
+// their CryptoServices share keystores, since the trustmanager keystores are
+// safe for concurrent use.
 type NotaryRepository struct {
 	baseDir       string
 	gun           string
@@ -85,18 +482,226 @@ type NotaryRepository struct {
 	tufRepo       *tuf.Repo
 	roundTrip     http.RoundTripper
 	CertManager   *certs.Manager
+	readOnly      bool
+	cacheLayout   CacheLayout
+
+	requiredSnapshotChecksum string
+
+	// Offline, if set, makes the repository only use the trust data in the
+	// local cache, without ever contacting the server, instead of only
+	// falling back on the cache if the server can't be reached.  Whatever
+	// would have to contact the server fails with ErrOffline, as does
+	// Publish.
+	Offline bool
+
+	// RemoteKeyRetries is how many more times Initialize and RotateKey try
+	// to fetch a key the server manages when the server can't be reached,
+	// waiting twice as long before each retry, starting at one second.
+	RemoteKeyRetries int
+
+	// KeyAlgorithm is the algorithm of the keys Initialize, RotateKey and
+	// GenerateDelegationKey create, and KeyGenConfig sets their strength, e.g.
+	// for compliance regimes that mandate P-384 or RSA-4096 keys.  By default
+	// they create P-256 ECDSA keys.  A KeyGenConfig can only be used if the
+	// CryptoService can create keys with one, as a cryptoservice.CryptoService
+	// can.
+	KeyAlgorithm string
+	KeyGenConfig cryptoservice.KeyGenConfig
+
+	// MaxPublishBatchSize, if positive, is the maximum number of bytes of
+	// metadata Publish uploads in a single request.  The metadata is then
+	// split across as many requests as necessary, with the root and targets
+	// in the first one.  A single role's metadata is never split, so a role
+	// larger than the limit is uploaded in a request of its own.  Only
+	// repositories whose snapshot is signed by the server can be published
+	// in batches: if the client signs the snapshot, everything is uploaded
+	// in a single request regardless of the limit.
+	MaxPublishBatchSize int
+
+	// StreamPublish, if set, makes Publish upload the metadata of each
+	// targets role as soon as it has been signed, in a request of its own,
+	// instead of holding the metadata of every role to upload them together,
+	// so that a publish that changes many large delegated roles needs less
+	// memory.  The root, if it changed, goes with the first role.  This gives
+	// up atomicity: if a request fails, the roles uploaded before it stay
+	// published, and Publish returns an ErrPartialPublish.  Like
+	// MaxPublishBatchSize, it only applies to repositories whose snapshot is
+	// signed by the server, and is ignored otherwise, since a client-signed
+	// snapshot must be uploaded with every role it refers to.
+	StreamPublish bool
+
+	// VerifyPublish, if set, makes Publish download the trust data from the
+	// server again once it has been uploaded, and check that the server
+	// serves the versions of the roles that were published, and a root with
+	// the same keys, before clearing the changelist.  If it doesn't, Publish
+	// returns an ErrPublishNotAdopted.
+	VerifyPublish bool
+
+	// MaxDelegationDepth is how many levels of delegations below the base
+	// targets role are followed when the delegation tree is walked, e.g. to
+	// look up a target or download the delegated roles, so that a
+	// pathologically deep tree can't make the repository download metadata
+	// without end.  Deeper delegations make the walk fail with a
+	// tufclient.ErrMaxDelegationDepth.  If zero, it is
+	// tufclient.DefaultMaxDelegationDepth.
+	MaxDelegationDepth int
+
+	// PinnedRootKey, if set, is the only key trusted to sign the root
+	// metadata.  The root is then verified against this key directly, instead
+	// of against the certificates trusted by the CertManager, so it takes
+	// precedence over any certs.TrustPinConfig the repository was created
+	// with.  Use it when the root key has no certificate to pin.
+	PinnedRootKey data.PublicKey
+
+	// ValidTargetName, if set, is the policy target names must satisfy, e.g.
+	// the MatchString method of a regexp.Regexp.  AddTarget refuses to stage,
+	// and Publish to apply, a target whose name it returns false for.  If
+	// nil, any name is accepted.
+	ValidTargetName func(name string) bool
+
+	// Now, if set, is the time the expiry of the metadata the repository signs
+	// is counted from, instead of the current time.  Pinning it makes
+	// publishing the same changes to the same repository produce the same
+	// signed metadata, although the signatures only match if the keys sign
+	// deterministically, as ed25519 keys do.  The timestamp, and the snapshot
+	// if the server signs it, are up to the server.
+	Now func() time.Time
+
+	// DelegationShadowPolicy is what Publish does about targets added to the
+	// base targets role whose names fall under the paths of one of its
+	// delegations, which makes it ambiguous which role's target is meant.
+	// By default they are allowed.
+	DelegationShadowPolicy ShadowPolicy
+
+	// AllowConflictingChanges, if set, makes Publish apply every staged
+	// target in order, so that of several different targets staged with the
+	// same name in the same role, the last one wins.  By default Publish
+	// returns an ErrConflictingChanges instead, since they are usually the
+	// mistake of staging the same changes twice, e.g. by retrying a job.
+	AllowConflictingChanges bool
+
+	// MetadataSizeWarning is the size in bytes of serialized targets or
+	// snapshot metadata above which Publish logs a warning suggesting that
+	// the targets be split into delegations, so that clients aren't slowed
+	// down, and the metadata doesn't outgrow what clients will download.  If
+	// zero, it is DefaultMetadataSizeWarning.  If negative, Publish never
+	// warns.
+	MetadataSizeWarning int
+
+	// Logger, if set, is what the repository logs to, instead of the global
+	// logrus logger.
+	Logger Logger
+
+	// OpLogger, if set, is told about the start and end of every operation
+	// that modifies the repository.
+	OpLogger OpLogger
+
+	// SignerOverride, if set, signs the metadata of the SignerOverrideRoles
+	// when they are published, instead of the CryptoService.  This lets the
+	// signing keys of those roles live elsewhere, e.g. in an HSM.  Signatures
+	// that don't verify are discarded.
+	SignerOverride SignerOverride
+
+	// SignerOverrideRoles are the roles signed by the SignerOverride.  If
+	// empty, it signs for the targets and snapshot roles.
+	SignerOverrideRoles []string
+
+	// ChangelistFactory, if set, opens the changelist of the repository with
+	// the given GUN, in place of the changelist directory in the repository's
+	// trust directory.  Every call for a GUN must return a changelist backed
+	// by the same storage, so that changes staged by one operation are seen
+	// by the next.
+	ChangelistFactory func(gun string) (changelist.Changelist, error)
+
+	// TargetURLTemplate, if set, is the text/template TargetDownloadInfo
+	// makes the URL a target's content can be fetched from with, given the
+	// target's TargetURLFields, e.g.
+	// "https://blobs.example.com/sha256/{{.SHA256}}" for a content addressable
+	// store.
+	TargetURLTemplate string
 }
 
-// repositoryFromKeystores is a helper function for NewNotaryRepository that
-// takes some basic NotaryRepository parameters as well as keystores (in order
-// of usage preference), and returns a NotaryRepository.
-func repositoryFromKeystores(baseDir, gun, baseURL string, rt http.RoundTripper,
-	keyStores []trustmanager.KeyStore) (*NotaryRepository, error) {
+// now returns the time the expiry of signed metadata is counted from: the
+// pinned Now, or the current time
+func (r *NotaryRepository) now() time.Time {
+	if r.Now != nil {
+		return r.Now()
+	}
+	return time.Now()
+}
 
-	certManager, err := certs.NewManager(baseDir)
-	if err != nil {
-		return nil, err
+// DefaultMetadataSizeWarning is the default MetadataSizeWarning: 1MB
+const DefaultMetadataSizeWarning = 1 << 20
+
+// warnLargeMetadata logs a warning for each of the targets roles and
+// snapshot in updatedFiles whose metadata is larger than the
+// MetadataSizeWarning
+func (r *NotaryRepository) warnLargeMetadata(updatedFiles map[string][]byte) {
+	threshold := r.MetadataSizeWarning
+	if threshold == 0 {
+		threshold = DefaultMetadataSizeWarning
+	}
+	if threshold < 0 {
+		return
+	}
+	roles := make([]string, 0, len(updatedFiles))
+	for role := range updatedFiles {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	for _, role := range roles {
+		if role == data.CanonicalRootRole || role == data.CanonicalTimestampRole {
+			continue
+		}
+		if size := len(updatedFiles[role]); size > threshold {
+			r.logger().Warnf(
+				"the %s metadata is %d bytes, more than %d: consider moving its targets into delegations",
+				role, size, threshold)
+		}
+	}
+}
+
+// ShadowPolicy is what to do about a target that shadows a delegation
+type ShadowPolicy int
+
+const (
+	// ShadowAllow publishes the target
+	ShadowAllow ShadowPolicy = iota
+	// ShadowWarn publishes the target, but logs a warning
+	ShadowWarn
+	// ShadowError refuses to publish the target
+	ShadowError
+)
+
+var (
+	changelistLocksMu sync.Mutex
+	changelistLocks   = make(map[string]*sync.Mutex)
+)
+
+// lockChangelist acquires the in-process lock on this repository's changelist,
+// and returns the function that releases it
+func (r *NotaryRepository) lockChangelist() func() {
+	changelistLocksMu.Lock()
+	l, ok := changelistLocks[r.tufRepoPath]
+	if !ok {
+		l = &sync.Mutex{}
+		changelistLocks[r.tufRepoPath] = l
 	}
+	changelistLocksMu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// repositoryFromKeystores is a helper function for NewNotaryRepository that
+// takes some basic NotaryRepository parameters as well as keystores (in order
+// of usage preference) and the CertManager that validates its root
+// certificates, and returns a NotaryRepository.  The trust data and
+// changelist are kept under cacheDir, with the trust data laid out as layout
+// says.
+func repositoryFromKeystores(baseDir, cacheDir, gun, baseURL string, rt http.RoundTripper,
+	keyStores []trustmanager.KeyStore, certManager *certs.Manager,
+	layout CacheLayout) (*NotaryRepository, error) {
 
 	cryptoService := cryptoservice.NewCryptoService(gun, keyStores...)
 
@@ -104,16 +709,17 @@ func repositoryFromKeystores(baseDir, gun, baseURL string, rt http.RoundTripper,
 		gun:           gun,
 		baseDir:       baseDir,
 		baseURL:       baseURL,
-		tufRepoPath:   filepath.Join(baseDir, tufDir, filepath.FromSlash(gun)),
+		tufRepoPath:   filepath.Join(cacheDir, tufDir, filepath.FromSlash(gun)),
 		CryptoService: cryptoService,
 		roundTrip:     rt,
 		CertManager:   certManager,
+		cacheLayout:   layout.withDefaults(),
 	}
 
 	fileStore, err := store.NewFilesystemStore(
 		nRepo.tufRepoPath,
-		"metadata",
-		"json",
+		nRepo.cacheLayout.MetadataDir,
+		nRepo.cacheLayout.MetadataExtension,
 		"",
 	)
 	if err != nil {
@@ -124,6 +730,96 @@ func repositoryFromKeystores(baseDir, gun, baseURL string, rt http.RoundTripper,
 	return nRepo, nil
 }
 
+// SetCacheIndent sets whether the trust data cached on disk is written as
+// indented JSON, for people and tools to read.  Only the cached files differ:
+// the cache is read back as the trust data was signed and downloaded, so it
+// is still checked against the same checksums, and what is signed and
+// published is always canonical JSON.  A cache is only read back compacted
+// while this is set, so it should be set every time the repository is opened.
+// It has no effect on a repository that doesn't cache its trust data on disk.
+func (r *NotaryRepository) SetCacheIndent(indent bool) {
+	if fileStore, ok := r.fileStore.(*store.FilesystemStore); ok {
+		fileStore.SetIndent(indent)
+	}
+}
+
+// NewReadOnlyRepository returns a notary repository that can only be used to
+// inspect the trust data for gun on the remote server.  It has no keys, caches
+// its metadata in memory only, and trusts only root metadata signed by
+// trustPinning, so it needs no local state at all.  All operations that would
+// modify the repository return ErrReadOnly.
+func NewReadOnlyRepository(gun, baseURL string, rt http.RoundTripper,
+	trustPinning data.PublicKey) (*NotaryRepository, error) {
+
+	if trustPinning == nil {
+		return nil, fmt.Errorf("a read-only repository requires a pinned root key")
+	}
+
+	return &NotaryRepository{
+		gun:           gun,
+		baseURL:       baseURL,
+		fileStore:     store.NewMemoryStore(nil, nil),
+		roundTrip:     rt,
+		readOnly:      true,
+		PinnedRootKey: trustPinning,
+	}, nil
+}
+
+// NewReadOnlyRepositoryWithCertManager returns a notary repository like
+// NewReadOnlyRepository, but that trusts the root certificates certManager
+// trusts for gun instead of a pinned root key.  Other than the certificates
+// certManager comes to trust, it needs no local state, so e.g. a service can
+// verify many repositories against one trust store without caching any of
+// their trust data.
+func NewReadOnlyRepositoryWithCertManager(gun, baseURL string, rt http.RoundTripper,
+	certManager *certs.Manager) (*NotaryRepository, error) {
+
+	if certManager == nil {
+		return nil, fmt.Errorf("a read-only repository requires a certificate manager")
+	}
+
+	return &NotaryRepository{
+		gun:         gun,
+		baseURL:     baseURL,
+		fileStore:   store.NewMemoryStore(nil, nil),
+		roundTrip:   rt,
+		readOnly:    true,
+		CertManager: certManager,
+	}, nil
+}
+
+// WithoutCache returns a read-only repository for the same GUN as r, on the
+// same server and with the same trusted certificates and configuration, that
+// keeps the trust data it downloads in memory only.  Its trust data is
+// validated exactly as r's would be, but r's cache is never read or written,
+// so it can verify the repository without leaving any trust data behind, or
+// trusting any that was cached.
+func (r *NotaryRepository) WithoutCache() *NotaryRepository {
+	repo := *r
+	repo.fileStore = store.NewMemoryStore(nil, nil)
+	repo.readOnly = true
+	repo.tufRepo = nil
+	return &repo
+}
+
+// WithRemote returns a repository for the same GUN as r, with the same local
+// trust data, keys and trusted certificates, but whose trust data lives on the
+// server at newBaseURL, e.g. to move a repository to a new server.  The two
+// repositories share r's CryptoService and CertManager, and the rest of its
+// configuration.  If the new server has no trust data for the GUN yet, the
+// next Publish uploads the root and targets cached when the trust data was
+// last read from the old server, e.g. by ListTargets; delegated roles are not
+// uploaded.  The new server must sign with the same timestamp key as the old
+// one (and the same snapshot key, if it manages the snapshot), since those are
+// the keys the root lists.
+func (r *NotaryRepository) WithRemote(newBaseURL string) *NotaryRepository {
+	repo := *r
+	repo.baseURL = newBaseURL
+	// the trust data is read from the new server before it is used
+	repo.tufRepo = nil
+	return &repo
+}
+
 // Target represents a simplified version of the data TUF operates on, so external
 // applications don't have to depend on tuf data types.
 type Target struct {
@@ -132,27 +828,241 @@ type Target struct {
 	Length int64
 }
 
-// NewTarget is a helper method that returns a Target
+// NewTarget is a helper method that returns a Target for the file at targetPath
 func NewTarget(targetName string, targetPath string) (*Target, error) {
-	b, err := ioutil.ReadFile(targetPath)
+	f, err := os.Open(targetPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return NewTargetFromReader(targetName, f)
+}
+
+// NewTargetWithHashAlgorithms is a helper method that returns a Target with
+// exactly the hashes of the given algorithms, e.g. "sha256" and "sha512",
+// which are all published and checked when the target is verified.  With
+// no algorithms, it is the same as NewTarget.
+func NewTargetWithHashAlgorithms(targetName string, targetPath string,
+	algorithms []string) (*Target, error) {
+
+	f, err := os.Open(targetPath)
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 
-	meta, err := data.NewFileMeta(bytes.NewBuffer(b))
+	meta, err := data.NewFileMeta(f, algorithms...)
 	if err != nil {
 		return nil, err
 	}
+	return NewTargetWithMeta(targetName, meta.Length, meta.Hashes), nil
+}
+
+// NewTargetFromReader is a helper method that returns a Target whose length and
+// hashes are computed by streaming the contents of r, so the target is never
+// held in memory in its entirety
+func NewTargetFromReader(targetName string, r io.Reader) (*Target, error) {
+	meta, err := data.NewFileMeta(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTargetWithMeta(targetName, meta.Length, meta.Hashes), nil
+}
 
-	return &Target{Name: targetName, Hashes: meta.Hashes, Length: meta.Length}, nil
+// NewTargetWithMeta is a helper method that returns a Target for a file whose
+// length and hashes the caller has already computed
+func NewTargetWithMeta(targetName string, length int64, hashes data.Hashes) *Target {
+	return &Target{Name: targetName, Hashes: hashes, Length: length}
 }
 
 // Initialize creates a new repository by using rootKey as the root Key for the
-// TUF repository.
-func (r *NotaryRepository) Initialize(rootKeyID string, serverManagedRoles ...string) error {
+// TUF repository.  It can be retried if it fails: the local keys it created
+// are removed again, and those an earlier attempt left behind, e.g. because
+// it was killed, are reused, so only the missing keys are created.
+func (r *NotaryRepository) Initialize(rootKeyID string, serverManagedRoles ...string) (err error) {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+
+	end := r.startOp("Initialize", map[string]string{
+		"rootKeyID":          rootKeyID,
+		"serverManagedRoles": strings.Join(serverManagedRoles, ","),
+	})
+	defer func() { end(err) }()
+
+	return r.initialize([]string{rootKeyID}, nil, 1, serverManagedRoles, false)
+}
+
+// InitializeOffline creates a new repository like Initialize, but without
+// contacting the server, e.g. on a workstation that isn't connected to it.
+// The root is created without the keys of the roles the server manages (the
+// timestamp, and the snapshot if serverManagedRoles includes it), which the
+// first Publish gets from the server and adds to the root before uploading
+// it.  Until then, only the targets can be changed, since the repository
+// can't be read from the server.
+func (r *NotaryRepository) InitializeOffline(rootKeyID string, serverManagedRoles ...string) (err error) {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+
+	end := r.startOp("InitializeOffline", map[string]string{
+		"rootKeyID":          rootKeyID,
+		"serverManagedRoles": strings.Join(serverManagedRoles, ","),
+	})
+	defer func() { end(err) }()
+
+	return r.initialize([]string{rootKeyID}, nil, 1, serverManagedRoles, true)
+}
+
+// EnsureInitialized initializes the repository like Initialize, unless it
+// already exists, in which case created is false and nothing is changed.  The
+// repository exists if a root is cached locally, e.g. by an earlier Initialize
+// that hasn't been published yet, or the server has one.  Only the server
+// reporting that it has no root makes the repository new: any other error
+// getting the root, e.g. because the server is unavailable, is returned.
+func (r *NotaryRepository) EnsureInitialized(rootKeyID string, serverManagedRoles ...string) (
+	created bool, err error) {
+	if r.readOnly {
+		return false, ErrReadOnly
+	}
+
+	_, err = r.fileStore.GetMeta(data.CanonicalRootRole, maxSize)
+	if err == nil {
+		return false, nil
+	}
+	if _, ok := err.(store.ErrMetaNotFound); !ok {
+		return false, err
+	}
+
+	remote, err := r.remoteStore()
+	if err != nil {
+		return false, err
+	}
+	_, err = remote.GetMeta(data.CanonicalRootRole, maxSize)
+	if err == nil {
+		return false, nil
+	}
+	if _, ok := err.(store.ErrMetaNotFound); !ok {
+		return false, err
+	}
+
+	if err := r.Initialize(rootKeyID, serverManagedRoles...); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// InitializeWithCertificate creates a new repository like Initialize, but
+// represents the root key in the TUF repository by the given certificate,
+// e.g. one issued by an existing CA, instead of a newly generated self-signed
+// one.  The certificate must be for the repository's GUN and for the public
+// key of the root key, and is trusted as the repository's root certificate.
+func (r *NotaryRepository) InitializeWithCertificate(rootKeyID string,
+	rootCert *x509.Certificate, serverManagedRoles ...string) (err error) {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+
+	end := r.startOp("InitializeWithCertificate", map[string]string{
+		"rootKeyID":          rootKeyID,
+		"serverManagedRoles": strings.Join(serverManagedRoles, ","),
+	})
+	defer func() { end(err) }()
+
+	if rootCert == nil {
+		return ErrInvalidRootCert{Reason: "no certificate given"}
+	}
+	return r.initialize([]string{rootKeyID}, []*x509.Certificate{rootCert}, 1, serverManagedRoles, false)
+}
+
+// InitializeWithRootKeys creates a new repository like Initialize, but with
+// several root keys, any rootThreshold of which must sign the root.  A newly
+// generated certificate represents each of the keys, and is trusted as one of
+// the repository's root certificates.  Publishing changes to the root then
+// needs enough of the root keys to meet the threshold.
+func (r *NotaryRepository) InitializeWithRootKeys(rootKeyIDs []string, rootThreshold int,
+	serverManagedRoles ...string) (err error) {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+
+	end := r.startOp("InitializeWithRootKeys", map[string]string{
+		"rootKeyIDs":         strings.Join(rootKeyIDs, ","),
+		"rootThreshold":      strconv.Itoa(rootThreshold),
+		"serverManagedRoles": strings.Join(serverManagedRoles, ","),
+	})
+	defer func() { end(err) }()
+
+	return r.initialize(rootKeyIDs, nil, rootThreshold, serverManagedRoles, false)
+}
+
+// rootCertKey returns the public key that represents the root key with the
+// given ID in the TUF metadata, and the certificate it is made from: rootCert,
+// or a newly generated certificate if it is nil.
+func (r *NotaryRepository) rootCertKey(rootKeyID string, rootCert *x509.Certificate) (
+	data.PublicKey, *x509.Certificate, error) {
+
 	privKey, _, err := r.CryptoService.GetPrivateKey(rootKeyID)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	// the root key is published in an x509 certificate, which can only hold
+	// the RSA and ECDSA keys crypto/x509 supports
+	if algorithm := privKey.Algorithm(); algorithm != data.RSAKey && algorithm != data.ECDSAKey {
+		return nil, nil, ErrUnsupportedRootKey{KeyID: rootKeyID, Algorithm: algorithm}
+	}
+
+	if rootCert != nil {
+		if err := checkRootCert(rootCert, privKey, r.gun); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		// Hard-coded policy: the generated certificate expires in 10 years.
+		startTime := time.Now()
+		rootCert, err = cryptoservice.GenerateCertificate(
+			privKey, r.gun, startTime, startTime.AddDate(10, 0, 0))
+
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// The root key gets stored in the TUF metadata X509 encoded, linking
+	// the tuf root.json to our X509 PKI.
+	// If the key is RSA, we store it as type RSAx509, if it is ECDSA we store it
+	// as ECDSAx509 to allow the gotuf verifiers to correctly decode the
+	// key on verification of signatures.
+	switch privKey.Algorithm() {
+	case data.RSAKey:
+		return data.NewRSAx509PublicKey(trustmanager.CertToPEM(rootCert)), rootCert, nil
+	case data.ECDSAKey:
+		return data.NewECDSAx509PublicKey(trustmanager.CertToPEM(rootCert)), rootCert, nil
+	default:
+		return nil, nil, fmt.Errorf("invalid format for root key: %s", privKey.Algorithm())
+	}
+}
+
+// initialize creates a new repository with the given root keys, of which
+// rootThreshold must sign the root.  Each key is represented by the
+// certificate at the same index of rootCerts, or by a newly generated
+// certificate if there is none.  The certificates are only trusted once the
+// repository has been created: if that fails, e.g. because the keys the
+// server manages can't be fetched, the local keys created so far are removed
+// again, so Initialize can simply be retried.  Keys an earlier attempt
+// couldn't remove are reused rather than created again.  If offline, the keys
+// the server manages are left out of the root, to be added by the first
+// Publish.
+func (r *NotaryRepository) initialize(rootKeyIDs []string, rootCerts []*x509.Certificate,
+	rootThreshold int, serverManagedRoles []string, offline bool) (err error) {
+
+	if len(rootKeyIDs) == 0 || rootThreshold < 1 || rootThreshold > len(rootKeyIDs) {
+		return data.ErrInvalidRole{
+			Role: data.CanonicalRootRole,
+			Reason: fmt.Sprintf("threshold %d is not possible with %d keys",
+				rootThreshold, len(rootKeyIDs)),
+		}
 	}
 
 	// currently we only support server managing timestamps and snapshots, and
@@ -182,56 +1092,85 @@ func (r *NotaryRepository) Initialize(rootKeyID string, serverManagedRoles ...st
 		}
 	}
 
-	// Hard-coded policy: the generated certificate expires in 10 years.
-	startTime := time.Now()
-	rootCert, err := cryptoservice.GenerateCertificate(
-		privKey, r.gun, startTime, startTime.AddDate(10, 0, 0))
-
+	kdb := keys.NewDB()
+	rootKeys := make([]string, 0, len(rootKeyIDs))
+	trustedCerts := make([]*x509.Certificate, 0, len(rootKeyIDs))
+	for i, rootKeyID := range rootKeyIDs {
+		var rootCert *x509.Certificate
+		if i < len(rootCerts) {
+			rootCert = rootCerts[i]
+		}
+		rootKey, cert, err := r.rootCertKey(rootKeyID, rootCert)
+		if err != nil {
+			return err
+		}
+		kdb.AddKey(rootKey)
+		rootKeys = append(rootKeys, rootKey.ID())
+		trustedCerts = append(trustedCerts, cert)
+	}
+	rootRole, err := data.NewRole(data.CanonicalRootRole, rootThreshold, rootKeys, nil, nil)
 	if err != nil {
 		return err
 	}
-	r.CertManager.AddTrustedCert(rootCert)
+	if err := kdb.AddRole(rootRole); err != nil {
+		return err
+	}
 
-	// The root key gets stored in the TUF metadata X509 encoded, linking
-	// the tuf root.json to our X509 PKI.
-	// If the key is RSA, we store it as type RSAx509, if it is ECDSA we store it
-	// as ECDSAx509 to allow the gotuf verifiers to correctly decode the
-	// key on verification of signatures.
-	var rootKey data.PublicKey
-	switch privKey.Algorithm() {
-	case data.RSAKey:
-		rootKey = data.NewRSAx509PublicKey(trustmanager.CertToPEM(rootCert))
-	case data.ECDSAKey:
-		rootKey = data.NewECDSAx509PublicKey(trustmanager.CertToPEM(rootCert))
-	default:
-		return fmt.Errorf("invalid format for root key: %s", privKey.Algorithm())
-	}
-
-	kdb := keys.NewDB()
-	err = addKeyForRole(kdb, data.CanonicalRootRole, rootKey)
-	if err != nil {
-		return err
-	}
+	// keys of the repository are only left over from an earlier attempt if
+	// it never got as far as saving the root
+	_, rootErr := r.fileStore.GetMeta(data.CanonicalRootRole, maxSize)
+	_, reuseKeys := rootErr.(store.ErrMetaNotFound)
 
 	// we want to create all the local keys first so we don't have to
 	// make unnecessary network calls
+	var createdKeyIDs []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, keyID := range createdKeyIDs {
+			if rmErr := r.CryptoService.RemoveKey(keyID); rmErr != nil {
+				r.logger().Warnf("unable to remove key %s: %v", keyID, rmErr)
+			}
+		}
+	}()
 	for _, role := range locallyManagedKeys {
-		// This is currently hardcoding the keys to ECDSA.
-		key, err := r.CryptoService.Create(role, data.ECDSAKey)
-		if err != nil {
-			return err
+		var key data.PublicKey
+		if reuseKeys {
+			key = r.leftoverKey(role)
+		}
+		if key != nil {
+			r.logger().Debugf("reusing %s key with keyID: %s", role, key.ID())
+		} else {
+			key, err = r.createKey(role)
+			if err != nil {
+				return err
+			}
+			createdKeyIDs = append(createdKeyIDs, key.ID())
 		}
 		if err := addKeyForRole(kdb, role, key); err != nil {
 			return err
 		}
 	}
 	for _, role := range remotelyManagedKeys {
+		if offline {
+			// the role has no key until the first Publish gets it from the
+			// server
+			keylessRole, err := data.NewRole(role, 1, nil, nil, nil)
+			if err != nil {
+				return err
+			}
+			if err := kdb.AddRole(keylessRole); err != nil {
+				return err
+			}
+			continue
+		}
 		// This key is generated by the remote server.
-		key, err := getRemoteKey(r.baseURL, r.gun, role, r.roundTrip)
+		key, err := r.remoteKey(role)
 		if err != nil {
 			return err
 		}
-		logrus.Debugf("got remote %s %s key with keyID: %s",
+		r.logger().Debugf("got remote %s %s key with keyID: %s",
 			role, key.Algorithm(), key.ID())
 		if err := addKeyForRole(kdb, role, key); err != nil {
 			return err
@@ -242,25 +1181,55 @@ func (r *NotaryRepository) Initialize(rootKeyID string, serverManagedRoles ...st
 
 	err = r.tufRepo.InitRoot(false)
 	if err != nil {
-		logrus.Debug("Error on InitRoot: ", err.Error())
+		r.logger().Debug("Error on InitRoot: ", err.Error())
 		return err
 	}
 	err = r.tufRepo.InitTargets(data.CanonicalTargetsRole)
 	if err != nil {
-		logrus.Debug("Error on InitTargets: ", err.Error())
+		r.logger().Debug("Error on InitTargets: ", err.Error())
 		return err
 	}
 	err = r.tufRepo.InitSnapshot()
 	if err != nil {
-		logrus.Debug("Error on InitSnapshot: ", err.Error())
+		r.logger().Debug("Error on InitSnapshot: ", err.Error())
 		return err
 	}
 
-	return r.saveMetadata(serverManagesSnapshot)
+	if err := r.saveMetadata(serverManagesSnapshot); err != nil {
+		return err
+	}
+	for _, cert := range trustedCerts {
+		r.CertManager.AddTrustedCert(cert)
+	}
+	return nil
+}
+
+// leftoverKey returns a key of the repository's KeyAlgorithm for role that an
+// earlier, failed Initialize created, but couldn't remove again, e.g. because
+// the process was killed, so that retrying Initialize doesn't leave another
+// unused key behind.  It returns nil if there is no such key.
+func (r *NotaryRepository) leftoverKey(role string) data.PublicKey {
+	algorithm := r.KeyAlgorithm
+	if algorithm == "" {
+		algorithm = data.ECDSAKey
+	}
+	var keyIDs []string
+	for _, keyPath := range r.CryptoService.ListKeys(role) {
+		if filepath.Dir(keyPath) == r.gun {
+			keyIDs = append(keyIDs, filepath.Base(keyPath))
+		}
+	}
+	sort.Strings(keyIDs)
+	for _, keyID := range keyIDs {
+		if key := r.CryptoService.GetKey(keyID); key != nil && key.Algorithm() == algorithm {
+			return key
+		}
+	}
+	return nil
 }
 
 // adds a TUF Change template to the given roles
-func addChange(cl *changelist.FileChangelist, c changelist.Change, roles ...string) error {
+func addChange(cl changelist.Changelist, c changelist.Change, roles ...string) error {
 
 	if len(roles) == 0 {
 		roles = []string{data.CanonicalTargetsRole}
@@ -303,22 +1272,67 @@ func addChange(cl *changelist.FileChangelist, c changelist.Change, roles ...stri
 func (r *NotaryRepository) AddDelegation(name string, threshold int,
 	delegationKeys []data.PublicKey) error {
 
+	return r.AddDelegationWithPaths(name, threshold, delegationKeys, nil, nil)
+}
+
+// AddDelegationWithPaths is like AddDelegation, but also restricts the
+// targets the delegated role may sign to those whose names start with one of
+// paths, or whose hex encoded SHA256 checksums of their names start with one
+// of pathHashPrefixes.  A delegation can be restricted by paths or by path
+// hash prefixes but not both, so setting both returns an ErrInvalidRole, as
+// does an empty path or prefix, which would match every target and so
+// restrict nothing.  Paths are prefixes rather than patterns: "qa/" restricts
+// the delegation to the targets under qa/.  Restrictions are added to those
+// the delegation already has.
+func (r *NotaryRepository) AddDelegationWithPaths(name string, threshold int,
+	delegationKeys []data.PublicKey, paths, pathHashPrefixes []string) (err error) {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+
+	end := r.startOp("AddDelegation", map[string]string{
+		"name":             name,
+		"threshold":        strconv.Itoa(threshold),
+		"keys":             strings.Join(data.KeyList(delegationKeys).IDs(), ","),
+		"paths":            strings.Join(paths, ","),
+		"pathHashPrefixes": strings.Join(pathHashPrefixes, ","),
+	})
+	defer func() { end(err) }()
+
 	if !data.IsDelegation(name) {
 		return data.ErrInvalidRole{Role: name, Reason: "invalid delegation role name"}
 	}
+	if len(paths) > 0 && len(pathHashPrefixes) > 0 {
+		return data.ErrInvalidRole{
+			Role:   name,
+			Reason: "a delegation can't have both paths and path hash prefixes",
+		}
+	}
+	for _, restriction := range append(append([]string{}, paths...), pathHashPrefixes...) {
+		if restriction == "" {
+			return data.ErrInvalidRole{
+				Role:   name,
+				Reason: "delegation paths and path hash prefixes can't be empty",
+			}
+		}
+	}
+
+	defer r.lockChangelist()()
 
-	cl, err := changelist.NewFileChangelist(filepath.Join(r.tufRepoPath, "changelist"))
+	cl, err := r.openChangelist()
 	if err != nil {
 		return err
 	}
 	defer cl.Close()
 
-	logrus.Debugf(`Adding delegation "%s" with threshold %d, and %d keys\n`,
+	r.logger().Debugf(`Adding delegation "%s" with threshold %d, and %d keys\n`,
 		name, threshold, len(delegationKeys))
 
 	tdJSON, err := json.Marshal(&changelist.TufDelegation{
-		NewThreshold: threshold,
-		AddKeys:      data.KeyList(delegationKeys),
+		NewThreshold:        threshold,
+		AddKeys:             data.KeyList(delegationKeys),
+		AddPaths:            paths,
+		AddPathHashPrefixes: pathHashPrefixes,
 	})
 	if err != nil {
 		return err
@@ -339,19 +1353,27 @@ func (r *NotaryRepository) AddDelegation(name string, threshold int,
 // the repository when the changelist gets applied at publish time.
 // This does not validate that the delegation exists, since one might exist
 // after applying all changes.
-func (r *NotaryRepository) RemoveDelegation(name string) error {
+func (r *NotaryRepository) RemoveDelegation(name string) (err error) {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+
+	end := r.startOp("RemoveDelegation", map[string]string{"name": name})
+	defer func() { end(err) }()
 
 	if !data.IsDelegation(name) {
 		return data.ErrInvalidRole{Role: name, Reason: "invalid delegation role name"}
 	}
 
-	cl, err := changelist.NewFileChangelist(filepath.Join(r.tufRepoPath, "changelist"))
+	defer r.lockChangelist()()
+
+	cl, err := r.openChangelist()
 	if err != nil {
 		return err
 	}
 	defer cl.Close()
 
-	logrus.Debugf(`Removing delegation "%s"\n`, name)
+	r.logger().Debugf(`Removing delegation "%s"\n`, name)
 
 	template := changelist.NewTufChange(
 		changelist.ActionDelete,
@@ -364,17 +1386,183 @@ func (r *NotaryRepository) RemoveDelegation(name string) error {
 	return addChange(cl, template, name)
 }
 
+// GenerateDelegationKey creates a new key in the local keystore for signing
+// the delegated role, and returns its public key, so that it can be given to
+// AddDelegation or exported for the delegation's signers.  Like the keys of
+// every delegation, it is stored as a key of the targets role.
+func (r *NotaryRepository) GenerateDelegationKey(role string) (pubKey data.PublicKey, err error) {
+	if r.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	end := r.startOp("GenerateDelegationKey", map[string]string{"role": role})
+	defer func() { end(err) }()
+
+	if !data.IsDelegation(role) {
+		return nil, data.ErrInvalidRole{Role: role, Reason: "invalid delegation role name"}
+	}
+	return r.createDelegationKey()
+}
+
+// createDelegationKey creates a new key in the local keystore for signing a
+// delegated role
+func (r *NotaryRepository) createDelegationKey() (data.PublicKey, error) {
+	return r.createKey(data.CanonicalTargetsRole)
+}
+
+// keyGenConfigCreator is implemented by the CryptoServices that can create
+// keys of the strength a KeyGenConfig sets
+type keyGenConfigCreator interface {
+	CreateWithConfig(role, algorithm string, config cryptoservice.KeyGenConfig) (data.PublicKey, error)
+}
+
+// createKey creates a new key for role in the CryptoService, of the
+// repository's KeyAlgorithm and KeyGenConfig
+func (r *NotaryRepository) createKey(role string) (data.PublicKey, error) {
+	algorithm := r.KeyAlgorithm
+	if algorithm == "" {
+		algorithm = data.ECDSAKey
+	}
+	if r.KeyGenConfig == (cryptoservice.KeyGenConfig{}) {
+		return r.CryptoService.Create(role, algorithm)
+	}
+	creator, ok := r.CryptoService.(keyGenConfigCreator)
+	if !ok {
+		return nil, fmt.Errorf("the repository's CryptoService can't create keys with a KeyGenConfig")
+	}
+	return creator.CreateWithConfig(role, algorithm, r.KeyGenConfig)
+}
+
+// RotateDelegationKey creates a new key for the delegation, and a changelist
+// entry that replaces all of the delegation's existing keys with it when the
+// changelist gets applied at publish time.  The new public key is returned so
+// that it can be distributed to the delegation's signers.  The existing keys
+// are those of the delegation in the local copy of the repository: if there is
+// no record of it there, an error is returned, unless force is set, in which
+// case the new key is added without removing any.  Until the delegation's
+// metadata is signed again with the new key, by publishing a change to it,
+// clients can't verify it.
+func (r *NotaryRepository) RotateDelegationKey(name string, force bool) (
+	pubKey data.PublicKey, err error) {
+
+	if r.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	end := r.startOp("RotateDelegationKey", map[string]string{
+		"name":  name,
+		"force": strconv.FormatBool(force),
+	})
+	defer func() { end(err) }()
+
+	if !data.IsDelegation(name) {
+		return nil, data.ErrInvalidRole{Role: name, Reason: "invalid delegation role name"}
+	}
+
+	var oldKeyIDs []string
+	role, err := r.localDelegation(name)
+	switch {
+	case err == nil:
+		oldKeyIDs = role.KeyIDs
+	case force:
+		r.logger().Debugf("No local record of delegation %s, only adding a key: %v", name, err)
+	default:
+		return nil, err
+	}
+
+	defer r.lockChangelist()()
+
+	cl, err := r.openChangelist()
+	if err != nil {
+		return nil, err
+	}
+	defer cl.Close()
+
+	pubKey, err = r.createDelegationKey()
+	if err != nil {
+		return nil, err
+	}
+
+	r.logger().Debugf(`Rotating the keys of delegation "%s" to %s, removing %d keys`,
+		name, pubKey.ID(), len(oldKeyIDs))
+
+	tdJSON, err := json.Marshal(&changelist.TufDelegation{
+		AddKeys:    data.KeyList{pubKey},
+		RemoveKeys: oldKeyIDs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	template := changelist.NewTufChange(
+		changelist.ActionUpdate,
+		name,
+		changelist.TypeTargetsDelegation,
+		"", // no path
+		tdJSON,
+	)
+
+	if err := addChange(cl, template, name); err != nil {
+		return nil, err
+	}
+	return pubKey, nil
+}
+
+// localDelegation returns the delegation role with the given name from the
+// repository last loaded, which includes anything published since, or else
+// from the locally cached metadata of its parent.  It returns
+// data.ErrNoSuchRole if the parent doesn't delegate to it.
+func (r *NotaryRepository) localDelegation(name string) (*data.Role, error) {
+	if r.tufRepo != nil {
+		if role, err := r.tufRepo.GetDelegation(name); err == nil {
+			return role, nil
+		}
+	}
+
+	parent := filepath.Dir(name)
+	parentJSON, err := r.fileStore.GetMeta(parent, 0)
+	if err != nil {
+		return nil, r.corruptedCache(parent, err)
+	}
+	targets := &data.SignedTargets{}
+	if err := json.Unmarshal(parentJSON, targets); err != nil {
+		return nil, r.corruptedCache(parent, err)
+	}
+	foundAt := utils.FindRoleIndex(targets.Signed.Delegations.Roles, name)
+	if foundAt < 0 {
+		return nil, data.ErrNoSuchRole{Role: name}
+	}
+	return targets.Signed.Delegations.Roles[foundAt], nil
+}
+
 // AddTarget creates new changelist entries to add a target to the given roles
 // in the repository when the changelist gets appied at publish time.
 // If roles are unspecified, the default role is "target".
-func (r *NotaryRepository) AddTarget(target *Target, roles ...string) error {
+func (r *NotaryRepository) AddTarget(target *Target, roles ...string) (err error) {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+
+	end := r.startOp("AddTarget", map[string]string{
+		"target": target.Name,
+		"sha256": hex.EncodeToString(target.Hashes["sha256"]),
+		"length": strconv.FormatInt(target.Length, 10),
+		"roles":  strings.Join(roles, ","),
+	})
+	defer func() { end(err) }()
+
+	if err := r.checkTargetName(target.Name); err != nil {
+		return err
+	}
+
+	defer r.lockChangelist()()
 
-	cl, err := changelist.NewFileChangelist(filepath.Join(r.tufRepoPath, "changelist"))
+	cl, err := r.openChangelist()
 	if err != nil {
 		return err
 	}
 	defer cl.Close()
-	logrus.Debugf("Adding target \"%s\" with sha256 \"%x\" and size %d bytes.\n", target.Name, target.Hashes["sha256"], target.Length)
+	r.logger().Debugf("Adding target \"%s\" with sha256 \"%x\" and size %d bytes.\n", target.Name, target.Hashes["sha256"], target.Length)
 
 	meta := data.FileMeta{Length: target.Length, Hashes: target.Hashes}
 	metaJSON, err := json.Marshal(meta)
@@ -388,152 +1576,937 @@ func (r *NotaryRepository) AddTarget(target *Target, roles ...string) error {
 	return addChange(cl, template, roles...)
 }
 
+// checkTargetName returns an ErrInvalidTargetName if name doesn't satisfy the
+// repository's ValidTargetName policy
+func (r *NotaryRepository) checkTargetName(name string) error {
+	if r.ValidTargetName != nil && !r.ValidTargetName(name) {
+		return ErrInvalidTargetName{Name: name}
+	}
+	return nil
+}
+
+// checkShadowedTargets applies the repository's DelegationShadowPolicy to the
+// targets the changelist adds to the base targets role, once it has been
+// applied to the tuf repo, so that delegations it adds are taken into account
+func (r *NotaryRepository) checkShadowedTargets(cl changelist.Changelist) error {
+	if r.DelegationShadowPolicy == ShadowAllow {
+		return nil
+	}
+	base, ok := r.tufRepo.Targets[data.CanonicalTargetsRole]
+	if !ok {
+		return nil
+	}
+	for _, c := range cl.List() {
+		if c.Type() != changelist.TypeTargetsTarget || c.Action() != changelist.ActionCreate ||
+			c.Scope() != data.CanonicalTargetsRole {
+			continue
+		}
+		delegations := base.GetDelegations(c.Path())
+		if len(delegations) == 0 {
+			continue
+		}
+		err := ErrTargetShadowsDelegation{Name: c.Path(), Role: delegations[0].Name}
+		if r.DelegationShadowPolicy == ShadowError {
+			return err
+		}
+		r.logger().Warn(err.Error())
+	}
+	return nil
+}
+
+// checkConflictingChanges returns an ErrConflictingChanges if, unless the
+// repository AllowConflictingChanges, the changelist creates a target in a
+// role that it has already created with different content, without deleting
+// it in between
+func (r *NotaryRepository) checkConflictingChanges(cl changelist.Changelist) error {
+	if r.AllowConflictingChanges {
+		return nil
+	}
+	changes := cl.List()
+	// the index of the latest change creating each role's targets, by role
+	// and name
+	created := make(map[string]map[string]int)
+	conflicting := make(map[int]bool)
+	for i, c := range changes {
+		if c.Type() != changelist.TypeTargetsTarget {
+			continue
+		}
+		targets, ok := created[c.Scope()]
+		if !ok {
+			targets = make(map[string]int)
+			created[c.Scope()] = targets
+		}
+		if c.Action() != changelist.ActionCreate {
+			delete(targets, c.Path())
+			continue
+		}
+		if prev, ok := targets[c.Path()]; ok && !bytes.Equal(changes[prev].Content(), c.Content()) {
+			conflicting[prev] = true
+			conflicting[i] = true
+		}
+		targets[c.Path()] = i
+	}
+	var conflicts []changelist.Change
+	for i, c := range changes {
+		if conflicting[i] {
+			conflicts = append(conflicts, c)
+		}
+	}
+	if len(conflicts) > 0 {
+		return ErrConflictingChanges{Changes: conflicts}
+	}
+	return nil
+}
+
 // RemoveTarget creates new changelist entries to remove a target from the given
 // roles in the repository when the changelist gets applied at publish time.
 // If roles are unspecified, the default role is "target".
-func (r *NotaryRepository) RemoveTarget(targetName string, roles ...string) error {
+func (r *NotaryRepository) RemoveTarget(targetName string, roles ...string) (err error) {
+	if r.readOnly {
+		return ErrReadOnly
+	}
 
-	cl, err := changelist.NewFileChangelist(filepath.Join(r.tufRepoPath, "changelist"))
+	end := r.startOp("RemoveTarget", map[string]string{
+		"target": targetName,
+		"roles":  strings.Join(roles, ","),
+	})
+	defer func() { end(err) }()
+
+	defer r.lockChangelist()()
+
+	cl, err := r.openChangelist()
 	if err != nil {
 		return err
 	}
-	logrus.Debugf("Removing target \"%s\"", targetName)
+	defer cl.Close()
+
+	r.logger().Debugf("Removing target \"%s\"", targetName)
 	template := changelist.NewTufChange(changelist.ActionDelete, "",
 		changelist.TypeTargetsTarget, targetName, nil)
 	return addChange(cl, template, roles...)
 }
 
-// ListTargets lists all targets for the current repository
-func (r *NotaryRepository) ListTargets() ([]*Target, error) {
-	c, err := r.bootstrapClient()
+// RemoveTargetMatching creates a new changelist entry to remove a target like
+// RemoveTarget, but only if the target currently signed by each of the given
+// roles (by default the targets role) has the expected hashes, so that a
+// target republished under the same name since it was read isn't removed.
+// Every algorithm in expectedHashes must have the same hash in the signed
+// target.  Otherwise nothing is staged, and the error is an ErrTargetMismatch.
+func (r *NotaryRepository) RemoveTargetMatching(targetName string, expectedHashes data.Hashes,
+	roles ...string) (err error) {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+
+	end := r.startOp("RemoveTargetMatching", map[string]string{
+		"target": targetName,
+		"roles":  strings.Join(roles, ","),
+	})
+	defer func() { end(err) }()
+
+	defer r.lockChangelist()()
+
+	c, err := r.updateTUF()
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	err = c.Update()
+	signedBy := make(map[string]data.Hashes)
+	err = c.WalkTargetRoles(targetName, func(role string) bool {
+		signedBy[role] = r.tufRepo.TargetMeta(role, targetName).Hashes
+		return true
+	})
 	if err != nil {
-		if err, ok := err.(signed.ErrExpired); ok {
-			return nil, ErrExpired{err}
+		return err
+	}
+	checkRoles := roles
+	if len(checkRoles) == 0 {
+		checkRoles = []string{data.CanonicalTargetsRole}
+	}
+	for _, role := range checkRoles {
+		role = strings.ToLower(role)
+		hashes, ok := signedBy[role]
+		if !ok {
+			return ErrTargetMismatch{Name: targetName, Role: role, Reason: "target is not signed by the role"}
+		}
+		if !hashesMatch(expectedHashes, hashes) {
+			return ErrTargetMismatch{Name: targetName, Role: role, Reason: "target has different hashes"}
 		}
-		return nil, err
 	}
 
-	var targetList []*Target
-	for name, meta := range r.tufRepo.Targets["targets"].Signed.Targets {
-		target := &Target{Name: name, Hashes: meta.Hashes, Length: meta.Length}
-		targetList = append(targetList, target)
+	cl, err := r.openChangelist()
+	if err != nil {
+		return err
 	}
+	defer cl.Close()
 
-	return targetList, nil
+	r.logger().Debugf("Removing target \"%s\"", targetName)
+	template := changelist.NewTufChange(changelist.ActionDelete, "",
+		changelist.TypeTargetsTarget, targetName, nil)
+	return addChange(cl, template, roles...)
 }
 
-// GetTargetByName returns a target given a name
-func (r *NotaryRepository) GetTargetByName(name string) (*Target, error) {
-	c, err := r.bootstrapClient()
+// RemoveTargetsByPrefix creates changelist entries to remove every target
+// whose name starts with prefix from the given roles (by default the targets
+// role), as currently signed by each role, so that none of them is missed.
+// The roles are searched like ListTargetsByPrefix searches them.
+// It returns the names of the targets it staged the removal of, which are
+// none if no target matches.
+func (r *NotaryRepository) RemoveTargetsByPrefix(prefix string, roles ...string) (
+	removed []string, err error) {
+	if r.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	end := r.startOp("RemoveTargetsByPrefix", map[string]string{
+		"prefix": prefix,
+		"roles":  strings.Join(roles, ","),
+	})
+	defer func() { end(err) }()
+
+	defer r.lockChangelist()()
+
+	c, err := r.updateTUF()
 	if err != nil {
 		return nil, err
 	}
+	if len(roles) == 0 {
+		roles = []string{data.CanonicalTargetsRole}
+	} else if err := c.DownloadDelegations(); err != nil {
+		return nil, err
+	}
 
-	err = c.Update()
+	// the targets to remove from each role
+	matches := make(map[string][]string)
+	names := make(map[string]bool)
+	for _, role := range roles {
+		role = strings.ToLower(role)
+		targets, ok := r.tufRepo.Targets[role]
+		if !ok {
+			return nil, data.ErrNoSuchRole{Role: role}
+		}
+		for name := range targets.Signed.Targets {
+			if strings.HasPrefix(name, prefix) {
+				matches[role] = append(matches[role], name)
+				names[name] = true
+			}
+		}
+	}
+	removed = make([]string, 0, len(names))
+	if len(names) == 0 {
+		return removed, nil
+	}
+
+	cl, err := r.openChangelist()
 	if err != nil {
-		if err, ok := err.(signed.ErrExpired); ok {
-			return nil, ErrExpired{err}
+		return nil, err
+	}
+	defer cl.Close()
+
+	for _, role := range roles {
+		role = strings.ToLower(role)
+		roleNames := matches[role]
+		delete(matches, role)
+		sort.Strings(roleNames)
+		for _, name := range roleNames {
+			r.logger().Debugf("Removing target \"%s\" from %s", name, role)
+			template := changelist.NewTufChange(changelist.ActionDelete, "",
+				changelist.TypeTargetsTarget, name, nil)
+			if err := addChange(cl, template, role); err != nil {
+				return nil, err
+			}
 		}
+	}
+	for name := range names {
+		removed = append(removed, name)
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
+
+// ListTargets lists all targets for the current repository
+func (r *NotaryRepository) ListTargets() ([]*Target, error) {
+	var targetList []*Target
+	err := r.WalkTargets(func(target *Target) error {
+		targetList = append(targetList, target)
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
+	return targetList, nil
+}
 
-	meta, err := c.TargetMeta(name)
-	if meta == nil {
-		return nil, fmt.Errorf("No trust data for %s", name)
-	} else if err != nil {
+// ListTargetsByPrefix lists, sorted by name, the targets whose names start
+// with prefix in the given targets roles of the current repository.  If no
+// roles are given, only the base targets role is searched.  If a target is in
+// more than one of the roles, it is listed as it appears in the first of them.
+func (r *NotaryRepository) ListTargetsByPrefix(prefix string, roles ...string) ([]*Target, error) {
+	c, err := r.updateTUF()
+	if err != nil {
+		return nil, err
+	}
+	if len(roles) == 0 {
+		roles = []string{data.CanonicalTargetsRole}
+	} else if err := c.DownloadDelegations(); err != nil {
 		return nil, err
 	}
 
-	return &Target{Name: name, Hashes: meta.Hashes, Length: meta.Length}, nil
+	seen := make(map[string]bool)
+	var targetList []*Target
+	for _, role := range roles {
+		role = strings.ToLower(role)
+		targets, ok := r.tufRepo.Targets[role]
+		if !ok {
+			return nil, data.ErrNoSuchRole{Role: role}
+		}
+		for name, meta := range targets.Signed.Targets {
+			if !strings.HasPrefix(name, prefix) || seen[name] {
+				continue
+			}
+			seen[name] = true
+			targetList = append(targetList,
+				&Target{Name: name, Hashes: meta.Hashes, Length: meta.Length})
+		}
+	}
+	sort.Sort(targetsByName(targetList))
+	return targetList, nil
 }
 
-// GetChangelist returns the list of the repository's unpublished changes
-func (r *NotaryRepository) GetChangelist() (changelist.Changelist, error) {
-	changelistDir := filepath.Join(r.tufRepoPath, "changelist")
-	cl, err := changelist.NewFileChangelist(changelistDir)
+// GetDelegationRoles updates the repository from the remote server, and
+// returns every delegation role in the repository, at any depth
+func (r *NotaryRepository) GetDelegationRoles() ([]*data.Role, error) {
+	c, err := r.updateTUF()
 	if err != nil {
-		logrus.Debug("Error initializing changelist")
 		return nil, err
 	}
-	return cl, nil
+	if err := c.DownloadDelegations(); err != nil {
+		return nil, err
+	}
+
+	var roles []*data.Role
+	for _, targets := range r.tufRepo.Targets {
+		roles = append(roles, targets.Signed.Delegations.Roles...)
+	}
+	return roles, nil
 }
 
-// Publish pushes the local changes in signed material to the remote notary-server
-// Conceptually it performs an operation similar to a `git rebase`
-func (r *NotaryRepository) Publish() error {
-	var updateRoot bool
-	// attempt to initialize the repo from the remote store
-	c, err := r.bootstrapClient()
+// PrefetchDelegations updates the repository from the remote server, and
+// downloads the metadata of every delegated role in the snapshot's delegation
+// tree into the local cache.  Later lookups of targets signed by delegations,
+// such as GetTargetByName, then use the cached metadata, which is checked
+// against the snapshot, instead of downloading each role as it's reached.
+func (r *NotaryRepository) PrefetchDelegations() error {
+	c, err := r.updateTUF()
 	if err != nil {
-		if _, ok := err.(store.ErrMetaNotFound); ok {
-			// if the remote store return a 404 (translated into ErrMetaNotFound),
-			// there is no trust data for yet. Attempt to load it from disk.
-			err := r.bootstrapRepo()
-			if err != nil {
-				// There are lots of reasons there might be an error, such as
-				// corrupt metadata.  We need better errors from bootstrapRepo.
-				logrus.Debugf("Unable to load repository from local files: %s",
-					err.Error())
-				return err
-			}
-			// We had local data but the server doesn't know about the repo yet,
-			// ensure we will push the initial root file.  The root may not
-			// be marked as Dirty, since there may not be any changes that
-			// update it, so use a different boolean.
-			updateRoot = true
-		} else {
-			// The remote store returned an error other than 404. We're
-			// unable to determine if the repo has been initialized or not.
-			logrus.Error("Could not publish Repository: ", err.Error())
+		return err
+	}
+	return c.DownloadDelegations()
+}
+
+// RoleVersions updates the repository from the remote server, and returns the
+// version of the metadata of each role it now trusts: the root, targets,
+// snapshot and timestamp, and any delegated roles that have been downloaded.
+func (r *NotaryRepository) RoleVersions() (map[string]int, error) {
+	if _, err := r.updateTUF(); err != nil {
+		return nil, err
+	}
+
+	versions := map[string]int{
+		data.CanonicalRootRole:      r.tufRepo.Root.Signed.Version,
+		data.CanonicalSnapshotRole:  r.tufRepo.Snapshot.Signed.Version,
+		data.CanonicalTimestampRole: r.tufRepo.Timestamp.Signed.Version,
+	}
+	for role, targets := range r.tufRepo.Targets {
+		versions[role] = targets.Signed.Version
+	}
+	return versions, nil
+}
+
+// WalkTargets updates the repository from the remote server and then calls
+// walkFn for every target in the current repository, without building the
+// full list of targets in memory.  If walkFn returns an error, the walk stops
+// and that error is returned.
+func (r *NotaryRepository) WalkTargets(walkFn func(*Target) error) error {
+	if _, err := r.updateTUF(); err != nil {
+		return err
+	}
+
+	for name, meta := range r.tufRepo.Targets["targets"].Signed.Targets {
+		target := &Target{Name: name, Hashes: meta.Hashes, Length: meta.Length}
+		if err := walkFn(target); err != nil {
 			return err
 		}
-	} else {
-		// If we were successfully able to bootstrap the client (which only pulls
-		// root.json), update it with the rest of the tuf metadata in
-		// preparation for applying the changelist.
-		err = c.Update()
-		if err != nil {
-			if err, ok := err.(signed.ErrExpired); ok {
-				return ErrExpired{err}
+	}
+	return nil
+}
+
+// GetTargetByName returns a target given a name
+func (r *NotaryRepository) GetTargetByName(name string) (*Target, error) {
+	c, err := r.updateTUF()
+	if err != nil {
+		return nil, err
+	}
+
+	// the repository was just updated, so there's no need for TargetMeta to
+	// update it again
+	var meta *data.FileMeta
+	err = c.WalkTargetRoles(name, func(role string) bool {
+		meta = r.tufRepo.TargetMeta(role, name)
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return nil, fmt.Errorf("No trust data for %s", name)
+	}
+
+	return &Target{Name: name, Hashes: meta.Hashes, Length: meta.Length}, nil
+}
+
+// TargetWithRole is a target, along with the targets role that signed it
+type TargetWithRole struct {
+	Target
+	Role string
+}
+
+// GetAllTargetMetadataByName returns the target with the given name from
+// every targets role that has metadata for it, in order of priority, so the
+// first is the target GetTargetByName returns.  This shows whether several
+// delegations sign conflicting targets for the same name.
+func (r *NotaryRepository) GetAllTargetMetadataByName(name string) ([]TargetWithRole, error) {
+	c, err := r.updateTUF()
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []TargetWithRole
+	err = c.WalkTargetRoles(name, func(role string) bool {
+		meta := r.tufRepo.TargetMeta(role, name)
+		targets = append(targets, TargetWithRole{
+			Target: Target{Name: name, Hashes: meta.Hashes, Length: meta.Length},
+			Role:   role,
+		})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("No trust data for %s", name)
+	}
+	return targets, nil
+}
+
+// FindTargetsByHash updates the repository from the remote server, and
+// returns the targets in the given targets roles whose hash of the given
+// algorithm, "sha256" or "sha512", is hash, e.g. to find whether an artifact
+// was published, and under which names.  If no roles are given, only the base
+// targets role is searched.  The targets are listed in the order of the roles
+// they are found in, and by name within each role.  If no target has the
+// hash, the list is empty.
+func (r *NotaryRepository) FindTargetsByHash(algo string, hash []byte, roles ...string) (
+	[]TargetWithRole, error) {
+
+	if algo != "sha256" && algo != "sha512" {
+		return nil, fmt.Errorf("Unknown Hash Algorithm: %s", algo)
+	}
+	c, err := r.updateTUF()
+	if err != nil {
+		return nil, err
+	}
+	if len(roles) == 0 {
+		roles = []string{data.CanonicalTargetsRole}
+	} else if err := c.DownloadDelegations(); err != nil {
+		return nil, err
+	}
+
+	var found []TargetWithRole
+	for _, role := range roles {
+		role = strings.ToLower(role)
+		targets, ok := r.tufRepo.Targets[role]
+		if !ok {
+			return nil, data.ErrNoSuchRole{Role: role}
+		}
+		var matches []*Target
+		for name, meta := range targets.Signed.Targets {
+			if targetHash, ok := meta.Hashes[algo]; ok && bytes.Equal(targetHash, hash) {
+				matches = append(matches,
+					&Target{Name: name, Hashes: meta.Hashes, Length: meta.Length})
 			}
-			return err
 		}
+		sort.Sort(targetsByName(matches))
+		for _, target := range matches {
+			found = append(found, TargetWithRole{Target: *target, Role: role})
+		}
+	}
+	return found, nil
+}
+
+// UpdateAndReport updates the repository from the remote server, and returns
+// the names of the roles whose version advanced compared to the versions that
+// were in the local cache before the update.  Roles that were not cached at all
+// are reported as changed.  The timestamp and snapshot are never reported,
+// since they routinely advance even if nothing else changed, and advance
+// whenever anything else does.
+func (r *NotaryRepository) UpdateAndReport() ([]string, error) {
+	before := cachedMetadataVersions(r.fileStore)
+
+	if _, err := r.updateTUF(); err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	for role, version := range loadedMetadataVersions(r.tufRepo) {
+		if role == data.CanonicalTimestampRole || role == data.CanonicalSnapshotRole {
+			continue
+		}
+		if oldVersion, ok := before[role]; !ok || version > oldVersion {
+			changed = append(changed, role)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// DuplicateTargetNames updates the repository from the remote server, including
+// every published delegated role, and returns the target names that are
+// claimed by more than one role, mapped to the names of the roles claiming them.
+// An empty map means every target name is signed by exactly one role.
+func (r *NotaryRepository) DuplicateTargetNames() (map[string][]string, error) {
+	c, err := r.updateTUF()
+	if err != nil {
+		return nil, err
 	}
+	if err := c.DownloadDelegations(); err != nil {
+		return nil, err
+	}
+	return duplicateTargetNames(r.tufRepo), nil
+}
+
+// CompactCache removes superseded version-prefixed metadata files (named
+// <version>.<role>.json, as kept for consistent snapshots) from the local
+// cache, keeping only the keepVersions most recent versions of each role.
+// The version of each role that the cache currently trusts is never removed.
+// It returns the number of files removed.
+func (r *NotaryRepository) CompactCache(keepVersions int) (removed int, err error) {
+	if r.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	end := r.startOp("CompactCache", map[string]string{"keepVersions": strconv.Itoa(keepVersions)})
+	defer func() { end(err) }()
+
+	if keepVersions < 0 {
+		return 0, fmt.Errorf("cannot keep a negative number of versions: %d", keepVersions)
+	}
+	versioned, err := versionedMetadataFiles(
+		filepath.Join(r.tufRepoPath, r.cacheLayout.MetadataDir), r.cacheLayout.MetadataExtension)
+	if err != nil {
+		return 0, err
+	}
+	current := cachedMetadataVersions(r.fileStore)
+
+	for role, files := range versioned {
+		sort.Sort(newestVersionFirst(files))
+		for i, f := range files {
+			if version, ok := current[role]; i < keepVersions || (ok && f.version == version) {
+				continue
+			}
+			if err := os.Remove(f.path); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// PruneUnapplicableChanges applies each change in the changelist, in order, to
+// the current metadata (from the remote server, or from the local files if the
+// repository was never published), and removes from the changelist the changes
+// that fail to apply, such as a delegation whose parent role doesn't exist and
+// isn't created by an earlier change.  It returns the removed changes, so they
+// can be reviewed.
+func (r *NotaryRepository) PruneUnapplicableChanges() (pruned []changelist.Change, err error) {
+	if r.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	end := r.startOp("PruneUnapplicableChanges", nil)
+	defer func() { end(err) }()
+
+	defer r.lockChangelist()()
+
+	if _, err := r.updateTUF(); err != nil {
+		if _, ok := err.(store.ErrMetaNotFound); !ok {
+			return nil, err
+		}
+		if err := r.bootstrapRepo(); err != nil {
+			return nil, err
+		}
+	}
+
 	cl, err := r.GetChangelist()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	remover, ok := cl.(interface {
+		Remove(idxs []int) error
+	})
+	if !ok {
+		return nil, fmt.Errorf("the changelist of this repository can't be pruned")
+	}
+
+	// apply the changes to a copy, so the repository's own metadata is left
+	// as it was
+	scratch, err := copyTufRepo(r.tufRepo)
+	if err != nil {
+		return nil, err
+	}
+
+	var idxs []int
+	for i, c := range cl.List() {
+		if err := applyChange(scratch, c, r.logger()); err != nil {
+			r.logger().Debugf("pruning change to %s %s in %s: %s",
+				c.Type(), c.Path(), c.Scope(), err.Error())
+			pruned = append(pruned, c)
+			idxs = append(idxs, i)
+		}
+	}
+	if len(idxs) > 0 {
+		if err := remover.Remove(idxs); err != nil {
+			return nil, err
+		}
+	}
+	return pruned, nil
+}
+
+// ValidateChangelist applies the changelist, as Publish would, to a copy of
+// the current metadata (from the remote server, or from the local files if the
+// repository was never published), without stopping at the first change that
+// fails to apply.  It returns every change that would make Publish fail, such
+// as a change scoped to an invalid role, a delegation whose parent role doesn't
+// exist, or a change whose content isn't valid, so that they can all be fixed
+// at once.  Nothing is changed or published.
+func (r *NotaryRepository) ValidateChangelist() (changeErrs []ChangeError, err error) {
+	if r.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	end := r.startOp("ValidateChangelist", nil)
+	defer func() { end(err) }()
+
+	defer r.lockChangelist()()
+
+	c, err := r.updateTUF()
+	if err != nil {
+		if _, ok := err.(store.ErrMetaNotFound); !ok {
+			return nil, err
+		}
+		if err := r.bootstrapRepo(); err != nil {
+			return nil, err
+		}
+	}
+
+	cl, err := r.GetChangelist()
+	if err != nil {
+		return nil, err
+	}
+	changedRoles, changesDelegations := pendingTargetsChanges(cl)
+	if c != nil && changesDelegations {
+		if err := c.DownloadDelegations(); err != nil {
+			return nil, err
+		}
+	}
+
+	// apply the changes to a copy, so the repository's own metadata is left
+	// as it was
+	scratch, err := copyTufRepo(r.tufRepo)
+	if err != nil {
+		return nil, err
+	}
+	if err := initDelegatedTargets(scratch, changedRoles); err != nil {
+		return nil, err
+	}
+
+	for _, c := range changelist.Squash(cl.List()) {
+		if c.Type() == changelist.TypeTargetsTarget && c.Action() == changelist.ActionCreate {
+			if err := r.checkTargetName(c.Path()); err != nil {
+				changeErrs = append(changeErrs, ChangeError{Change: c, Err: err})
+				continue
+			}
+		}
+		err := applyChange(scratch, c, r.logger())
+		if _, ok := err.(errScopeNotSupported); ok {
+			// Publish skips these too
+			continue
+		}
+		if err != nil {
+			changeErrs = append(changeErrs, ChangeError{Change: c, Err: err})
+		}
+	}
+	return changeErrs, nil
+}
+
+// SignRole signs the current content of the role's metadata in memory with
+// the keys available to the repository, and returns the signed metadata,
+// without publishing it, e.g. to sign a role on one machine and assemble the
+// repository's metadata on another, with ImportMetadata.  The metadata expires at expiry, or if
+// that is zero, after the role's default expiry counted from now.  If the
+// repository hasn't been loaded yet, it is updated from the server first, or
+// loaded from the local files if the repository was never published.  Like
+// Publish, signing increments the role's version in memory, and signing the
+// snapshot or timestamp takes in the current metadata they refer to.
+func (r *NotaryRepository) SignRole(role string, expiry time.Time) ([]byte, error) {
+	if r.readOnly {
+		return nil, ErrReadOnly
+	}
+	if !data.ValidRole(role) || role != strings.ToLower(role) {
+		return nil, data.ErrInvalidRole{Role: role, Reason: "not a valid role name"}
+	}
+
+	if r.tufRepo == nil {
+		c, err := r.updateTUF()
+		if err == nil && data.IsDelegation(role) {
+			err = c.DownloadDelegations()
+		}
+		if _, ok := err.(store.ErrMetaNotFound); ok {
+			err = r.bootstrapRepo()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if expiry.IsZero() {
+		defaultsRole := role
+		if data.IsDelegation(role) {
+			defaultsRole = data.CanonicalTargetsRole
+		}
+		expiry = data.DefaultExpiresFrom(defaultsRole, r.now())
+	}
+
+	noMetadata := data.ErrInvalidRole{Role: role, Reason: "no metadata to sign"}
+	var (
+		signedRole *data.Signed
+		err        error
+	)
+	switch {
+	case role == data.CanonicalRootRole:
+		if r.tufRepo.Root == nil {
+			return nil, noMetadata
+		}
+		signedRole, err = r.tufRepo.SignRoot(expiry)
+		if err == nil {
+			err = checkRootThreshold(r.tufRepo.Root, signedRole)
+		}
+	case role == data.CanonicalTargetsRole || data.IsDelegation(role):
+		if _, ok := r.tufRepo.Targets[role]; !ok {
+			return nil, noMetadata
+		}
+		signedRole, err = r.tufRepo.SignTargets(role, expiry)
+	case role == data.CanonicalSnapshotRole:
+		if r.tufRepo.Root == nil || r.tufRepo.Snapshot == nil {
+			return nil, noMetadata
+		}
+		signedRole, err = r.tufRepo.SignSnapshot(expiry)
+	case role == data.CanonicalTimestampRole:
+		if r.tufRepo.Snapshot == nil || r.tufRepo.Timestamp == nil {
+			return nil, noMetadata
+		}
+		signedRole, err = r.tufRepo.SignTimestamp(expiry)
+	default:
+		return nil, data.ErrInvalidRole{Role: role, Reason: "not a valid role name"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return marshalSigned(signedRole)
+}
+
+// RenewDelegations updates the repository, and stages the renewal of every
+// delegated targets role whose metadata expires within the given window, so
+// that the next Publish re-signs and uploads it with a new expiry.  It returns
+// the roles it staged a renewal for.  If there were expiring roles it has no
+// keys for, it still stages the others, and returns ErrDelegationsNotRenewed
+// listing the roles it couldn't renew.
+func (r *NotaryRepository) RenewDelegations(within time.Duration) (renewed []string, err error) {
+	if r.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	end := r.startOp("RenewDelegations", map[string]string{"within": within.String()})
+	defer func() { end(err) }()
+
+	defer r.lockChangelist()()
+
+	c, err := r.updateTUF()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.DownloadDelegations(); err != nil {
+		return nil, err
+	}
+
+	// signing the expiring roles finds the ones we have the keys for; they
+	// are signed again when they are published
+	renewed, unsignable, err := renewDelegations(r.tufRepo, within, r.now())
+	if err != nil {
+		return nil, err
+	}
+
+	cl, err := r.openChangelist()
+	if err != nil {
+		return nil, err
+	}
+	defer cl.Close()
+	for _, role := range renewed {
+		renewal := changelist.NewTufChange(
+			changelist.ActionUpdate, role, changelist.TypeTargetsRenew, "", nil)
+		if err := cl.Add(renewal); err != nil {
+			return nil, err
+		}
+	}
+	if len(unsignable) > 0 {
+		return renewed, ErrDelegationsNotRenewed{Roles: unsignable}
+	}
+	return renewed, nil
+}
+
+// GetChangelist returns the list of the repository's unpublished changes
+func (r *NotaryRepository) GetChangelist() (changelist.Changelist, error) {
+	if r.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	return r.openChangelist()
+}
+
+// ClearChangelist discards all the changes staged since the last Publish.  If
+// the changelist can't be opened or cleared, the error is an
+// ErrChangelistNotReset.
+func (r *NotaryRepository) ClearChangelist() (err error) {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+
+	end := r.startOp("ClearChangelist", nil)
+	defer func() { end(err) }()
+
+	defer r.lockChangelist()()
+
+	var changelistDir string
+	if r.ChangelistFactory == nil {
+		changelistDir = filepath.Join(r.tufRepoPath, "changelist")
+	}
+
+	cl, err := r.openChangelist()
+	if err != nil {
+		return ErrChangelistNotReset{Dir: changelistDir, Err: err}
+	}
+	defer cl.Close()
+
+	if err := cl.Clear(""); err != nil {
+		return ErrChangelistNotReset{Dir: changelistDir, Err: err}
+	}
+	return nil
+}
+
+// openChangelist opens the repository's changelist, either from the
+// ChangelistFactory or, by default, from the changelist directory
+func (r *NotaryRepository) openChangelist() (changelist.Changelist, error) {
+	var (
+		cl  changelist.Changelist
+		err error
+	)
+	if r.ChangelistFactory != nil {
+		cl, err = r.ChangelistFactory(r.gun)
+	} else {
+		cl, err = changelist.NewFileChangelist(filepath.Join(r.tufRepoPath, "changelist"))
 	}
-	// apply the changelist to the repo
-	err = applyChangelist(r.tufRepo, cl)
 	if err != nil {
-		logrus.Debug("Error applying changelist")
+		r.logger().Debug("Error initializing changelist")
+		return nil, err
+	}
+	return cl, nil
+}
+
+// Publish pushes the local changes in signed material to the remote notary-server
+// Conceptually it performs an operation similar to a `git rebase`
+func (r *NotaryRepository) Publish() (err error) {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+
+	end := r.startOp("Publish", nil)
+	defer func() { end(err) }()
+
+	if r.Offline {
+		return ErrOffline
+	}
+
+	// hold the changelist lock until the changes have been published and
+	// cleared, so that no change staged in the meantime is cleared unpublished
+	defer r.lockChangelist()()
+
+	cl, changedRoles, updateRoot, err := r.applyPendingChanges()
+	if err != nil {
 		return err
 	}
+	now := r.now()
 
 	// these are the tuf files we will need to update, serialized as JSON before
 	// we send anything to remote
 	updatedFiles := make(map[string][]byte)
 
-	// check if our root file is nearing expiry. Resign if it is.
-	if nearExpiry(r.tufRepo.Root) || r.tufRepo.Root.Dirty || updateRoot {
-		rootJSON, err := serializeCanonicalRole(r.tufRepo, data.CanonicalRootRole)
+	// a root prepared for offline signing is uploaded with the signatures
+	// attached to it instead of being signed here
+	stagedRoot, err := r.loadStagedRoot()
+	if err != nil {
+		return err
+	}
+	if stagedRoot != nil {
+		rootJSON, err := r.useStagedRoot(stagedRoot)
+		if err != nil {
+			return err
+		}
+		updatedFiles[data.CanonicalRootRole] = rootJSON
+	} else if nearExpiry(r.tufRepo.Root, now) || r.tufRepo.Root.Dirty || updateRoot {
+		// check if our root file is nearing expiry. Resign if it is.
+		rootJSON, err := serializeCanonicalRole(r.tufRepo, data.CanonicalRootRole, now)
 		if err != nil {
 			return err
 		}
 		updatedFiles[data.CanonicalRootRole] = rootJSON
 	}
 
-	// we will always re-sign targets
-	targetsJSON, err := serializeCanonicalRole(r.tufRepo, data.CanonicalTargetsRole)
+	snapshotSignedLocally, err := r.hasSnapshotKey()
 	if err != nil {
 		return err
 	}
-	updatedFiles[data.CanonicalTargetsRole] = targetsJSON
+	if !snapshotSignedLocally {
+		// make sure the server can sign the snapshot before signing and
+		// uploading everything else
+		if err := r.checkServerSnapshotKey(); err != nil {
+			return err
+		}
+		if r.StreamPublish {
+			return r.streamPublish(cl, updatedFiles[data.CanonicalRootRole],
+				changedRoles, updateRoot, stagedRoot != nil, now)
+		}
+	}
+
+	// sign the targets roles that have changes, and re-sign the base targets
+	// role if we can, so that a collaborator with only the keys of a delegated
+	// role can still publish changes to it
+	targetsFiles, err := signTargetsRoles(r.tufRepo, changedRoles, updateRoot, now, r.logger())
+	if err != nil {
+		return err
+	}
+	for role, targetsJSON := range targetsFiles {
+		updatedFiles[role] = targetsJSON
+	}
 
 	// if we initialized the repo while designating the server as the snapshot
 	// signer, then there won't be a snapshots file.  However, we might now
@@ -545,7 +2518,7 @@ func (r *NotaryRepository) Publish() error {
 	}
 
 	snapshotJSON, err := serializeCanonicalRole(
-		r.tufRepo, data.CanonicalSnapshotRole)
+		r.tufRepo, data.CanonicalSnapshotRole, now)
 
 	if err == nil {
 		// Only update the snapshot if we've sucessfully signed it.
@@ -554,28 +2527,315 @@ func (r *NotaryRepository) Publish() error {
 		// If signing fails due to us not having the snapshot key, then
 		// assume the server is going to sign, and do not include any snapshot
 		// data.
-		logrus.Debugf("Client does not have the key to sign snapshot. " +
+		r.logger().Debugf("Client does not have the key to sign snapshot. " +
 			"Assuming that server should sign the snapshot.")
 	} else {
-		logrus.Debugf("Client was unable to sign the snapshot: %s", err.Error())
+		r.logger().Debugf("Client was unable to sign the snapshot: %s", err.Error())
 		return err
 	}
 
-	remote, err := getRemoteStore(r.baseURL, r.gun, r.roundTrip)
+	r.warnLargeMetadata(updatedFiles)
+
+	remote, err := r.remoteStore()
 	if err != nil {
 		return err
 	}
 
-	err = remote.SetMultiMeta(updatedFiles)
+	batches := batchMetadata(updatedFiles, r.MaxPublishBatchSize)
+	var uploaded []string
+	for i, batch := range batches {
+		metas := make(map[string][]byte, len(batch))
+		for _, role := range batch {
+			metas[role] = updatedFiles[role]
+		}
+		err = remote.SetMultiMeta(metas)
+		if err != nil {
+			err = publishRejected(batch, err)
+			if i == 0 {
+				return err
+			}
+			var remaining []string
+			for _, rest := range batches[i:] {
+				remaining = append(remaining, rest...)
+			}
+			return ErrPartialPublish{Uploaded: uploaded, Remaining: remaining, Err: err}
+		}
+		uploaded = append(uploaded, batch...)
+		if i == 0 && stagedRoot != nil {
+			// the root is always in the first batch
+			r.removeStagedRoot()
+		}
+	}
+	if r.VerifyPublish {
+		if err := r.verifyPublished(uploaded); err != nil {
+			return err
+		}
+	}
+	return r.clearPublishedChanges(cl)
+}
+
+// streamPublish signs the targets roles to publish like Publish, but uploads
+// the metadata of each role as soon as it has been signed, along with rootJSON
+// in the first request if it isn't nil.  The server signs a new snapshot for
+// every request.  If the root came from a staged root, it is removed once the
+// root has been uploaded.
+func (r *NotaryRepository) streamPublish(cl changelist.Changelist, rootJSON []byte,
+	changedRoles map[string]bool, updateRoot, stagedRoot bool, now time.Time) error {
+
+	remote, err := r.remoteStore()
 	if err != nil {
 		return err
 	}
-	err = cl.Clear("")
+
+	pending := make(map[string][]byte)
+	if rootJSON != nil {
+		pending[data.CanonicalRootRole] = rootJSON
+	}
+	var uploaded []string
+	upload := func() error {
+		r.warnLargeMetadata(pending)
+		if err := remote.SetMultiMeta(pending); err != nil {
+			roles := make([]string, 0, len(pending))
+			for role := range pending {
+				roles = append(roles, role)
+			}
+			return publishRejected(roles, err)
+		}
+		if _, ok := pending[data.CanonicalRootRole]; ok && stagedRoot {
+			r.removeStagedRoot()
+		}
+		for role := range pending {
+			uploaded = append(uploaded, role)
+		}
+		pending = make(map[string][]byte)
+		return nil
+	}
+	err = signTargetsRolesTo(r.tufRepo, changedRoles, updateRoot, now, r.logger(),
+		func(role string, targetsJSON []byte) error {
+			pending[role] = targetsJSON
+			return upload()
+		})
+	if err == nil && len(pending) > 0 {
+		// there was only the root to publish
+		err = upload()
+	}
 	if err != nil {
-		// This is not a critical problem when only a single host is pushing
-		// but will cause weird behaviour if changelist cleanup is failing
-		// and there are multiple hosts writing to the repo.
-		logrus.Warn("Unable to clear changelist. You may want to manually delete the folder ", filepath.Join(r.tufRepoPath, "changelist"))
+		if len(uploaded) == 0 {
+			return err
+		}
+		// whatever has changes and wasn't uploaded is left
+		var remaining []string
+		for role, targets := range r.tufRepo.Targets {
+			if targets.Dirty && !utils.StrSliceContains(uploaded, role) {
+				remaining = append(remaining, role)
+			}
+		}
+		sort.Sort(publishOrder(uploaded))
+		sort.Sort(publishOrder(remaining))
+		return ErrPartialPublish{Uploaded: uploaded, Remaining: remaining, Err: err}
+	}
+	if r.VerifyPublish {
+		if err := r.verifyPublished(uploaded); err != nil {
+			return err
+		}
+	}
+	return r.clearPublishedChanges(cl)
+}
+
+// verifyPublished downloads the trust data from the server, without caching
+// it, and checks that the server serves the versions of the published roles
+// the repository has loaded, and, if the root was published, a root that
+// gives each role the same keys and threshold.
+func (r *NotaryRepository) verifyPublished(roles []string) error {
+	remote := r.WithoutCache()
+	c, err := remote.updateTUF()
+	if err != nil {
+		return err
+	}
+	for _, role := range roles {
+		if data.IsDelegation(role) {
+			if err := c.DownloadDelegations(); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	for _, role := range roles {
+		var published, served int
+		switch role {
+		case data.CanonicalRootRole:
+			published, served = r.tufRepo.Root.Signed.Version, remote.tufRepo.Root.Signed.Version
+		case data.CanonicalSnapshotRole:
+			published, served = r.tufRepo.Snapshot.Signed.Version, remote.tufRepo.Snapshot.Signed.Version
+		default:
+			servedTargets, ok := remote.tufRepo.Targets[role]
+			if !ok {
+				return ErrPublishNotAdopted{Role: role, Reason: "the server has none"}
+			}
+			published, served = r.tufRepo.Targets[role].Signed.Version, servedTargets.Signed.Version
+		}
+		if published != served {
+			return ErrPublishNotAdopted{
+				Role:   role,
+				Reason: fmt.Sprintf("the server serves version %d instead of %d", served, published),
+			}
+		}
+	}
+
+	if !utils.StrSliceContains(roles, data.CanonicalRootRole) {
+		return nil
+	}
+	for name, role := range r.tufRepo.Root.Signed.Roles {
+		servedRole, ok := remote.tufRepo.Root.Signed.Roles[name]
+		if !ok || servedRole.Threshold != role.Threshold || !sameKeyIDs(servedRole.KeyIDs, role.KeyIDs) {
+			return ErrPublishNotAdopted{
+				Role:   data.CanonicalRootRole,
+				Reason: fmt.Sprintf("the served root doesn't give the %s role the published keys", name),
+			}
+		}
+	}
+	return nil
+}
+
+// sameKeyIDs returns whether a and b have the same key IDs, in any order
+func sameKeyIDs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, keyID := range a {
+		if !utils.StrSliceContains(b, keyID) {
+			return false
+		}
+	}
+	return true
+}
+
+// clearPublishedChanges clears the changelist once its changes have been
+// published
+func (r *NotaryRepository) clearPublishedChanges(cl changelist.Changelist) error {
+	err := cl.Clear("")
+	if err != nil {
+		// The changes have been published, so the next Publish would apply
+		// them again: make sure the caller knows the changelist is stale.
+		if r.ChangelistFactory != nil {
+			r.logger().Warn("Unable to clear changelist: ", err.Error())
+			return ErrChangelistNotCleared{Err: err}
+		}
+		changelistDir := filepath.Join(r.tufRepoPath, "changelist")
+		r.logger().Warn("Unable to clear changelist. You may want to manually delete the folder ", changelistDir)
+		return ErrChangelistNotCleared{Dir: changelistDir, Err: err}
+	}
+	return nil
+}
+
+// applyPendingChanges brings the tuf repo up to date with the server, or
+// loads it from the local cache if the server has no trust data for the
+// repository yet, and applies the changelist to it.  It returns the
+// changelist, the targets roles it changes, and whether the root has to be
+// uploaded even if it hasn't changed, since the server has none.
+func (r *NotaryRepository) applyPendingChanges() (
+	cl changelist.Changelist, changedRoles map[string]bool, updateRoot bool, err error) {
+
+	// attempt to initialize the repo from the remote store
+	c, err := r.bootstrapClient()
+	if err != nil {
+		if _, ok := err.(store.ErrMetaNotFound); ok {
+			// if the remote store return a 404 (translated into ErrMetaNotFound),
+			// there is no trust data for yet. Attempt to load it from disk.
+			err := r.bootstrapRepo()
+			if err != nil {
+				// There are lots of reasons there might be an error, such as
+				// corrupt metadata, which is reported as ErrCorruptedCache.
+				r.logger().Debugf("Unable to load repository from local files: %s",
+					err.Error())
+				return nil, nil, false, err
+			}
+			// We had local data but the server doesn't know about the repo yet,
+			// ensure we will push the initial root file.  The root may not
+			// be marked as Dirty, since there may not be any changes that
+			// update it, so use a different boolean.
+			updateRoot = true
+			if err := r.addDeferredRemoteKeys(); err != nil {
+				return nil, nil, false, err
+			}
+		} else {
+			// The remote store returned an error other than 404. We're
+			// unable to determine if the repo has been initialized or not.
+			r.logger().Error("Could not publish Repository: ", err.Error())
+			return nil, nil, false, err
+		}
+	} else {
+		// If we were successfully able to bootstrap the client (which only pulls
+		// root.json), update it with the rest of the tuf metadata in
+		// preparation for applying the changelist.
+		err = c.Update()
+		if err != nil {
+			if err, ok := err.(signed.ErrExpired); ok {
+				return nil, nil, false, newErrExpired(err)
+			}
+			return nil, nil, false, err
+		}
+		if err := r.checkSnapshotChecksum(); err != nil {
+			return nil, nil, false, err
+		}
+	}
+	cl, err = r.GetChangelist()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	changedRoles, changesDelegations := pendingTargetsChanges(cl)
+	if c != nil && changesDelegations {
+		// changes to delegated roles apply to their published metadata
+		if err := c.DownloadDelegations(); err != nil {
+			return nil, nil, false, err
+		}
+	}
+	if err := initDelegatedTargets(r.tufRepo, changedRoles); err != nil {
+		return nil, nil, false, err
+	}
+	// changelists can come from elsewhere, so check they only add targets
+	// with valid names
+	for _, c := range cl.List() {
+		if c.Type() == changelist.TypeTargetsTarget && c.Action() == changelist.ActionCreate {
+			if err := r.checkTargetName(c.Path()); err != nil {
+				return nil, nil, false, err
+			}
+		}
+	}
+	if err := r.checkConflictingChanges(cl); err != nil {
+		return nil, nil, false, err
+	}
+	// apply the changelist to the repo
+	err = applyChangelist(r.tufRepo, cl, r.logger())
+	if err != nil {
+		r.logger().Debug("Error applying changelist")
+		return nil, nil, false, err
+	}
+	if err := r.checkShadowedTargets(cl); err != nil {
+		return nil, nil, false, err
+	}
+	return cl, changedRoles, updateRoot, nil
+}
+
+// addDeferredRemoteKeys gets the keys of the roles the server manages that
+// the loaded root has no keys for, because the repository was created with
+// InitializeOffline, from the server, and adds them to the root
+func (r *NotaryRepository) addDeferredRemoteKeys() error {
+	for _, role := range []string{data.CanonicalTimestampRole, data.CanonicalSnapshotRole} {
+		rootRole, ok := r.tufRepo.Root.Signed.Roles[role]
+		if !ok || len(rootRole.KeyIDs) > 0 {
+			continue
+		}
+		key, err := r.remoteKey(role)
+		if err != nil {
+			return err
+		}
+		r.logger().Debugf("got deferred remote %s %s key with keyID: %s",
+			role, key.Algorithm(), key.ID())
+		if err := r.tufRepo.AddBaseKeys(role, key); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -587,43 +2847,43 @@ func (r *NotaryRepository) Publish() error {
 // This assumes that bootstrapRepo is only used by Publish()
 func (r *NotaryRepository) bootstrapRepo() error {
 	kdb := keys.NewDB()
-	tufRepo := tuf.NewRepo(kdb, r.CryptoService)
+	tufRepo := tuf.NewRepo(kdb, r.signingService())
 
-	logrus.Debugf("Loading trusted collection.")
-	rootJSON, err := r.fileStore.GetMeta("root", 0)
+	r.logger().Debugf("Loading trusted collection.")
+	rootJSON, err := r.fileStore.GetMeta(data.CanonicalRootRole, 0)
 	if err != nil {
-		return err
+		return r.corruptedCache(data.CanonicalRootRole, err)
 	}
 	root := &data.SignedRoot{}
 	err = json.Unmarshal(rootJSON, root)
 	if err != nil {
-		return err
+		return r.corruptedCache(data.CanonicalRootRole, err)
 	}
 	err = tufRepo.SetRoot(root)
 	if err != nil {
-		return err
+		return r.corruptedCache(data.CanonicalRootRole, err)
 	}
-	targetsJSON, err := r.fileStore.GetMeta("targets", 0)
+	targetsJSON, err := r.fileStore.GetMeta(data.CanonicalTargetsRole, 0)
 	if err != nil {
-		return err
+		return r.corruptedCache(data.CanonicalTargetsRole, err)
 	}
 	targets := &data.SignedTargets{}
 	err = json.Unmarshal(targetsJSON, targets)
 	if err != nil {
-		return err
+		return r.corruptedCache(data.CanonicalTargetsRole, err)
 	}
-	tufRepo.SetTargets("targets", targets)
+	tufRepo.SetTargets(data.CanonicalTargetsRole, targets)
 
-	snapshotJSON, err := r.fileStore.GetMeta("snapshot", 0)
+	snapshotJSON, err := r.fileStore.GetMeta(data.CanonicalSnapshotRole, 0)
 	if err == nil {
 		snapshot := &data.SignedSnapshot{}
 		err = json.Unmarshal(snapshotJSON, snapshot)
 		if err != nil {
-			return err
+			return r.corruptedCache(data.CanonicalSnapshotRole, err)
 		}
 		tufRepo.SetSnapshot(snapshot)
 	} else if _, ok := err.(store.ErrMetaNotFound); !ok {
-		return err
+		return r.corruptedCache(data.CanonicalSnapshotRole, err)
 	}
 
 	r.tufRepo = tufRepo
@@ -631,10 +2891,25 @@ func (r *NotaryRepository) bootstrapRepo() error {
 	return nil
 }
 
+// corruptedCache wraps an error loading the cached metadata for role in an
+// ErrCorruptedCache, unless the metadata simply isn't there
+func (r *NotaryRepository) corruptedCache(role string, err error) error {
+	if _, ok := err.(store.ErrMetaNotFound); ok {
+		return err
+	}
+	return ErrCorruptedCache{
+		Role: role,
+		Path: filepath.Join(r.tufRepoPath, r.cacheLayout.MetadataDir,
+			role+"."+r.cacheLayout.MetadataExtension),
+		Err: err,
+	}
+}
+
 func (r *NotaryRepository) saveMetadata(ignoreSnapshot bool) error {
-	logrus.Debugf("Saving changes to Trusted Collection.")
+	r.logger().Debugf("Saving changes to Trusted Collection.")
+	now := r.now()
 
-	rootJSON, err := serializeCanonicalRole(r.tufRepo, data.CanonicalRootRole)
+	rootJSON, err := serializeCanonicalRole(r.tufRepo, data.CanonicalRootRole, now)
 	if err != nil {
 		return err
 	}
@@ -645,7 +2920,7 @@ func (r *NotaryRepository) saveMetadata(ignoreSnapshot bool) error {
 
 	targetsToSave := make(map[string][]byte)
 	for t := range r.tufRepo.Targets {
-		signedTargets, err := r.tufRepo.SignTargets(t, data.DefaultExpires("targets"))
+		signedTargets, err := r.tufRepo.SignTargets(t, data.DefaultExpiresFrom("targets", now))
 		if err != nil {
 			return err
 		}
@@ -666,7 +2941,7 @@ func (r *NotaryRepository) saveMetadata(ignoreSnapshot bool) error {
 		return nil
 	}
 
-	snapshotJSON, err := serializeCanonicalRole(r.tufRepo, data.CanonicalSnapshotRole)
+	snapshotJSON, err := serializeCanonicalRole(r.tufRepo, data.CanonicalSnapshotRole, now)
 	if err != nil {
 		return err
 	}
@@ -674,9 +2949,299 @@ func (r *NotaryRepository) saveMetadata(ignoreSnapshot bool) error {
 	return r.fileStore.SetMeta(data.CanonicalSnapshotRole, snapshotJSON)
 }
 
+// updateTUF bootstraps a tuf client from the remote server (or the cache,
+// if the server can't be reached) and then updates it.
+func (r *NotaryRepository) updateTUF() (*tufclient.Client, error) {
+	c, err := r.bootstrapClient()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.Update()
+	if err != nil {
+		if err, ok := err.(signed.ErrExpired); ok {
+			return nil, newErrExpired(err)
+		}
+		return nil, err
+	}
+	if err := r.checkSnapshotChecksum(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// PruneCache removes the cached metadata that the cached snapshot doesn't
+// reference, such as that of delegated roles that have since been deleted.
+// The root, snapshot and timestamp, and every role in the snapshot, are always
+// kept.  It returns the names of the roles whose metadata was removed.
+func (r *NotaryRepository) PruneCache() (removed []string, err error) {
+	if r.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	end := r.startOp("PruneCache", nil)
+	defer func() { end(err) }()
+
+	cache, ok := r.fileStore.(interface {
+		ListMeta() ([]string, error)
+		RemoveMeta(name string) error
+	})
+	if !ok {
+		return nil, fmt.Errorf("the metadata cache of this repository can't be pruned")
+	}
+
+	snapshotJSON, err := r.fileStore.GetMeta(data.CanonicalSnapshotRole, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &data.SignedSnapshot{}
+	if err := json.Unmarshal(snapshotJSON, snapshot); err != nil {
+		return nil, r.corruptedCache(data.CanonicalSnapshotRole, err)
+	}
+
+	referenced := map[string]bool{
+		data.CanonicalRootRole:      true,
+		data.CanonicalSnapshotRole:  true,
+		data.CanonicalTimestampRole: true,
+	}
+	for role := range snapshot.Signed.Meta {
+		referenced[role] = true
+	}
+
+	cached, err := cache.ListMeta()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(cached)
+	for _, role := range cached {
+		if referenced[role] {
+			continue
+		}
+		if err := cache.RemoveMeta(role); err != nil {
+			return removed, err
+		}
+		r.logger().Debugf("removed unreferenced %s metadata from the cache", role)
+		removed = append(removed, role)
+	}
+	return removed, nil
+}
+
+// RemoteMetaVersion fetches just the metadata for the given base role (root,
+// targets, snapshot or timestamp) from the server, verifies its signatures
+// against the repository's validated root, and returns its version.  This is
+// useful to check that the server's timestamp is still being rolled over,
+// without updating the whole repository.
+func (r *NotaryRepository) RemoteMetaVersion(role string) (int, error) {
+	c, err := r.bootstrapClient()
+	if err != nil {
+		return 0, err
+	}
+	s, err := c.RemoteMeta(role)
+	if err != nil {
+		if err, ok := err.(signed.ErrExpired); ok {
+			return 0, newErrExpired(err)
+		}
+		return 0, err
+	}
+	meta := data.SignedCommon{}
+	if err := json.Unmarshal(s.Signed, &meta); err != nil {
+		return 0, err
+	}
+	return meta.Version, nil
+}
+
+// EstimatedTimestampAge returns an estimate of how long ago the cached
+// timestamp was signed, without contacting the server, so that a maximum
+// staleness can be enforced even when offline: a server that stopped
+// refreshing its timestamp leaves an old one cached.  The timestamp has no
+// signing time, so the estimate is its expiry minus the default timestamp
+// expiry, which is how long the server signs it for.  It is only as accurate
+// as that assumption: a timestamp signed for longer than the default is
+// estimated to be younger than it is.  The time the cached timestamp was
+// downloaded wouldn't do instead, since a timestamp that is no longer
+// refreshed is still downloaded again on every update.
+func (r *NotaryRepository) EstimatedTimestampAge() (time.Duration, error) {
+	tsJSON, err := r.fileStore.GetMeta(data.CanonicalTimestampRole, maxSize)
+	if err != nil {
+		return 0, err
+	}
+	s := &data.Signed{}
+	if err := json.Unmarshal(tsJSON, s); err != nil {
+		return 0, r.corruptedCache(data.CanonicalTimestampRole, err)
+	}
+	ts, err := data.TimestampFromSigned(s)
+	if err != nil {
+		return 0, r.corruptedCache(data.CanonicalTimestampRole, err)
+	}
+
+	expires := ts.Signed.Expires
+	validity := data.DefaultExpiresFrom(data.CanonicalTimestampRole, expires).Sub(expires)
+	return r.now().Sub(expires.Add(-validity)), nil
+}
+
+// VerifySnapshotConsistency updates the repository, and checks that the
+// snapshot it loaded is the one its timestamp refers to, by both length and
+// SHA256 checksum.  If it isn't, the server is serving a timestamp and a
+// snapshot that don't belong together, and ErrTimestampSnapshotMismatch is
+// returned.
+func (r *NotaryRepository) VerifySnapshotConsistency() error {
+	if _, err := r.updateTUF(); err != nil {
+		return err
+	}
+	if r.tufRepo.Timestamp == nil {
+		return ErrTimestampSnapshotMismatch{Reason: "no timestamp was loaded"}
+	}
+	snapshotJSON, err := r.fileStore.GetMeta(data.CanonicalSnapshotRole, maxSize)
+	if err != nil {
+		return err
+	}
+	return checkTimestampSnapshot(r.tufRepo.Timestamp, snapshotJSON)
+}
+
+// VerifyRootAgainstLog fetches the repository's current root.json from the
+// server, checks that its hex encoded SHA256 checksum is the latest of the
+// checksums lookup returns for the repository's GUN, and then validates it.
+// lookup is expected to return the checksums in an append-only log of the
+// repository's roots, oldest first.  If the checksum isn't the latest entry,
+// ErrRootNotInLog is returned, and the root's certificate isn't trusted.
+func (r *NotaryRepository) VerifyRootAgainstLog(lookup func(gun string) ([]string, error)) error {
+	remote, err := r.remoteStore()
+	if err != nil {
+		return err
+	}
+	rootJSON, err := remote.GetMeta(data.CanonicalRootRole, maxSize)
+	if err != nil {
+		return err
+	}
+	root := &data.Signed{}
+	if err := json.Unmarshal(rootJSON, root); err != nil {
+		return err
+	}
+
+	// check the log first: validating the root may trust its certificate
+	rootChecksum := sha256.Sum256(rootJSON)
+	checksum := hex.EncodeToString(rootChecksum[:])
+
+	logged, err := lookup(r.gun)
+	if err != nil {
+		return err
+	}
+	if len(logged) == 0 || !strings.EqualFold(logged[len(logged)-1], checksum) {
+		return ErrRootNotInLog{GUN: r.gun, Checksum: checksum}
+	}
+	return r.validateRoot(root)
+}
+
+// RemoveTrustedRootCert removes the certificate with the given fingerprint
+// from the certificates the repository's CertManager trusts, e.g. once a
+// root rotated away from it, or the repository was decommissioned.  If the
+// certificate holds one of the root keys of the repository's current root,
+// as last loaded or cached, removing it could leave no certificate to
+// validate the root, so ErrRootCertInUse is returned, unless force is set.
+func (r *NotaryRepository) RemoveTrustedRootCert(fingerprint string, force bool) (err error) {
+	end := r.startOp("RemoveTrustedRootCert", map[string]string{
+		"fingerprint": fingerprint,
+		"force":       strconv.FormatBool(force),
+	})
+	defer func() { end(err) }()
+
+	if !force {
+		root, err := r.currentRoot()
+		if err != nil {
+			return err
+		}
+		if root != nil {
+			if role, ok := root.Signed.Roles[data.CanonicalRootRole]; ok &&
+				utils.StrSliceContains(role.KeyIDs, fingerprint) {
+				return ErrRootCertInUse{Fingerprint: fingerprint}
+			}
+		}
+	}
+	return r.CertManager.RemoveTrustedCert(fingerprint)
+}
+
+// currentRoot returns the root last loaded, or else the cached root, or nil
+// if neither exists
+func (r *NotaryRepository) currentRoot() (*data.SignedRoot, error) {
+	if r.tufRepo != nil && r.tufRepo.Root != nil {
+		return r.tufRepo.Root, nil
+	}
+	rootJSON, err := r.fileStore.GetMeta(data.CanonicalRootRole, maxSize)
+	if _, ok := err.(store.ErrMetaNotFound); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, r.corruptedCache(data.CanonicalRootRole, err)
+	}
+	s := &data.Signed{}
+	if err := json.Unmarshal(rootJSON, s); err != nil {
+		return nil, r.corruptedCache(data.CanonicalRootRole, err)
+	}
+	root, err := data.RootFromSigned(s)
+	if err != nil {
+		return nil, r.corruptedCache(data.CanonicalRootRole, err)
+	}
+	return root, nil
+}
+
+// RequireSnapshotChecksum makes every later update of the repository fail with
+// ErrSnapshotChecksumMismatch unless the snapshot it gets has the given hex
+// encoded SHA256 checksum.  This pins the repository to exactly the trust data
+// described by that snapshot.  An empty checksum removes the requirement.
+func (r *NotaryRepository) RequireSnapshotChecksum(sha256 string) {
+	r.requiredSnapshotChecksum = strings.ToLower(sha256)
+}
+
+// checkSnapshotChecksum checks the checksum of the snapshot that was just
+// updated, which the timestamp has already vouched for, against the one the
+// repository is required to have, if any
+func (r *NotaryRepository) checkSnapshotChecksum() error {
+	if r.requiredSnapshotChecksum == "" {
+		return nil
+	}
+	var actual string
+	if r.tufRepo.Timestamp != nil {
+		snapshotMeta := r.tufRepo.Timestamp.Signed.Meta[data.CanonicalSnapshotRole]
+		actual = hex.EncodeToString(snapshotMeta.Hashes["sha256"])
+	}
+	if actual != r.requiredSnapshotChecksum {
+		return ErrSnapshotChecksumMismatch{Expected: r.requiredSnapshotChecksum, Actual: actual}
+	}
+	return nil
+}
+
+// validateRoot checks that the root is signed by the pinned root key, if there
+// is one, or else by a certificate trusted for the repository
+func (r *NotaryRepository) validateRoot(root *data.Signed) error {
+	if err := checkRootGUN(root, r.gun); err != nil {
+		return err
+	}
+	if r.PinnedRootKey != nil {
+		return verifyPinnedRoot(root, r.PinnedRootKey)
+	}
+	return r.CertManager.ValidateRoot(root, r.gun)
+}
+
+// remoteStore returns the store of the repository's trust data on the server,
+// or if the repository is Offline, a store that fails with ErrOffline
+func (r *NotaryRepository) remoteStore() (store.RemoteStore, error) {
+	if r.Offline {
+		return offlineStore{}, nil
+	}
+	return getRemoteStore(r.baseURL, r.gun, r.roundTrip)
+}
+
+// remoteKey fetches the public key the server manages for role, or fails with
+// ErrOffline if the repository is Offline
+func (r *NotaryRepository) remoteKey(role string) (data.PublicKey, error) {
+	if r.Offline {
+		return nil, ErrOffline
+	}
+	return getRemoteKey(r.baseURL, r.gun, role, r.roundTrip, r.RemoteKeyRetries, r.logger())
+}
+
 func (r *NotaryRepository) bootstrapClient() (*tufclient.Client, error) {
 	var rootJSON []byte
-	remote, err := getRemoteStore(r.baseURL, r.gun, r.roundTrip)
+	remote, err := r.remoteStore()
 	if err == nil {
 		// if remote store successfully set up, try and get root from remote
 		rootJSON, err = remote.GetMeta("root", maxSize)
@@ -697,7 +3262,7 @@ func (r *NotaryRepository) bootstrapClient() (*tufclient.Client, error) {
 			return nil, err
 		}
 		rootJSON = result
-		logrus.Debugf(
+		r.logger().Debugf(
 			"Using local cache instead of remote due to failure: %s", err.Error())
 	}
 	// can't just unmarshal into SignedRoot because validate root
@@ -709,13 +3274,12 @@ func (r *NotaryRepository) bootstrapClient() (*tufclient.Client, error) {
 		return nil, err
 	}
 
-	err = r.CertManager.ValidateRoot(root, r.gun)
-	if err != nil {
+	if err := r.validateRoot(root); err != nil {
 		return nil, err
 	}
 
 	kdb := keys.NewDB()
-	r.tufRepo = tuf.NewRepo(kdb, r.CryptoService)
+	r.tufRepo = tuf.NewRepo(kdb, r.signingService())
 
 	signedRoot, err := data.RootFromSigned(root)
 	if err != nil {
@@ -726,18 +3290,226 @@ func (r *NotaryRepository) bootstrapClient() (*tufclient.Client, error) {
 		return nil, err
 	}
 
-	return tufclient.NewClient(
+	c := tufclient.NewClient(
 		r.tufRepo,
 		remote,
 		kdb,
 		r.fileStore,
-	), nil
+	)
+	c.MaxDelegationDepth = r.MaxDelegationDepth
+	return c, nil
+}
+
+// SnapshotSignedLocally updates the repository, and returns whether the
+// snapshot can be signed locally, with a private key for the snapshot role in
+// its root or through the SignerOverride.  If it can't be,
+// the server signs the snapshot, and Publish leaves it to the server.  A
+// read-only repository has no keys, so its snapshot is never signed locally.
+func (r *NotaryRepository) SnapshotSignedLocally() (bool, error) {
+	if _, err := r.updateTUF(); err != nil {
+		return false, err
+	}
+	if r.readOnly {
+		return false, nil
+	}
+	return r.hasSnapshotKey()
+}
+
+// hasSnapshotKey returns whether the signing service Publish signs with can
+// sign the snapshot with a key for the snapshot role in the loaded root: a
+// SignerOverride that signs the snapshot can sign with any of them, and the
+// CryptoService only with those it has the private key of
+func (r *NotaryRepository) hasSnapshotKey() (bool, error) {
+	snapshotRole, ok := r.tufRepo.Root.Signed.Roles[data.CanonicalSnapshotRole]
+	if !ok {
+		return false, data.ErrInvalidRole{
+			Role:   data.CanonicalSnapshotRole,
+			Reason: "role is not in the root",
+		}
+	}
+	if utils.StrSliceContains(r.overriddenRoles(), data.CanonicalSnapshotRole) {
+		for _, keyID := range snapshotRole.KeyIDs {
+			if _, ok := r.tufRepo.Root.Signed.Keys[keyID]; ok {
+				return true, nil
+			}
+		}
+	}
+	// the snapshot keys of this repository are listed by their path, which
+	// the GUN is part of
+	keyPaths := r.CryptoService.ListKeys(data.CanonicalSnapshotRole)
+	for _, keyID := range snapshotRole.KeyIDs {
+		if utils.StrSliceContains(keyPaths, filepath.Join(r.gun, keyID)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkServerSnapshotKey returns ErrNoSnapshotKey if the server's snapshot
+// key isn't one the root trusts to sign the snapshot.  If the server can't be
+// reached, that is left for the upload to report.
+func (r *NotaryRepository) checkServerSnapshotKey() error {
+	keyIDs := r.tufRepo.Root.Signed.Roles[data.CanonicalSnapshotRole].KeyIDs
+	key, err := r.remoteKey(data.CanonicalSnapshotRole)
+	switch err.(type) {
+	case nil:
+		if utils.StrSliceContains(keyIDs, key.ID()) {
+			return nil
+		}
+	case ErrRemoteKeyRefused:
+	default:
+		r.logger().Debugf("Unable to check the server's snapshot key: %s", err.Error())
+		return nil
+	}
+	return ErrNoSnapshotKey{KeyIDs: keyIDs}
 }
 
 // RotateKey removes all existing keys associated with the role, and either
 // creates and adds one new key or delegates managing the key to the server.
 // These changes are staged in a changelist until publish is called.
-func (r *NotaryRepository) RotateKey(role string, serverManagesKey bool) error {
+func (r *NotaryRepository) RotateKey(role string, serverManagesKey bool) (err error) {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+
+	end := r.startOp("RotateKey", map[string]string{
+		"role":             role,
+		"serverManagesKey": strconv.FormatBool(serverManagesKey),
+	})
+	defer func() { end(err) }()
+
+	if err := checkRotation(role, serverManagesKey); err != nil {
+		return err
+	}
+	if role == data.CanonicalSnapshotRole && !serverManagesKey {
+		if err := r.loadSnapshotToSign(); err != nil {
+			return err
+		}
+	}
+	pubKey, err := r.rotatedKey(role, serverManagesKey)
+	if err != nil {
+		return err
+	}
+	return r.rootFileKeyChange(role, changelist.ActionCreate, pubKey)
+}
+
+// RotateKeys rotates the keys of several roles like RotateKey, each
+// role mapping to whether the server should manage its new key, so that the
+// rotations can be published together.  All the rotations are checked before
+// any new key is made, and if a rotation fails, none of them are staged and
+// the keys already made for the others are removed.
+func (r *NotaryRepository) RotateKeys(roles map[string]bool) (err error) {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+
+	roleNames := make([]string, 0, len(roles))
+	for role := range roles {
+		roleNames = append(roleNames, role)
+	}
+	sort.Strings(roleNames)
+
+	end := r.startOp("RotateKeys", map[string]string{
+		"roles": strings.Join(roleNames, ","),
+	})
+	defer func() { end(err) }()
+
+	for _, role := range roleNames {
+		if err := checkRotation(role, roles[role]); err != nil {
+			return err
+		}
+	}
+	if serverManagesKey, ok := roles[data.CanonicalSnapshotRole]; ok && !serverManagesKey {
+		if err := r.loadSnapshotToSign(); err != nil {
+			return err
+		}
+	}
+
+	var created []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, keyID := range created {
+			if rmErr := r.CryptoService.RemoveKey(keyID); rmErr != nil {
+				r.logger().Warnf("unable to remove key %s: %v", keyID, rmErr)
+			}
+		}
+	}()
+
+	// the keys the server manages are fetched first, since that is more
+	// likely to fail than creating keys
+	var changes []changelist.Change
+	for _, serverManagesKey := range []bool{true, false} {
+		for _, role := range roleNames {
+			if roles[role] != serverManagesKey {
+				continue
+			}
+			pubKey, err := r.rotatedKey(role, serverManagesKey)
+			if err != nil {
+				return err
+			}
+			if !serverManagesKey {
+				created = append(created, pubKey.ID())
+			}
+			c, err := rootKeyChange(role, changelist.ActionCreate, pubKey)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, c)
+		}
+	}
+
+	defer r.lockChangelist()()
+
+	cl, err := r.openChangelist()
+	if err != nil {
+		return err
+	}
+	defer cl.Close()
+
+	return r.stageChanges(cl, changes)
+}
+
+// stageChanges adds all the changes to the changelist, or none of them: if one
+// can't be added, the ones added before it are removed again.  The changelist
+// lock must be held, so that the changes added are the last in the changelist.
+func (r *NotaryRepository) stageChanges(cl changelist.Changelist, changes []changelist.Change) error {
+	staged := len(cl.List())
+	for i, c := range changes {
+		if err := cl.Add(c); err != nil {
+			if i > 0 {
+				r.unstageChanges(cl, staged, i)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// unstageChanges removes the count changes at the end of the changelist that
+// follow the first staged ones
+func (r *NotaryRepository) unstageChanges(cl changelist.Changelist, staged, count int) {
+	remover, ok := cl.(interface {
+		Remove(idxs []int) error
+	})
+	if !ok {
+		r.logger().Warnf("unable to remove the %d changes already staged: "+
+			"the changelist of this repository can't be pruned", count)
+		return
+	}
+	idxs := make([]int, 0, count)
+	for i := staged; i < staged+count; i++ {
+		idxs = append(idxs, i)
+	}
+	if err := remover.Remove(idxs); err != nil {
+		r.logger().Warnf("unable to remove the %d changes already staged: %v", count, err)
+	}
+}
+
+// checkRotation returns an error if the key of role can't be rotated, or
+// can't be managed by the server if serverManagesKey is true
+func checkRotation(role string, serverManagesKey bool) error {
 	if role == data.CanonicalRootRole || role == data.CanonicalTimestampRole {
 		return fmt.Errorf(
 			"notary does not currently support rotating the %s key", role)
@@ -745,30 +3517,79 @@ func (r *NotaryRepository) RotateKey(role string, serverManagesKey bool) error {
 	if serverManagesKey && role == data.CanonicalTargetsRole {
 		return ErrInvalidRemoteRole{Role: data.CanonicalTargetsRole}
 	}
+	return nil
+}
 
-	var (
-		pubKey data.PublicKey
-		err    error
-	)
+// loadSnapshotToSign loads the snapshot metadata that the client will have
+// to sign once it holds the snapshot key, so that taking over signing the
+// snapshot fails before any key is made if that metadata can't be read.  It
+// is the server's snapshot, or if the server can't provide it, the cached
+// one: a repository that has only ever had its snapshot signed by the server
+// may have none, in which case a new snapshot is made.
+func (r *NotaryRepository) loadSnapshotToSign() error {
+	if _, err := r.updateTUF(); err != nil {
+		r.logger().Debugf("Using the cached snapshot, since the repository can't be updated: %s",
+			err.Error())
+		if err := r.bootstrapRepo(); err != nil {
+			return ErrSnapshotUnavailable{Err: err}
+		}
+	}
+	if r.tufRepo.Snapshot == nil {
+		if err := r.tufRepo.InitSnapshot(); err != nil {
+			return ErrSnapshotUnavailable{Err: err}
+		}
+	}
+	return nil
+}
+
+// rotatedKey returns the new key for role, which is either fetched from the
+// server or created locally
+func (r *NotaryRepository) rotatedKey(role string, serverManagesKey bool) (data.PublicKey, error) {
 	if serverManagesKey {
-		pubKey, err = getRemoteKey(r.baseURL, r.gun, role, r.roundTrip)
-	} else {
-		pubKey, err = r.CryptoService.Create(role, data.ECDSAKey)
+		return r.remoteKey(role)
 	}
-	if err != nil {
-		return err
+	return r.createKey(role)
+}
+
+// ChangeKeyPassphrase re-encrypts the private key with the given ID with a new
+// passphrase, leaving the key itself unchanged.  Both the current and the new
+// passphrase are asked for through the repository's passphrase retriever.  If
+// the current passphrase can't be provided, the error is
+// trustmanager.ErrPasswordInvalid or trustmanager.ErrAttemptsExceeded.
+func (r *NotaryRepository) ChangeKeyPassphrase(keyID string) (err error) {
+	if r.readOnly {
+		return ErrReadOnly
 	}
 
-	return r.rootFileKeyChange(role, changelist.ActionCreate, pubKey)
+	end := r.startOp("ChangeKeyPassphrase", map[string]string{"keyID": keyID})
+	defer func() { end(err) }()
+
+	changer, ok := r.CryptoService.(interface {
+		ChangeKeyPassphrase(keyID string) error
+	})
+	if !ok {
+		return fmt.Errorf("the keys of this repository have no passphrase to change")
+	}
+	return changer.ChangeKeyPassphrase(keyID)
 }
 
 func (r *NotaryRepository) rootFileKeyChange(role, action string, key data.PublicKey) error {
-	cl, err := changelist.NewFileChangelist(filepath.Join(r.tufRepoPath, "changelist"))
+	defer r.lockChangelist()()
+
+	cl, err := r.openChangelist()
 	if err != nil {
 		return err
 	}
 	defer cl.Close()
 
+	c, err := rootKeyChange(role, action, key)
+	if err != nil {
+		return err
+	}
+	return cl.Add(c)
+}
+
+func rootKeyChange(role, action string, key data.PublicKey) (changelist.Change, error) {
 	kl := make(data.KeyList, 0, 1)
 	kl = append(kl, key)
 	meta := changelist.TufRootData{
@@ -777,19 +3598,14 @@ func (r *NotaryRepository) rootFileKeyChange(role, action string, key data.Publi
 	}
 	metaJSON, err := json.Marshal(meta)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	c := changelist.NewTufChange(
+	return changelist.NewTufChange(
 		action,
 		changelist.ScopeRoot,
 		changelist.TypeRootRole,
 		role,
 		metaJSON,
-	)
-	err = cl.Add(c)
-	if err != nil {
-		return err
-	}
-	return nil
+	), nil
 }
@@ -2,7 +2,14 @@ package client
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
 	regJson "encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -10,9 +17,11 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	ctxu "github.com/docker/distribution/context"
@@ -23,9 +32,11 @@ import (
 	"github.com/docker/notary/server"
 	"github.com/docker/notary/server/storage"
 	"github.com/docker/notary/trustmanager"
+	tufclient "github.com/docker/notary/tuf/client"
 	"github.com/docker/notary/tuf/data"
 	"github.com/docker/notary/tuf/signed"
 	"github.com/docker/notary/tuf/store"
+	"github.com/docker/notary/tuf/utils"
 	"github.com/docker/notary/tuf/validation"
 	"github.com/jfrazelle/go/canonical/json"
 	"github.com/stretchr/testify/assert"
@@ -62,9 +73,18 @@ func simpleTestServer(t *testing.T) (
 }
 
 func fullTestServer(t *testing.T) *httptest.Server {
+	return fullTestServerWithStorage(t, storage.NewMemStorage(),
+		cryptoservice.NewCryptoService(
+			"", trustmanager.NewKeyMemoryStore(passphraseRetriever)))
+}
+
+// a full server which stores its data in metaStore and signs with the keys of
+// cryptoService, so that servers can be made to manage the same keys
+func fullTestServerWithStorage(t *testing.T, metaStore storage.MetaStore,
+	cryptoService signed.CryptoService) *httptest.Server {
+
 	// Set up server
-	ctx := context.WithValue(
-		context.Background(), "metaStore", storage.NewMemStorage())
+	ctx := context.WithValue(context.Background(), "metaStore", metaStore)
 
 	// Do not pass one of the const KeyAlgorithms here as the value! Passing a
 	// string is in itself good test that we are handling it correctly as we
@@ -77,8 +97,6 @@ func fullTestServer(t *testing.T) *httptest.Server {
 	l.Out = &b
 	ctx = ctxu.WithLogger(ctx, logrus.NewEntry(l))
 
-	cryptoService := cryptoservice.NewCryptoService(
-		"", trustmanager.NewKeyMemoryStore(passphraseRetriever))
 	return httptest.NewServer(server.RootHandler(nil, ctx, cryptoService))
 }
 
@@ -390,6 +408,29 @@ func testInitRepoAttemptsExceeded(t *testing.T, rootType string) {
 	assert.EqualError(t, err, trustmanager.ErrAttemptsExceeded{}.Error())
 }
 
+// A repository can't be initialized with an ED25519 root key, since it can't
+// be put in an x509 certificate.
+func TestInitRepoED25519RootKey(t *testing.T) {
+	gun := "docker.com/notary"
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	defer os.RemoveAll(tempBaseDir)
+
+	ts, _, _ := simpleTestServer(t)
+	defer ts.Close()
+
+	repo, err := NewNotaryRepository(tempBaseDir, gun, ts.URL, http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err, "error creating repo: %s", err)
+	rootPubKey, err := repo.CryptoService.Create("root", data.ED25519Key)
+	assert.NoError(t, err, "error generating root key: %s", err)
+
+	err = repo.Initialize(rootPubKey.ID())
+	assert.Equal(t, ErrUnsupportedRootKey{KeyID: rootPubKey.ID(), Algorithm: data.ED25519Key}, err)
+	_, err = repo.fileStore.GetMeta(data.CanonicalRootRole, maxSize)
+	assert.IsType(t, store.ErrMetaNotFound{}, err)
+}
+
 // TestInitRepoPasswordInvalid tests error handling when passphrase.Retriever
 // (or rather the user) fails to provide a correct password.
 func TestInitRepoPasswordInvalid(t *testing.T) {
@@ -427,6 +468,320 @@ func testInitRepoPasswordInvalid(t *testing.T, rootType string) {
 	assert.EqualError(t, err, trustmanager.ErrPasswordInvalid{}.Error())
 }
 
+// Initializing a repo against a server that can't be reached fails with an
+// ErrRemoteKeyUnavailable, without leaving behind any keys other than the root
+// key, or any trusted certificates, so that Initialize can be retried.
+func TestInitRepoRemoteKeyUnavailable(t *testing.T) {
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	defer os.RemoveAll(tempBaseDir)
+
+	ts := errorTestServer(t, 500)
+	defer ts.Close()
+
+	repo, rootPubKeyID := createRepoAndKey(
+		t, data.ECDSAKey, tempBaseDir, "docker.com/notary", ts.URL)
+	err = repo.Initialize(rootPubKeyID, data.CanonicalSnapshotRole)
+	assert.Error(t, err)
+	assert.IsType(t, ErrRemoteKeyUnavailable{}, err)
+	assert.Equal(t, data.CanonicalTimestampRole, err.(ErrRemoteKeyUnavailable).Role)
+
+	assert.Equal(t, map[string]string{rootPubKeyID: data.CanonicalRootRole},
+		repo.CryptoService.ListAllKeys())
+	assert.Empty(t, repo.CertManager.TrustedCertificateStore().GetCertificates())
+	_, err = os.Stat(filepath.Join(tempBaseDir, tufDir,
+		filepath.FromSlash("docker.com/notary"), "metadata", "root.json"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// Initializing a repo against a server that refuses to provide a key fails
+// with an ErrRemoteKeyRefused, without retrying.
+func TestInitRepoRemoteKeyRefused(t *testing.T) {
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	defer os.RemoveAll(tempBaseDir)
+
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	repo, rootPubKeyID := createRepoAndKey(
+		t, data.ECDSAKey, tempBaseDir, "docker.com/notary", ts.URL)
+	repo.RemoteKeyRetries = 3
+	err = repo.Initialize(rootPubKeyID)
+	assert.Error(t, err)
+	assert.IsType(t, ErrRemoteKeyRefused{}, err)
+	assert.Equal(t, 1, requests)
+}
+
+// If RemoteKeyRetries is set, fetching a key the server manages is retried
+// while the server can't be reached.
+func TestInitRepoRetriesRemoteKey(t *testing.T) {
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	defer os.RemoveAll(tempBaseDir)
+
+	defer func(delay time.Duration) { remoteKeyRetryDelay = delay }(remoteKeyRetryDelay)
+	remoteKeyRetryDelay = time.Millisecond
+
+	keyServer, mux, _ := simpleTestServer(t)
+	keyServer.Close()
+	var failures int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".key") && failures < 2 {
+			failures++
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	repo, rootPubKeyID := createRepoAndKey(
+		t, data.ECDSAKey, tempBaseDir, "docker.com/notary", ts.URL)
+	repo.RemoteKeyRetries = 1
+	err = repo.Initialize(rootPubKeyID)
+	assert.Error(t, err)
+	assert.IsType(t, ErrRemoteKeyUnavailable{}, err)
+
+	failures = 0
+	repo.RemoteKeyRetries = 2
+	err = repo.Initialize(rootPubKeyID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, failures)
+}
+
+// Retrying Initialize after an attempt that left keys behind, e.g. because
+// it was killed before it could remove them, reuses those keys instead of
+// creating new ones, and doesn't remove them if it fails again.
+func TestInitRepoReusesLeftoverKeys(t *testing.T) {
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	defer os.RemoveAll(tempBaseDir)
+
+	keyServer, mux, _ := simpleTestServer(t)
+	keyServer.Close()
+	unavailable := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unavailable {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	gun := "docker.com/notary"
+	repo, rootPubKeyID := createRepoAndKey(t, data.ECDSAKey, tempBaseDir, gun, ts.URL)
+	leftover, err := repo.CryptoService.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	// the keys of other repositories are never reused
+	otherRepo, err := NewNotaryRepository(
+		tempBaseDir, "docker.com/other", ts.URL, http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err)
+	otherKey, err := otherRepo.CryptoService.Create(data.CanonicalSnapshotRole, data.ECDSAKey)
+	assert.NoError(t, err)
+
+	err = repo.Initialize(rootPubKeyID)
+	assert.IsType(t, ErrRemoteKeyUnavailable{}, err)
+	assert.Equal(t, map[string]string{
+		rootPubKeyID:                                     data.CanonicalRootRole,
+		filepath.Join(gun, leftover.ID()):                data.CanonicalTargetsRole,
+		filepath.Join("docker.com/other", otherKey.ID()): data.CanonicalSnapshotRole,
+	}, repo.CryptoService.ListAllKeys())
+
+	unavailable = false
+	assert.NoError(t, repo.Initialize(rootPubKeyID))
+	assert.Equal(t, []string{leftover.ID()},
+		repo.tufRepo.Root.Signed.Roles[data.CanonicalTargetsRole].KeyIDs)
+	snapshotKeyIDs := repo.tufRepo.Root.Signed.Roles[data.CanonicalSnapshotRole].KeyIDs
+	assert.Len(t, snapshotKeyIDs, 1)
+	assert.NotEqual(t, otherKey.ID(), snapshotKeyIDs[0])
+	assert.Len(t, repo.CryptoService.ListKeys(data.CanonicalTargetsRole), 1)
+}
+
+// EnsureInitialized only initializes a repository that neither the local
+// cache nor the server has a root for, and doesn't initialize one if the
+// server can't say whether it has one.
+func TestEnsureInitialized(t *testing.T) {
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	defer os.RemoveAll(tempBaseDir)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, rootPubKeyID := createRepoAndKey(t, data.ECDSAKey, tempBaseDir, gun, ts.URL)
+	created, err := repo.EnsureInitialized(rootPubKeyID)
+	assert.NoError(t, err)
+	assert.True(t, created)
+
+	// the unpublished root is cached locally
+	created, err = repo.EnsureInitialized(rootPubKeyID)
+	assert.NoError(t, err)
+	assert.False(t, created)
+	assert.NoError(t, repo.Publish())
+
+	// the server has the root
+	tempBaseDir2, err := ioutil.TempDir("", "notary-test-")
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	defer os.RemoveAll(tempBaseDir2)
+	otherRepo, otherRootKeyID := createRepoAndKey(t, data.ECDSAKey, tempBaseDir2, gun, ts.URL)
+	created, err = otherRepo.EnsureInitialized(otherRootKeyID)
+	assert.NoError(t, err)
+	assert.False(t, created)
+	_, err = otherRepo.fileStore.GetMeta(data.CanonicalRootRole, maxSize)
+	assert.IsType(t, store.ErrMetaNotFound{}, err)
+
+	// the server is unavailable
+	errServer := errorTestServer(t, http.StatusServiceUnavailable)
+	defer errServer.Close()
+	tempBaseDir3, err := ioutil.TempDir("", "notary-test-")
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	defer os.RemoveAll(tempBaseDir3)
+	unavailableRepo, unavailableRootKeyID := createRepoAndKey(
+		t, data.ECDSAKey, tempBaseDir3, gun, errServer.URL)
+	created, err = unavailableRepo.EnsureInitialized(unavailableRootKeyID)
+	assert.Error(t, err)
+	assert.False(t, created)
+	_, err = unavailableRepo.fileStore.GetMeta(data.CanonicalRootRole, maxSize)
+	assert.IsType(t, store.ErrMetaNotFound{}, err)
+}
+
+// A repository created with separate key and cache directories keeps its keys
+// and trusted certificates in one, and its trust data in the other.
+func TestNewNotaryRepositoryWithDirs(t *testing.T) {
+	keyDir, err := ioutil.TempDir("", "notary-test-keys-")
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	defer os.RemoveAll(keyDir)
+	cacheDir, err := ioutil.TempDir("", "notary-test-cache-")
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	defer os.RemoveAll(cacheDir)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, err := NewNotaryRepositoryWithDirs(keyDir, cacheDir, gun, ts.URL,
+		http.DefaultTransport, passphraseRetriever, certs.TrustPinConfig{})
+	assert.NoError(t, err)
+	rootPubKey, err := repo.CryptoService.Create(data.CanonicalRootRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	assert.NoError(t, repo.Initialize(rootPubKey.ID()))
+	assert.NoError(t, repo.Publish())
+
+	for _, dir := range []string{"private", "trusted_certificates"} {
+		_, err := os.Stat(filepath.Join(keyDir, dir))
+		assert.NoError(t, err)
+		_, err = os.Stat(filepath.Join(cacheDir, dir))
+		assert.True(t, os.IsNotExist(err), "%s is in the cache directory", dir)
+	}
+	_, err = os.Stat(filepath.Join(cacheDir, tufDir, filepath.FromSlash(gun), "metadata", "root.json"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(keyDir, tufDir))
+	assert.True(t, os.IsNotExist(err), "trust data is in the key directory")
+
+	// the cache can be discarded, and is downloaded again
+	assert.NoError(t, os.RemoveAll(cacheDir))
+	repo, err = NewNotaryRepositoryWithDirs(keyDir, cacheDir, gun, ts.URL,
+		http.DefaultTransport, passphraseRetriever, certs.TrustPinConfig{})
+	assert.NoError(t, err)
+	_, err = repo.ListTargets()
+	assert.NoError(t, err)
+}
+
+// Repositories created with the same CertManager share its trust store, and
+// keep no trusted certificates of their own.
+func TestNewNotaryRepositoryWithCertManager(t *testing.T) {
+	trustDir, err := ioutil.TempDir("", "notary-test-trust-")
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	defer os.RemoveAll(trustDir)
+	certManager, err := certs.NewManager(trustDir)
+	assert.NoError(t, err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	newRepo := func() (*NotaryRepository, string) {
+		baseDir, err := ioutil.TempDir("", "notary-test-")
+		assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+		repo, err := NewNotaryRepositoryWithCertManager(baseDir, baseDir, gun, ts.URL,
+			http.DefaultTransport, passphraseRetriever, certManager)
+		assert.NoError(t, err)
+		assert.True(t, repo.CertManager == certManager)
+		return repo, baseDir
+	}
+
+	repo, baseDir := newRepo()
+	defer os.RemoveAll(baseDir)
+	rootPubKey, err := repo.CryptoService.Create(data.CanonicalRootRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	assert.NoError(t, repo.Initialize(rootPubKey.ID()))
+	assert.NoError(t, repo.Publish())
+	trusted, err := certManager.TrustedCertificateStore().GetCertificatesByCN(gun)
+	assert.NoError(t, err)
+	assert.Len(t, trusted, 1)
+
+	reader, readerDir := newRepo()
+	defer os.RemoveAll(readerDir)
+	_, err = reader.ListTargets()
+	assert.NoError(t, err)
+	trusted, err = certManager.TrustedCertificateStore().GetCertificatesByCN(gun)
+	assert.NoError(t, err)
+	assert.Len(t, trusted, 1)
+
+	for _, dir := range []string{baseDir, readerDir} {
+		_, err := os.Stat(filepath.Join(dir, "trusted_certificates"))
+		assert.True(t, os.IsNotExist(err), "%s has its own trusted certificates", dir)
+	}
+	_, err = os.Stat(filepath.Join(trustDir, "trusted_certificates"))
+	assert.NoError(t, err)
+}
+
+// A repository created with a cache layout caches its trust data as it says,
+// and reports corrupted metadata at its path in the layout.
+func TestNewNotaryRepositoryWithCacheLayout(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	certManager, err := certs.NewManager(tempBaseDir)
+	assert.NoError(t, err)
+	repo, err := NewNotaryRepositoryWithCacheLayout(tempBaseDir, tempBaseDir, gun, ts.URL,
+		http.DefaultTransport, passphraseRetriever, certManager,
+		CacheLayout{MetadataDir: "trust-data", MetadataExtension: "tuf.json"})
+	assert.NoError(t, err)
+	rootPubKey, err := repo.CryptoService.Create(data.CanonicalRootRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	assert.NoError(t, repo.Initialize(rootPubKey.ID()))
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+
+	repoDir := filepath.Join(tempBaseDir, tufDir, filepath.FromSlash(gun))
+	for _, role := range []string{
+		data.CanonicalRootRole, data.CanonicalTargetsRole, data.CanonicalSnapshotRole} {
+		_, err := os.Stat(filepath.Join(repoDir, "trust-data", role+".tuf.json"))
+		assert.NoError(t, err, "%s metadata isn't cached as expected", role)
+	}
+	_, err = os.Stat(filepath.Join(repoDir, "metadata"))
+	assert.True(t, os.IsNotExist(err))
+
+	targetsPath := filepath.Join(repoDir, "trust-data", data.CanonicalTargetsRole+".tuf.json")
+	err = repo.corruptedCache(data.CanonicalTargetsRole, fmt.Errorf("corrupted"))
+	assert.IsType(t, ErrCorruptedCache{}, err)
+	assert.Equal(t, targetsPath, err.(ErrCorruptedCache).Path)
+}
+
 func addTarget(t *testing.T, repo *NotaryRepository, targetName, targetFile string,
 	roles ...string) *Target {
 	target, err := NewTarget(targetName, targetFile)
@@ -436,6 +791,27 @@ func addTarget(t *testing.T, repo *NotaryRepository, targetName, targetFile stri
 	return target
 }
 
+// TestNewTargetVariants confirms that building a target from a path, from a
+// reader, or from precomputed metadata all produce the same target.
+func TestNewTargetVariants(t *testing.T) {
+	targetFile := "../fixtures/intermediate-ca.crt"
+	fromPath, err := NewTarget("latest", targetFile)
+	assert.NoError(t, err)
+
+	f, err := os.Open(targetFile)
+	assert.NoError(t, err)
+	defer f.Close()
+	fromReader, err := NewTargetFromReader("latest", f)
+	assert.NoError(t, err)
+	assert.Equal(t, fromPath, fromReader)
+
+	fromMeta := NewTargetWithMeta("latest", fromPath.Length, fromPath.Hashes)
+	assert.Equal(t, fromPath, fromMeta)
+
+	_, err = NewTarget("latest", "../fixtures/does-not-exist")
+	assert.Error(t, err)
+}
+
 // calls GetChangelist and gets the actual changes out
 func getChanges(t *testing.T, repo *NotaryRepository) []changelist.Change {
 	changeList, err := repo.GetChangelist()
@@ -464,6 +840,155 @@ func TestAddTargetToTargetRoleByDefault(t *testing.T) {
 		[]string{data.CanonicalTargetsRole})
 }
 
+// TestAddTargetConcurrently adds targets from many goroutines, through two
+// NotaryRepositories sharing the same directory, and confirms that no change
+// is lost.
+func TestAddTargetConcurrently(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+
+	ts, _, _ := simpleTestServer(t)
+	defer ts.Close()
+
+	repo1, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	repo2, err := NewNotaryRepository(tempBaseDir, gun, ts.URL,
+		http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err, "error creating repo: %s", err)
+
+	target, err := NewTarget("latest", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, err, "error creating target")
+
+	numTargets := 20
+	errs := make(chan error, numTargets)
+	for i := 0; i < numTargets; i++ {
+		repo := repo1
+		if i%2 == 1 {
+			repo = repo2
+		}
+		go func(repo *NotaryRepository, name string) {
+			errs <- repo.AddTarget(NewTargetWithMeta(name, target.Length, target.Hashes))
+		}(repo, fmt.Sprintf("target%d", i))
+	}
+	for i := 0; i < numTargets; i++ {
+		assert.NoError(t, <-errs)
+	}
+
+	names := make(map[string]bool)
+	for _, c := range getChanges(t, repo1) {
+		names[c.Path()] = true
+	}
+	assert.Len(t, names, numTargets, "some changes were lost")
+}
+
+// PruneUnapplicableChanges removes the changes that can't be applied to the
+// current metadata plus the earlier changes, and keeps the rest.
+func TestPruneUnapplicableChanges(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+
+	ts, _, _ := simpleTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+
+	key, err := repo.CryptoService.Create("targets/a", data.ECDSAKey)
+	assert.NoError(t, err)
+
+	addTarget(t, repo, "latest", "../fixtures/intermediate-ca.crt")
+	// the parent of this delegation is never created
+	assert.NoError(t, repo.AddDelegation("targets/x/y", 1, []data.PublicKey{key}))
+	// this role never exists
+	addTarget(t, repo, "current", "../fixtures/intermediate-ca.crt", "targets/nope")
+	// the parent of the second delegation is created by the first
+	assert.NoError(t, repo.AddDelegation("targets/a", 1, []data.PublicKey{key}))
+	assert.NoError(t, repo.AddDelegation("targets/a/b", 1, []data.PublicKey{key}))
+
+	pruned, err := repo.PruneUnapplicableChanges()
+	assert.NoError(t, err)
+	assert.Len(t, pruned, 2)
+	assert.Equal(t, "targets/x/y", pruned[0].Scope())
+	assert.Equal(t, "targets/nope", pruned[1].Scope())
+
+	var remaining []string
+	for _, c := range getChanges(t, repo) {
+		remaining = append(remaining, c.Scope())
+	}
+	assert.Equal(t, []string{data.CanonicalTargetsRole, "targets/a", "targets/a/b"}, remaining)
+
+	// the changes were not applied to the repository itself
+	_, ok := repo.tufRepo.Targets["targets/a"]
+	assert.False(t, ok)
+	assert.Empty(t, repo.tufRepo.Targets[data.CanonicalTargetsRole].Signed.Targets)
+}
+
+// ValidateChangelist reports every change that can't be applied, not just the
+// first, and leaves the changelist and the repository as they were
+func TestValidateChangelist(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+
+	ts, _, _ := simpleTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+
+	changeErrs, err := repo.ValidateChangelist()
+	assert.NoError(t, err)
+	assert.Empty(t, changeErrs)
+
+	key, err := repo.CryptoService.Create("targets/a", data.ECDSAKey)
+	assert.NoError(t, err)
+
+	addTarget(t, repo, "latest", "../fixtures/intermediate-ca.crt")
+	// the parent of this delegation is never created
+	assert.NoError(t, repo.AddDelegation("targets/x/y", 1, []data.PublicKey{key}))
+	// this role never exists
+	addTarget(t, repo, "current", "../fixtures/intermediate-ca.crt", "targets/nope")
+	// the parent of the second delegation is created by the first
+	assert.NoError(t, repo.AddDelegation("targets/a", 1, []data.PublicKey{key}))
+	assert.NoError(t, repo.AddDelegation("targets/a/b", 1, []data.PublicKey{key}))
+	// the content of this change isn't valid
+	cl, err := repo.openChangelist()
+	assert.NoError(t, err)
+	assert.NoError(t, cl.Add(changelist.NewTufChange(changelist.ActionCreate,
+		changelist.ScopeTargets, changelist.TypeTargetsTarget, "broken", []byte("{"))))
+	assert.NoError(t, cl.Close())
+
+	changeErrs, err = repo.ValidateChangelist()
+	assert.NoError(t, err)
+	assert.Len(t, changeErrs, 3)
+	var invalid []string
+	for _, changeErr := range changeErrs {
+		assert.Error(t, changeErr.Err)
+		invalid = append(invalid, changeErr.Change.Scope()+" "+changeErr.Change.Path())
+	}
+	assert.Equal(t, []string{"targets/x/y ", "targets/nope current", "targets broken"}, invalid)
+
+	// nothing was removed from the changelist, or applied to the repository
+	assert.Len(t, getChanges(t, repo), 6)
+	_, ok := repo.tufRepo.Targets["targets/a"]
+	assert.False(t, ok)
+	assert.Empty(t, repo.tufRepo.Targets[data.CanonicalTargetsRole].Signed.Targets)
+
+	// publishing still stops at the first change that fails
+	assert.Error(t, repo.Publish())
+}
+
 // Tests that adding a target to a repo or deleting a target from a repo,
 // with the given roles, makes a change to the expected scopes
 func testAddOrDeleteTarget(t *testing.T, repo *NotaryRepository, action string,
@@ -864,7 +1389,7 @@ func testListTarget(t *testing.T, rootType string) {
 	assert.NoError(t, err, "could not open changelist")
 
 	// apply the changelist to the repo
-	err = applyChangelist(repo.tufRepo, cl)
+	err = applyChangelist(repo.tufRepo, cl, logrus.StandardLogger())
 	assert.NoError(t, err, "could not apply changelist")
 
 	fakeServerData(t, repo, mux, keys)
@@ -889,6 +1414,33 @@ func testListTarget(t *testing.T, rootType string) {
 	newCurrentTarget, err := repo.GetTargetByName("current")
 	assert.NoError(t, err)
 	assert.Equal(t, currentTarget, newCurrentTarget, "current target does not match")
+
+	// WalkTargets stops as soon as the walk function returns an error
+	walked := 0
+	stopErr := fmt.Errorf("stop walking")
+	err = repo.WalkTargets(func(target *Target) error {
+		walked++
+		return stopErr
+	})
+	assert.Equal(t, stopErr, err)
+	assert.Equal(t, 1, walked, "WalkTargets should have stopped after the first target")
+
+	// ListTargetsByPrefix only lists the matching targets, sorted by name
+	prefixed, err := repo.ListTargetsByPrefix("l")
+	assert.NoError(t, err)
+	assert.Equal(t, []*Target{latestTarget}, prefixed)
+
+	prefixed, err = repo.ListTargetsByPrefix("", data.CanonicalTargetsRole)
+	assert.NoError(t, err)
+	assert.Equal(t, []*Target{currentTarget, latestTarget}, prefixed)
+
+	_, err = repo.ListTargetsByPrefix("", "targets/nope")
+	assert.IsType(t, data.ErrNoSuchRole{}, err)
+
+	// No delegations, so no target can be claimed by more than one role
+	dups, err := repo.DuplicateTargetNames()
+	assert.NoError(t, err)
+	assert.Empty(t, dups)
 }
 
 // TestValidateRootKey verifies that the public data in root.json for the root
@@ -1126,17 +1678,10 @@ func testPublishAfterPullServerHasSnapshotKey(t *testing.T, rootType string) {
 	assert.NoError(t, err)
 }
 
-// If neither the client nor the server has the snapshot key, signing will fail
-// with an ErrNoKeys error.
-// We test this with both an RSA and ECDSA root key
-func TestPublishNoOneHasSnapshotKey(t *testing.T) {
-	testPublishNoOneHasSnapshotKey(t, data.ECDSAKey)
-	if !testing.Short() {
-		testPublishNoOneHasSnapshotKey(t, data.RSAKey)
-	}
-}
-
-func testPublishNoOneHasSnapshotKey(t *testing.T, rootType string) {
+// UpdateAndReport reports every role but the timestamp and snapshot as
+// changed on the first pull, and after that only reports roles whose version
+// has advanced on the server.
+func TestUpdateAndReport(t *testing.T) {
 	// Temporary directory where test files will be created
 	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
 	defer os.RemoveAll(tempBaseDir)
@@ -1146,40 +1691,80 @@ func testPublishNoOneHasSnapshotKey(t *testing.T, rootType string) {
 	ts := fullTestServer(t)
 	defer ts.Close()
 
-	// create repo and delete the snapshot key and metadata
-	repo, _ := initializeRepo(t, rootType, tempBaseDir, gun, ts.URL, false)
-	snapshotRole, ok := repo.tufRepo.Root.Signed.Roles[data.CanonicalSnapshotRole]
-	assert.True(t, ok)
-	for _, keyID := range snapshotRole.KeyIDs {
-		repo.CryptoService.RemoveKey(keyID)
-	}
-
-	// Publish something
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
 	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
-	err = repo.Publish()
-	assert.Error(t, err)
-	assert.IsType(t, validation.ErrBadHierarchy{}, err)
-}
+	assert.NoError(t, repo.Publish())
 
-// If the snapshot metadata is corrupt, whether the client or server has the
-// snapshot key, we can't publish.
-// We test this with both an RSA and ECDSA root key
-func TestPublishSnapshotCorrupt(t *testing.T) {
-	testPublishBadExistingSnapshot(t, data.ECDSAKey, true, true)
-	testPublishBadExistingSnapshot(t, data.ECDSAKey, false, true)
+	// Create a new repo and pull from the server
+	tempBaseDir2, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir2)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	repo2, err := NewNotaryRepository(tempBaseDir2, gun, ts.URL,
+		http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err, "error creating repository: %s", err)
+
+	changed, err := repo2.UpdateAndReport()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{data.CanonicalRootRole, data.CanonicalTargetsRole}, changed)
+
+	// nothing has been published since the last update
+	changed, err = repo2.UpdateAndReport()
+	assert.NoError(t, err)
+	assert.Empty(t, changed)
+
+	// publishing a new target changes targets, but not root
+	addTarget(t, repo, "v2", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+
+	changed, err = repo2.UpdateAndReport()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{data.CanonicalTargetsRole}, changed)
 }
 
-// If the snapshot metadata is unreadable, whether the client or server has the
-// snapshot key, we can't publish.
-// We test this with both an RSA and ECDSA root key
-func TestPublishSnapshotUnreadable(t *testing.T) {
-	testPublishBadExistingSnapshot(t, data.ECDSAKey, true, false)
-	testPublishBadExistingSnapshot(t, data.ECDSAKey, false, false)
+// failingUploadRoundTripper forwards all requests except metadata uploads: it
+// pretends to accept the first upload, and fails all the following ones
+type failingUploadRoundTripper struct {
+	uploads int
 }
 
-func testPublishBadExistingSnapshot(t *testing.T, rootType string,
-	serverManagesSnapshot bool, readable bool) {
+func (rt *failingUploadRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "POST" {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	rt.uploads++
+	if rt.uploads > 1 {
+		return nil, fmt.Errorf("upload failed")
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+	}, nil
+}
+
+// addDelegationWithPaths stages the creation of a delegated role, with the
+// given key, that may sign the given paths, or every path if none are given
+func addDelegationWithPaths(t *testing.T, repo *NotaryRepository, role string,
+	key data.PublicKey, paths ...string) {
+
+	if len(paths) == 0 {
+		paths = []string{""}
+	}
+	tdJSON, err := json.Marshal(&changelist.TufDelegation{
+		NewThreshold: 1,
+		AddKeys:      data.KeyList{key},
+		AddPaths:     paths,
+	})
+	assert.NoError(t, err)
+	cl, err := repo.GetChangelist()
+	assert.NoError(t, err)
+	assert.NoError(t, cl.Add(changelist.NewTufChange(changelist.ActionCreate,
+		role, changelist.TypeTargetsDelegation, "", tdJSON)))
+}
 
+// If the metadata is uploaded in batches and one of them fails after another
+// succeeded, Publish returns an ErrPartialPublish and keeps the changelist.
+func TestPublishPartialFailure(t *testing.T) {
 	// Temporary directory where test files will be created
 	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
 	defer os.RemoveAll(tempBaseDir)
@@ -1189,437 +1774,3207 @@ func testPublishBadExistingSnapshot(t *testing.T, rootType string,
 	ts := fullTestServer(t)
 	defer ts.Close()
 
-	repo, _ := initializeRepo(
-		t, rootType, tempBaseDir, gun, ts.URL, serverManagesSnapshot)
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, true)
+	key, err := repo.CryptoService.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	addDelegationWithPaths(t, repo, "targets/a", key)
+
+	repo.roundTrip = &failingUploadRoundTripper{}
+	repo.MaxPublishBatchSize = 1
+	err = repo.Publish()
+	assert.Error(t, err)
+	assert.IsType(t, ErrPartialPublish{}, err)
+
+	partial := err.(ErrPartialPublish)
+	assert.Equal(t, []string{data.CanonicalRootRole, data.CanonicalTargetsRole},
+		partial.Uploaded)
+	assert.Equal(t, []string{"targets/a"}, partial.Remaining)
+	assert.Len(t, getChanges(t, repo), 1, "changelist should not have been cleared")
+}
+
+// If the client signs the snapshot, the metadata is uploaded in a single
+// request whatever the batch size, so a failed upload is not a partial publish.
+func TestPublishClientSignedSnapshotNotBatched(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
 
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
 	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
 
-	var expectedErrType interface{}
-	if readable {
-		// write a corrupt snapshots file
-		repo.fileStore.SetMeta(data.CanonicalSnapshotRole, []byte("this isn't JSON"))
-		expectedErrType = &regJson.SyntaxError{}
-	} else {
-		// create a directory instead of a file
-		path := fmt.Sprintf("%s.%s",
-			filepath.Join(tempBaseDir, tufDir, filepath.FromSlash(gun),
-				"metadata", data.CanonicalSnapshotRole), "json")
-		os.RemoveAll(path)
-		err := os.Mkdir(path, 0755)
-		defer os.RemoveAll(path)
+	rt := &failingUploadRoundTripper{}
+	repo.roundTrip = rt
+	repo.MaxPublishBatchSize = 1
+	assert.NoError(t, repo.Publish())
+	assert.Equal(t, 1, rt.uploads)
+}
+
+// A repository whose snapshot is signed by the server can be published in
+// batches, both when it is first published and when delegations are added to
+// it later, and other clients see all of the published metadata.
+func TestPublishInBatches(t *testing.T) {
+	// Temporary directories where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	tempBaseDir2, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir2)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, true)
+	repo.MaxPublishBatchSize = 1
+	key, err := repo.CryptoService.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.NoError(t, err)
+
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
+	addDelegationWithPaths(t, repo, "targets/a", key)
+	addDelegationWithPaths(t, repo, "targets/a/b", key)
+	addTarget(t, repo, "v2", "../fixtures/intermediate-ca.crt", "targets/a/b")
+	assert.NoError(t, repo.Publish())
+	assert.Empty(t, getChanges(t, repo))
+
+	// a later publish adds another delegation below an existing one
+	addDelegationWithPaths(t, repo, "targets/a/c", key)
+	addTarget(t, repo, "v3", "../fixtures/intermediate-ca.crt", "targets/a/c")
+	assert.NoError(t, repo.Publish())
+	assert.Empty(t, getChanges(t, repo))
+
+	repo2, err := NewNotaryRepository(tempBaseDir2, gun, ts.URL,
+		http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err, "error creating repository: %s", err)
+
+	for role, name := range map[string]string{
+		data.CanonicalTargetsRole: "v1", "targets/a/b": "v2", "targets/a/c": "v3"} {
+
+		targets, err := repo2.ListTargetsByPrefix("", role)
 		assert.NoError(t, err)
+		var names []string
+		for _, target := range targets {
+			names = append(names, target.Name)
+		}
+		assert.Contains(t, names, name, "%s is missing from %s", name, role)
+	}
+}
 
-		expectedErrType = &os.PathError{}
+// rejectingUploadRoundTripper responds to every upload of metadata with the
+// given status and body
+type rejectingUploadRoundTripper struct {
+	status int
+	body   string
+}
+
+func (rt rejectingUploadRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "POST" {
+		return http.DefaultTransport.RoundTrip(req)
 	}
+	return &http.Response{
+		StatusCode: rt.status,
+		Body:       ioutil.NopCloser(strings.NewReader(rt.body)),
+	}, nil
+}
+
+// If the server rejects the metadata as invalid, Publish says which roles
+// weren't accepted, and which of them the server found invalid.
+func TestPublishRejected(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, "docker.com/notary", ts.URL, true)
+	key, err := repo.CryptoService.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	addDelegationWithPaths(t, repo, "targets/a", key)
+
+	badTargets := `{"errors": [{"code": "INVALID_UPDATE", "message": "invalid update", "detail":
+		{"Name": "ErrBadTargets", "Error": {"Msg": "bad signature", "Role": "targets/a"}}}]}`
+	repo.roundTrip = rejectingUploadRoundTripper{status: http.StatusBadRequest, body: badTargets}
+	err = repo.Publish()
+	assert.Equal(t, ErrPublishRejected{
+		Roles:    []string{data.CanonicalRootRole, data.CanonicalTargetsRole, "targets/a"},
+		Rejected: "targets/a",
+		Err:      validation.ErrBadTargets{Msg: "bad signature", Role: "targets/a"},
+	}, err)
+
+	repo.StreamPublish = true
+	err = repo.Publish()
+	assert.Equal(t, ErrPublishRejected{
+		Roles:    []string{data.CanonicalRootRole, data.CanonicalTargetsRole},
+		Rejected: "targets/a",
+		Err:      validation.ErrBadTargets{Msg: "bad signature", Role: "targets/a"},
+	}, err)
+	repo.StreamPublish = false
+
+	// a failure that isn't the metadata being found invalid
+	repo.roundTrip = rejectingUploadRoundTripper{status: http.StatusInternalServerError}
 	err = repo.Publish()
 	assert.Error(t, err)
-	assert.IsType(t, expectedErrType, err)
+	assert.IsType(t, store.ErrServerUnavailable{}, err)
+	assert.Len(t, getChanges(t, repo), 1, "changelist should not have been cleared")
 }
 
-type cannotCreateKeys struct {
-	signed.CryptoService
+// countingUploadRoundTripper counts the uploads of metadata
+type countingUploadRoundTripper struct {
+	uploads int
 }
 
-func (cs cannotCreateKeys) Create(_, _ string) (data.PublicKey, error) {
-	return nil, fmt.Errorf("Oh no I cannot create keys")
+func (rt *countingUploadRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == "POST" {
+		rt.uploads++
+	}
+	return http.DefaultTransport.RoundTrip(req)
 }
 
-// If there is an error creating the local keys, no call is made to get a
-// remote key.
-func TestPublishSnapshotLocalKeysCreatedFirst(t *testing.T) {
-	// Temporary directory where test files will be created
+// A repository whose snapshot is signed by the server can stream its
+// metadata to the server one role at a time.  If an upload fails after
+// another succeeded, Publish returns an ErrPartialPublish.
+func TestStreamPublish(t *testing.T) {
+	// Temporary directories where test files will be created
 	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
 	defer os.RemoveAll(tempBaseDir)
 	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
-	gun := "docker.com/notary"
+	tempBaseDir2, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir2)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
 
-	requestMade := false
-	ts := httptest.NewServer(http.HandlerFunc(
-		func(http.ResponseWriter, *http.Request) { requestMade = true }))
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
 	defer ts.Close()
 
-	repo, err := NewNotaryRepository(
-		tempBaseDir, gun, ts.URL, http.DefaultTransport, passphraseRetriever)
-	assert.NoError(t, err, "error creating repo: %s", err)
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, true)
+	repo.StreamPublish = true
+	key, err := repo.CryptoService.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.NoError(t, err)
 
-	cs := cryptoservice.NewCryptoService(gun,
-		trustmanager.NewKeyMemoryStore(passphraseRetriever))
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
+	addDelegationWithPaths(t, repo, "targets/a", key)
+	addDelegationWithPaths(t, repo, "targets/a/b", key)
+	addTarget(t, repo, "v2", "../fixtures/intermediate-ca.crt", "targets/a/b")
+	rt := &countingUploadRoundTripper{}
+	repo.roundTrip = rt
+	assert.NoError(t, repo.Publish())
+	assert.Empty(t, getChanges(t, repo))
+	// the root and targets, then each delegated role
+	assert.Equal(t, 3, rt.uploads)
 
-	rootPubKey, err := cs.Create(data.CanonicalRootRole, data.ECDSAKey)
-	assert.NoError(t, err, "error generating root key: %s", err)
+	repo2, err := NewNotaryRepository(tempBaseDir2, gun, ts.URL,
+		http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err, "error creating repository: %s", err)
+	for role, name := range map[string]string{
+		data.CanonicalTargetsRole: "v1", "targets/a/b": "v2"} {
 
-	repo.CryptoService = cannotCreateKeys{CryptoService: cs}
+		targets, err := repo2.ListTargetsByPrefix("", role)
+		assert.NoError(t, err)
+		assert.Len(t, targets, 1)
+		assert.Equal(t, name, targets[0].Name)
+	}
 
-	err = repo.Initialize(rootPubKey.ID(), data.CanonicalSnapshotRole)
-	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "Oh no I cannot create keys")
-	assert.False(t, requestMade)
+	addDelegationWithPaths(t, repo, "targets/c", key)
+	addDelegationWithPaths(t, repo, "targets/d", key)
+	repo.roundTrip = &failingUploadRoundTripper{}
+	err = repo.Publish()
+	assert.IsType(t, ErrPartialPublish{}, err)
+	partial := err.(ErrPartialPublish)
+	assert.Equal(t, []string{data.CanonicalTargetsRole}, partial.Uploaded)
+	assert.Equal(t, []string{"targets/c", "targets/d"}, partial.Remaining)
+	assert.Len(t, getChanges(t, repo), 2, "changelist should not have been cleared")
 }
 
-// Rotate invalid roles, or attempt to delegate target signing to the server
-func TestRotateKeyInvalidRole(t *testing.T) {
+// If the client signs the snapshot, the metadata isn't streamed.
+func TestStreamPublishClientSignedSnapshot(t *testing.T) {
+	// Temporary directory where test files will be created
 	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
 	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, "docker.com/notary", ts.URL, false)
+	key, err := repo.CryptoService.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	addDelegationWithPaths(t, repo, "targets/a", key)
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt", "targets/a")
+
+	rt := &countingUploadRoundTripper{}
+	repo.roundTrip = rt
+	repo.StreamPublish = true
+	assert.NoError(t, repo.Publish())
+	assert.Equal(t, 1, rt.uploads)
+}
+
+// A repository pinned to a root key, with or without its certificate, can be
+// pulled if its root is signed by that key, without any trusted certificates, and fails with ErrRootPinMismatch if it
+// is pinned to a different key.
+func TestPinnedRootKey(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
 	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
 
 	gun := "docker.com/notary"
-	ts, _, _ := simpleTestServer(t)
+	ts := fullTestServer(t)
 	defer ts.Close()
 
 	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
 
-	// the equivalent of: (root, true), (root, false), (timestamp, true),
-	// (timestamp, false), (targets, true)
-	for role := range data.ValidRoles {
-		if role == data.CanonicalSnapshotRole {
-			continue
+	rootKeyID := repo.tufRepo.Root.Signed.Roles[data.CanonicalRootRole].KeyIDs[0]
+	rootKey := repo.tufRepo.Root.Signed.Keys[rootKeyID]
+
+	// the raw public key, without the certificate the root wraps it in
+	canonicalRootKeyID, err := utils.CanonicalKeyID(rootKey)
+	assert.NoError(t, err)
+	rawRootKey := repo.CryptoService.GetKey(canonicalRootKeyID)
+	assert.NotNil(t, rawRootKey)
+	assert.Equal(t, data.ECDSAKey, rawRootKey.Algorithm())
+
+	for _, pinnedKey := range []data.PublicKey{rootKey, rawRootKey, nil} {
+		pinned := pinnedKey != nil
+
+		tempBaseDir2, err := ioutil.TempDir("/tmp", "notary-test-")
+		defer os.RemoveAll(tempBaseDir2)
+		assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+		repo2, err := NewNotaryRepository(tempBaseDir2, gun, ts.URL,
+			http.DefaultTransport, passphraseRetriever)
+		assert.NoError(t, err, "error creating repository: %s", err)
+
+		if pinned {
+			repo2.PinnedRootKey = pinnedKey
+		} else {
+			otherKey, err := repo2.CryptoService.Create(data.CanonicalRootRole, data.ECDSAKey)
+			assert.NoError(t, err)
+			repo2.PinnedRootKey = otherKey
 		}
-		for _, serverManagesKey := range []bool{true, false} {
-			if role == data.CanonicalTargetsRole && !serverManagesKey {
-				continue
-			}
-			err = repo.RotateKey(role, serverManagesKey)
-			assert.Error(t, err,
-				"Rotating a %s key with server-managing the key as %v should fail",
-				role, serverManagesKey)
+
+		targets, err := repo2.ListTargets()
+		if pinned {
+			assert.NoError(t, err)
+			assert.Len(t, targets, 1)
+			// no certificate was needed, so none was trusted
+			assert.Empty(t, repo2.CertManager.TrustedCertificateStore().GetCertificates())
+		} else {
+			assert.Error(t, err)
+			assert.IsType(t, ErrRootPinMismatch{}, err)
 		}
 	}
 }
 
-// Rotates the keys.  After the rotation, downloading the latest metadata
-// and assert that the keys have changed
-func assertRotationSuccessful(t *testing.T, repo *NotaryRepository,
-	keysToRotate map[string]bool) {
-
-	oldKeyIDs := make(map[string][]string)
-	for role := range keysToRotate {
-		keyIDs := repo.tufRepo.Root.Signed.Roles[role].KeyIDs
-		oldKeyIDs[role] = keyIDs
-	}
+// A repository created with trust pinning only accepts a root whose
+// certificate is pinned for its GUN, even on first use.
+func TestNewNotaryRepositoryWithTrustPinning(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
 
-	// Do rotation
-	for role, serverManaged := range keysToRotate {
-		assert.NoError(t, repo.RotateKey(role, serverManaged))
-	}
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
 
-	// Publish
-	err := repo.Publish()
-	assert.NoError(t, err)
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	assert.NoError(t, repo.Publish())
 
-	// Get root.json. Check keys have changed.
-	_, err = repo.GetTargetByName("latest") // force a pull
-	assert.NoError(t, err)
+	rootKeyID := repo.tufRepo.Root.Signed.Roles[data.CanonicalRootRole].KeyIDs[0]
 
-	for role, isRemoteKey := range keysToRotate {
-		keyIDs := repo.tufRepo.Root.Signed.Roles[role].KeyIDs
-		assert.Len(t, keyIDs, 1)
+	for _, pinnedID := range []string{rootKeyID, "not-the-root-key"} {
+		tempBaseDir2, err := ioutil.TempDir("/tmp", "notary-test-")
+		defer os.RemoveAll(tempBaseDir2)
+		assert.NoError(t, err, "failed to create a temporary directory: %s", err)
 
-		// the new key is not the same as any of the old keys, and the
-		// old keys have been removed not just from the TUF file, but
-		// from the cryptoservice
-		for _, oldKeyID := range oldKeyIDs[role] {
-			assert.NotEqual(t, oldKeyID, keyIDs[0])
-			_, _, err := repo.CryptoService.GetPrivateKey(oldKeyID)
-			assert.Error(t, err)
-		}
+		repo2, err := NewNotaryRepositoryWithTrustPinning(tempBaseDir2, gun, ts.URL,
+			http.DefaultTransport, passphraseRetriever,
+			certs.TrustPinConfig{Certs: map[string][]string{gun: {pinnedID}}})
+		assert.NoError(t, err, "error creating repository: %s", err)
 
-		// the new key is present in the cryptoservice, or not present if remote
-		key, _, err := repo.CryptoService.GetPrivateKey(keyIDs[0])
-		if isRemoteKey {
-			assert.Error(t, err)
-			assert.Nil(t, key)
-		} else {
+		_, err = repo2.ListTargets()
+		if pinnedID == rootKeyID {
 			assert.NoError(t, err)
-			assert.NotNil(t, key)
+		} else {
+			assert.Error(t, err)
+			assert.IsType(t, &certs.ErrTrustPinMismatch{}, err)
 		}
 	}
-
-	// Confirm changelist dir empty after publishing changes
-	changes := getChanges(t, repo)
-	assert.Len(t, changes, 0, "wrong number of changelist files found")
 }
 
-// Initialize repo to have the server sign snapshots (remote snapshot key)
-// Without downloading a server-signed snapshot file, rotate keys so that
-//    snapshots are locally signed (local snapshot key)
-// Assert that we can publish.
-func TestRotateBeforePublishFromRemoteKeyToLocalKey(t *testing.T) {
+// A read-only repository can pull and verify a remote repository without any
+// local state, but refuses to modify it.
+func TestReadOnlyRepository(t *testing.T) {
 	// Temporary directory where test files will be created
-	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
 	defer os.RemoveAll(tempBaseDir)
-
 	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
 
 	gun := "docker.com/notary"
 	ts := fullTestServer(t)
 	defer ts.Close()
 
-	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, true)
-	// Adding a target will allow us to confirm the repository is still valid
-	// after rotating the keys.
-	addTarget(t, repo, "latest", "../fixtures/intermediate-ca.crt")
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	latestTarget := addTarget(t, repo, "latest", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+
+	rootKeyID := repo.tufRepo.Root.Signed.Roles[data.CanonicalRootRole].KeyIDs[0]
+	rootKey := repo.tufRepo.Root.Signed.Keys[rootKeyID]
+
+	_, err = NewReadOnlyRepository(gun, ts.URL, http.DefaultTransport, nil)
+	assert.Error(t, err)
+
+	roRepo, err := NewReadOnlyRepository(gun, ts.URL, http.DefaultTransport, rootKey)
+	assert.NoError(t, err)
+
+	targets, err := roRepo.ListTargets()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Target{latestTarget}, targets)
+
+	target, err := roRepo.GetTargetByName("latest")
+	assert.NoError(t, err)
+	assert.Equal(t, latestTarget, target)
+
+	assert.Equal(t, ErrReadOnly, roRepo.AddTarget(latestTarget))
+	assert.Equal(t, ErrReadOnly, roRepo.RemoveTarget("latest"))
+	assert.Equal(t, ErrReadOnly, roRepo.Publish())
+	assert.Equal(t, ErrReadOnly, roRepo.RotateKey(data.CanonicalSnapshotRole, false))
+	_, err = roRepo.GetChangelist()
+	assert.Equal(t, ErrReadOnly, err)
+}
+
+// A repository without a cache validates the trust data like any other, but
+// keeps it in memory only.
+func TestWithoutCache(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	metaStore := storage.NewMemStorage()
+	ts := fullTestServerWithStorage(t, metaStore, cryptoservice.NewCryptoService(
+		"", trustmanager.NewKeyMemoryStore(passphraseRetriever)))
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	latestTarget := addTarget(t, repo, "latest", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+
+	tempBaseDir2, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir2)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	reader, err := NewNotaryRepository(
+		tempBaseDir2, gun, ts.URL, http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err)
+	verifier := reader.WithoutCache()
+	targets, err := verifier.ListTargets()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Target{latestTarget}, targets)
+	assert.Equal(t, ErrReadOnly, verifier.AddTarget(latestTarget))
+	_, err = reader.fileStore.GetMeta(data.CanonicalRootRole, maxSize)
+	assert.IsType(t, store.ErrMetaNotFound{}, err)
+
+	// a repository trusting a shared trust store needs no other local state
+	trustDir, err := ioutil.TempDir("", "notary-test-trust-")
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	defer os.RemoveAll(trustDir)
+	certManager, err := certs.NewManager(trustDir)
+	assert.NoError(t, err)
+	_, err = NewReadOnlyRepositoryWithCertManager(gun, ts.URL, http.DefaultTransport, nil)
+	assert.Error(t, err)
+	roRepo, err := NewReadOnlyRepositoryWithCertManager(gun, ts.URL, http.DefaultTransport, certManager)
+	assert.NoError(t, err)
+	targets, err = roRepo.ListTargets()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Target{latestTarget}, targets)
+
+	// the server now serves a targets that isn't the one in the snapshot,
+	// which fails to validate either way
+	err = metaStore.UpdateCurrent(gun, storage.MetaUpdate{
+		Role:    data.CanonicalTargetsRole,
+		Version: repo.tufRepo.Targets[data.CanonicalTargetsRole].Signed.Version + 1,
+		Data:    []byte("{}"),
+	})
+	assert.NoError(t, err)
+	_, err = reader.ListTargets()
+	assert.IsType(t, tufclient.ErrChecksumMismatch{}, err)
+	_, err = reader.WithoutCache().ListTargets()
+	assert.IsType(t, tufclient.ErrChecksumMismatch{}, err)
+}
+
+// CompactCache removes all but the most recent version-prefixed metadata files
+// for each role, but never the version currently trusted by the cache, and
+// leaves the unprefixed metadata alone.
+func TestCompactCache(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts, _, _ := simpleTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	metadataDir := filepath.Join(tempBaseDir, tufDir, filepath.FromSlash(gun), "metadata")
+	rootVersion := repo.tufRepo.Root.Signed.Version
+
+	for _, name := range []string{
+		fmt.Sprintf("%d.root.json", rootVersion),
+		fmt.Sprintf("%d.root.json", rootVersion+1),
+		fmt.Sprintf("%d.root.json", rootVersion+2),
+		fmt.Sprintf("%d.root.json", rootVersion+3),
+		"targets/1.a.json",
+		"targets/2.a.json",
+	} {
+		path := filepath.Join(metadataDir, filepath.FromSlash(name))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, ioutil.WriteFile(path, []byte("{}"), 0644))
+	}
+
+	_, err = repo.CompactCache(-1)
+	assert.Error(t, err)
+
+	removed, err := repo.CompactCache(1)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, removed)
+
+	for name, exists := range map[string]bool{
+		"root.json":                                true,
+		fmt.Sprintf("%d.root.json", rootVersion):   true,
+		fmt.Sprintf("%d.root.json", rootVersion+1): false,
+		fmt.Sprintf("%d.root.json", rootVersion+2): false,
+		fmt.Sprintf("%d.root.json", rootVersion+3): true,
+		"targets/1.a.json":                         false,
+		"targets/2.a.json":                         true,
+	} {
+		_, err := os.Stat(filepath.Join(metadataDir, filepath.FromSlash(name)))
+		assert.Equal(t, exists, err == nil, "unexpected state for %s", name)
+	}
+}
+
+// If neither the client nor the server has the snapshot key, Publish fails
+// with an ErrNoSnapshotKey error before uploading anything.
+// We test this with both an RSA and ECDSA root key
+func TestPublishNoOneHasSnapshotKey(t *testing.T) {
+	testPublishNoOneHasSnapshotKey(t, data.ECDSAKey)
+	if !testing.Short() {
+		testPublishNoOneHasSnapshotKey(t, data.RSAKey)
+	}
+}
+
+func testPublishNoOneHasSnapshotKey(t *testing.T, rootType string) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	// create repo and delete the snapshot key and metadata
+	repo, _ := initializeRepo(t, rootType, tempBaseDir, gun, ts.URL, false)
+	snapshotRole, ok := repo.tufRepo.Root.Signed.Roles[data.CanonicalSnapshotRole]
+	assert.True(t, ok)
+	for _, keyID := range snapshotRole.KeyIDs {
+		repo.CryptoService.RemoveKey(keyID)
+	}
+
+	// Publish something
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
+	err = repo.Publish()
+	assert.Error(t, err)
+	assert.IsType(t, ErrNoSnapshotKey{}, err)
+	assert.Equal(t, snapshotRole.KeyIDs, err.(ErrNoSnapshotKey).KeyIDs)
+
+	// nothing was uploaded
+	_, err = repo.ListTargets()
+	assert.Error(t, err)
+	assert.IsType(t, store.ErrMetaNotFound{}, err)
+
+	// rotating the snapshot key to the server fixes it
+	assert.NoError(t, repo.RotateKey(data.CanonicalSnapshotRole, true))
+	assert.NoError(t, repo.Publish())
+}
+
+// If the snapshot metadata is corrupt, whether the client or server has the
+// snapshot key, we can't publish.
+// We test this with both an RSA and ECDSA root key
+func TestPublishSnapshotCorrupt(t *testing.T) {
+	testPublishBadExistingSnapshot(t, data.ECDSAKey, true, true)
+	testPublishBadExistingSnapshot(t, data.ECDSAKey, false, true)
+}
+
+// If the snapshot metadata is unreadable, whether the client or server has the
+// snapshot key, we can't publish.
+// We test this with both an RSA and ECDSA root key
+func TestPublishSnapshotUnreadable(t *testing.T) {
+	testPublishBadExistingSnapshot(t, data.ECDSAKey, true, false)
+	testPublishBadExistingSnapshot(t, data.ECDSAKey, false, false)
+}
+
+func testPublishBadExistingSnapshot(t *testing.T, rootType string,
+	serverManagesSnapshot bool, readable bool) {
+
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(
+		t, rootType, tempBaseDir, gun, ts.URL, serverManagesSnapshot)
+
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
+
+	var expectedErrType interface{}
+	if readable {
+		// write a corrupt snapshots file
+		repo.fileStore.SetMeta(data.CanonicalSnapshotRole, []byte("this isn't JSON"))
+		expectedErrType = &regJson.SyntaxError{}
+	} else {
+		// create a directory instead of a file
+		path := fmt.Sprintf("%s.%s",
+			filepath.Join(tempBaseDir, tufDir, filepath.FromSlash(gun),
+				"metadata", data.CanonicalSnapshotRole), "json")
+		os.RemoveAll(path)
+		err := os.Mkdir(path, 0755)
+		defer os.RemoveAll(path)
+		assert.NoError(t, err)
+
+		expectedErrType = &os.PathError{}
+	}
+	err = repo.Publish()
+	assert.Error(t, err)
+	assert.IsType(t, ErrCorruptedCache{}, err)
+	assert.Equal(t, data.CanonicalSnapshotRole, err.(ErrCorruptedCache).Role)
+	assert.IsType(t, expectedErrType, err.(ErrCorruptedCache).Err)
+}
+
+type cannotCreateKeys struct {
+	signed.CryptoService
+}
+
+func (cs cannotCreateKeys) Create(_, _ string) (data.PublicKey, error) {
+	return nil, fmt.Errorf("Oh no I cannot create keys")
+}
+
+// If there is an error creating the local keys, no call is made to get a
+// remote key.
+func TestPublishSnapshotLocalKeysCreatedFirst(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	gun := "docker.com/notary"
+
+	requestMade := false
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(http.ResponseWriter, *http.Request) { requestMade = true }))
+	defer ts.Close()
+
+	repo, err := NewNotaryRepository(
+		tempBaseDir, gun, ts.URL, http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err, "error creating repo: %s", err)
+
+	cs := cryptoservice.NewCryptoService(gun,
+		trustmanager.NewKeyMemoryStore(passphraseRetriever))
+
+	rootPubKey, err := cs.Create(data.CanonicalRootRole, data.ECDSAKey)
+	assert.NoError(t, err, "error generating root key: %s", err)
+
+	repo.CryptoService = cannotCreateKeys{CryptoService: cs}
+
+	err = repo.Initialize(rootPubKey.ID(), data.CanonicalSnapshotRole)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Oh no I cannot create keys")
+	assert.False(t, requestMade)
+}
+
+// Rotate invalid roles, or attempt to delegate target signing to the server
+func TestRotateKeyInvalidRole(t *testing.T) {
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	defer os.RemoveAll(tempBaseDir)
+
+	gun := "docker.com/notary"
+	ts, _, _ := simpleTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+
+	// the equivalent of: (root, true), (root, false), (timestamp, true),
+	// (timestamp, false), (targets, true)
+	for role := range data.ValidRoles {
+		if role == data.CanonicalSnapshotRole {
+			continue
+		}
+		for _, serverManagesKey := range []bool{true, false} {
+			if role == data.CanonicalTargetsRole && !serverManagesKey {
+				continue
+			}
+			err = repo.RotateKey(role, serverManagesKey)
+			assert.Error(t, err,
+				"Rotating a %s key with server-managing the key as %v should fail",
+				role, serverManagesKey)
+		}
+	}
+}
+
+// Rotates the keys.  After the rotation, downloading the latest metadata
+// and assert that the keys have changed
+func assertRotationSuccessful(t *testing.T, repo *NotaryRepository,
+	keysToRotate map[string]bool) {
+
+	oldKeyIDs := make(map[string][]string)
+	for role := range keysToRotate {
+		keyIDs := repo.tufRepo.Root.Signed.Roles[role].KeyIDs
+		oldKeyIDs[role] = keyIDs
+	}
+
+	// Do rotation
+	for role, serverManaged := range keysToRotate {
+		assert.NoError(t, repo.RotateKey(role, serverManaged))
+	}
+
+	// Publish
+	err := repo.Publish()
+	assert.NoError(t, err)
+
+	// Get root.json. Check keys have changed.
+	_, err = repo.GetTargetByName("latest") // force a pull
+	assert.NoError(t, err)
+
+	for role, isRemoteKey := range keysToRotate {
+		keyIDs := repo.tufRepo.Root.Signed.Roles[role].KeyIDs
+		assert.Len(t, keyIDs, 1)
+
+		// the new key is not the same as any of the old keys, and the
+		// old keys have been removed not just from the TUF file, but
+		// from the cryptoservice
+		for _, oldKeyID := range oldKeyIDs[role] {
+			assert.NotEqual(t, oldKeyID, keyIDs[0])
+			_, _, err := repo.CryptoService.GetPrivateKey(oldKeyID)
+			assert.Error(t, err)
+		}
+
+		// the new key is present in the cryptoservice, or not present if remote
+		key, _, err := repo.CryptoService.GetPrivateKey(keyIDs[0])
+		if isRemoteKey {
+			assert.Error(t, err)
+			assert.Nil(t, key)
+		} else {
+			assert.NoError(t, err)
+			assert.NotNil(t, key)
+		}
+	}
+
+	// Confirm changelist dir empty after publishing changes
+	changes := getChanges(t, repo)
+	assert.Len(t, changes, 0, "wrong number of changelist files found")
+}
+
+// Initialize repo to have the server sign snapshots (remote snapshot key)
+// Without downloading a server-signed snapshot file, rotate keys so that
+//
+//	snapshots are locally signed (local snapshot key)
+//
+// Assert that we can publish.
+func TestRotateBeforePublishFromRemoteKeyToLocalKey(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, true)
+	// Adding a target will allow us to confirm the repository is still valid
+	// after rotating the keys.
+	addTarget(t, repo, "latest", "../fixtures/intermediate-ca.crt")
 	assertRotationSuccessful(t, repo, map[string]bool{
 		data.CanonicalTargetsRole:  false,
 		data.CanonicalSnapshotRole: false})
 }
 
-// Initialize a repo, locally signed snapshots
-// Publish some content (so that the server has a root.json), and download root.json
-// Rotate keys
-// Download the latest metadata and assert that the keys have changed.
-func TestRotateKeyAfterPublishNoServerManagementChange(t *testing.T) {
-	// rotate a single target key
-	testRotateKeySuccess(t, false, map[string]bool{data.CanonicalTargetsRole: false})
-	testRotateKeySuccess(t, false, map[string]bool{data.CanonicalSnapshotRole: false})
-	// rotate two at once before publishing
-	testRotateKeySuccess(t, false, map[string]bool{
-		data.CanonicalSnapshotRole: false,
-		data.CanonicalTargetsRole:  false})
+// Taking over signing the snapshot loads the snapshot to sign first, from the
+// cache if the server can't provide it, and fails without making a key if
+// it can't be read.
+func TestRotateSnapshotKeyToLocalLoadsSnapshot(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, true)
+	assert.NoError(t, repo.Publish())
+	_, err = repo.ListTargets()
+	assert.NoError(t, err)
+	numKeys := len(repo.CryptoService.ListKeys(data.CanonicalSnapshotRole))
+
+	// the server can't be reached, but the cached snapshot can be signed
+	ts.Close()
+	assert.NoError(t, repo.RotateKey(data.CanonicalSnapshotRole, false))
+	assert.NotNil(t, repo.tufRepo.Snapshot)
+	assert.Len(t, repo.CryptoService.ListKeys(data.CanonicalSnapshotRole), numKeys+1)
+	assert.NoError(t, repo.ClearChangelist())
+
+	// if the cached snapshot can't be read either, no key is made
+	assert.NoError(t, repo.fileStore.SetMeta(data.CanonicalSnapshotRole, []byte("{")))
+	for _, rotate := range []func() error{
+		func() error { return repo.RotateKey(data.CanonicalSnapshotRole, false) },
+		func() error { return repo.RotateKeys(map[string]bool{data.CanonicalSnapshotRole: false}) },
+	} {
+		err = rotate()
+		assert.IsType(t, ErrSnapshotUnavailable{}, err)
+		assert.IsType(t, ErrCorruptedCache{}, err.(ErrSnapshotUnavailable).Err)
+	}
+	assert.Len(t, repo.CryptoService.ListKeys(data.CanonicalSnapshotRole), numKeys+1)
+	assert.Empty(t, getChanges(t, repo))
+}
+
+// Initialize a repo, locally signed snapshots
+// Publish some content (so that the server has a root.json), and download root.json
+// Rotate keys
+// Download the latest metadata and assert that the keys have changed.
+func TestRotateKeyAfterPublishNoServerManagementChange(t *testing.T) {
+	// rotate a single target key
+	testRotateKeySuccess(t, false, map[string]bool{data.CanonicalTargetsRole: false})
+	testRotateKeySuccess(t, false, map[string]bool{data.CanonicalSnapshotRole: false})
+	// rotate two at once before publishing
+	testRotateKeySuccess(t, false, map[string]bool{
+		data.CanonicalSnapshotRole: false,
+		data.CanonicalTargetsRole:  false})
+}
+
+// Tests rotating keys when there's a change from locally managed keys to
+// remotely managed keys and vice versa
+// Before rotating, publish some content (so that the server has a root.json),
+// and download root.json
+func TestRotateKeyAfterPublishServerManagementChange(t *testing.T) {
+	// delegate snapshot key management to the server
+	testRotateKeySuccess(t, false, map[string]bool{
+		data.CanonicalSnapshotRole: true,
+		data.CanonicalTargetsRole:  false,
+	})
+	// reclaim snapshot key management from the server
+	testRotateKeySuccess(t, true, map[string]bool{
+		data.CanonicalSnapshotRole: false,
+		data.CanonicalTargetsRole:  false,
+	})
+}
+
+func testRotateKeySuccess(t *testing.T, serverManagesSnapshotInit bool,
+	keysToRotate map[string]bool) {
+
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL,
+		serverManagesSnapshotInit)
+
+	// Adding a target will allow us to confirm the repository is still valid after
+	// rotating the keys.
+	addTarget(t, repo, "latest", "../fixtures/intermediate-ca.crt")
+
+	// Publish
+	err = repo.Publish()
+	assert.NoError(t, err)
+
+	// Get root.json and capture targets + snapshot key IDs
+	repo.GetTargetByName("latest") // force a pull
+	assertRotationSuccessful(t, repo, keysToRotate)
+}
+
+// RotateKeys stages the rotations of several roles, which are published
+// together.
+func TestRotateKeys(t *testing.T) {
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	addTarget(t, repo, "latest", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+
+	oldKeyIDs := make(map[string][]string)
+	for _, role := range []string{data.CanonicalTargetsRole, data.CanonicalSnapshotRole} {
+		oldKeyIDs[role] = repo.tufRepo.Root.Signed.Roles[role].KeyIDs
+	}
+
+	assert.NoError(t, repo.RotateKeys(map[string]bool{
+		data.CanonicalTargetsRole:  false,
+		data.CanonicalSnapshotRole: true,
+	}))
+	assert.Len(t, getChanges(t, repo), 2)
+	assert.NoError(t, repo.Publish())
+
+	_, err = repo.GetTargetByName("latest") // force a pull
+	assert.NoError(t, err)
+	for role, keyIDs := range oldKeyIDs {
+		newKeyIDs := repo.tufRepo.Root.Signed.Roles[role].KeyIDs
+		assert.Len(t, newKeyIDs, 1)
+		assert.NotEqual(t, keyIDs, newKeyIDs, "the %s key was not rotated", role)
+	}
+}
+
+// If any of the rotations RotateKeys is given can't be made, none of them is
+// staged, and no keys are left behind.
+func TestRotateKeysFailure(t *testing.T) {
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts, _, _ := simpleTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	numKeys := len(repo.CryptoService.ListAllKeys())
+
+	err = repo.RotateKeys(map[string]bool{
+		data.CanonicalSnapshotRole:  false,
+		data.CanonicalTimestampRole: false,
+	})
+	assert.Error(t, err)
+	err = repo.RotateKeys(map[string]bool{
+		data.CanonicalSnapshotRole: false,
+		data.CanonicalTargetsRole:  true,
+	})
+	assert.IsType(t, ErrInvalidRemoteRole{}, err)
+	assert.Empty(t, getChanges(t, repo))
+	assert.Len(t, repo.CryptoService.ListAllKeys(), numKeys)
+
+	// the server can't provide a key
+	ts.Close()
+	err = repo.RotateKeys(map[string]bool{
+		data.CanonicalTargetsRole:  false,
+		data.CanonicalSnapshotRole: true,
+	})
+	assert.IsType(t, ErrRemoteKeyUnavailable{}, err)
+	assert.Empty(t, getChanges(t, repo))
+	assert.Len(t, repo.CryptoService.ListAllKeys(), numKeys)
+
+	// the second rotation can't be staged: the first is removed again, and
+	// the changes staged before are left as they were
+	fileChangelist, err := changelist.NewFileChangelist(filepath.Join(tempBaseDir, "changelist"))
+	assert.NoError(t, err)
+	assert.NoError(t, fileChangelist.Add(changelist.NewTufChange(changelist.ActionCreate,
+		data.CanonicalTargetsRole, changelist.TypeTargetsTarget, "v1", []byte("{}"))))
+	repo.ChangelistFactory = func(string) (changelist.Changelist, error) {
+		return &failingAddChangelist{FileChangelist: fileChangelist, failAt: 2}, nil
+	}
+	err = repo.RotateKeys(map[string]bool{
+		data.CanonicalTargetsRole:  false,
+		data.CanonicalSnapshotRole: false,
+	})
+	assert.Error(t, err)
+	changes := fileChangelist.List()
+	assert.Len(t, changes, 1)
+	assert.Equal(t, "v1", changes[0].Path())
+	assert.Len(t, repo.CryptoService.ListAllKeys(), numKeys)
+}
+
+// failingAddChangelist is a file changelist whose failAt-th Add fails
+type failingAddChangelist struct {
+	*changelist.FileChangelist
+	adds   int
+	failAt int
+}
+
+func (cl *failingAddChangelist) Add(c changelist.Change) error {
+	cl.adds++
+	if cl.adds == cl.failAt {
+		return fmt.Errorf("no space left on device")
+	}
+	return cl.FileChangelist.Add(c)
+}
+
+// If there is no local cache, notary operations return the remote error code
+func TestRemoteServerUnavailableNoLocalCache(t *testing.T) {
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	defer os.RemoveAll(tempBaseDir)
+
+	ts := errorTestServer(t, 500)
+	defer ts.Close()
+
+	repo, err := NewNotaryRepository(tempBaseDir, "docker.com/notary",
+		ts.URL, http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err, "error creating repo: %s", err)
+
+	_, err = repo.ListTargets()
+	assert.Error(t, err)
+	assert.IsType(t, store.ErrServerUnavailable{}, err)
+
+	_, err = repo.GetTargetByName("targetName")
+	assert.Error(t, err)
+	assert.IsType(t, store.ErrServerUnavailable{}, err)
+
+	err = repo.Publish()
+	assert.Error(t, err)
+	assert.IsType(t, store.ErrServerUnavailable{}, err)
+}
+
+// AddDelegation creates a valid changefile (rejects invalid delegation names,
+// but does not check the delegation hierarchy).  When applied, the change adds
+// a new delegation role with the correct keys.
+func TestAddDelegationChangefileValid(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts, _, _ := simpleTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	targetKeyIds := repo.CryptoService.ListKeys(data.CanonicalTargetsRole)
+	assert.NotEmpty(t, targetKeyIds)
+	targetPubKey := repo.CryptoService.GetKey(targetKeyIds[0])
+	assert.NotNil(t, targetPubKey)
+
+	err = repo.AddDelegation("root", 1, []data.PublicKey{targetPubKey})
+	assert.Error(t, err)
+	assert.IsType(t, data.ErrInvalidRole{}, err)
+	assert.Empty(t, getChanges(t, repo))
+
+	// to show that adding does not care about the hierarchy
+	err = repo.AddDelegation("targets/a/b/c", 1, []data.PublicKey{targetPubKey})
+	assert.NoError(t, err)
+
+	// ensure that the changefiles is correct
+	changes := getChanges(t, repo)
+	assert.Len(t, changes, 1)
+	assert.Equal(t, changelist.ActionCreate, changes[0].Action())
+	assert.Equal(t, "targets/a/b/c", changes[0].Scope())
+	assert.Equal(t, changelist.TypeTargetsDelegation, changes[0].Type())
+	assert.Equal(t, "", changes[0].Path())
+	assert.NotEmpty(t, changes[0].Content())
+}
+
+// The changefile produced by AddDelegation, when applied, actually adds
+// the delegation to the repo (assuming the delegation hierarchy is correct -
+// tests for change application validation are in helpers_test.go)
+func TestAddDelegationChangefileApplicable(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts, _, _ := simpleTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	targetKeyIds := repo.CryptoService.ListKeys(data.CanonicalTargetsRole)
+	assert.NotEmpty(t, targetKeyIds)
+	targetPubKey := repo.CryptoService.GetKey(targetKeyIds[0])
+	assert.NotNil(t, targetPubKey)
+
+	// this hierarchy has to be right to be applied
+	err = repo.AddDelegation("targets/a", 1, []data.PublicKey{targetPubKey})
+	assert.NoError(t, err)
+	changes := getChanges(t, repo)
+	assert.Len(t, changes, 1)
+
+	// ensure that it can be applied correctly
+	err = applyTargetsChange(repo.tufRepo, changes[0], logrus.StandardLogger())
+	assert.NoError(t, err)
+
+	targetRole := repo.tufRepo.Targets[data.CanonicalTargetsRole]
+	assert.Len(t, targetRole.Signed.Delegations.Roles, 1)
+	assert.Len(t, targetRole.Signed.Delegations.Keys, 1)
+
+	_, ok := targetRole.Signed.Delegations.Keys[targetPubKey.ID()]
+	assert.True(t, ok)
+
+	newDelegationRole := targetRole.Signed.Delegations.Roles[0]
+	assert.Len(t, newDelegationRole.KeyIDs, 1)
+	assert.Equal(t, targetPubKey.ID(), newDelegationRole.KeyIDs[0])
+	assert.Equal(t, "targets/a", newDelegationRole.Name)
+}
+
+// Delegations can be restricted to paths or to path hash prefixes, but not
+// both, and not to empty ones.
+func TestAddDelegationWithPaths(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, "docker.com/notary", ts.URL, false)
+	key, err := repo.CryptoService.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	keys := []data.PublicKey{key}
+
+	err = repo.AddDelegationWithPaths("targets/c", 1, keys, []string{"c/"}, []string{"ab"})
+	assert.IsType(t, data.ErrInvalidRole{}, err)
+	err = repo.AddDelegationWithPaths("targets/c", 1, keys, []string{"c/", ""}, nil)
+	assert.IsType(t, data.ErrInvalidRole{}, err)
+	err = repo.AddDelegationWithPaths("targets/c", 1, keys, nil, []string{""})
+	assert.IsType(t, data.ErrInvalidRole{}, err)
+	assert.Empty(t, getChanges(t, repo))
+
+	assert.NoError(t, repo.AddDelegationWithPaths("targets/a", 1, keys, []string{"a/", "b/"}, nil))
+	assert.NoError(t, repo.AddDelegationWithPaths("targets/b", 1, keys, nil, []string{"ab"}))
+	assert.NoError(t, repo.Publish())
+
+	roles, err := repo.GetDelegationRoles()
+	assert.NoError(t, err)
+	assert.Len(t, roles, 2)
+	for _, role := range roles {
+		switch role.Name {
+		case "targets/a":
+			assert.Equal(t, []string{"a/", "b/"}, role.Paths)
+			assert.Empty(t, role.PathHashPrefixes)
+		case "targets/b":
+			assert.Empty(t, role.Paths)
+			assert.Equal(t, []string{"ab"}, role.PathHashPrefixes)
+		default:
+			t.Fatalf("unexpected delegation %s", role.Name)
+		}
+	}
+
+	// adding hash prefixes to a delegation with paths fails when applied
+	assert.NoError(t, repo.AddDelegationWithPaths("targets/a", 1, keys, nil, []string{"ab"}))
+	assert.IsType(t, data.ErrInvalidRole{}, repo.Publish())
+}
+
+// TestAddDelegationErrorWritingChanges expects errors writing a change to file
+// to be propagated.
+func TestAddDelegationErrorWritingChanges(t *testing.T) {
+	testErrorWritingChangefiles(t, func(repo *NotaryRepository) error {
+		targetKeyIds := repo.CryptoService.ListKeys(data.CanonicalTargetsRole)
+		assert.NotEmpty(t, targetKeyIds)
+		targetPubKey := repo.CryptoService.GetKey(targetKeyIds[0])
+		assert.NotNil(t, targetPubKey)
+
+		return repo.AddDelegation("targets/a", 1, []data.PublicKey{targetPubKey})
+	})
+}
+
+// RemoveDelegation rejects attempts to remove invalidly-named delegations,
+// but otherwise does not validate the name of the delegation to remove.  This
+// test ensures that the changefile generated by RemoveDelegation is correct.
+func TestRemoveDelegationChangefileValid(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts, _, _ := simpleTestServer(t)
+	defer ts.Close()
+
+	repo, rootKeyID := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	rootPubKey := repo.CryptoService.GetKey(rootKeyID)
+	assert.NotNil(t, rootPubKey)
+
+	err = repo.RemoveDelegation("root")
+	assert.Error(t, err)
+	assert.IsType(t, data.ErrInvalidRole{}, err)
+	assert.Empty(t, getChanges(t, repo))
+
+	// to demonstrate that so long as the delegation name is valid, the
+	// existence of the delegation doesn't matter
+	assert.NoError(t, repo.RemoveDelegation("targets/a/b/c"))
+
+	// ensure that the changefile is correct
+	changes := getChanges(t, repo)
+	assert.Len(t, changes, 1)
+	assert.Equal(t, changelist.ActionDelete, changes[0].Action())
+	assert.Equal(t, "targets/a/b/c", changes[0].Scope())
+	assert.Equal(t, changelist.TypeTargetsDelegation, changes[0].Type())
+	assert.Equal(t, "", changes[0].Path())
+	assert.Empty(t, changes[0].Content())
+}
+
+// The changefile produced by RemoveDelegation, when applied, actually removes
+// the delegation from the repo (assuming the repo exists - tests for
+// change application validation are in helpers_test.go)
+func TestRemoveDelegationChangefileApplicable(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts, _, _ := simpleTestServer(t)
+	defer ts.Close()
+
+	repo, rootKeyID := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	rootPubKey := repo.CryptoService.GetKey(rootKeyID)
+	assert.NotNil(t, rootPubKey)
+
+	// add a delegation first so it can be removed
+	assert.NoError(t, repo.AddDelegation("targets/a", 1, []data.PublicKey{rootPubKey}))
+	changes := getChanges(t, repo)
+	assert.Len(t, changes, 1)
+	assert.NoError(t, applyTargetsChange(repo.tufRepo, changes[0], logrus.StandardLogger()))
+
+	targetRole := repo.tufRepo.Targets[data.CanonicalTargetsRole]
+	assert.Len(t, targetRole.Signed.Delegations.Roles, 1)
+	assert.Len(t, targetRole.Signed.Delegations.Keys, 1)
+
+	// now remove it
+	assert.NoError(t, repo.RemoveDelegation("targets/a"))
+	changes = getChanges(t, repo)
+	assert.Len(t, changes, 2)
+	assert.NoError(t, applyTargetsChange(repo.tufRepo, changes[1], logrus.StandardLogger()))
+
+	targetRole = repo.tufRepo.Targets[data.CanonicalTargetsRole]
+	assert.Empty(t, targetRole.Signed.Delegations.Roles)
+	assert.Empty(t, targetRole.Signed.Delegations.Keys)
+}
+
+// TestRemoveDelegationErrorWritingChanges expects errors writing a change to
+// file to be propagated.
+func TestRemoveDelegationErrorWritingChanges(t *testing.T) {
+	testErrorWritingChangefiles(t, func(repo *NotaryRepository) error {
+		return repo.RemoveDelegation("targets/a")
+	})
+}
+
+// A repository required to have a particular snapshot checksum can be updated
+// only if the snapshot it gets has that checksum.
+func TestRequireSnapshotChecksum(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+
+	_, err = repo.ListTargets()
+	assert.NoError(t, err)
+	checksum := hex.EncodeToString(
+		repo.tufRepo.Timestamp.Signed.Meta[data.CanonicalSnapshotRole].Hashes["sha256"])
+
+	repo.RequireSnapshotChecksum(strings.ToUpper(checksum))
+	targets, err := repo.ListTargets()
+	assert.NoError(t, err)
+	assert.Len(t, targets, 1)
+
+	wrong := strings.Repeat("0", len(checksum))
+	repo.RequireSnapshotChecksum(wrong)
+	_, err = repo.ListTargets()
+	assert.Error(t, err)
+	assert.IsType(t, ErrSnapshotChecksumMismatch{}, err)
+	assert.Equal(t, wrong, err.(ErrSnapshotChecksumMismatch).Expected)
+	assert.Equal(t, checksum, err.(ErrSnapshotChecksumMismatch).Actual)
+
+	addTarget(t, repo, "v2", "../fixtures/intermediate-ca.crt")
+	assert.IsType(t, ErrSnapshotChecksumMismatch{}, repo.Publish())
+
+	repo.RequireSnapshotChecksum("")
+	_, err = repo.ListTargets()
+	assert.NoError(t, err)
+}
+
+// A repository's root verifies against a log only if the root's checksum is
+// the latest entry in the log.
+func TestVerifyRootAgainstLog(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	assert.NoError(t, repo.Publish())
+
+	remote, err := getRemoteStore(ts.URL, gun, http.DefaultTransport)
+	assert.NoError(t, err)
+	rootJSON, err := remote.GetMeta(data.CanonicalRootRole, maxSize)
+	assert.NoError(t, err)
+	rootChecksum := sha256.Sum256(rootJSON)
+	checksum := hex.EncodeToString(rootChecksum[:])
+	other := strings.Repeat("0", len(checksum))
+
+	logs := map[string][]string{gun: {other, strings.ToUpper(checksum)}}
+	lookup := func(gun string) ([]string, error) {
+		return logs[gun], nil
+	}
+	assert.NoError(t, repo.VerifyRootAgainstLog(lookup))
+
+	// the root is logged, but isn't the latest entry
+	logs[gun] = []string{checksum, other}
+	err = repo.VerifyRootAgainstLog(lookup)
+	assert.IsType(t, ErrRootNotInLog{}, err)
+	assert.Equal(t, checksum, err.(ErrRootNotInLog).Checksum)
+
+	// nothing has been logged for this GUN
+	delete(logs, gun)
+	assert.IsType(t, ErrRootNotInLog{}, repo.VerifyRootAgainstLog(lookup))
+
+	// errors looking up the log are returned as is
+	lookupErr := fmt.Errorf("log unavailable")
+	assert.Equal(t, lookupErr, repo.VerifyRootAgainstLog(
+		func(string) ([]string, error) { return nil, lookupErr }))
+
+	// a repository that has never seen the root doesn't trust its certificate
+	// if the log rejects it, and only trusts it once the log accepts it
+	tempBaseDir2, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir2)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	repo2, err := NewNotaryRepository(tempBaseDir2, gun, ts.URL,
+		http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err)
+
+	assert.IsType(t, ErrRootNotInLog{}, repo2.VerifyRootAgainstLog(lookup))
+	assert.Empty(t, repo2.CertManager.TrustedCertificateStore().GetCertificates())
+
+	logs[gun] = []string{checksum}
+	assert.NoError(t, repo2.VerifyRootAgainstLog(lookup))
+	assert.Len(t, repo2.CertManager.TrustedCertificateStore().GetCertificates(), 1)
+}
+
+// A repository with a ChangelistFactory stages its changes in the changelist
+// the factory returns instead of the changelist directory, and publishes and
+// clears them from there.
+func TestChangelistFactory(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+
+	memChangelist := changelist.NewMemChangelist()
+	repo.ChangelistFactory = func(clGUN string) (changelist.Changelist, error) {
+		assert.Equal(t, gun, clGUN)
+		return memChangelist, nil
+	}
+
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
+	addTarget(t, repo, "v2", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.RemoveTarget("v2"))
+	assert.Len(t, memChangelist.List(), 3)
+
+	fileChangelist, err := changelist.NewFileChangelist(
+		filepath.Join(repo.tufRepoPath, "changelist"))
+	assert.NoError(t, err)
+	assert.Empty(t, fileChangelist.List())
+
+	assert.NoError(t, repo.Publish())
+	assert.Empty(t, memChangelist.List())
+
+	targets, err := repo.ListTargets()
+	assert.NoError(t, err)
+	assert.Len(t, targets, 1)
+	assert.Equal(t, "v1", targets[0].Name)
+}
+
+// A repository initialized with a CA-issued certificate for its root key uses
+// that certificate in its root, and trusts it, but refuses certificates for
+// another key or another GUN.
+func TestInitializeWithCertificate(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	caKey, err := trustmanager.GenerateECDSAKey(rand.Reader)
+	assert.NoError(t, err)
+	startTime := time.Now()
+	caTemplate, err := trustmanager.NewCertificate("CA", startTime, startTime.AddDate(1, 0, 0))
+	assert.NoError(t, err)
+	caTemplate.IsCA = true
+	caTemplate.KeyUsage |= x509.KeyUsageCertSign
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate,
+		caKey.CryptoSigner().Public(), caKey.CryptoSigner())
+	assert.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	assert.NoError(t, err)
+
+	issue := func(cn string, pubKey crypto.PublicKey, tweaks ...func(*x509.Certificate)) *x509.Certificate {
+		template, err := trustmanager.NewCertificate(cn, startTime, startTime.AddDate(1, 0, 0))
+		assert.NoError(t, err)
+		for _, tweak := range tweaks {
+			tweak(template)
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, pubKey,
+			caKey.CryptoSigner())
+		assert.NoError(t, err)
+		cert, err := x509.ParseCertificate(der)
+		assert.NoError(t, err)
+		return cert
+	}
+
+	repo, rootKeyID := createRepoAndKey(t, data.ECDSAKey, tempBaseDir, gun, ts.URL)
+	rootKey, _, err := repo.CryptoService.GetPrivateKey(rootKeyID)
+	assert.NoError(t, err)
+
+	err = repo.InitializeWithCertificate(rootKeyID, issue(gun, caKey.CryptoSigner().Public()))
+	assert.IsType(t, ErrInvalidRootCert{}, err)
+	err = repo.InitializeWithCertificate(rootKeyID,
+		issue("docker.com/other", rootKey.CryptoSigner().Public()))
+	assert.IsType(t, ErrInvalidRootCert{}, err)
+	assert.IsType(t, ErrInvalidRootCert{}, repo.InitializeWithCertificate(rootKeyID, nil))
+	// certificates the CertManager wouldn't accept when validating the root
+	err = repo.InitializeWithCertificate(rootKeyID,
+		issue(gun, rootKey.CryptoSigner().Public(), func(c *x509.Certificate) {
+			c.NotBefore = startTime.AddDate(-1, 0, 0)
+			c.NotAfter = startTime.Add(-time.Hour)
+		}))
+	assert.IsType(t, ErrInvalidRootCert{}, err)
+	err = repo.InitializeWithCertificate(rootKeyID,
+		issue(gun, rootKey.CryptoSigner().Public(), func(c *x509.Certificate) {
+			c.SignatureAlgorithm = x509.ECDSAWithSHA1
+		}))
+	assert.IsType(t, ErrInvalidRootCert{}, err)
+
+	rootCert := issue(gun, rootKey.CryptoSigner().Public())
+	assert.NoError(t, repo.InitializeWithCertificate(rootKeyID, rootCert))
+
+	rootRole := repo.tufRepo.Root.Signed.Roles[data.CanonicalRootRole]
+	assert.Len(t, rootRole.KeyIDs, 1)
+	rootPubKey := repo.tufRepo.Root.Signed.Keys[rootRole.KeyIDs[0]]
+	assert.Equal(t, trustmanager.CertToPEM(rootCert), rootPubKey.Public())
+	assert.Equal(t, []*x509.Certificate{rootCert},
+		repo.CertManager.TrustedCertificateStore().GetCertificates())
+
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+	targets, err := repo.ListTargets()
+	assert.NoError(t, err)
+	assert.Len(t, targets, 1)
+}
+
+// A repository's snapshot is consistent with its timestamp after publishing.
+func TestVerifySnapshotConsistency(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+
+	assert.NoError(t, repo.VerifySnapshotConsistency())
+}
+
+// A repository initialized with several root keys and a threshold lists all of
+// them in its root, and can only re-sign its root while enough of them are
+// available.
+func TestInitializeWithRootKeys(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, firstKeyID := createRepoAndKey(t, data.ECDSAKey, tempBaseDir, gun, ts.URL)
+	rootKeyIDs := []string{firstKeyID}
+	for i := 0; i < 2; i++ {
+		rootPubKey, err := repo.CryptoService.Create(data.CanonicalRootRole, data.ECDSAKey)
+		assert.NoError(t, err)
+		rootKeyIDs = append(rootKeyIDs, rootPubKey.ID())
+	}
+
+	for _, threshold := range []int{0, 4} {
+		err = repo.InitializeWithRootKeys(rootKeyIDs, threshold)
+		assert.IsType(t, data.ErrInvalidRole{}, err)
+	}
+	assert.NoError(t, repo.InitializeWithRootKeys(rootKeyIDs, 2))
+
+	rootRole := repo.tufRepo.Root.Signed.Roles[data.CanonicalRootRole]
+	assert.Len(t, rootRole.KeyIDs, 3)
+	assert.Equal(t, 2, rootRole.Threshold)
+	assert.Len(t, repo.tufRepo.Root.Signatures, 3)
+	assert.Len(t, repo.CertManager.TrustedCertificateStore().GetCertificates(), 3)
+
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+
+	tempBaseDir2, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir2)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	repo2, err := NewNotaryRepository(tempBaseDir2, gun, ts.URL,
+		http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err)
+	targets, err := repo2.ListTargets()
+	assert.NoError(t, err)
+	assert.Len(t, targets, 1)
+
+	// rotating a key changes the root, which still has two signing keys
+	assert.NoError(t, repo.CryptoService.RemoveKey(rootKeyIDs[0]))
+	assert.NoError(t, repo.RotateKey(data.CanonicalTargetsRole, false))
+	assert.NoError(t, repo.Publish())
+
+	// but not after losing another one
+	assert.NoError(t, repo.CryptoService.RemoveKey(rootKeyIDs[1]))
+	assert.NoError(t, repo.RotateKey(data.CanonicalTargetsRole, false))
+	assert.IsType(t, signed.ErrInsufficientSignatures{}, repo.Publish())
+}
+
+// Publishing a repository that isn't on the server yet, and whose cached root
+// or targets metadata is corrupt, reports which metadata file is corrupt.
+func TestPublishCorruptedCache(t *testing.T) {
+	for _, role := range []string{data.CanonicalRootRole, data.CanonicalTargetsRole} {
+		// Temporary directory where test files will be created
+		tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+		defer os.RemoveAll(tempBaseDir)
+		assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+		gun := "docker.com/notary"
+		ts := fullTestServer(t)
+		defer ts.Close()
+
+		repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+
+		path := filepath.Join(repo.tufRepoPath, "metadata", role+".json")
+		assert.NoError(t, ioutil.WriteFile(path, []byte("{corrupt"), 0600))
+
+		err = repo.Publish()
+		assert.IsType(t, ErrCorruptedCache{}, err)
+		assert.Equal(t, role, err.(ErrCorruptedCache).Role)
+		assert.Equal(t, path, err.(ErrCorruptedCache).Path)
+	}
+}
+
+// RemoteMetaVersion returns the version of the verified metadata the server
+// has for a base role, which increases as the repository is published.
+func TestRemoteMetaVersion(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+
+	firstVersions := make(map[string]int)
+	for _, role := range []string{data.CanonicalRootRole, data.CanonicalTargetsRole,
+		data.CanonicalSnapshotRole, data.CanonicalTimestampRole} {
+		version, err := repo.RemoteMetaVersion(role)
+		assert.NoError(t, err)
+		assert.True(t, version > 0, "%s has no version", role)
+		firstVersions[role] = version
+	}
+
+	addTarget(t, repo, "v2", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+
+	for _, role := range []string{data.CanonicalTargetsRole, data.CanonicalSnapshotRole,
+		data.CanonicalTimestampRole} {
+		version, err := repo.RemoteMetaVersion(role)
+		assert.NoError(t, err)
+		assert.True(t, version > firstVersions[role], "%s was not updated", role)
+	}
+
+	_, err = repo.RemoteMetaVersion("targets/a")
+	assert.IsType(t, data.ErrInvalidRole{}, err)
+}
+
+// Changing the passphrase of a root or a signing key re-encrypts it so that
+// only the new passphrase decrypts it, and the key stays the same.
+func TestChangeKeyPassphrase(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, rootKeyID := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	targetsKeyIDs := repo.CryptoService.ListKeys(data.CanonicalTargetsRole)
+	assert.Len(t, targetsKeyIDs, 1)
+
+	changeRetriever := func(keyID, alias string, createNew bool, numAttempts int) (string, bool, error) {
+		if createNew {
+			return "new passphrase", false, nil
+		}
+		return "passphrase", false, nil
+	}
+	changingRepo, err := NewNotaryRepository(
+		tempBaseDir, gun, ts.URL, http.DefaultTransport, changeRetriever)
+	assert.NoError(t, err)
+
+	for _, keyID := range []string{rootKeyID, targetsKeyIDs[0]} {
+		oldKey, _, err := repo.CryptoService.GetPrivateKey(keyID)
+		assert.NoError(t, err)
+
+		assert.NoError(t, changingRepo.ChangeKeyPassphrase(keyID))
+
+		newRepo, err := NewNotaryRepository(tempBaseDir, gun, ts.URL,
+			http.DefaultTransport, passphrase.ConstantRetriever("new passphrase"))
+		assert.NoError(t, err)
+		newKey, _, err := newRepo.CryptoService.GetPrivateKey(keyID)
+		assert.NoError(t, err)
+		assert.Equal(t, oldKey.Private(), newKey.Private())
+
+		oldRepo, err := NewNotaryRepository(tempBaseDir, gun, ts.URL,
+			http.DefaultTransport, passphrase.ConstantRetriever("passphrase"))
+		assert.NoError(t, err)
+		_, _, err = oldRepo.CryptoService.GetPrivateKey(keyID)
+		assert.IsType(t, trustmanager.ErrAttemptsExceeded{}, err)
+	}
+
+	// the current passphrase is needed to change it
+	err = changingRepo.ChangeKeyPassphrase(rootKeyID)
+	assert.IsType(t, trustmanager.ErrAttemptsExceeded{}, err)
+
+	err = changingRepo.ChangeKeyPassphrase("not-a-key")
+	assert.IsType(t, &trustmanager.ErrKeyNotFound{}, err)
+}
+
+// Pruning the cache removes only the metadata that isn't referenced by the
+// cached snapshot, and does nothing when there is none.
+func TestPruneCache(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+	_, err = repo.ListTargets()
+	assert.NoError(t, err)
+
+	removed, err := repo.PruneCache()
+	assert.NoError(t, err)
+	assert.Empty(t, removed)
+
+	metadataDir := filepath.Join(tempBaseDir, tufDir, filepath.FromSlash(gun), "metadata")
+	assert.NoError(t, os.MkdirAll(filepath.Join(metadataDir, "targets"), 0700))
+	for _, role := range []string{"targets/deleted", "stale"} {
+		assert.NoError(t, repo.fileStore.SetMeta(role, []byte("{}")))
+	}
+
+	removed, err = repo.PruneCache()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"stale", "targets/deleted"}, removed)
+
+	for _, role := range []string{data.CanonicalRootRole, data.CanonicalTargetsRole,
+		data.CanonicalSnapshotRole, data.CanonicalTimestampRole} {
+		_, err := repo.fileStore.GetMeta(role, maxSize)
+		assert.NoError(t, err, "%s metadata was removed", role)
+	}
+	_, err = repo.fileStore.GetMeta("stale", maxSize)
+	assert.IsType(t, store.ErrMetaNotFound{}, err)
+
+	removed, err = repo.PruneCache()
+	assert.NoError(t, err)
+	assert.Empty(t, removed)
+}
+
+// The snapshot is signed locally when the snapshot key in the root is held
+// locally, and not when the server manages it.
+func TestSnapshotSignedLocally(t *testing.T) {
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	for _, serverManagesSnapshot := range []bool{false, true} {
+		// Temporary directory where test files will be created
+		tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+		defer os.RemoveAll(tempBaseDir)
+		assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+		gun := fmt.Sprintf("docker.com/notary/%v", serverManagesSnapshot)
+		repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL,
+			serverManagesSnapshot)
+		assert.NoError(t, repo.Publish())
+
+		signedLocally, err := repo.SnapshotSignedLocally()
+		assert.NoError(t, err)
+		assert.Equal(t, !serverManagesSnapshot, signedLocally)
+	}
+
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	// without the private key, the snapshot can't be signed locally
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, "docker.com/notary", ts.URL, false)
+	assert.NoError(t, repo.Publish())
+	snapshotKeyIDs := repo.CryptoService.ListKeys(data.CanonicalSnapshotRole)
+	assert.Len(t, snapshotKeyIDs, 1)
+	assert.NoError(t, repo.CryptoService.RemoveKey(snapshotKeyIDs[0]))
+
+	signedLocally, err := repo.SnapshotSignedLocally()
+	assert.NoError(t, err)
+	assert.False(t, signedLocally)
+}
+
+// A collaborator who only has the key of a delegated role can publish targets
+// to it, without the base targets key, and those targets are then found in the
+// delegated role.  Changes to the base targets role still need its key.
+func TestPublishDelegatedTargetsWithoutTargetsKey(t *testing.T) {
+	ts := fullTestServer(t)
+	defer ts.Close()
+	gun := "docker.com/notary"
+
+	// Temporary directories where test files will be created
+	ownerDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(ownerDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	delegateDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(delegateDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	// the server signs the snapshot, since the delegate has no snapshot key
+	owner, _ := initializeRepo(t, data.ECDSAKey, ownerDir, gun, ts.URL, true)
+
+	delegate, err := NewNotaryRepository(
+		delegateDir, gun, ts.URL, http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err)
+	delegateKey, err := delegate.CryptoService.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.NoError(t, err)
+
+	// the owner delegates every path to the delegate, and publishes, without
+	// being able to sign the new delegated role
+	tdJSON, err := json.Marshal(&changelist.TufDelegation{
+		NewThreshold: 1,
+		AddKeys:      data.KeyList{delegateKey},
+		AddPaths:     []string{""},
+	})
+	assert.NoError(t, err)
+	cl, err := owner.GetChangelist()
+	assert.NoError(t, err)
+	assert.NoError(t, cl.Add(changelist.NewTufChange(changelist.ActionCreate,
+		"targets/releases", changelist.TypeTargetsDelegation, "", tdJSON)))
+	assert.NoError(t, owner.Publish())
+
+	addTarget(t, delegate, "v1", "../fixtures/intermediate-ca.crt", "targets/releases")
+	assert.NoError(t, delegate.Publish())
+	assert.Empty(t, getChanges(t, delegate))
+
+	// only the delegated role was signed, by the delegate
+	releases, ok := delegate.tufRepo.Targets["targets/releases"]
+	assert.True(t, ok)
+	_, ok = releases.Signed.Targets["v1"]
+	assert.True(t, ok)
+	assert.Len(t, releases.Signatures, 1)
+	assert.Equal(t, delegateKey.ID(), releases.Signatures[0].KeyID)
+	assert.False(t, delegate.tufRepo.Targets[data.CanonicalTargetsRole].Dirty)
+
+	// and the owner can see the delegate's target
+	targets, err := owner.ListTargetsByPrefix("", "targets/releases")
+	assert.NoError(t, err)
+	assert.Len(t, targets, 1)
+	if len(targets) == 1 {
+		assert.Equal(t, "v1", targets[0].Name)
+	}
+
+	addTarget(t, delegate, "v2", "../fixtures/intermediate-ca.crt")
+	err = delegate.Publish()
+	assert.Error(t, err)
+	assert.IsType(t, signed.ErrNoKeys{}, err)
+}
+
+// GetDelegationRoles returns the delegations of the published repository
+func TestGetDelegationRoles(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	assert.NoError(t, repo.Publish())
+
+	roles, err := repo.GetDelegationRoles()
+	assert.NoError(t, err)
+	assert.Empty(t, roles)
+
+	key, err := repo.CryptoService.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	assert.NoError(t, repo.AddDelegation("targets/a", 1, []data.PublicKey{key}))
+	assert.NoError(t, repo.Publish())
+
+	roles, err = repo.GetDelegationRoles()
+	assert.NoError(t, err)
+	assert.Len(t, roles, 1)
+	assert.Equal(t, "targets/a", roles[0].Name)
+	assert.Equal(t, []string{key.ID()}, roles[0].KeyIDs)
+}
+
+// PrefetchDelegations caches the metadata of every delegation, so that looking
+// up targets signed by them doesn't download any more of it.
+func TestPrefetchDelegations(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	var delegationRequests int
+	countingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/targets/") {
+			delegationRequests++
+		}
+		ts.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer countingServer.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	key, err := repo.CryptoService.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	addDelegationWithPaths(t, repo, "targets/a", key)
+	addDelegationWithPaths(t, repo, "targets/a/b", key)
+	addTarget(t, repo, "deep", "../fixtures/intermediate-ca.crt", "targets/a/b")
+	assert.NoError(t, repo.Publish())
+
+	tempBaseDir2, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir2)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	otherRepo, err := NewNotaryRepository(
+		tempBaseDir2, gun, countingServer.URL, http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err)
+
+	assert.NoError(t, otherRepo.PrefetchDelegations())
+	assert.Equal(t, 2, delegationRequests)
+	for _, role := range []string{"targets/a", "targets/a/b"} {
+		_, err := otherRepo.fileStore.GetMeta(role, maxSize)
+		assert.NoError(t, err, "%s was not cached", role)
+	}
+
+	target, err := otherRepo.GetTargetByName("deep")
+	assert.NoError(t, err)
+	assert.Equal(t, "deep", target.Name)
+	assert.Equal(t, 2, delegationRequests)
+}
+
+// RenewDelegations stages the renewal of the expiring delegations it has the
+// keys for, which Publish then re-signs and uploads.
+func TestRenewDelegationsPublishes(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	key, err := repo.CryptoService.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	assert.NoError(t, repo.AddDelegation("targets/a", 1, []data.PublicKey{key}))
+	assert.NoError(t, repo.Publish())
+
+	// nothing expires within the hour
+	renewed, err := repo.RenewDelegations(time.Hour)
+	assert.NoError(t, err)
+	assert.Empty(t, renewed)
+	assert.Empty(t, getChanges(t, repo))
+
+	// but everything expires within 10 years
+	renewed, err = repo.RenewDelegations(10 * 365 * 24 * time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"targets/a"}, renewed)
+	changes := getChanges(t, repo)
+	assert.Len(t, changes, 1)
+	assert.Equal(t, changelist.TypeTargetsRenew, changes[0].Type())
+	assert.Equal(t, "targets/a", changes[0].Scope())
+
+	assert.NoError(t, repo.Publish())
+	assert.Empty(t, getChanges(t, repo))
+
+	// another client downloads the renewed role from the server
+	tempBaseDir2, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir2)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	repo2, err := NewNotaryRepository(tempBaseDir2, gun, ts.URL,
+		http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err)
+	_, err = repo2.GetDelegationRoles()
+	assert.NoError(t, err)
+	renewedTargets, ok := repo2.tufRepo.Targets["targets/a"]
+	assert.True(t, ok)
+	if ok {
+		assert.Equal(t, 2, renewedTargets.Signed.Version)
+	}
+}
+
+// RotateDelegationKey replaces the keys of a delegation with a new one, which
+// can then sign the delegation's targets, and refuses to rotate delegations
+// it has no record of unless forced.
+func TestRotateDelegationKey(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	oldKey, err := repo.CryptoService.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	addDelegationWithPaths(t, repo, "targets/a", oldKey)
+	assert.NoError(t, repo.Publish())
+
+	_, err = repo.RotateDelegationKey("nope", false)
+	assert.Error(t, err)
+	assert.IsType(t, data.ErrInvalidRole{}, err)
+
+	_, err = repo.RotateDelegationKey("targets/b", false)
+	assert.Error(t, err)
+	assert.IsType(t, data.ErrNoSuchRole{}, err)
+	assert.Empty(t, getChanges(t, repo))
+
+	newKey, err := repo.RotateDelegationKey("targets/a", false)
+	assert.NoError(t, err)
+	assert.NotEqual(t, oldKey.ID(), newKey.ID())
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt", "targets/a")
+	assert.NoError(t, repo.Publish())
+
+	roles, err := repo.GetDelegationRoles()
+	assert.NoError(t, err)
+	assert.Len(t, roles, 1)
+	assert.Equal(t, []string{newKey.ID()}, roles[0].KeyIDs)
+
+	targets, err := repo.ListTargetsByPrefix("", "targets/a")
+	assert.NoError(t, err)
+	assert.Len(t, targets, 1)
+
+	// forcing stages the rotation of a delegation with no local record
+	_, err = repo.RotateDelegationKey("targets/b", true)
+	assert.NoError(t, err)
+	changes := getChanges(t, repo)
+	assert.Len(t, changes, 1)
+	assert.Equal(t, "targets/b", changes[0].Scope())
+}
+
+// GenerateDelegationKey creates a key that can sign for the delegation it is
+// added to.
+func TestGenerateDelegationKey(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, "docker.com/notary", ts.URL, false)
+
+	_, err = repo.GenerateDelegationKey("nope")
+	assert.Error(t, err)
+	assert.IsType(t, data.ErrInvalidRole{}, err)
+
+	pubKey, err := repo.GenerateDelegationKey("targets/a")
+	assert.NoError(t, err)
+	assert.Equal(t, data.ECDSAKey, pubKey.Algorithm())
+	_, role, err := repo.CryptoService.GetPrivateKey(pubKey.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, data.CanonicalTargetsRole, role)
+
+	assert.NoError(t, repo.AddDelegationWithPaths("targets/a", 1, []data.PublicKey{pubKey},
+		[]string{"a/"}, nil))
+	addTarget(t, repo, "a/v1", "../fixtures/intermediate-ca.crt", "targets/a")
+	assert.NoError(t, repo.Publish())
+
+	targets, err := repo.ListTargetsByPrefix("", "targets/a")
+	assert.NoError(t, err)
+	assert.Len(t, targets, 1)
+}
+
+// A repository whose keys are in a KMS can be initialized, have its keys
+// rotated and be published like any other.
+func TestKMSCryptoService(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	kms := make(map[string]data.PrivateKey)
+	cs := cryptoservice.NewKMSCryptoService(gun,
+		func(keyID string, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+			return kms[keyID].CryptoSigner().Sign(rand.Reader, digest, opts)
+		})
+	cs.Provision = func(role, algorithm string) (data.PublicKey, error) {
+		privKey, err := trustmanager.GenerateECDSAKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		kms[privKey.ID()] = privKey
+		return data.PublicKeyFromPrivate(privKey), nil
+	}
+
+	repo, err := NewNotaryRepository(tempBaseDir, gun, ts.URL, http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err)
+	repo.CryptoService = cs
+	rootPubKey, err := cs.Create(data.CanonicalRootRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	assert.NoError(t, repo.Initialize(rootPubKey.ID()))
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+
+	assert.NoError(t, repo.RotateKey(data.CanonicalTargetsRole, false))
+	addTarget(t, repo, "v2", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+
+	// none of the keys were stored on disk
+	filepath.Walk(filepath.Join(tempBaseDir, "private"), func(path string, fi os.FileInfo, err error) error {
+		assert.False(t, err == nil && !fi.IsDir(), "key file %s was written", path)
+		return nil
+	})
+
+	tempBaseDir2, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir2)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	reader, err := NewNotaryRepository(tempBaseDir2, gun, ts.URL, http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err)
+	targets, err := reader.ListTargets()
+	assert.NoError(t, err)
+	assert.Len(t, targets, 2)
+}
+
+// GetAllTargetMetadataByName returns the target from every role that signs
+// it, in order of priority, and fails for a target no role signs.
+func TestGetAllTargetMetadataByName(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	key, err := repo.CryptoService.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	addDelegationWithPaths(t, repo, "targets/a", key)
+	addDelegationWithPaths(t, repo, "targets/b", key)
+	baseTarget := addTarget(t, repo, "latest", "../fixtures/intermediate-ca.crt")
+	delegatedTarget := addTarget(t, repo, "latest", "../fixtures/root-ca.crt", "targets/b")
+	addTarget(t, repo, "other", "../fixtures/root-ca.crt", "targets/a")
+	assert.NoError(t, repo.Publish())
+
+	targets, err := repo.GetAllTargetMetadataByName("latest")
+	assert.NoError(t, err)
+	assert.Equal(t, []TargetWithRole{
+		{Target: *baseTarget, Role: data.CanonicalTargetsRole},
+		{Target: *delegatedTarget, Role: "targets/b"},
+	}, targets)
+
+	_, err = repo.GetAllTargetMetadataByName("nope")
+	assert.Error(t, err)
+}
+
+// FindTargetsByHash returns every target with the hash in the given roles, by
+// role and then by name
+func TestFindTargetsByHash(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	key, err := repo.CryptoService.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	addDelegationWithPaths(t, repo, "targets/a", key)
+	latest := addTarget(t, repo, "latest", "../fixtures/intermediate-ca.crt")
+	current := addTarget(t, repo, "current", "../fixtures/intermediate-ca.crt")
+	addTarget(t, repo, "other", "../fixtures/root-ca.crt")
+	delegated := addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt", "targets/a")
+	assert.NoError(t, repo.Publish())
+
+	hash := latest.Hashes["sha256"]
+	targets, err := repo.FindTargetsByHash("sha256", hash)
+	assert.NoError(t, err)
+	assert.Equal(t, []TargetWithRole{
+		{Target: *current, Role: data.CanonicalTargetsRole},
+		{Target: *latest, Role: data.CanonicalTargetsRole},
+	}, targets)
+
+	targets, err = repo.FindTargetsByHash("sha256", hash, "targets/a", data.CanonicalTargetsRole)
+	assert.NoError(t, err)
+	assert.Equal(t, []TargetWithRole{
+		{Target: *delegated, Role: "targets/a"},
+		{Target: *current, Role: data.CanonicalTargetsRole},
+		{Target: *latest, Role: data.CanonicalTargetsRole},
+	}, targets)
+
+	// no target has the hash of another algorithm, or an unknown hash
+	targets, err = repo.FindTargetsByHash("sha512", hash)
+	assert.NoError(t, err)
+	assert.Empty(t, targets)
+	targets, err = repo.FindTargetsByHash("sha256", []byte("nope"))
+	assert.NoError(t, err)
+	assert.Empty(t, targets)
+
+	_, err = repo.FindTargetsByHash("md5", hash)
+	assert.Error(t, err)
+	_, err = repo.FindTargetsByHash("sha256", hash, "targets/nope")
+	assert.IsType(t, data.ErrNoSuchRole{}, err)
+}
+
+// RemoveTargetMatching only stages the removal of a target if every role
+// signs it with the expected hashes.
+func TestRemoveTargetMatching(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	key, err := repo.CryptoService.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	addDelegationWithPaths(t, repo, "targets/a", key)
+	published := addTarget(t, repo, "latest", "../fixtures/intermediate-ca.crt")
+	republished, err := NewTarget("latest", "../fixtures/root-ca.crt")
+	assert.NoError(t, err)
+	assert.NoError(t, repo.Publish())
+
+	// a different target was published under the name
+	err = repo.RemoveTargetMatching("latest", republished.Hashes)
+	assert.IsType(t, ErrTargetMismatch{}, err)
+	// the hash for one of the algorithms differs
+	mixed := data.Hashes{"sha256": published.Hashes["sha256"], "sha512": republished.Hashes["sha256"]}
+	err = repo.RemoveTargetMatching("latest", mixed)
+	assert.IsType(t, ErrTargetMismatch{}, err)
+	// the target is not signed by every role
+	err = repo.RemoveTargetMatching("latest", published.Hashes,
+		data.CanonicalTargetsRole, "targets/a")
+	assert.IsType(t, ErrTargetMismatch{}, err)
+	err = repo.RemoveTargetMatching("latest", data.Hashes{})
+	assert.IsType(t, ErrTargetMismatch{}, err)
+	assert.Empty(t, getChanges(t, repo))
+
+	err = repo.RemoveTargetMatching("latest",
+		data.Hashes{"sha256": published.Hashes["sha256"]})
+	assert.NoError(t, err)
+	changes := getChanges(t, repo)
+	assert.Len(t, changes, 1)
+	assert.Equal(t, changelist.ActionDelete, changes[0].Action())
+	assert.Equal(t, data.CanonicalTargetsRole, changes[0].Scope())
+
+	assert.NoError(t, repo.Publish())
+	_, err = repo.GetTargetByName("latest")
+	assert.Error(t, err)
+}
+
+// RemoveTargetsByPrefix stages the removal of every target under the prefix
+// from each of the roles that signs it.
+func TestRemoveTargetsByPrefix(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	key, err := repo.CryptoService.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	addDelegationWithPaths(t, repo, "targets/a", key)
+	for _, name := range []string{"deprecated/one", "deprecated/two", "current"} {
+		addTarget(t, repo, name, "../fixtures/intermediate-ca.crt")
+	}
+	addTarget(t, repo, "deprecated/three", "../fixtures/intermediate-ca.crt", "targets/a")
+	assert.NoError(t, repo.Publish())
+
+	removed, err := repo.RemoveTargetsByPrefix("obsolete/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, removed)
+	assert.Empty(t, getChanges(t, repo))
+
+	removed, err = repo.RemoveTargetsByPrefix("deprecated/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"deprecated/one", "deprecated/two"}, removed)
+	changes := getChanges(t, repo)
+	assert.Len(t, changes, 2)
+	for _, change := range changes {
+		assert.Equal(t, changelist.ActionDelete, change.Action())
+		assert.Equal(t, data.CanonicalTargetsRole, change.Scope())
+	}
+	assert.NoError(t, repo.ClearChangelist())
+
+	removed, err = repo.RemoveTargetsByPrefix("deprecated/", data.CanonicalTargetsRole, "targets/a")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"deprecated/one", "deprecated/three", "deprecated/two"}, removed)
+	assert.Len(t, getChanges(t, repo), 3)
+
+	assert.NoError(t, repo.Publish())
+	targets, err := repo.ListTargetsByPrefix("", data.CanonicalTargetsRole, "targets/a")
+	assert.NoError(t, err)
+	assert.Len(t, targets, 1)
+	assert.Equal(t, "current", targets[0].Name)
+
+	_, err = repo.RemoveTargetsByPrefix("", "targets/b")
+	assert.IsType(t, data.ErrNoSuchRole{}, err)
+}
+
+// unclearableChangelist is a changelist that can't be cleared
+type unclearableChangelist struct {
+	changelist.Changelist
+}
+
+func (cl unclearableChangelist) Clear(archive string) error {
+	return fmt.Errorf("permission denied")
+}
+
+// ClearChangelist discards the staged changes, and fails with an
+// ErrChangelistNotReset if the changelist can't be cleared.
+func TestClearChangelist(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts, _, _ := simpleTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
+	addTarget(t, repo, "v2", "../fixtures/intermediate-ca.crt")
+	assert.Len(t, getChanges(t, repo), 2)
+
+	assert.NoError(t, repo.ClearChangelist())
+	assert.Empty(t, getChanges(t, repo))
+
+	memChangelist := changelist.NewMemChangelist()
+	repo.ChangelistFactory = func(string) (changelist.Changelist, error) {
+		return unclearableChangelist{memChangelist}, nil
+	}
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
+
+	err = repo.ClearChangelist()
+	assert.Error(t, err)
+	assert.IsType(t, ErrChangelistNotReset{}, err)
+	assert.Len(t, memChangelist.List(), 1)
+}
+
+// With a ValidTargetName policy, AddTarget refuses to stage, and Publish to
+// apply, targets with names the policy rejects.
+func TestValidTargetName(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	repo.ValidTargetName = regexp.MustCompile(`^[\w][\w.-]{0,127}$`).MatchString
+
+	target, err := NewTarget("not a tag", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, err)
+	err = repo.AddTarget(target)
+	assert.Error(t, err)
+	assert.IsType(t, ErrInvalidTargetName{}, err)
+	assert.Empty(t, getChanges(t, repo))
+
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+
+	// a change staged without AddTarget is checked when it is published
+	metaJSON, err := json.Marshal(data.FileMeta{Length: target.Length, Hashes: target.Hashes})
+	assert.NoError(t, err)
+	cl, err := repo.GetChangelist()
+	assert.NoError(t, err)
+	assert.NoError(t, cl.Add(changelist.NewTufChange(changelist.ActionCreate,
+		data.CanonicalTargetsRole, changelist.TypeTargetsTarget, "not a tag", metaJSON)))
+	err = repo.Publish()
+	assert.Error(t, err)
+	assert.IsType(t, ErrInvalidTargetName{}, err)
+	assert.Len(t, getChanges(t, repo), 1)
+
+	// but targets with such names can still be removed
+	assert.NoError(t, repo.ClearChangelist())
+	assert.NoError(t, repo.RemoveTarget("not a tag"))
+	assert.NoError(t, repo.Publish())
+}
+
+// recordingRoundTripper records the paths of the requests it forwards
+type recordingRoundTripper struct {
+	paths []string
+}
+
+func (rt *recordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.paths = append(rt.paths, req.URL.Path)
+	return http.DefaultTransport.RoundTrip(req)
 }
 
-// Tests rotating keys when there's a change from locally managed keys to
-// remotely managed keys and vice versa
-// Before rotating, publish some content (so that the server has a root.json),
-// and download root.json
-func TestRotateKeyAfterPublishServerManagementChange(t *testing.T) {
-	// delegate snapshot key management to the server
-	testRotateKeySuccess(t, false, map[string]bool{
-		data.CanonicalSnapshotRole: true,
-		data.CanonicalTargetsRole:  false,
-	})
-	// reclaim snapshot key management from the server
-	testRotateKeySuccess(t, true, map[string]bool{
-		data.CanonicalSnapshotRole: false,
-		data.CanonicalTargetsRole:  false,
-	})
+// A repository initialized offline doesn't contact the server until it is
+// first published, which adds the keys the server manages to the root.
+func TestInitializeOffline(t *testing.T) {
+	for _, serverManagesSnapshot := range []bool{false, true} {
+		testInitializeOffline(t, serverManagesSnapshot)
+	}
+}
+
+func testInitializeOffline(t *testing.T, serverManagesSnapshot bool) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	rt := &recordingRoundTripper{}
+	repo, err := NewNotaryRepository(tempBaseDir, gun, ts.URL, rt, passphraseRetriever)
+	assert.NoError(t, err)
+	rootPubKey, err := repo.CryptoService.Create(data.CanonicalRootRole, data.ECDSAKey)
+	assert.NoError(t, err)
+
+	var serverManagedRoles []string
+	if serverManagesSnapshot {
+		serverManagedRoles = []string{data.CanonicalSnapshotRole}
+	}
+	assert.NoError(t, repo.InitializeOffline(rootPubKey.ID(), serverManagedRoles...))
+	addTarget(t, repo, "current", "../fixtures/intermediate-ca.crt")
+	assert.Empty(t, rt.paths, "the server was contacted")
+	root := repo.tufRepo.Root.Signed
+	assert.Empty(t, root.Roles[data.CanonicalTimestampRole].KeyIDs)
+	assert.Equal(t, serverManagesSnapshot, len(root.Roles[data.CanonicalSnapshotRole].KeyIDs) == 0)
+
+	assert.NoError(t, repo.Publish())
+	root = repo.tufRepo.Root.Signed
+	assert.Len(t, root.Roles[data.CanonicalTimestampRole].KeyIDs, 1)
+	assert.Len(t, root.Roles[data.CanonicalSnapshotRole].KeyIDs, 1)
+
+	// the published repository can be read by anyone
+	tempBaseDir2, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir2)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	reader, err := NewNotaryRepository(
+		tempBaseDir2, gun, ts.URL, http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err)
+	target, err := reader.GetTargetByName("current")
+	assert.NoError(t, err)
+	assert.Equal(t, "current", target.Name)
+}
+
+// Once a repository's metadata, including that of its delegations, is cached,
+// updating it again only downloads the root and the timestamp until the
+// timestamp says the snapshot changed.
+func TestUpdateSkipsUnchangedRoles(t *testing.T) {
+	// Temporary directories where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	tempBaseDir2, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir2)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	key, err := repo.CryptoService.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	addDelegationWithPaths(t, repo, "targets/a", key)
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt", "targets/a")
+	assert.NoError(t, repo.Publish())
+
+	rt := &recordingRoundTripper{}
+	repo2, err := NewNotaryRepository(tempBaseDir2, gun, ts.URL, rt, passphraseRetriever)
+	assert.NoError(t, err, "error creating repository: %s", err)
+
+	prefix := "/v2/" + gun + "/_trust/tuf/"
+	_, err = repo2.GetTargetByName("v1")
+	assert.NoError(t, err)
+	assert.Contains(t, rt.paths, prefix+"targets/a.json")
+
+	rt.paths = nil
+	_, err = repo2.GetTargetByName("v1")
+	assert.NoError(t, err)
+	_, err = repo2.ListTargetsByPrefix("", "targets/a")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{prefix + "root.json", prefix + "timestamp.json",
+		prefix + "root.json", prefix + "timestamp.json"}, rt.paths)
+
+	// once the snapshot changes, the changed roles are downloaded again
+	addTarget(t, repo, "v2", "../fixtures/intermediate-ca.crt", "targets/a")
+	assert.NoError(t, repo.Publish())
+	rt.paths = nil
+	_, err = repo2.GetTargetByName("v2")
+	assert.NoError(t, err)
+	assert.Contains(t, rt.paths, prefix+"snapshot.json")
+	assert.Contains(t, rt.paths, prefix+"targets/a.json")
+}
+
+// RoleVersions returns the versions of the roles of the published repository
+func TestRoleVersions(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	_, err = repo.RoleVersions()
+	assert.Error(t, err)
+
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+
+	before, err := repo.RoleVersions()
+	assert.NoError(t, err)
+	assert.Len(t, before, 4)
+	for role := range data.ValidRoles {
+		assert.True(t, before[role] > 0, "no version for %s", role)
+	}
+
+	// publishing a target changes every role but the root
+	addTarget(t, repo, "v2", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+
+	after, err := repo.RoleVersions()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{
+		data.CanonicalRootRole:      before[data.CanonicalRootRole],
+		data.CanonicalTargetsRole:   before[data.CanonicalTargetsRole] + 1,
+		data.CanonicalSnapshotRole:  before[data.CanonicalSnapshotRole] + 1,
+		data.CanonicalTimestampRole: before[data.CanonicalTimestampRole] + 1,
+	}, after)
+}
+
+// WithRemote returns a repository that publishes the local trust data to
+// another server, sharing the keys and certificates of the original
+func TestWithRemote(t *testing.T) {
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	defer os.RemoveAll(tempBaseDir)
+
+	serverCS := cryptoservice.NewCryptoService(
+		"", trustmanager.NewKeyMemoryStore(passphraseRetriever))
+	oldStore, newStore := storage.NewMemStorage(), storage.NewMemStorage()
+	oldServer := fullTestServerWithStorage(t, oldStore, serverCS)
+	defer oldServer.Close()
+	newServer := fullTestServerWithStorage(t, newStore, serverCS)
+	defer newServer.Close()
+
+	gun := "docker.com/notary"
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, oldServer.URL, false)
+	addTarget(t, repo, "latest", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+	// refresh the local cache of the trust data, which is what gets migrated
+	_, err = repo.ListTargets()
+	assert.NoError(t, err)
+
+	// migrate the timestamp key to the new server, but none of the metadata
+	algorithm, public, err := oldStore.GetKey(gun, data.CanonicalTimestampRole)
+	assert.NoError(t, err)
+	assert.NoError(t, newStore.SetKey(gun, data.CanonicalTimestampRole, algorithm, public))
+
+	moved := repo.WithRemote(newServer.URL)
+	assert.Equal(t, newServer.URL, moved.baseURL)
+	assert.Equal(t, oldServer.URL, repo.baseURL)
+	assert.True(t, moved.CryptoService == repo.CryptoService)
+	assert.True(t, moved.CertManager == repo.CertManager)
+
+	assert.NoError(t, moved.Publish())
+
+	tempBaseDir2, err := ioutil.TempDir("", "notary-test-")
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	defer os.RemoveAll(tempBaseDir2)
+	newClient, err := NewNotaryRepository(
+		tempBaseDir2, gun, newServer.URL, http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err)
+	targets, err := newClient.ListTargets()
+	assert.NoError(t, err)
+	assert.Len(t, targets, 1)
+	assert.Equal(t, "latest", targets[0].Name)
+}
+
+// The expiry of the metadata a repository signs is counted from its pinned
+// Now, if it has one.
+func TestPinnedNow(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	pinned := time.Now().UTC().Truncate(24 * time.Hour)
+	repo, rootKeyID := createRepoAndKey(t, data.ECDSAKey, tempBaseDir, gun, ts.URL)
+	repo.Now = func() time.Time { return pinned }
+	assert.NoError(t, repo.Initialize(rootKeyID))
+	addTarget(t, repo, "latest", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+
+	tempBaseDir2, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir2)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	otherRepo, err := NewNotaryRepository(
+		tempBaseDir2, gun, ts.URL, http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err)
+	_, err = otherRepo.ListTargets()
+	assert.NoError(t, err)
+
+	tufRepo := otherRepo.tufRepo
+	for role, expires := range map[string]time.Time{
+		data.CanonicalRootRole:     tufRepo.Root.Signed.Expires,
+		data.CanonicalTargetsRole:  tufRepo.Targets[data.CanonicalTargetsRole].Signed.Expires,
+		data.CanonicalSnapshotRole: tufRepo.Snapshot.Signed.Expires,
+	} {
+		assert.True(t, data.DefaultExpiresFrom(role, pinned).Equal(expires),
+			"%s expires at %s", role, expires)
+	}
+}
+
+// EstimatedTimestampAge estimates the age of the cached timestamp, also once
+// the server can't be reached.
+func TestEstimatedTimestampAge(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	_, err = repo.EstimatedTimestampAge()
+	assert.IsType(t, store.ErrMetaNotFound{}, err)
+
+	assert.NoError(t, repo.Publish())
+	_, err = repo.ListTargets()
+	assert.NoError(t, err)
+	ts.Close()
+
+	age, err := repo.EstimatedTimestampAge()
+	assert.NoError(t, err)
+	assert.True(t, age > -time.Minute && age < time.Minute, "age is %s", age)
+
+	later := time.Now().Add(6 * time.Hour)
+	repo.Now = func() time.Time { return later }
+	age, err = repo.EstimatedTimestampAge()
+	assert.NoError(t, err)
+	assert.True(t, age > 5*time.Hour && age < 7*time.Hour, "age is %s", age)
+}
+
+// An ErrExpired has the role that expired, its expiry, and the local time it
+// was checked against.
+func TestErrExpiredHasTimes(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	metaStore := storage.NewMemStorage()
+	ts := fullTestServerWithStorage(t, metaStore, cryptoservice.NewCryptoService(
+		"", trustmanager.NewKeyMemoryStore(passphraseRetriever)))
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	assert.NoError(t, repo.Publish())
+
+	// the server is given targets that have expired, which it wouldn't accept
+	// from a publish
+	expires := time.Now().Add(-time.Hour).UTC().Round(time.Second)
+	targetsSigned, err := repo.tufRepo.SignTargets(data.CanonicalTargetsRole, expires)
+	assert.NoError(t, err)
+	snapshotSigned, err := repo.tufRepo.SignSnapshot(data.DefaultExpires(data.CanonicalSnapshotRole))
+	assert.NoError(t, err)
+	targetsJSON, err := json.Marshal(targetsSigned)
+	assert.NoError(t, err)
+	snapshotJSON, err := json.Marshal(snapshotSigned)
+	assert.NoError(t, err)
+	targetsVersion := repo.tufRepo.Targets[data.CanonicalTargetsRole].Signed.Version
+	snapshotVersion := repo.tufRepo.Snapshot.Signed.Version
+	assert.NoError(t, metaStore.UpdateMany(gun, []storage.MetaUpdate{
+		{Role: data.CanonicalTargetsRole, Version: targetsVersion, Data: targetsJSON},
+		{Role: data.CanonicalSnapshotRole, Version: snapshotVersion, Data: snapshotJSON},
+	}))
+
+	before := time.Now()
+	_, err = repo.ListTargets()
+	assert.IsType(t, ErrExpired{}, err)
+	expired := err.(ErrExpired)
+	assert.Equal(t, data.CanonicalTargetsRole, expired.Role)
+	assert.True(t, expires.Equal(expired.Expires), "expired at %s", expired.Expires)
+	assert.False(t, expired.Now.Before(before))
+}
+
+// A server that serves the root of another GUN is caught by the GUN the root
+// was minted for.
+func TestGUNMismatch(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	otherGUN := "docker.com/other"
+	metaStore := storage.NewMemStorage()
+	ts := fullTestServerWithStorage(t, metaStore, cryptoservice.NewCryptoService(
+		"", trustmanager.NewKeyMemoryStore(passphraseRetriever)))
+	defer ts.Close()
+
+	otherRepo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, otherGUN, ts.URL, false)
+	assert.NoError(t, otherRepo.Publish())
+
+	// the server serves the other GUN's root as the root of gun
+	rootJSON, err := metaStore.GetCurrent(otherGUN, data.CanonicalRootRole)
+	assert.NoError(t, err)
+	assert.NoError(t, metaStore.UpdateCurrent(gun, storage.MetaUpdate{
+		Role: data.CanonicalRootRole, Version: 1, Data: rootJSON}))
+
+	repo, err := NewNotaryRepository(
+		tempBaseDir, gun, ts.URL, http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err)
+	_, err = repo.ListTargets()
+	assert.Equal(t, ErrGUNMismatch{Expected: gun, Got: otherGUN}, err)
+
+	// the other GUN's root is still valid for the other GUN
+	_, err = otherRepo.ListTargets()
+	assert.NoError(t, err)
+}
+
+// With an indented cache, the cached trust data is human-readable, and is
+// still used as the trust data that was downloaded.
+func TestCacheIndent(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	repo.SetCacheIndent(true)
+	addTarget(t, repo, "latest", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+
+	tempBaseDir2, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir2)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	otherRepo, err := NewNotaryRepository(
+		tempBaseDir2, gun, ts.URL, http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err)
+	otherRepo.SetCacheIndent(true)
+
+	for _, r := range []*NotaryRepository{repo, otherRepo} {
+		for i := 0; i < 2; i++ {
+			targets, err := r.ListTargets()
+			assert.NoError(t, err)
+			assert.Len(t, targets, 1)
+		}
+		for _, role := range []string{data.CanonicalRootRole, data.CanonicalTargetsRole,
+			data.CanonicalSnapshotRole, data.CanonicalTimestampRole} {
+			onDisk, err := ioutil.ReadFile(
+				filepath.Join(r.tufRepoPath, "metadata", role+".json"))
+			assert.NoError(t, err)
+			assert.Contains(t, string(onDisk), "\n  \"signed\": {\n", "%s is not indented", role)
+		}
+	}
+}
+
+// A target made with several hash algorithms is published with all of their
+// hashes.
+func TestNewTargetWithHashAlgorithms(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	targetFile := "../fixtures/intermediate-ca.crt"
+	_, err = NewTargetWithHashAlgorithms("latest", targetFile, []string{"md5"})
+	assert.Error(t, err)
+
+	target, err := NewTargetWithHashAlgorithms("latest", targetFile, nil)
+	assert.NoError(t, err)
+	defaultTarget, err := NewTarget("latest", targetFile)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultTarget, target)
+
+	target, err = NewTargetWithHashAlgorithms("latest", targetFile, []string{"sha256", "sha512"})
+	assert.NoError(t, err)
+	assert.Len(t, target.Hashes, 2)
+	assert.Equal(t, defaultTarget.Hashes["sha256"], target.Hashes["sha256"])
+	assert.Len(t, target.Hashes["sha512"], sha512.Size)
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	assert.NoError(t, repo.AddTarget(target))
+	assert.NoError(t, repo.Publish())
+
+	tempBaseDir2, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir2)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	otherRepo, err := NewNotaryRepository(
+		tempBaseDir2, gun, ts.URL, http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err)
+	published, err := otherRepo.GetTargetByName("latest")
+	assert.NoError(t, err)
+	assert.Equal(t, target, published)
+}
+
+// Publish applies the DelegationShadowPolicy to targets added to the base
+// targets role under the paths of one of its delegations.
+func TestDelegationShadowPolicy(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	key, err := repo.CryptoService.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	addDelegationWithPaths(t, repo, "targets/prod", key, "prod/")
+	assert.NoError(t, repo.Publish())
+
+	// a target under the delegation's paths, in the delegation, or outside of
+	// its paths is fine
+	repo.DelegationShadowPolicy = ShadowError
+	addTarget(t, repo, "prod/app", "../fixtures/intermediate-ca.crt", "targets/prod")
+	addTarget(t, repo, "dev/app", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+
+	addTarget(t, repo, "prod/app", "../fixtures/intermediate-ca.crt")
+	err = repo.Publish()
+	assert.Equal(t, ErrTargetShadowsDelegation{Name: "prod/app", Role: "targets/prod"}, err)
+
+	var logs bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &logs
+	repo.Logger = logger
+	repo.DelegationShadowPolicy = ShadowWarn
+	assert.NoError(t, repo.Publish())
+	assert.Contains(t, logs.String(), "under the paths delegated to targets/prod")
 }
 
-func testRotateKeySuccess(t *testing.T, serverManagesSnapshotInit bool,
-	keysToRotate map[string]bool) {
+// Publish refuses a changelist that stages different targets of the same name
+// in the same role, unless the repository allows the last one to win.
+func TestConflictingChanges(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, "docker.com/notary", ts.URL, false)
+	assert.NoError(t, repo.Publish())
+
+	// the same target staged twice, or staged again after being removed, is
+	// not a conflict
+	addTarget(t, repo, "same", "../fixtures/intermediate-ca.crt")
+	addTarget(t, repo, "same", "../fixtures/intermediate-ca.crt")
+	addTarget(t, repo, "readded", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.RemoveTarget("readded"))
+	addTarget(t, repo, "readded", "../fixtures/root-ca.crt")
+	assert.NoError(t, repo.Publish())
+
+	first := addTarget(t, repo, "latest", "../fixtures/intermediate-ca.crt")
+	addTarget(t, repo, "other", "../fixtures/intermediate-ca.crt")
+	last := addTarget(t, repo, "latest", "../fixtures/root-ca.crt")
+	err = repo.Publish()
+	assert.IsType(t, ErrConflictingChanges{}, err)
+	conflicts := err.(ErrConflictingChanges).Changes
+	assert.Len(t, conflicts, 2)
+	for _, c := range conflicts {
+		assert.Equal(t, data.CanonicalTargetsRole, c.Scope())
+		assert.Equal(t, "latest", c.Path())
+	}
+	assert.Contains(t, err.Error(), `targets "latest"`)
+	assert.Len(t, getChanges(t, repo), 3)
+	assert.NotEqual(t, first.Hashes, last.Hashes)
+
+	repo.AllowConflictingChanges = true
+	assert.NoError(t, repo.Publish())
+	target, err := repo.GetTargetByName("latest")
+	assert.NoError(t, err)
+	assert.Equal(t, last.Hashes, target.Hashes)
+}
 
+// Publish warns about targets and snapshot metadata larger than the
+// MetadataSizeWarning.
+func TestMetadataSizeWarning(t *testing.T) {
 	// Temporary directory where test files will be created
-	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
 	defer os.RemoveAll(tempBaseDir)
-
 	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
 
-	gun := "docker.com/notary"
 	ts := fullTestServer(t)
 	defer ts.Close()
 
-	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL,
-		serverManagesSnapshotInit)
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, "docker.com/notary", ts.URL, false)
+	var logs bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &logs
+	repo.Logger = logger
 
-	// Adding a target will allow us to confirm the repository is still valid after
-	// rotating the keys.
 	addTarget(t, repo, "latest", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+	assert.NotContains(t, logs.String(), "consider moving its targets into delegations")
 
-	// Publish
-	err = repo.Publish()
-	assert.NoError(t, err)
-
-	// Get root.json and capture targets + snapshot key IDs
-	repo.GetTargetByName("latest") // force a pull
-	assertRotationSuccessful(t, repo, keysToRotate)
+	repo.MetadataSizeWarning = 10
+	addTarget(t, repo, "current", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+	assert.Contains(t, logs.String(), "the targets metadata is")
+	assert.Contains(t, logs.String(), "the snapshot metadata is")
+	assert.NotContains(t, logs.String(), "the root metadata is")
+
+	logs.Reset()
+	repo.MetadataSizeWarning = -1
+	addTarget(t, repo, "next", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+	assert.NotContains(t, logs.String(), "consider moving its targets into delegations")
 }
 
-// If there is no local cache, notary operations return the remote error code
-func TestRemoteServerUnavailableNoLocalCache(t *testing.T) {
+// An Offline repository reads the cached trust data without contacting the
+// server, and fails with ErrOffline when it would have to.
+func TestOffline(t *testing.T) {
+	// Temporary directory where test files will be created
 	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
-	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
 	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
 
-	ts := errorTestServer(t, 500)
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
 	defer ts.Close()
 
-	repo, err := NewNotaryRepository(tempBaseDir, "docker.com/notary",
-		ts.URL, http.DefaultTransport, passphraseRetriever)
-	assert.NoError(t, err, "error creating repo: %s", err)
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
 
-	_, err = repo.ListTargets()
-	assert.Error(t, err)
-	assert.IsType(t, store.ErrServerUnavailable{}, err)
+	tempBaseDir2, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir2)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	rt := &recordingRoundTripper{}
+	reader, err := NewNotaryRepository(tempBaseDir2, gun, ts.URL, rt, passphraseRetriever)
+	assert.NoError(t, err)
+	reader.Offline = true
 
-	_, err = repo.GetTargetByName("targetName")
-	assert.Error(t, err)
-	assert.IsType(t, store.ErrServerUnavailable{}, err)
+	// nothing is cached yet
+	_, err = reader.ListTargets()
+	assert.Equal(t, ErrOffline, err)
 
-	err = repo.Publish()
-	assert.Error(t, err)
-	assert.IsType(t, store.ErrServerUnavailable{}, err)
+	reader.Offline = false
+	_, err = reader.ListTargets()
+	assert.NoError(t, err)
+	rt.paths = nil
+
+	// the server's targets changed since, but the cached ones are read
+	reader.Offline = true
+	addTarget(t, repo, "v2", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+	targets, err := reader.ListTargets()
+	assert.NoError(t, err)
+	assert.Len(t, targets, 1)
+	target, err := reader.GetTargetByName("v1")
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", target.Name)
+
+	addTarget(t, reader, "v3", "../fixtures/intermediate-ca.crt")
+	assert.Equal(t, ErrOffline, reader.Publish())
+	assert.Empty(t, rt.paths)
+	assert.Len(t, getChanges(t, reader), 1)
 }
 
-// AddDelegation creates a valid changefile (rejects invalid delegation names,
-// but does not check the delegation hierarchy).  When applied, the change adds
-// a new delegation role with the correct keys.
-func TestAddDelegationChangefileValid(t *testing.T) {
+// droppingRoundTripper answers the uploads of metadata as if the server
+// accepted them, without forwarding them, while drop is set
+type droppingRoundTripper struct {
+	drop bool
+}
+
+func (rt *droppingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt.drop && req.Method == "POST" {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+			Request:    req,
+		}, nil
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// A repository that verifies what it publishes fails to publish, and keeps
+// its changes, if the server doesn't serve them once they were uploaded.
+func TestVerifyPublish(t *testing.T) {
 	// Temporary directory where test files will be created
-	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
 	defer os.RemoveAll(tempBaseDir)
 	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
 
 	gun := "docker.com/notary"
-	ts, _, _ := simpleTestServer(t)
+	ts := fullTestServer(t)
 	defer ts.Close()
 
-	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
-	targetKeyIds := repo.CryptoService.ListKeys(data.CanonicalTargetsRole)
-	assert.NotEmpty(t, targetKeyIds)
-	targetPubKey := repo.CryptoService.GetKey(targetKeyIds[0])
-	assert.NotNil(t, targetPubKey)
+	rt := &droppingRoundTripper{}
+	repo, err := NewNotaryRepository(tempBaseDir, gun, ts.URL, rt, passphraseRetriever)
+	assert.NoError(t, err)
+	repo.VerifyPublish = true
+	rootPubKey, err := repo.CryptoService.Create(data.CanonicalRootRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	assert.NoError(t, repo.Initialize(rootPubKey.ID()))
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
 
-	err = repo.AddDelegation("root", 1, []data.PublicKey{targetPubKey})
-	assert.Error(t, err)
-	assert.IsType(t, data.ErrInvalidRole{}, err)
-	assert.Empty(t, getChanges(t, repo))
+	// rotating a key republishes the root, and the new key is served
+	assert.NoError(t, repo.RotateKey(data.CanonicalTargetsRole, false))
+	assert.NoError(t, repo.Publish())
 
-	// to show that adding does not care about the hierarchy
-	err = repo.AddDelegation("targets/a/b/c", 1, []data.PublicKey{targetPubKey})
-	assert.NoError(t, err)
+	rt.drop = true
+	addTarget(t, repo, "v2", "../fixtures/intermediate-ca.crt")
+	err = repo.Publish()
+	assert.IsType(t, ErrPublishNotAdopted{}, err)
+	assert.Equal(t, data.CanonicalTargetsRole, err.(ErrPublishNotAdopted).Role)
+	assert.Len(t, getChanges(t, repo), 1)
 
-	// ensure that the changefiles is correct
-	changes := getChanges(t, repo)
-	assert.Len(t, changes, 1)
-	assert.Equal(t, changelist.ActionCreate, changes[0].Action())
-	assert.Equal(t, "targets/a/b/c", changes[0].Scope())
-	assert.Equal(t, changelist.TypeTargetsDelegation, changes[0].Type())
-	assert.Equal(t, "", changes[0].Path())
-	assert.NotEmpty(t, changes[0].Content())
+	rt.drop = false
+	assert.NoError(t, repo.Publish())
+	assert.Empty(t, getChanges(t, repo))
 }
 
-// The changefile produced by AddDelegation, when applied, actually adds
-// the delegation to the repo (assuming the delegation hierarchy is correct -
-// tests for change application validation are in helpers_test.go)
-func TestAddDelegationChangefileApplicable(t *testing.T) {
+// A trusted root certificate can be removed, unless it holds a key of the
+// repository's current root and removing it isn't forced.
+func TestRemoveTrustedRootCert(t *testing.T) {
 	// Temporary directory where test files will be created
-	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
 	defer os.RemoveAll(tempBaseDir)
 	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
 
 	gun := "docker.com/notary"
-	ts, _, _ := simpleTestServer(t)
+	ts := fullTestServer(t)
 	defer ts.Close()
 
-	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
-	targetKeyIds := repo.CryptoService.ListKeys(data.CanonicalTargetsRole)
-	assert.NotEmpty(t, targetKeyIds)
-	targetPubKey := repo.CryptoService.GetKey(targetKeyIds[0])
-	assert.NotNil(t, targetPubKey)
-
-	// this hierarchy has to be right to be applied
-	err = repo.AddDelegation("targets/a", 1, []data.PublicKey{targetPubKey})
+	repo, rootKeyID := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	assert.NoError(t, repo.Publish())
+	_, err = repo.ListTargets()
 	assert.NoError(t, err)
-	changes := getChanges(t, repo)
-	assert.Len(t, changes, 1)
+	rootCertID := repo.tufRepo.Root.Signed.Roles[data.CanonicalRootRole].KeyIDs[0]
 
-	// ensure that it can be applied correctly
-	err = applyTargetsChange(repo.tufRepo, changes[0])
+	otherKey, _, err := repo.CryptoService.GetPrivateKey(rootKeyID)
 	assert.NoError(t, err)
+	otherCert, err := cryptoservice.GenerateTestingCertificate(otherKey.CryptoSigner(), "docker.com/other")
+	assert.NoError(t, err)
+	repo.CertManager.AddTrustedCert(otherCert)
+	otherCertID, err := trustmanager.FingerprintCert(otherCert)
+	assert.NoError(t, err)
+	assert.Len(t, repo.CertManager.ListTrustedCerts(), 2)
 
-	targetRole := repo.tufRepo.Targets[data.CanonicalTargetsRole]
-	assert.Len(t, targetRole.Signed.Delegations.Roles, 1)
-	assert.Len(t, targetRole.Signed.Delegations.Keys, 1)
+	err = repo.RemoveTrustedRootCert(rootCertID, false)
+	assert.Equal(t, ErrRootCertInUse{Fingerprint: rootCertID}, err)
+	assert.Error(t, repo.RemoveTrustedRootCert("nonexistent", false))
 
-	_, ok := targetRole.Signed.Delegations.Keys[targetPubKey.ID()]
-	assert.True(t, ok)
+	assert.NoError(t, repo.RemoveTrustedRootCert(otherCertID, false))
+	infos := repo.CertManager.ListTrustedCerts()
+	assert.Len(t, infos, 1)
+	assert.Equal(t, rootCertID, infos[0].Fingerprint)
 
-	newDelegationRole := targetRole.Signed.Delegations.Roles[0]
-	assert.Len(t, newDelegationRole.KeyIDs, 1)
-	assert.Equal(t, targetPubKey.ID(), newDelegationRole.KeyIDs[0])
-	assert.Equal(t, "targets/a", newDelegationRole.Name)
+	assert.NoError(t, repo.RemoveTrustedRootCert(rootCertID, true))
+	assert.Empty(t, repo.CertManager.ListTrustedCerts())
 }
 
-// TestAddDelegationErrorWritingChanges expects errors writing a change to file
-// to be propagated.
-func TestAddDelegationErrorWritingChanges(t *testing.T) {
-	testErrorWritingChangefiles(t, func(repo *NotaryRepository) error {
-		targetKeyIds := repo.CryptoService.ListKeys(data.CanonicalTargetsRole)
-		assert.NotEmpty(t, targetKeyIds)
-		targetPubKey := repo.CryptoService.GetKey(targetKeyIds[0])
-		assert.NotNil(t, targetPubKey)
+// Repositories of several GUNs that share a key store, and so their root key,
+// can publish at the same time.  Run with -race to check for data races.
+func TestConcurrentPublishSharedKeyStore(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
 
-		return repo.AddDelegation("targets/a", 1, []data.PublicKey{targetPubKey})
-	})
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	keyStore, err := trustmanager.NewKeyFileStore(tempBaseDir, passphraseRetriever)
+	assert.NoError(t, err)
+	rootKey, err := cryptoservice.NewCryptoService("", keyStore).Create(
+		data.CanonicalRootRole, data.ECDSAKey)
+	assert.NoError(t, err)
+
+	guns := []string{"docker.com/notary", "docker.com/other", "docker.com/third"}
+	var repos []*NotaryRepository
+	for _, gun := range guns {
+		repo, err := NewNotaryRepository(
+			tempBaseDir, gun, ts.URL, http.DefaultTransport, passphraseRetriever)
+		assert.NoError(t, err)
+		repo.CryptoService = cryptoservice.NewCryptoService(gun, keyStore)
+		assert.NoError(t, repo.Initialize(rootKey.ID()))
+		repos = append(repos, repo)
+	}
+
+	errs := make(chan error)
+	for _, repo := range repos {
+		go func(repo *NotaryRepository) {
+			target, err := NewTarget("latest", "../fixtures/intermediate-ca.crt")
+			if err == nil {
+				err = repo.AddTarget(target)
+			}
+			if err == nil {
+				err = repo.Publish()
+			}
+			errs <- err
+		}(repo)
+	}
+	for range repos {
+		assert.NoError(t, <-errs)
+	}
+
+	for _, repo := range repos {
+		targets, err := repo.ListTargets()
+		assert.NoError(t, err)
+		assert.Len(t, targets, 1)
+	}
 }
 
-// RemoveDelegation rejects attempts to remove invalidly-named delegations,
-// but otherwise does not validate the name of the delegation to remove.  This
-// test ensures that the changefile generated by RemoveDelegation is correct.
-func TestRemoveDelegationChangefileValid(t *testing.T) {
+// The keys Initialize, RotateKey and GenerateDelegationKey create are of the
+// repository's KeyGenConfig
+func TestKeyGenConfig(t *testing.T) {
 	// Temporary directory where test files will be created
-	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
 	defer os.RemoveAll(tempBaseDir)
 	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
 
 	gun := "docker.com/notary"
-	ts, _, _ := simpleTestServer(t)
+	ts := fullTestServer(t)
 	defer ts.Close()
 
-	repo, rootKeyID := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
-	rootPubKey := repo.CryptoService.GetKey(rootKeyID)
-	assert.NotNil(t, rootPubKey)
+	repo, err := NewNotaryRepository(
+		tempBaseDir, gun, ts.URL, http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err)
+	repo.KeyGenConfig = cryptoservice.KeyGenConfig{ECDSACurve: elliptic.P384()}
 
-	err = repo.RemoveDelegation("root")
-	assert.Error(t, err)
-	assert.IsType(t, data.ErrInvalidRole{}, err)
-	assert.Empty(t, getChanges(t, repo))
+	assertCurve := func(key data.PublicKey) {
+		parsed, err := x509.ParsePKIXPublicKey(key.Public())
+		assert.NoError(t, err)
+		ecdsaKey, ok := parsed.(*ecdsa.PublicKey)
+		assert.True(t, ok)
+		if ok {
+			assert.Equal(t, elliptic.P384(), ecdsaKey.Curve)
+		}
+	}
 
-	// to demonstrate that so long as the delegation name is valid, the
-	// existence of the delegation doesn't matter
-	assert.NoError(t, repo.RemoveDelegation("targets/a/b/c"))
+	rootKey, err := repo.CryptoService.(*cryptoservice.CryptoService).CreateWithConfig(
+		data.CanonicalRootRole, data.ECDSAKey, repo.KeyGenConfig)
+	assert.NoError(t, err)
+	assert.NoError(t, repo.Initialize(rootKey.ID()))
+	for _, role := range []string{data.CanonicalTargetsRole, data.CanonicalSnapshotRole} {
+		keyIDs := repo.tufRepo.Root.Signed.Roles[role].KeyIDs
+		assert.Len(t, keyIDs, 1)
+		assertCurve(repo.tufRepo.Root.Signed.Keys[keyIDs[0]])
+	}
+	assert.NoError(t, repo.Publish())
 
-	// ensure that the changefile is correct
-	changes := getChanges(t, repo)
-	assert.Len(t, changes, 1)
-	assert.Equal(t, changelist.ActionDelete, changes[0].Action())
-	assert.Equal(t, "targets/a/b/c", changes[0].Scope())
-	assert.Equal(t, changelist.TypeTargetsDelegation, changes[0].Type())
-	assert.Equal(t, "", changes[0].Path())
-	assert.Empty(t, changes[0].Content())
+	assert.NoError(t, repo.RotateKey(data.CanonicalTargetsRole, false))
+	assert.NoError(t, repo.Publish())
+	_, err = repo.ListTargets()
+	assert.NoError(t, err)
+	keyIDs := repo.tufRepo.Root.Signed.Roles[data.CanonicalTargetsRole].KeyIDs
+	assert.Len(t, keyIDs, 1)
+	assertCurve(repo.tufRepo.Root.Signed.Keys[keyIDs[0]])
+
+	delegationKey, err := repo.GenerateDelegationKey("targets/a")
+	assert.NoError(t, err)
+	assertCurve(delegationKey)
+
+	// a CryptoService that can't create keys with a KeyGenConfig can't be
+	// used with one
+	repo.CryptoService = cryptoservice.NewKMSCryptoService(gun, nil)
+	_, err = repo.GenerateDelegationKey("targets/a")
+	assert.Error(t, err)
 }
 
-// The changefile produced by RemoveDelegation, when applied, actually removes
-// the delegation from the repo (assuming the repo exists - tests for
-// change application validation are in helpers_test.go)
-func TestRemoveDelegationChangefileApplicable(t *testing.T) {
+// SignRole signs a role's metadata without publishing it, and the signed
+// metadata can be imported by another client of the repository
+func TestSignRole(t *testing.T) {
 	// Temporary directory where test files will be created
-	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
 	defer os.RemoveAll(tempBaseDir)
 	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
 
 	gun := "docker.com/notary"
-	ts, _, _ := simpleTestServer(t)
+	ts := fullTestServer(t)
 	defer ts.Close()
 
-	repo, rootKeyID := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
-	rootPubKey := repo.CryptoService.GetKey(rootKeyID)
-	assert.NotNil(t, rootPubKey)
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, true)
+	addTarget(t, repo, "latest", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
 
-	// add a delegation first so it can be removed
-	assert.NoError(t, repo.AddDelegation("targets/a", 1, []data.PublicKey{rootPubKey}))
-	changes := getChanges(t, repo)
-	assert.Len(t, changes, 1)
-	assert.NoError(t, applyTargetsChange(repo.tufRepo, changes[0]))
+	// a client that only has the published trust data
+	otherDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(otherDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	otherRepo, err := NewNotaryRepository(
+		otherDir, gun, ts.URL, http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err)
+	_, err = otherRepo.ListTargets()
+	assert.NoError(t, err)
 
-	targetRole := repo.tufRepo.Targets[data.CanonicalTargetsRole]
-	assert.Len(t, targetRole.Signed.Delegations.Roles, 1)
-	assert.Len(t, targetRole.Signed.Delegations.Keys, 1)
+	// the signer loads the repository itself
+	signer, err := NewNotaryRepository(
+		tempBaseDir, gun, ts.URL, http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err)
+	expiry := time.Now().AddDate(0, 1, 0).UTC().Round(time.Second)
+	signedJSON, err := signer.SignRole(data.CanonicalTargetsRole, expiry)
+	assert.NoError(t, err)
 
-	// now remove it
-	assert.NoError(t, repo.RemoveDelegation("targets/a"))
-	changes = getChanges(t, repo)
-	assert.Len(t, changes, 2)
-	assert.NoError(t, applyTargetsChange(repo.tufRepo, changes[1]))
+	targets := &data.SignedTargets{}
+	assert.NoError(t, regJson.Unmarshal(signedJSON, targets))
+	assert.Equal(t, 3, targets.Signed.Version)
+	assert.True(t, expiry.Equal(targets.Signed.Expires))
+	_, ok := targets.Signed.Targets["latest"]
+	assert.True(t, ok)
+	assert.NoError(t, otherRepo.ImportMetadata(data.CanonicalTargetsRole, signedJSON))
+	imported, err := otherRepo.fileStore.GetMeta(data.CanonicalTargetsRole, maxSize)
+	assert.NoError(t, err)
+	assert.Equal(t, signedJSON, imported)
 
-	targetRole = repo.tufRepo.Targets[data.CanonicalTargetsRole]
-	assert.Empty(t, targetRole.Signed.Delegations.Roles)
-	assert.Empty(t, targetRole.Signed.Delegations.Keys)
+	// nothing was published
+	_, err = repo.ListTargets()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, repo.tufRepo.Targets[data.CanonicalTargetsRole].Signed.Version)
+
+	for _, role := range []string{"", "nope", "Targets", "targets/"} {
+		_, err := signer.SignRole(role, time.Time{})
+		assert.IsType(t, data.ErrInvalidRole{}, err, "role %q", role)
+	}
+	// there is no metadata for this delegation
+	_, err = signer.SignRole("targets/a", time.Time{})
+	assert.IsType(t, data.ErrInvalidRole{}, err)
+	// the server holds the snapshot key
+	_, err = signer.SignRole(data.CanonicalSnapshotRole, time.Time{})
+	assert.Error(t, err)
 }
 
-// TestRemoveDelegationErrorWritingChanges expects errors writing a change to
-// file to be propagated.
-func TestRemoveDelegationErrorWritingChanges(t *testing.T) {
-	testErrorWritingChangefiles(t, func(repo *NotaryRepository) error {
-		return repo.RemoveDelegation("targets/a")
-	})
+// Delegations nested deeper than the repository's MaxDelegationDepth aren't
+// followed when looking up targets
+func TestMaxDelegationDepth(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	key, err := repo.CryptoService.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	addDelegationWithPaths(t, repo, "targets/a", key)
+	addDelegationWithPaths(t, repo, "targets/a/b", key)
+	addTarget(t, repo, "latest", "../fixtures/intermediate-ca.crt", "targets/a/b")
+	assert.NoError(t, repo.Publish())
+
+	target, err := repo.GetTargetByName("latest")
+	assert.NoError(t, err)
+	assert.NotNil(t, target)
+
+	repo.MaxDelegationDepth = 1
+	depthErr := tufclient.ErrMaxDelegationDepth{Role: "targets/a/b", MaxDepth: 1}
+	_, err = repo.GetTargetByName("latest")
+	assert.Equal(t, depthErr, err)
+	_, err = repo.GetAllTargetMetadataByName("latest")
+	assert.Equal(t, depthErr, err)
+	_, err = repo.GetDelegationRoles()
+	assert.Equal(t, depthErr, err)
 }
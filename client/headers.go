@@ -0,0 +1,43 @@
+package client
+
+import (
+	"net/http"
+
+	"github.com/docker/distribution/registry/client/transport"
+)
+
+// WithHeaders returns a RoundTripper that sends requests through base, which
+// defaults to http.DefaultTransport if nil, with the given headers, such as a
+// User-Agent, set on every request, replacing any the request already has.
+// Wrapping an authenticating RoundTripper, or being wrapped by one, both
+// work.
+func WithHeaders(base http.RoundTripper, headers http.Header) http.RoundTripper {
+	fixed := make(http.Header, len(headers))
+	for k, v := range headers {
+		fixed[k] = append([]string(nil), v...)
+	}
+	return transport.NewTransport(base, headerSetter(func(req *http.Request) {
+		for k, v := range fixed {
+			req.Header[k] = append([]string(nil), v...)
+		}
+	}))
+}
+
+// WithRequestID returns a RoundTripper that sends requests through base,
+// which defaults to http.DefaultTransport if nil, with the header set on
+// every request to the value newID returns for it, e.g. a new correlation ID
+// to trace the request through the server's logs.
+func WithRequestID(base http.RoundTripper, header string, newID func(req *http.Request) string) http.RoundTripper {
+	return transport.NewTransport(base, headerSetter(func(req *http.Request) {
+		req.Header.Set(header, newID(req))
+	}))
+}
+
+// headerSetter is a transport.RequestModifier that sets headers on every
+// request
+type headerSetter func(req *http.Request)
+
+func (m headerSetter) ModifyRequest(req *http.Request) error {
+	m(req)
+	return nil
+}
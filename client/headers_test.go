@@ -0,0 +1,51 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// WithHeaders sets its headers on every request, and composes with the other
+// RoundTripper wrappers.
+func TestWithHeaders(t *testing.T) {
+	var received []http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header)
+	}))
+	defer ts.Close()
+
+	headers := http.Header{}
+	headers.Set("User-Agent", "notary-test/1.0")
+	headers.Set("X-Client", "ci")
+	var ids int
+	rt := WithRequestID(WithBasicAuth(WithHeaders(nil, headers), "user", "pass"),
+		"X-Request-Id", func(req *http.Request) string {
+			ids++
+			return strconv.Itoa(ids)
+		})
+	// changing the headers afterwards has no effect
+	headers.Set("X-Client", "changed")
+
+	req, err := http.NewRequest("GET", ts.URL+"/v2/docker.com/notary/_trust/tuf/root.json", nil)
+	assert.NoError(t, err)
+	req.Header.Set("User-Agent", "replaced")
+	for i := 0; i < 2; i++ {
+		resp, err := rt.RoundTrip(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+	}
+	// the request itself isn't modified
+	assert.Equal(t, "replaced", req.Header.Get("User-Agent"))
+
+	assert.Len(t, received, 2)
+	for i, header := range received {
+		assert.Equal(t, []string{"notary-test/1.0"}, header["User-Agent"])
+		assert.Equal(t, "ci", header.Get("X-Client"))
+		assert.Equal(t, "Basic dXNlcjpwYXNz", header.Get("Authorization"))
+		assert.Equal(t, strconv.Itoa(i+1), header.Get("X-Request-Id"))
+	}
+}
@@ -1,17 +1,28 @@
 package client
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/docker/notary/client/changelist"
+	"github.com/docker/notary/trustmanager"
 	tuf "github.com/docker/notary/tuf"
 	"github.com/docker/notary/tuf/data"
 	"github.com/docker/notary/tuf/keys"
+	"github.com/docker/notary/tuf/signed"
 	"github.com/docker/notary/tuf/store"
+	"github.com/docker/notary/tuf/utils"
 )
 
 // Use this to initialize remote HTTPStores from the config settings
@@ -26,43 +37,141 @@ func getRemoteStore(baseURL, gun string, rt http.RoundTripper) (store.RemoteStor
 	)
 }
 
-func applyChangelist(repo *tuf.Repo, cl changelist.Changelist) error {
+// offlineStore is the remote store of an Offline repository, which fails
+// without contacting the server
+type offlineStore struct{}
+
+func (offlineStore) GetMeta(name string, size int64) ([]byte, error) { return nil, ErrOffline }
+func (offlineStore) SetMeta(name string, blob []byte) error          { return ErrOffline }
+func (offlineStore) SetMultiMeta(map[string][]byte) error            { return ErrOffline }
+func (offlineStore) GetKey(role string) ([]byte, error)              { return nil, ErrOffline }
+func (offlineStore) GetTarget(path string) (io.ReadCloser, error)    { return nil, ErrOffline }
+
+func applyChangelist(repo *tuf.Repo, cl changelist.Changelist, logger Logger) error {
 	it, err := cl.NewIterator()
 	if err != nil {
 		return err
 	}
-	index := 0
+	var changes []changelist.Change
 	for it.HasNext() {
 		c, err := it.Next()
 		if err != nil {
 			return err
 		}
-		switch c.Scope() {
-		case changelist.ScopeTargets:
-			err = applyTargetsChange(repo, c)
-		case changelist.ScopeRoot:
-			err = applyRootChange(repo, c)
-		default:
-			logrus.Debug("scope not supported: ", c.Scope())
+		changes = append(changes, c)
+	}
+	// drop the changes that are superseded by later ones
+	changes = changelist.Squash(changes)
+
+	index := 0
+	for _, c := range changes {
+		err = applyChange(repo, c, logger)
+		if _, ok := err.(errScopeNotSupported); ok {
+			logger.Debug(err.Error())
+			continue
 		}
 		index++
 		if err != nil {
 			return err
 		}
 	}
-	logrus.Debugf("applied %d change(s)", index)
+	logger.Debugf("applied %d change(s)", index)
 	return nil
 }
 
-func applyTargetsChange(repo *tuf.Repo, c changelist.Change) error {
+// errScopeNotSupported is returned when a change is scoped to a role that
+// changes can't be applied to
+type errScopeNotSupported struct {
+	scope string
+}
+
+func (e errScopeNotSupported) Error() string {
+	return fmt.Sprintf("scope not supported: %s", e.scope)
+}
+
+// applyChange applies a single change to the repo, according to the role it is
+// scoped to, returning errScopeNotSupported for a role it can't be applied to
+func applyChange(repo *tuf.Repo, c changelist.Change, logger Logger) error {
+	switch {
+	case c.Scope() == changelist.ScopeTargets || data.IsDelegation(c.Scope()):
+		return applyTargetsChange(repo, c, logger)
+	case c.Scope() == changelist.ScopeRoot:
+		return applyRootChange(repo, c, logger)
+	default:
+		return errScopeNotSupported{scope: c.Scope()}
+	}
+}
+
+// copyTufRepo returns a copy of the metadata in repo, which can be changed
+// without affecting repo, and can't sign
+func copyTufRepo(repo *tuf.Repo) (*tuf.Repo, error) {
+	scratch := tuf.NewRepo(keys.NewDB(), nil)
+	if repo.Root != nil {
+		root := &data.SignedRoot{}
+		if err := copyMetadata(repo.Root, root); err != nil {
+			return nil, err
+		}
+		if err := scratch.SetRoot(root); err != nil {
+			return nil, err
+		}
+	}
+	for role, t := range repo.Targets {
+		targets := &data.SignedTargets{}
+		if err := copyMetadata(t, targets); err != nil {
+			return nil, err
+		}
+		if err := scratch.SetTargets(role, targets); err != nil {
+			return nil, err
+		}
+	}
+	if repo.Snapshot != nil {
+		snapshot := &data.SignedSnapshot{}
+		if err := copyMetadata(repo.Snapshot, snapshot); err != nil {
+			return nil, err
+		}
+		scratch.SetSnapshot(snapshot)
+	}
+	if repo.Timestamp != nil {
+		timestamp := &data.SignedTimestamp{}
+		if err := copyMetadata(repo.Timestamp, timestamp); err != nil {
+			return nil, err
+		}
+		scratch.SetTimestamp(timestamp)
+	}
+	return scratch, nil
+}
+
+// copyMetadata deep-copies the metadata in from into to
+func copyMetadata(from, to interface{}) error {
+	b, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, to)
+}
+
+func applyTargetsChange(repo *tuf.Repo, c changelist.Change, logger Logger) error {
 	switch c.Type() {
 	case changelist.TypeTargetsTarget:
-		return changeTargetMeta(repo, c)
+		return changeTargetMeta(repo, c, logger)
 	case changelist.TypeTargetsDelegation:
 		return changeTargetsDelegation(repo, c)
+	case changelist.TypeTargetsRenew:
+		return renewTargets(repo, c)
 	default:
-		return fmt.Errorf("only target meta and delegations changes supported")
+		return fmt.Errorf("only target meta, delegations and renewal changes supported")
+	}
+}
+
+// renewTargets marks the role the change is scoped to as changed, so it is
+// re-signed, with a new expiry, when it is published
+func renewTargets(repo *tuf.Repo, c changelist.Change) error {
+	targets, ok := repo.Targets[c.Scope()]
+	if !ok {
+		return data.ErrInvalidRole{Role: c.Scope(), Reason: "no metadata to renew"}
 	}
+	targets.Dirty = true
+	return nil
 }
 
 func changeTargetsDelegation(repo *tuf.Repo, c changelist.Change) error {
@@ -121,11 +230,11 @@ func changeTargetsDelegation(repo *tuf.Repo, c changelist.Change) error {
 
 }
 
-func changeTargetMeta(repo *tuf.Repo, c changelist.Change) error {
+func changeTargetMeta(repo *tuf.Repo, c changelist.Change, logger Logger) error {
 	var err error
 	switch c.Action() {
 	case changelist.ActionCreate:
-		logrus.Debug("changelist add: ", c.Path())
+		logger.Debug("changelist add: ", c.Path())
 		meta := &data.FileMeta{}
 		err = json.Unmarshal(c.Content(), meta)
 		if err != nil {
@@ -134,26 +243,26 @@ func changeTargetMeta(repo *tuf.Repo, c changelist.Change) error {
 		files := data.Files{c.Path(): *meta}
 		_, err = repo.AddTargets(c.Scope(), files)
 	case changelist.ActionDelete:
-		logrus.Debug("changelist remove: ", c.Path())
+		logger.Debug("changelist remove: ", c.Path())
 		err = repo.RemoveTargets(c.Scope(), c.Path())
 	default:
-		logrus.Debug("action not yet supported: ", c.Action())
+		logger.Debug("action not yet supported: ", c.Action())
 	}
 	return err
 }
 
-func applyRootChange(repo *tuf.Repo, c changelist.Change) error {
+func applyRootChange(repo *tuf.Repo, c changelist.Change, logger Logger) error {
 	var err error
 	switch c.Type() {
 	case changelist.TypeRootRole:
-		err = applyRootRoleChange(repo, c)
+		err = applyRootRoleChange(repo, c, logger)
 	default:
-		logrus.Debug("type of root change not yet supported: ", c.Type())
+		logger.Debug("type of root change not yet supported: ", c.Type())
 	}
 	return err // might be nil
 }
 
-func applyRootRoleChange(repo *tuf.Repo, c changelist.Change) error {
+func applyRootRoleChange(repo *tuf.Repo, c changelist.Change, logger Logger) error {
 	switch c.Action() {
 	case changelist.ActionCreate:
 		// replaces all keys for a role
@@ -167,27 +276,105 @@ func applyRootRoleChange(repo *tuf.Repo, c changelist.Change) error {
 			return err
 		}
 	default:
-		logrus.Debug("action not yet supported for root: ", c.Action())
+		logger.Debug("action not yet supported for root: ", c.Action())
 	}
 	return nil
 }
 
-func nearExpiry(r *data.SignedRoot) bool {
-	plus6mo := time.Now().AddDate(0, 6, 0)
+func nearExpiry(r *data.SignedRoot, now time.Time) bool {
+	plus6mo := now.AddDate(0, 6, 0)
 	return r.Signed.Expires.Before(plus6mo)
 }
 
-// Fetches a public key from a remote store, given a gun and role
-func getRemoteKey(url, gun, role string, rt http.RoundTripper) (data.PublicKey, error) {
-	remote, err := getRemoteStore(url, gun, rt)
+// checkRootCert checks that cert can represent privKey as the root key of the
+// repository with the given gun: it must be for the gun, and for privKey's
+// public key, and pass the same checks the CertManager makes when validating
+// the root
+func checkRootCert(cert *x509.Certificate, privKey data.PrivateKey, gun string) error {
+	if cert.Subject.CommonName != gun {
+		return ErrInvalidRootCert{Reason: fmt.Sprintf(
+			"certificate is for %s, not %s", cert.Subject.CommonName, gun)}
+	}
+	if err := trustmanager.ValidateCertificate(cert); err != nil {
+		return ErrInvalidRootCert{Reason: err.Error()}
+	}
+	signer := privKey.CryptoSigner()
+	if signer == nil {
+		return fmt.Errorf("key type not supported for certificates: %s", privKey.Algorithm())
+	}
+	certPubKey, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
 	if err != nil {
-		return nil, err
+		return ErrInvalidRootCert{Reason: err.Error()}
 	}
-	rawPubKey, err := remote.GetKey(role)
+	rootPubKey, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(certPubKey, rootPubKey) {
+		return ErrInvalidRootCert{Reason: fmt.Sprintf(
+			"certificate is not for the public key of root key %s", privKey.ID())}
+	}
+	return nil
+}
+
+// checkTimestampSnapshot checks that snapshotJSON has the length and SHA256
+// checksum the timestamp records for the snapshot
+func checkTimestampSnapshot(timestamp *data.SignedTimestamp, snapshotJSON []byte) error {
+	meta, ok := timestamp.Signed.Meta[data.CanonicalSnapshotRole]
+	if !ok {
+		return ErrTimestampSnapshotMismatch{Reason: "timestamp has no snapshot"}
+	}
+	if meta.Length != int64(len(snapshotJSON)) {
+		return ErrTimestampSnapshotMismatch{Reason: fmt.Sprintf(
+			"snapshot is %d bytes, timestamp expects %d", len(snapshotJSON), meta.Length)}
+	}
+	expected, ok := meta.Hashes["sha256"]
+	if !ok {
+		return ErrTimestampSnapshotMismatch{Reason: "timestamp has no SHA256 checksum of the snapshot"}
+	}
+	actual := sha256.Sum256(snapshotJSON)
+	if !bytes.Equal(actual[:], expected) {
+		return ErrTimestampSnapshotMismatch{Reason: fmt.Sprintf(
+			"snapshot has SHA256 checksum %x, timestamp expects %x", actual, expected)}
+	}
+	return nil
+}
+
+// remoteKeyRetryDelay is how long getRemoteKey waits before its first retry.
+// The wait doubles before each further retry.
+var remoteKeyRetryDelay = time.Second
+
+// Fetches a public key from a remote store, given a gun and role.  If the
+// server can't be reached, the fetch is retried up to retries more times
+// with exponential backoff.  The error is an ErrRemoteKeyUnavailable if the
+// server still couldn't be reached, or an ErrRemoteKeyRefused if it declined
+// to provide the key.
+func getRemoteKey(url, gun, role string, rt http.RoundTripper, retries int,
+	logger Logger) (data.PublicKey, error) {
+	remote, err := getRemoteStore(url, gun, rt)
 	if err != nil {
 		return nil, err
 	}
 
+	var rawPubKey []byte
+	delay := remoteKeyRetryDelay
+	for attempt := 0; ; attempt++ {
+		rawPubKey, err = remote.GetKey(role)
+		if err == nil {
+			break
+		}
+		switch err.(type) {
+		case store.ErrInvalidOperation, store.ErrMetaNotFound:
+			return nil, ErrRemoteKeyRefused{Role: role, Err: err}
+		}
+		if attempt >= retries {
+			return nil, ErrRemoteKeyUnavailable{Role: role, Err: err}
+		}
+		logger.Debugf("failed to get remote %s key, retrying in %s: %v", role, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+
 	pubKey, err := data.UnmarshalPublicKey(rawPubKey)
 	if err != nil {
 		return nil, err
@@ -196,6 +383,21 @@ func getRemoteKey(url, gun, role string, rt http.RoundTripper) (data.PublicKey,
 	return pubKey, nil
 }
 
+// hashesMatch returns whether actual has the same hash as expected for each of
+// the algorithms in expected, of which there must be at least one
+func hashesMatch(expected, actual data.Hashes) bool {
+	if len(expected) == 0 {
+		return false
+	}
+	for algorithm, hash := range expected {
+		actualHash, ok := actual[algorithm]
+		if !ok || !bytes.Equal(hash, actualHash) {
+			return false
+		}
+	}
+	return true
+}
+
 // add a key to a KeyDB, and create a role for the key and add it.
 func addKeyForRole(kdb *keys.KeyDB, role string, key data.PublicKey) error {
 	theRole, err := data.NewRole(role, 1, []string{key.ID()}, nil, nil)
@@ -209,16 +411,49 @@ func addKeyForRole(kdb *keys.KeyDB, role string, key data.PublicKey) error {
 	return nil
 }
 
-// signs and serializes the metadata for a canonical role in a tuf repo to JSON
-func serializeCanonicalRole(tufRepo *tuf.Repo, role string) (out []byte, err error) {
+// checkRootThreshold checks that the newly signed root has valid signatures
+// from at least as many of its root keys as its threshold requires.  Signing
+// keeps the old signatures of keys that weren't available, which no longer
+// verify, so they can't be counted.
+func checkRootThreshold(root *data.SignedRoot, s *data.Signed) error {
+	rootRole, ok := root.Signed.Roles[data.CanonicalRootRole]
+	if !ok {
+		return nil
+	}
+	kdb := keys.NewDB()
+	for _, keyID := range rootRole.KeyIDs {
+		if key, ok := root.Signed.Keys[keyID]; ok {
+			kdb.AddKey(key)
+		}
+	}
+	role, err := data.NewRole(data.CanonicalRootRole, rootRole.Threshold, rootRole.KeyIDs, nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := kdb.AddRole(role); err != nil {
+		return err
+	}
+	if err := signed.VerifySignatures(s, data.CanonicalRootRole, kdb); err != nil {
+		return signed.ErrInsufficientSignatures{Name: fmt.Sprintf(
+			"root needs valid signatures from %d of its keys: %v", rootRole.Threshold, err)}
+	}
+	return nil
+}
+
+// signs and serializes the metadata for a canonical role in a tuf repo to JSON,
+// with the default expiry counted from now
+func serializeCanonicalRole(tufRepo *tuf.Repo, role string, now time.Time) (out []byte, err error) {
 	var s *data.Signed
 	switch role {
 	case data.CanonicalRootRole:
-		s, err = tufRepo.SignRoot(data.DefaultExpires(role))
+		s, err = tufRepo.SignRoot(data.DefaultExpiresFrom(role, now))
+		if err == nil {
+			err = checkRootThreshold(tufRepo.Root, s)
+		}
 	case data.CanonicalSnapshotRole:
-		s, err = tufRepo.SignSnapshot(data.DefaultExpires(role))
+		s, err = tufRepo.SignSnapshot(data.DefaultExpiresFrom(role, now))
 	case data.CanonicalTargetsRole:
-		s, err = tufRepo.SignTargets(role, data.DefaultExpires(role))
+		s, err = tufRepo.SignTargets(role, data.DefaultExpiresFrom(role, now))
 	default:
 		err = fmt.Errorf("%s not supported role to sign on the client", role)
 	}
@@ -227,5 +462,454 @@ func serializeCanonicalRole(tufRepo *tuf.Repo, role string) (out []byte, err err
 		return
 	}
 
-	return json.Marshal(s)
+	return marshalSigned(s)
+}
+
+// serializeTargetsRole signs and serializes the metadata for the base targets
+// role or a delegated targets role, with the default expiry counted from now.
+// If it can't be signed, the metadata is left as it was.
+func serializeTargetsRole(tufRepo *tuf.Repo, role string, now time.Time) ([]byte, error) {
+	targets := tufRepo.Targets[role]
+	expires, version := targets.Signed.Expires, targets.Signed.Version
+	s, err := tufRepo.SignTargets(role, data.DefaultExpiresFrom(data.CanonicalTargetsRole, now))
+	if err != nil {
+		targets.Signed.Expires, targets.Signed.Version = expires, version
+		return nil, err
+	}
+	return marshalSigned(s)
+}
+
+// marshalSigned serializes signed metadata like json.Marshal, except that the
+// signed part, which is already canonical JSON, is copied as it is instead of
+// being validated and compacted again, which for a large targets role costs
+// nearly as much as signing it.  It is also then exactly the bytes that were
+// signed.
+func marshalSigned(s *data.Signed) ([]byte, error) {
+	signatures, err := json.Marshal(s.Signatures)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, len(s.Signed)+len(signatures)+32))
+	buf.WriteString(`{"signed":`)
+	buf.Write(s.Signed)
+	buf.WriteString(`,"signatures":`)
+	buf.Write(signatures)
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// pendingTargetsChanges returns the roles whose targets the changelist
+// changes or renews, and whether any of its changes are scoped to a delegated
+// role
+func pendingTargetsChanges(cl changelist.Changelist) (map[string]bool, bool) {
+	changed := make(map[string]bool)
+	var delegated bool
+	for _, c := range cl.List() {
+		if c.Type() == changelist.TypeTargetsTarget || c.Type() == changelist.TypeTargetsRenew {
+			changed[c.Scope()] = true
+		}
+		if data.IsDelegation(c.Scope()) {
+			delegated = true
+		}
+	}
+	return changed, delegated
+}
+
+// initDelegatedTargets creates empty metadata for the delegated roles in roles
+// that their parent delegates to, but that haven't been published yet, so that
+// targets can be added to them
+func initDelegatedTargets(tufRepo *tuf.Repo, roles map[string]bool) error {
+	for role := range roles {
+		if _, ok := tufRepo.Targets[role]; ok || !data.IsDelegation(role) {
+			continue
+		}
+		if _, err := tufRepo.GetDelegation(role); err != nil {
+			continue
+		}
+		if err := tufRepo.InitTargets(role); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signTargetsRoles signs and serializes the metadata of the targets roles to
+// publish.  The base targets role is re-signed whenever its keys are
+// available, and must be if it has changes or requireBase is set.  A delegated
+// role is signed only if it has changes.  If the keys of a changed delegated
+// role aren't available, that's an error if changed says its targets were
+// changed.  Otherwise the role is dropped from the repo, so that the snapshot
+// doesn't refer to metadata that wasn't published.  The default expiry is
+// counted from now.  The roles that are neither signed nor published are
+// logged to logger.
+func signTargetsRoles(tufRepo *tuf.Repo, changed map[string]bool, requireBase bool,
+	now time.Time, logger Logger) (map[string][]byte, error) {
+	signedRoles := make(map[string][]byte)
+	err := signTargetsRolesTo(tufRepo, changed, requireBase, now, logger,
+		func(role string, targetsJSON []byte) error {
+			signedRoles[role] = targetsJSON
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return signedRoles, nil
+}
+
+// signTargetsRolesTo signs the targets roles like signTargetsRoles, but
+// passes the metadata of each role to emit as soon as it has been signed,
+// parents before their children, and stops at the first error emit returns.
+func signTargetsRolesTo(tufRepo *tuf.Repo, changed map[string]bool, requireBase bool,
+	now time.Time, logger Logger, emit func(role string, targetsJSON []byte) error) error {
+	var roles []string
+	for role := range tufRepo.Targets {
+		roles = append(roles, role)
+	}
+	// a parent's name is a prefix of its children's, so it sorts first
+	sort.Strings(roles)
+
+	for _, role := range roles {
+		isBase := role == data.CanonicalTargetsRole
+		dirty := tufRepo.Targets[role].Dirty
+		if !isBase && !dirty {
+			continue
+		}
+		targetsJSON, err := serializeTargetsRole(tufRepo, role, now)
+		if err == nil {
+			if err := emit(role, targetsJSON); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, ok := err.(signed.ErrNoKeys); !ok && err != keys.ErrInvalidKey {
+			return err
+		}
+		switch {
+		case isBase && !dirty && !requireBase:
+			logger.Debugf("no keys to re-sign %s, which has no changes", role)
+		case !isBase && !changed[role]:
+			logger.Debugf("no keys to sign %s, which has no target changes", role)
+			delete(tufRepo.Targets, role)
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// cachedMetadataVersions returns the versions of the base roles, and of any
+// roles listed in the cached snapshot, found in the given metadata cache.
+// Metadata that is missing or can't be parsed is omitted.
+func cachedMetadataVersions(cache store.MetadataStore) map[string]int {
+	roles := []string{
+		data.CanonicalRootRole,
+		data.CanonicalTargetsRole,
+		data.CanonicalSnapshotRole,
+		data.CanonicalTimestampRole,
+	}
+	if snapshotJSON, err := cache.GetMeta(data.CanonicalSnapshotRole, maxSize); err == nil {
+		snapshot := &data.SignedSnapshot{}
+		if err := json.Unmarshal(snapshotJSON, snapshot); err == nil {
+			for role := range snapshot.Signed.Meta {
+				if data.IsDelegation(role) {
+					roles = append(roles, role)
+				}
+			}
+		}
+	}
+
+	versions := make(map[string]int)
+	for _, role := range roles {
+		roleJSON, err := cache.GetMeta(role, maxSize)
+		if err != nil {
+			continue
+		}
+		meta := &data.SignedMeta{}
+		if err := json.Unmarshal(roleJSON, meta); err != nil {
+			continue
+		}
+		versions[role] = meta.Signed.Version
+	}
+	return versions
+}
+
+// loadedMetadataVersions returns the versions of all the roles currently
+// loaded in the tuf repo
+func loadedMetadataVersions(repo *tuf.Repo) map[string]int {
+	versions := make(map[string]int)
+	if repo.Root != nil {
+		versions[data.CanonicalRootRole] = repo.Root.Signed.Version
+	}
+	for role, targets := range repo.Targets {
+		versions[role] = targets.Signed.Version
+	}
+	if repo.Snapshot != nil {
+		versions[data.CanonicalSnapshotRole] = repo.Snapshot.Signed.Version
+	}
+	if repo.Timestamp != nil {
+		versions[data.CanonicalTimestampRole] = repo.Timestamp.Signed.Version
+	}
+	return versions
+}
+
+// duplicateTargetNames returns every target name that appears in more than one
+// of the targets roles loaded in the tuf repo, mapped to the sorted list of
+// roles that contain it
+func duplicateTargetNames(repo *tuf.Repo) map[string][]string {
+	claims := make(map[string][]string)
+	for role, targets := range repo.Targets {
+		for name := range targets.Signed.Targets {
+			claims[name] = append(claims[name], role)
+		}
+	}
+	for name, roles := range claims {
+		if len(roles) < 2 {
+			delete(claims, name)
+			continue
+		}
+		sort.Strings(roles)
+	}
+	return claims
+}
+
+// targetsByName sorts targets by name
+type targetsByName []*Target
+
+func (t targetsByName) Len() int           { return len(t) }
+func (t targetsByName) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t targetsByName) Less(i, j int) bool { return t[i].Name < t[j].Name }
+
+// renewDelegations re-signs, with a new default expiry, every delegated targets
+// role loaded in the tuf repo whose metadata expires within the given window
+// from now.
+// It returns the sorted roles it re-signed, and the sorted roles it couldn't
+// re-sign because it doesn't have their keys.  A role it couldn't re-sign is
+// left as it was.
+func renewDelegations(repo *tuf.Repo, within time.Duration, now time.Time) (
+	renewed, unsignable []string, err error) {
+
+	var expiring []string
+	deadline := now.Add(within)
+	for role, targets := range repo.Targets {
+		if data.IsDelegation(role) && targets.Signed.Expires.Before(deadline) {
+			expiring = append(expiring, role)
+		}
+	}
+	sort.Strings(expiring)
+
+	for _, role := range expiring {
+		if _, err := repo.GetDelegation(role); err != nil {
+			unsignable = append(unsignable, role)
+			continue
+		}
+		targets := repo.Targets[role]
+		expires, version := targets.Signed.Expires, targets.Signed.Version
+		_, err := repo.SignTargets(role, data.DefaultExpiresFrom(data.CanonicalTargetsRole, now))
+		if _, ok := err.(signed.ErrNoKeys); ok || err == keys.ErrInvalidKey {
+			// signing failed before anything was signed, so undo the new
+			// expiry and version
+			targets.Signed.Expires, targets.Signed.Version = expires, version
+			unsignable = append(unsignable, role)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		renewed = append(renewed, role)
+	}
+	return renewed, unsignable, nil
+}
+
+// batchMetadata splits the roles in metas into batches whose metadata adds up
+// to no more than maxSize bytes, to be uploaded in order.  The server checks a
+// client-signed snapshot against the roles uploaded with it, so metadata that
+// includes a snapshot is never split.  Otherwise the server signs a new
+// snapshot for every batch, which it can only do once it has the root and
+// targets, so those two always go together in the first batch, followed by
+// the delegated roles, parents before their children since the server checks
+// each delegation against its parent.  If maxSize isn't positive, every role
+// goes in a single batch.
+func batchMetadata(metas map[string][]byte, maxSize int) [][]string {
+	var (
+		first []string
+		rest  []string
+	)
+	for role := range metas {
+		switch role {
+		case data.CanonicalRootRole, data.CanonicalTargetsRole:
+			first = append(first, role)
+		default:
+			rest = append(rest, role)
+		}
+	}
+	sort.Sort(publishOrder(first))
+	sort.Sort(publishOrder(rest))
+
+	if _, ok := metas[data.CanonicalSnapshotRole]; ok || maxSize <= 0 {
+		return [][]string{append(first, rest...)}
+	}
+
+	var (
+		batches   [][]string
+		batch     = first
+		batchSize int
+	)
+	for _, role := range first {
+		batchSize += len(metas[role])
+	}
+	for _, role := range rest {
+		size := len(metas[role])
+		if len(batch) > 0 && batchSize+size > maxSize {
+			batches = append(batches, batch)
+			batch, batchSize = nil, 0
+		}
+		batch = append(batch, role)
+		batchSize += size
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// publishOrder sorts role names into the order their metadata should be
+// uploaded: the base roles in a fixed order, and delegated roles by depth, so
+// that parents come before their children, and then by name
+type publishOrder []string
+
+func (p publishOrder) Len() int      { return len(p) }
+func (p publishOrder) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p publishOrder) Less(i, j int) bool {
+	ri, rj := publishRank(p[i]), publishRank(p[j])
+	if ri != rj {
+		return ri < rj
+	}
+	di, dj := strings.Count(p[i], "/"), strings.Count(p[j], "/")
+	if di != dj {
+		return di < dj
+	}
+	return p[i] < p[j]
+}
+
+// publishRank ranks a role by how early its metadata should be uploaded
+func publishRank(role string) int {
+	switch role {
+	case data.CanonicalRootRole:
+		return 0
+	case data.CanonicalTargetsRole:
+		return 1
+	case data.CanonicalSnapshotRole:
+		return 3
+	case data.CanonicalTimestampRole:
+		return 4
+	default:
+		return 2
+	}
+}
+
+// verifyPinnedRoot checks that the root is signed by the pinned root key,
+// returning ErrRootPinMismatch if it isn't.  The root lists its keys wrapped
+// in certificates, so its keys are matched against the pinned key by their
+// canonical key IDs, which ignore the certificate.
+func verifyPinnedRoot(root *data.Signed, pinnedKey data.PublicKey) error {
+	pinnedID, err := utils.CanonicalKeyID(pinnedKey)
+	if err != nil {
+		return err
+	}
+	signedRoot, err := data.RootFromSigned(root)
+	if err != nil {
+		return err
+	}
+	pinnedKeys := make(map[string]data.PublicKey)
+	for keyID, key := range signedRoot.Signed.Keys {
+		if canonicalID, err := utils.CanonicalKeyID(key); err == nil && canonicalID == pinnedID {
+			pinnedKeys[keyID] = key
+		}
+	}
+
+	err = signed.VerifyRoot(root, 0, pinnedKeys)
+	if _, ok := err.(signed.ErrRoleThreshold); ok || err == signed.ErrNoSignatures {
+		return ErrRootPinMismatch{KeyID: pinnedKey.ID()}
+	}
+	return err
+}
+
+// checkRootGUN returns ErrGUNMismatch if none of the certificates of the
+// root keys in root are for gun.  Root keys that aren't certificates don't
+// declare a GUN, and are left to the validation of the root.
+func checkRootGUN(root *data.Signed, gun string) error {
+	signedRoot, err := data.RootFromSigned(root)
+	if err != nil {
+		return err
+	}
+	rootRole, ok := signedRoot.Signed.Roles[data.CanonicalRootRole]
+	if !ok {
+		return nil
+	}
+	var got string
+	for _, keyID := range rootRole.KeyIDs {
+		key, ok := signedRoot.Signed.Keys[keyID]
+		if !ok {
+			continue
+		}
+		cert, err := trustmanager.LoadCertFromPEM(key.Public())
+		if err != nil {
+			continue
+		}
+		if cert.Subject.CommonName == gun {
+			return nil
+		}
+		got = cert.Subject.CommonName
+	}
+	if got == "" {
+		return nil
+	}
+	return ErrGUNMismatch{Expected: gun, Got: got}
+}
+
+// versionedMetadataFile is a version-prefixed metadata file in the cache
+type versionedMetadataFile struct {
+	path    string
+	version int
+}
+
+// newestVersionFirst sorts versioned metadata files from the most recent
+// version to the oldest
+type newestVersionFirst []versionedMetadataFile
+
+func (v newestVersionFirst) Len() int           { return len(v) }
+func (v newestVersionFirst) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v newestVersionFirst) Less(i, j int) bool { return v[i].version > v[j].version }
+
+// versionedMetadataFiles finds all the metadata files in metadataDir named
+// <version>.<role>.<extension>, and returns them grouped by role
+func versionedMetadataFiles(metadataDir, extension string) (map[string][]versionedMetadataFile, error) {
+	files := make(map[string][]versionedMetadataFile)
+	err := filepath.Walk(metadataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(info.Name(), "."+extension) {
+			return nil
+		}
+		parts := strings.SplitN(strings.TrimSuffix(info.Name(), "."+extension), ".", 2)
+		if len(parts) != 2 {
+			return nil
+		}
+		version, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(metadataDir, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		role := filepath.ToSlash(filepath.Join(rel, parts[1]))
+		files[role] = append(files[role], versionedMetadataFile{path: path, version: version})
+		return nil
+	})
+	return files, err
 }
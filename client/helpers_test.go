@@ -1,14 +1,19 @@
 package client
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/json"
+	"fmt"
 	"testing"
+	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/docker/notary/client/changelist"
 	tuf "github.com/docker/notary/tuf"
 	"github.com/docker/notary/tuf/data"
 	"github.com/docker/notary/tuf/keys"
+	"github.com/docker/notary/tuf/signed"
 	"github.com/docker/notary/tuf/testutils"
 	"github.com/stretchr/testify/assert"
 )
@@ -39,7 +44,7 @@ func TestApplyTargetsChange(t *testing.T) {
 		ChangePath: "latest",
 		Data:       fjson,
 	}
-	err = applyTargetsChange(repo, addChange)
+	err = applyTargetsChange(repo, addChange, logrus.StandardLogger())
 	assert.NoError(t, err)
 	assert.NotNil(t, repo.Targets["targets"].Signed.Targets["latest"])
 
@@ -50,7 +55,7 @@ func TestApplyTargetsChange(t *testing.T) {
 		ChangePath: "latest",
 		Data:       nil,
 	}
-	err = applyTargetsChange(repo, removeChange)
+	err = applyTargetsChange(repo, removeChange, logrus.StandardLogger())
 	assert.NoError(t, err)
 	_, ok := repo.Targets["targets"].Signed.Targets["latest"]
 	assert.False(t, ok)
@@ -84,7 +89,7 @@ func TestApplyChangelist(t *testing.T) {
 		Data:       fjson,
 	}
 	cl.Add(addChange)
-	err = applyChangelist(repo, cl)
+	err = applyChangelist(repo, cl, logrus.StandardLogger())
 	assert.NoError(t, err)
 	assert.NotNil(t, repo.Targets["targets"].Signed.Targets["latest"])
 
@@ -98,7 +103,7 @@ func TestApplyChangelist(t *testing.T) {
 		Data:       nil,
 	}
 	cl.Add(removeChange)
-	err = applyChangelist(repo, cl)
+	err = applyChangelist(repo, cl, logrus.StandardLogger())
 	assert.NoError(t, err)
 	_, ok := repo.Targets["targets"].Signed.Targets["latest"]
 	assert.False(t, ok)
@@ -143,7 +148,7 @@ func TestApplyChangelistMulti(t *testing.T) {
 	cl.Add(addChange)
 	cl.Add(removeChange)
 
-	err = applyChangelist(repo, cl)
+	err = applyChangelist(repo, cl, logrus.StandardLogger())
 	assert.NoError(t, err)
 	_, ok := repo.Targets["targets"].Signed.Targets["latest"]
 	assert.False(t, ok)
@@ -174,7 +179,7 @@ func TestApplyTargetsDelegationCreateDelete(t *testing.T) {
 		tdJSON,
 	)
 
-	err = applyTargetsChange(repo, ch)
+	err = applyTargetsChange(repo, ch, logrus.StandardLogger())
 	assert.NoError(t, err)
 
 	tgts := repo.Targets[data.CanonicalTargetsRole]
@@ -199,7 +204,7 @@ func TestApplyTargetsDelegationCreateDelete(t *testing.T) {
 		nil,
 	)
 
-	err = applyTargetsChange(repo, ch)
+	err = applyTargetsChange(repo, ch, logrus.StandardLogger())
 	assert.NoError(t, err)
 
 	assert.Len(t, tgts.Signed.Delegations.Roles, 0)
@@ -231,7 +236,7 @@ func TestApplyTargetsDelegationCreate2SharedKey(t *testing.T) {
 		tdJSON,
 	)
 
-	err = applyTargetsChange(repo, ch)
+	err = applyTargetsChange(repo, ch, logrus.StandardLogger())
 	assert.NoError(t, err)
 
 	// create second delegation
@@ -253,7 +258,7 @@ func TestApplyTargetsDelegationCreate2SharedKey(t *testing.T) {
 		tdJSON,
 	)
 
-	err = applyTargetsChange(repo, ch)
+	err = applyTargetsChange(repo, ch, logrus.StandardLogger())
 	assert.NoError(t, err)
 
 	tgts := repo.Targets[data.CanonicalTargetsRole]
@@ -281,7 +286,7 @@ func TestApplyTargetsDelegationCreate2SharedKey(t *testing.T) {
 		nil,
 	)
 
-	err = applyTargetsChange(repo, ch)
+	err = applyTargetsChange(repo, ch, logrus.StandardLogger())
 	assert.NoError(t, err)
 
 	assert.Len(t, tgts.Signed.Delegations.Roles, 1)
@@ -296,7 +301,7 @@ func TestApplyTargetsDelegationCreate2SharedKey(t *testing.T) {
 		nil,
 	)
 
-	err = applyTargetsChange(repo, ch)
+	err = applyTargetsChange(repo, ch, logrus.StandardLogger())
 	assert.NoError(t, err)
 
 	assert.Len(t, tgts.Signed.Delegations.Roles, 0)
@@ -328,7 +333,7 @@ func TestApplyTargetsDelegationCreateEdit(t *testing.T) {
 		tdJSON,
 	)
 
-	err = applyTargetsChange(repo, ch)
+	err = applyTargetsChange(repo, ch, logrus.StandardLogger())
 	assert.NoError(t, err)
 
 	// edit delegation
@@ -353,7 +358,7 @@ func TestApplyTargetsDelegationCreateEdit(t *testing.T) {
 		tdJSON,
 	)
 
-	err = applyTargetsChange(repo, ch)
+	err = applyTargetsChange(repo, ch, logrus.StandardLogger())
 	assert.NoError(t, err)
 
 	tgts := repo.Targets[data.CanonicalTargetsRole]
@@ -395,7 +400,7 @@ func TestApplyTargetsDelegationEditNonExisting(t *testing.T) {
 		tdJSON,
 	)
 
-	err = applyTargetsChange(repo, ch)
+	err = applyTargetsChange(repo, ch, logrus.StandardLogger())
 	assert.Error(t, err)
 	assert.IsType(t, data.ErrNoSuchRole{}, err)
 }
@@ -425,14 +430,14 @@ func TestApplyTargetsDelegationCreateAlreadyExisting(t *testing.T) {
 		tdJSON,
 	)
 
-	err = applyTargetsChange(repo, ch)
+	err = applyTargetsChange(repo, ch, logrus.StandardLogger())
 	assert.NoError(t, err)
 	// we have sufficient checks elsewhere we don't need to confirm that
 	// creating fresh works here via more asserts.
 
 	// when attempting to create the same role again, assert we receive
 	// an ErrInvalidRole because an existing role can't be "created"
-	err = applyTargetsChange(repo, ch)
+	err = applyTargetsChange(repo, ch, logrus.StandardLogger())
 	assert.Error(t, err)
 	assert.IsType(t, data.ErrInvalidRole{}, err)
 }
@@ -462,7 +467,7 @@ func TestApplyTargetsDelegationInvalidRole(t *testing.T) {
 		tdJSON,
 	)
 
-	err = applyTargetsChange(repo, ch)
+	err = applyTargetsChange(repo, ch, logrus.StandardLogger())
 	assert.Error(t, err)
 }
 
@@ -491,7 +496,7 @@ func TestApplyTargetsDelegationInvalidJSONContent(t *testing.T) {
 		tdJSON[1:],
 	)
 
-	err = applyTargetsChange(repo, ch)
+	err = applyTargetsChange(repo, ch, logrus.StandardLogger())
 	assert.Error(t, err)
 }
 
@@ -506,7 +511,7 @@ func TestApplyTargetsDelegationInvalidAction(t *testing.T) {
 		nil,
 	)
 
-	err := applyTargetsChange(repo, ch)
+	err := applyTargetsChange(repo, ch, logrus.StandardLogger())
 	assert.Error(t, err)
 }
 
@@ -521,7 +526,7 @@ func TestApplyTargetsChangeInvalidType(t *testing.T) {
 		nil,
 	)
 
-	err := applyTargetsChange(repo, ch)
+	err := applyTargetsChange(repo, ch, logrus.StandardLogger())
 	assert.Error(t, err)
 }
 
@@ -553,7 +558,7 @@ func TestApplyTargetsDelegationConflictPathsPrefixes(t *testing.T) {
 		tdJSON,
 	)
 
-	err = applyTargetsChange(repo, ch)
+	err = applyTargetsChange(repo, ch, logrus.StandardLogger())
 	assert.NoError(t, err)
 
 	// add prefixes and update
@@ -570,7 +575,7 @@ func TestApplyTargetsDelegationConflictPathsPrefixes(t *testing.T) {
 		tdJSON,
 	)
 
-	err = applyTargetsChange(repo, ch)
+	err = applyTargetsChange(repo, ch, logrus.StandardLogger())
 	assert.Error(t, err)
 }
 
@@ -599,7 +604,7 @@ func TestApplyTargetsDelegationConflictPrefixesPaths(t *testing.T) {
 		tdJSON,
 	)
 
-	err = applyTargetsChange(repo, ch)
+	err = applyTargetsChange(repo, ch, logrus.StandardLogger())
 	assert.NoError(t, err)
 
 	// add paths and update
@@ -616,7 +621,7 @@ func TestApplyTargetsDelegationConflictPrefixesPaths(t *testing.T) {
 		tdJSON,
 	)
 
-	err = applyTargetsChange(repo, ch)
+	err = applyTargetsChange(repo, ch, logrus.StandardLogger())
 	assert.Error(t, err)
 }
 
@@ -646,7 +651,7 @@ func TestApplyTargetsDelegationCreateInvalid(t *testing.T) {
 		tdJSON,
 	)
 
-	err = applyTargetsChange(repo, ch)
+	err = applyTargetsChange(repo, ch, logrus.StandardLogger())
 	assert.Error(t, err)
 }
 
@@ -675,7 +680,7 @@ func TestApplyTargetsDelegationCreate2Deep(t *testing.T) {
 		tdJSON,
 	)
 
-	err = applyTargetsChange(repo, ch)
+	err = applyTargetsChange(repo, ch, logrus.StandardLogger())
 	assert.NoError(t, err)
 
 	tgts := repo.Targets[data.CanonicalTargetsRole]
@@ -712,7 +717,7 @@ func TestApplyTargetsDelegationCreate2Deep(t *testing.T) {
 		tdJSON,
 	)
 
-	err = applyTargetsChange(repo, ch)
+	err = applyTargetsChange(repo, ch, logrus.StandardLogger())
 	assert.NoError(t, err)
 
 	tgts = repo.Targets["targets/level1"]
@@ -759,7 +764,174 @@ func TestApplyTargetsDelegationParentDoesntExist(t *testing.T) {
 		tdJSON,
 	)
 
-	err = applyTargetsChange(repo, ch)
+	err = applyTargetsChange(repo, ch, logrus.StandardLogger())
 	assert.Error(t, err)
 	assert.IsType(t, data.ErrInvalidRole{}, err)
 }
+
+// Only target names that appear in more than one role are reported as
+// duplicates, and the roles claiming them are sorted.
+func TestDuplicateTargetNames(t *testing.T) {
+	_, repo, _ := testutils.EmptyRepo()
+	repo.Targets["targets/b"] = data.NewTargets()
+	repo.Targets["targets/a"] = data.NewTargets()
+
+	hash := sha256.Sum256([]byte{})
+	meta := data.FileMeta{Length: 1, Hashes: data.Hashes{"sha256": hash[:]}}
+	repo.Targets["targets"].Signed.Targets["unique"] = meta
+	for _, role := range []string{"targets", "targets/a", "targets/b"} {
+		repo.Targets[role].Signed.Targets["shared"] = meta
+	}
+	repo.Targets["targets/b"].Signed.Targets["pair"] = meta
+	repo.Targets["targets/a"].Signed.Targets["pair"] = meta
+
+	dups := duplicateTargetNames(repo)
+	assert.Len(t, dups, 2)
+	assert.Equal(t, []string{"targets", "targets/a", "targets/b"}, dups["shared"])
+	assert.Equal(t, []string{"targets/a", "targets/b"}, dups["pair"])
+}
+
+// Metadata is batched in publish order, with the snapshot last, and no batch
+// exceeds the maximum size unless it holds a single oversized role.
+func TestBatchMetadata(t *testing.T) {
+	metas := map[string][]byte{
+		data.CanonicalTargetsRole: make([]byte, 10),
+		"targets/b":               make([]byte, 10),
+		"targets/a/x":             make([]byte, 10),
+		"targets/a":               make([]byte, 30),
+		data.CanonicalRootRole:    make([]byte, 10),
+	}
+
+	// no limit means a single batch, with parents before their children
+	batches := batchMetadata(metas, 0)
+	assert.Equal(t, [][]string{{data.CanonicalRootRole, data.CanonicalTargetsRole,
+		"targets/a", "targets/b", "targets/a/x"}}, batches)
+
+	// root and targets always go together, even if they exceed the limit
+	batches = batchMetadata(metas, 10)
+	assert.Equal(t, [][]string{
+		{data.CanonicalRootRole, data.CanonicalTargetsRole},
+		{"targets/a"},
+		{"targets/b"},
+		{"targets/a/x"},
+	}, batches)
+
+	batches = batchMetadata(metas, 40)
+	assert.Equal(t, [][]string{
+		{data.CanonicalRootRole, data.CanonicalTargetsRole},
+		{"targets/a", "targets/b"},
+		{"targets/a/x"},
+	}, batches)
+
+	// a client-signed snapshot is never split from the roles it references
+	metas[data.CanonicalSnapshotRole] = make([]byte, 10)
+	batches = batchMetadata(metas, 10)
+	assert.Equal(t, [][]string{{data.CanonicalRootRole, data.CanonicalTargetsRole,
+		"targets/a", "targets/b", "targets/a/x", data.CanonicalSnapshotRole}}, batches)
+}
+
+// Only the delegations expiring within the window are renewed, and those whose
+// keys aren't available are reported and left untouched.
+func TestRenewDelegations(t *testing.T) {
+	_, repo, cs := testutils.EmptyRepo()
+
+	ourKey, err := cs.Create("targets/a", data.ED25519Key)
+	assert.NoError(t, err)
+	theirKey, err := signed.NewEd25519().Create("targets/b", data.ED25519Key)
+	assert.NoError(t, err)
+
+	for role, key := range map[string]data.PublicKey{
+		"targets/a": ourKey, "targets/b": theirKey, "targets/c": ourKey} {
+		r, err := data.NewRole(role, 1, nil, []string{""}, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, repo.UpdateDelegations(r, []data.PublicKey{key}))
+	}
+	soon := time.Now().Add(time.Hour)
+	repo.Targets["targets/a"].Signed.Expires = soon
+	repo.Targets["targets/b"].Signed.Expires = soon
+
+	renewed, unsignable, err := renewDelegations(repo, 24*time.Hour, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"targets/a"}, renewed)
+	assert.Equal(t, []string{"targets/b"}, unsignable)
+
+	renewedTargets := repo.Targets["targets/a"]
+	assert.True(t, renewedTargets.Signed.Expires.After(soon))
+	assert.Equal(t, 1, renewedTargets.Signed.Version)
+	assert.Len(t, renewedTargets.Signatures, 1)
+
+	assert.Equal(t, soon, repo.Targets["targets/b"].Signed.Expires)
+	assert.Equal(t, 0, repo.Targets["targets/b"].Signed.Version)
+	assert.Equal(t, 0, repo.Targets["targets/c"].Signed.Version)
+}
+
+// A snapshot is consistent with a timestamp only if it has the length and
+// checksum the timestamp records for it.
+func TestCheckTimestampSnapshot(t *testing.T) {
+	_, repo, _ := testutils.EmptyRepo()
+	snapshotJSON, err := json.Marshal(repo.Snapshot)
+	assert.NoError(t, err)
+
+	meta, err := data.NewFileMeta(bytes.NewReader(snapshotJSON), "sha256")
+	assert.NoError(t, err)
+	repo.Timestamp.Signed.Meta[data.CanonicalSnapshotRole] = meta
+
+	assert.NoError(t, checkTimestampSnapshot(repo.Timestamp, snapshotJSON))
+
+	// same length, different contents
+	tampered := append([]byte{}, snapshotJSON...)
+	tampered[len(tampered)-1] = ' '
+	assert.IsType(t, ErrTimestampSnapshotMismatch{},
+		checkTimestampSnapshot(repo.Timestamp, tampered))
+
+	assert.IsType(t, ErrTimestampSnapshotMismatch{},
+		checkTimestampSnapshot(repo.Timestamp, snapshotJSON[1:]))
+
+	delete(repo.Timestamp.Signed.Meta, data.CanonicalSnapshotRole)
+	assert.IsType(t, ErrTimestampSnapshotMismatch{},
+		checkTimestampSnapshot(repo.Timestamp, snapshotJSON))
+}
+
+// marshalSigned serializes signed metadata exactly as json.Marshal does.
+func TestMarshalSigned(t *testing.T) {
+	_, repo, _ := testutils.EmptyRepo()
+	_, err := repo.AddTargets(data.CanonicalTargetsRole, data.Files{
+		"latest": data.FileMeta{Length: 1, Hashes: data.Hashes{"sha256": make([]byte, 32)}},
+	})
+	assert.NoError(t, err)
+	s, err := repo.SignTargets(data.CanonicalTargetsRole, data.DefaultExpires(data.CanonicalTargetsRole))
+	assert.NoError(t, err)
+
+	expected, err := json.Marshal(s)
+	assert.NoError(t, err)
+	actual, err := marshalSigned(s)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+// BenchmarkSerializeLargeTargetsRole measures signing and serializing a
+// targets role with many targets, as Publish does after a single target was
+// added to it.
+func BenchmarkSerializeLargeTargetsRole(b *testing.B) {
+	_, repo, _ := testutils.EmptyRepo()
+	files := make(data.Files)
+	for i := 0; i < 20000; i++ {
+		files[fmt.Sprintf("target-%06d", i)] = data.FileMeta{
+			Length: int64(i),
+			Hashes: data.Hashes{"sha256": make([]byte, 32)},
+		}
+	}
+	_, err := repo.AddTargets(data.CanonicalTargetsRole, files)
+	if err != nil {
+		b.Fatal(err)
+	}
+	now := time.Now()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := serializeTargetsRole(repo, data.CanonicalTargetsRole, now); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"encoding/json"
+	"path/filepath"
+
+	tuf "github.com/docker/notary/tuf"
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/keys"
+	"github.com/docker/notary/tuf/signed"
+	"github.com/docker/notary/tuf/store"
+)
+
+// ImportMetadata verifies jsonBytes, the signed metadata of the targets role
+// or of a delegated role that was received out-of-band, against the trust
+// data in the cache, and if it is valid writes it to the cache.  The server
+// is never contacted.  Metadata that isn't signed by the role's keys, that
+// has expired, or that is older than the role's cached metadata is rejected.
+func (r *NotaryRepository) ImportMetadata(role string, jsonBytes []byte) (err error) {
+	end := r.startOp("ImportMetadata", map[string]string{"role": role})
+	defer func() { end(err) }()
+
+	if role != data.CanonicalTargetsRole && !data.IsDelegation(role) {
+		return data.ErrInvalidRole{Role: role, Reason: "only targets metadata can be imported"}
+	}
+	ancestors := []string{}
+	for parent := role; parent != data.CanonicalTargetsRole; {
+		parent = filepath.Dir(parent)
+		ancestors = append([]string{parent}, ancestors...)
+	}
+	kdb, err := r.cachedTrust(ancestors)
+	if err != nil {
+		return err
+	}
+	if kdb.GetRole(role) == nil {
+		return data.ErrInvalidRole{Role: role, Reason: "role is not delegated by the cached trust data"}
+	}
+
+	s := &data.Signed{}
+	if err := json.Unmarshal(jsonBytes, s); err != nil {
+		return err
+	}
+	if _, err := data.TargetsFromSigned(s); err != nil {
+		return err
+	}
+	// the imported metadata must not roll back the cached metadata
+	minVersion := 0
+	cachedJSON, err := r.fileStore.GetMeta(role, maxSize)
+	if err == nil {
+		cached := &data.SignedTargets{}
+		if err := json.Unmarshal(cachedJSON, cached); err != nil {
+			return r.corruptedCache(role, err)
+		}
+		minVersion = cached.Signed.Version
+	} else if _, ok := err.(store.ErrMetaNotFound); !ok {
+		return err
+	}
+	if err := signed.Verify(s, role, minVersion, kdb); err != nil {
+		return err
+	}
+	return r.fileStore.SetMeta(role, jsonBytes)
+}
+
+// cachedTrust returns the keys and roles trusted by the cached root and by
+// the cached metadata of each of the targets roles, in order from the
+// targets role down, which are all validated along the way
+func (r *NotaryRepository) cachedTrust(targetsRoles []string) (*keys.KeyDB, error) {
+	rootJSON, err := r.fileStore.GetMeta(data.CanonicalRootRole, maxSize)
+	if err != nil {
+		return nil, r.corruptedCache(data.CanonicalRootRole, err)
+	}
+	root := &data.Signed{}
+	if err := json.Unmarshal(rootJSON, root); err != nil {
+		return nil, r.corruptedCache(data.CanonicalRootRole, err)
+	}
+	if err := r.validateRoot(root); err != nil {
+		return nil, err
+	}
+	signedRoot, err := data.RootFromSigned(root)
+	if err != nil {
+		return nil, err
+	}
+
+	kdb := keys.NewDB()
+	tufRepo := tuf.NewRepo(kdb, nil)
+	if err := tufRepo.SetRoot(signedRoot); err != nil {
+		return nil, err
+	}
+	for _, role := range targetsRoles {
+		targetsJSON, err := r.fileStore.GetMeta(role, maxSize)
+		if err != nil {
+			return nil, r.corruptedCache(role, err)
+		}
+		s := &data.Signed{}
+		if err := json.Unmarshal(targetsJSON, s); err != nil {
+			return nil, r.corruptedCache(role, err)
+		}
+		if err := signed.Verify(s, role, 0, kdb); err != nil {
+			return nil, err
+		}
+		targets, err := data.TargetsFromSigned(s)
+		if err != nil {
+			return nil, err
+		}
+		if err := tufRepo.SetTargets(role, targets); err != nil {
+			return nil, err
+		}
+	}
+	return kdb, nil
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/signed"
+	"github.com/stretchr/testify/assert"
+)
+
+// Targets metadata received out-of-band is imported into the cache without
+// contacting the server, but only if the cached trust data validates it.
+func TestImportMetadata(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	key, err := repo.CryptoService.Create("targets/a", data.ECDSAKey)
+	assert.NoError(t, err)
+	addDelegationWithPaths(t, repo, "targets/a", key)
+	assert.NoError(t, repo.Publish())
+	assert.NoError(t, repo.PrefetchDelegations())
+
+	tempBaseDir2, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir2)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	reader, err := NewNotaryRepository(
+		tempBaseDir2, gun, ts.URL, http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.PrefetchDelegations())
+	oldJSON, err := reader.fileStore.GetMeta("targets/a", maxSize)
+	assert.NoError(t, err)
+
+	// the server is never contacted
+	ts.Close()
+
+	sign := func(expires time.Time) []byte {
+		s, err := repo.tufRepo.SignTargets("targets/a", expires)
+		assert.NoError(t, err)
+		signedJSON, err := json.Marshal(s)
+		assert.NoError(t, err)
+		return signedJSON
+	}
+
+	_, err = repo.tufRepo.AddTargets("targets/a", data.Files{
+		"latest": data.FileMeta{Length: 1, Hashes: data.Hashes{"sha256": make([]byte, 32)}},
+	})
+	assert.NoError(t, err)
+	newJSON := sign(data.DefaultExpires(data.CanonicalTargetsRole))
+	assert.NoError(t, reader.ImportMetadata("targets/a", newJSON))
+	cachedJSON, err := reader.fileStore.GetMeta("targets/a", maxSize)
+	assert.NoError(t, err)
+	assert.Equal(t, newJSON, cachedJSON)
+
+	// the cached metadata can't be rolled back
+	err = reader.ImportMetadata("targets/a", oldJSON)
+	assert.IsType(t, signed.ErrLowVersion{}, err)
+
+	err = reader.ImportMetadata("targets/a", sign(time.Now().Add(-time.Hour)))
+	assert.IsType(t, signed.ErrExpired{}, err)
+
+	// metadata with a signature that doesn't verify
+	s := &data.Signed{}
+	assert.NoError(t, json.Unmarshal(sign(data.DefaultExpires(data.CanonicalTargetsRole)), s))
+	s.Signatures[0].Signature[0] ^= 0xff
+	badJSON, err := json.Marshal(s)
+	assert.NoError(t, err)
+	assert.Error(t, reader.ImportMetadata("targets/a", badJSON))
+
+	// only delegated targets roles can be imported
+	assert.IsType(t, data.ErrInvalidRole{}, reader.ImportMetadata("targets/b", newJSON))
+	assert.IsType(t, data.ErrInvalidRole{}, reader.ImportMetadata(data.CanonicalRootRole, newJSON))
+
+	cachedJSON, err = reader.fileStore.GetMeta("targets/a", maxSize)
+	assert.NoError(t, err)
+	assert.Equal(t, newJSON, cachedJSON)
+}
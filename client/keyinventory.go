@@ -0,0 +1,123 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/notary/passphrase"
+	"github.com/docker/notary/trustmanager"
+	"github.com/docker/notary/tuf/data"
+)
+
+// KeyInfo describes a private key held in a key store
+type KeyInfo struct {
+	GUN       string // "" if the role is root
+	Role      string
+	KeyID     string
+	Algorithm string // "" if it couldn't be read from the key store
+	Location  string
+}
+
+// KeyInventory lists every private key in the key store under baseDir, for
+// every GUN, in no particular order.  No key is decrypted, so the retriever is
+// never asked for a passphrase.
+func KeyInventory(baseDir string, retriever passphrase.Retriever) ([]KeyInfo, error) {
+	fileKeyStore, err := trustmanager.NewKeyFileStore(baseDir, retriever)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create private key store in directory: %s", baseDir)
+	}
+	return KeyStoresInventory([]trustmanager.KeyStore{fileKeyStore}), nil
+}
+
+// KeyStoresInventory lists every private key in the given key stores, in no
+// particular order.  The algorithm of each key is read from its encrypted
+// form, and is left empty for keys that can't be exported or read, which are
+// listed all the same.
+func KeyStoresInventory(keyStores []trustmanager.KeyStore) []KeyInfo {
+	var info []KeyInfo
+	for _, store := range keyStores {
+		for keyPath, role := range store.ListKeys() {
+			gun := ""
+			if role != data.CanonicalRootRole {
+				gun = filepath.Dir(keyPath)
+			}
+			info = append(info, KeyInfo{
+				GUN:       gun,
+				Role:      role,
+				KeyID:     filepath.Base(keyPath),
+				Algorithm: keyAlgorithm(store, keyPath),
+				Location:  store.Name(),
+			})
+		}
+	}
+	return info
+}
+
+// keyAlgorithm returns the algorithm of the key at keyPath in store, or "" if
+// it can't be read
+func keyAlgorithm(store trustmanager.KeyStore, keyPath string) string {
+	pemBytes, err := store.ExportKey(keyPath)
+	if err == nil {
+		var algorithm string
+		if algorithm, err = trustmanager.KeyAlgorithmFromPEM(pemBytes); err == nil {
+			return algorithm
+		}
+	}
+	logrus.Debugf("unable to read the algorithm of key %s in %s: %v", keyPath, store.Name(), err)
+	return ""
+}
+
+// ListRepositories returns the sorted GUNs of every repository with local
+// state under baseDir: trust data or a changelist in its trust directory, or
+// signing keys in the key store.  Root keys aren't tied to a GUN, so they
+// don't count.  No key is decrypted.  Only trust data cached with the default
+// CacheLayout is found.
+func ListRepositories(baseDir string) ([]string, error) {
+	guns := make(map[string]bool)
+
+	tufPath := filepath.Join(baseDir, tufDir)
+	err := filepath.Walk(tufPath, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == tufPath {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() || path == tufPath {
+			return nil
+		}
+		switch info.Name() {
+		case "metadata", "changelist":
+			gun, err := filepath.Rel(tufPath, filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+			guns[filepath.ToSlash(gun)] = true
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fileKeyStore, err := trustmanager.NewKeyFileStore(baseDir, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create private key store in directory: %s", baseDir)
+	}
+	for keyPath, role := range fileKeyStore.ListKeys() {
+		if role != data.CanonicalRootRole {
+			guns[filepath.ToSlash(filepath.Dir(keyPath))] = true
+		}
+	}
+
+	list := make([]string, 0, len(guns))
+	for gun := range guns {
+		list = append(list, gun)
+	}
+	sort.Strings(list)
+	return list, nil
+}
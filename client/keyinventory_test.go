@@ -0,0 +1,121 @@
+package client
+
+import (
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/notary/trustmanager"
+	"github.com/docker/notary/tuf/data"
+	"github.com/stretchr/testify/assert"
+)
+
+// The inventory lists the root and signing keys of every GUN in the key store,
+// with their algorithms.
+func TestKeyInventory(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	inventory, err := KeyInventory(tempBaseDir, passphraseRetriever)
+	assert.NoError(t, err)
+	assert.Empty(t, inventory)
+
+	fileKeyStore, err := trustmanager.NewKeyFileStore(tempBaseDir, passphraseRetriever)
+	assert.NoError(t, err)
+
+	rootKey, err := trustmanager.GenerateECDSAKey(rand.Reader)
+	assert.NoError(t, err)
+	assert.NoError(t, fileKeyStore.AddKey(rootKey.ID(), data.CanonicalRootRole, rootKey))
+
+	expected := map[string]KeyInfo{
+		rootKey.ID(): {Role: data.CanonicalRootRole, KeyID: rootKey.ID(),
+			Algorithm: data.ECDSAKey, Location: fileKeyStore.Name()},
+	}
+	for _, gun := range []string{"docker.com/notary", "docker.com/other"} {
+		key, err := trustmanager.GenerateED25519Key(rand.Reader)
+		assert.NoError(t, err)
+		assert.NoError(t, fileKeyStore.AddKey(
+			filepath.Join(gun, key.ID()), data.CanonicalTargetsRole, key))
+		expected[key.ID()] = KeyInfo{GUN: gun, Role: data.CanonicalTargetsRole,
+			KeyID: key.ID(), Algorithm: data.ED25519Key, Location: fileKeyStore.Name()}
+	}
+
+	// no key is decrypted, so no passphrase is needed
+	noPassphrase := func(string, string, bool, int) (string, bool, error) {
+		return "", true, errors.New("no passphrase should be needed")
+	}
+	inventory, err = KeyInventory(tempBaseDir, noPassphrase)
+	assert.NoError(t, err)
+	assert.Len(t, inventory, len(expected))
+	for _, info := range inventory {
+		assert.Equal(t, expected[info.KeyID], info)
+	}
+}
+
+// unexportableKeyStore is a key store whose keys can't be exported, like a
+// hardware key store
+type unexportableKeyStore struct {
+	trustmanager.KeyStore
+}
+
+func (s unexportableKeyStore) ExportKey(name string) ([]byte, error) {
+	return nil, errors.New("keys can't be exported")
+}
+
+// Keys whose algorithm can't be read are still listed, without an algorithm.
+func TestKeyStoresInventoryUnreadableKey(t *testing.T) {
+	keyStore := trustmanager.NewKeyMemoryStore(passphraseRetriever)
+	key, err := trustmanager.GenerateECDSAKey(rand.Reader)
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.AddKey(key.ID(), data.CanonicalRootRole, key))
+
+	inventory := KeyStoresInventory([]trustmanager.KeyStore{
+		unexportableKeyStore{KeyStore: keyStore}})
+	assert.Equal(t, []KeyInfo{{Role: data.CanonicalRootRole, KeyID: key.ID(),
+		Location: keyStore.Name()}}, inventory)
+}
+
+// ListRepositories lists the GUNs with trust data, staged changes or signing
+// keys under the base directory.
+func TestListRepositories(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	guns, err := ListRepositories(tempBaseDir)
+	assert.NoError(t, err)
+	assert.Empty(t, guns)
+
+	ts, _, _ := simpleTestServer(t)
+	defer ts.Close()
+
+	// trust data and keys
+	initializeRepo(t, data.ECDSAKey, tempBaseDir, "docker.com/notary", ts.URL, false)
+	// only staged changes
+	repo, err := NewNotaryRepository(tempBaseDir, "docker.com/staged", ts.URL,
+		http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err)
+	addTarget(t, repo, "latest", "../fixtures/intermediate-ca.crt")
+	// only a key
+	fileKeyStore, err := trustmanager.NewKeyFileStore(tempBaseDir, passphraseRetriever)
+	assert.NoError(t, err)
+	key, err := trustmanager.GenerateECDSAKey(rand.Reader)
+	assert.NoError(t, err)
+	assert.NoError(t, fileKeyStore.AddKey(
+		filepath.Join("docker.com/keys", key.ID()), data.CanonicalTargetsRole, key))
+	// a root key belongs to no repository
+	rootKey, err := trustmanager.GenerateECDSAKey(rand.Reader)
+	assert.NoError(t, err)
+	assert.NoError(t, fileKeyStore.AddKey(rootKey.ID(), data.CanonicalRootRole, rootKey))
+
+	guns, err = ListRepositories(tempBaseDir)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"docker.com/keys", "docker.com/notary", "docker.com/staged"}, guns)
+}
@@ -0,0 +1,26 @@
+package client
+
+import (
+	"github.com/Sirupsen/logrus"
+)
+
+// Logger is what a NotaryRepository logs to.  Both *logrus.Logger and
+// *logrus.Entry implement it, so a repository can be given its own logger,
+// with its own level and output, or an entry with fields identifying it.
+type Logger interface {
+	Debug(args ...interface{})
+	Debugf(format string, args ...interface{})
+	Warn(args ...interface{})
+	Warnf(format string, args ...interface{})
+	Error(args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// logger returns the repository's Logger, or the global logrus logger if it
+// hasn't been given one
+func (r *NotaryRepository) logger() Logger {
+	if r.Logger != nil {
+		return r.Logger
+	}
+	return logrus.StandardLogger()
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/notary/tuf/data"
+	"github.com/stretchr/testify/assert"
+)
+
+// A repository with its own Logger logs to it, at that logger's level, and
+// not to the global logrus logger.
+func TestRepositoryLogger(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+
+	var global bytes.Buffer
+	out := logrus.StandardLogger().Out
+	logrus.SetOutput(&global)
+	defer logrus.SetOutput(out)
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.DebugLevel)
+	defer logrus.SetLevel(level)
+
+	var own bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &own
+	logger.Level = logrus.DebugLevel
+	repo.Logger = logger.WithField("gun", gun)
+
+	addTarget(t, repo, "latest", "../fixtures/intermediate-ca.crt")
+	assert.Contains(t, own.String(), `Adding target \"latest\"`)
+	assert.Contains(t, own.String(), `gun="docker.com/notary"`)
+	assert.NotContains(t, global.String(), "Adding target")
+
+	// so do the changes applied when publishing
+	assert.NoError(t, repo.Publish())
+	assert.Contains(t, own.String(), "applied 1 change(s)")
+	assert.Contains(t, own.String(), "changelist add: latest")
+	assert.NotContains(t, global.String(), "applied 1 change(s)")
+	assert.NotContains(t, global.String(), "changelist add")
+}
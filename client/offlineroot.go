@@ -0,0 +1,222 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/signed"
+	"github.com/docker/notary/tuf/utils"
+)
+
+// ErrNoStagedRoot is returned by AttachRootSignature when no root has been
+// prepared for offline signing
+var ErrNoStagedRoot = errors.New("no root has been prepared for offline signing")
+
+// ErrInvalidRootSignature is returned by AttachRootSignature when a signature
+// isn't a valid signature of the prepared root by the root key with the given
+// ID
+type ErrInvalidRootSignature struct {
+	KeyID  string
+	Reason string
+}
+
+func (e ErrInvalidRootSignature) Error() string {
+	return fmt.Sprintf("invalid root signature for key %s: %s", e.KeyID, e.Reason)
+}
+
+// ErrStagedRootOutdated is returned by Publish when the root prepared for
+// offline signing is no longer the root the repository would publish, e.g.
+// because the root changed on the server, or further changes to it were
+// staged.  The root has to be prepared and signed again.
+type ErrStagedRootOutdated struct {
+	Version int
+}
+
+func (e ErrStagedRootOutdated) Error() string {
+	return fmt.Sprintf(
+		"the root (version %d) prepared for offline signing is outdated and must be prepared again",
+		e.Version)
+}
+
+// PrepareRootForOfflineSigning prepares the root the next Publish will
+// upload, with the staged changes to it applied, and returns the canonical
+// bytes the root keys have to sign, e.g. on a machine that isn't online.  The
+// signatures are then given to AttachRootSignature, and the next Publish
+// uploads the root with them instead of signing it with the root keys, which
+// need not be available.  Preparing the root again discards any signatures
+// attached to the previously prepared one.
+func (r *NotaryRepository) PrepareRootForOfflineSigning() (signedBytes []byte, err error) {
+	if r.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	end := r.startOp("PrepareRootForOfflineSigning", nil)
+	defer func() { end(err) }()
+
+	defer r.lockChangelist()()
+
+	if _, _, _, err := r.applyPendingChanges(); err != nil {
+		return nil, err
+	}
+
+	// this is the root SignRoot would sign when publishing
+	root := *r.tufRepo.Root
+	root.Signed.Version++
+	root.Signed.Expires = data.DefaultExpiresFrom(data.CanonicalRootRole, r.now())
+	root.Signatures = nil
+	s, err := root.ToSigned()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.saveStagedRoot(s); err != nil {
+		return nil, err
+	}
+	return s.Signed, nil
+}
+
+// AttachRootSignature adds sig, a signature by the root key with the given ID
+// of the bytes returned by PrepareRootForOfflineSigning, to the prepared root.
+// The key must be one of the root keys of the prepared root, and the
+// signature must verify against it.  A signature previously attached for the
+// same key is replaced.
+func (r *NotaryRepository) AttachRootSignature(keyID string, sig []byte) (err error) {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+
+	end := r.startOp("AttachRootSignature", map[string]string{"keyID": keyID})
+	defer func() { end(err) }()
+
+	defer r.lockChangelist()()
+
+	s, err := r.loadStagedRoot()
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return ErrNoStagedRoot
+	}
+	root, err := data.RootFromSigned(s)
+	if err != nil {
+		return err
+	}
+	rootRole, ok := root.Signed.Roles[data.CanonicalRootRole]
+	if !ok || !utils.StrSliceContains(rootRole.KeyIDs, keyID) {
+		return ErrInvalidRootSignature{KeyID: keyID, Reason: "not a root key"}
+	}
+	key, ok := root.Signed.Keys[keyID]
+	if !ok {
+		return ErrInvalidRootSignature{KeyID: keyID, Reason: "not a root key"}
+	}
+	method, err := verifyDetachedSignature(key, sig, s.Signed)
+	if err != nil {
+		return ErrInvalidRootSignature{KeyID: keyID, Reason: err.Error()}
+	}
+
+	signatures := []data.Signature{{KeyID: keyID, Method: method, Signature: sig}}
+	for _, existing := range s.Signatures {
+		if existing.KeyID != keyID {
+			signatures = append(signatures, existing)
+		}
+	}
+	s.Signatures = signatures
+	return r.saveStagedRoot(s)
+}
+
+// verifyDetachedSignature verifies sig against key with the signature methods
+// keys of its algorithm sign with, and returns the method it verifies with
+func verifyDetachedSignature(key data.PublicKey, sig, msg []byte) (data.SigAlgorithm, error) {
+	var methods []data.SigAlgorithm
+	switch key.Algorithm() {
+	case data.ECDSAKey, data.ECDSAx509Key:
+		methods = []data.SigAlgorithm{data.ECDSASignature}
+	case data.RSAKey, data.RSAx509Key:
+		methods = []data.SigAlgorithm{data.RSAPSSSignature, data.RSAPKCS1v15Signature}
+	case data.ED25519Key:
+		methods = []data.SigAlgorithm{data.EDDSASignature}
+	default:
+		return "", fmt.Errorf("unsupported key algorithm: %s", key.Algorithm())
+	}
+	for _, method := range methods {
+		if err := signed.Verifiers[method].Verify(key, sig, msg); err == nil {
+			return method, nil
+		}
+	}
+	return "", fmt.Errorf("signature does not verify")
+}
+
+// useStagedRoot makes the root prepared for offline signing the repository's
+// root, if it is still the root the repository would publish, and returns it
+// serialized for uploading.  It must have enough valid signatures attached.
+func (r *NotaryRepository) useStagedRoot(s *data.Signed) ([]byte, error) {
+	staged, err := data.RootFromSigned(s)
+	if err != nil {
+		return nil, err
+	}
+
+	// the staged root must be exactly what SignRoot would sign now
+	expected := data.SignedRoot{Signed: r.tufRepo.Root.Signed}
+	expected.Signed.Version++
+	expected.Signed.Expires = staged.Signed.Expires
+	expectedSigned, err := expected.ToSigned()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(expectedSigned.Signed, s.Signed) {
+		return nil, ErrStagedRootOutdated{Version: staged.Signed.Version}
+	}
+
+	if err := checkRootThreshold(staged, s); err != nil {
+		return nil, err
+	}
+	r.tufRepo.Root = staged
+	return json.Marshal(s)
+}
+
+func (r *NotaryRepository) stagedRootPath() string {
+	return filepath.Join(r.tufRepoPath, "staged", "root.json")
+}
+
+// loadStagedRoot returns the root prepared for offline signing, with the
+// signatures attached to it so far, or nil if there is none
+func (r *NotaryRepository) loadStagedRoot() (*data.Signed, error) {
+	raw, err := ioutil.ReadFile(r.stagedRootPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &data.Signed{}
+	if err := json.Unmarshal(raw, s); err != nil {
+		return nil, ErrCorruptedCache{
+			Role: data.CanonicalRootRole, Path: r.stagedRootPath(), Err: err}
+	}
+	return s, nil
+}
+
+func (r *NotaryRepository) saveStagedRoot(s *data.Signed) error {
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.stagedRootPath()), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.stagedRootPath(), raw, 0600)
+}
+
+// removeStagedRoot discards the root prepared for offline signing once it
+// has been published
+func (r *NotaryRepository) removeStagedRoot() {
+	if err := os.RemoveAll(r.stagedRootPath()); err != nil {
+		r.logger().Warnf("unable to remove the published staged root %s: %v",
+			r.stagedRootPath(), err)
+	}
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/signed"
+	"github.com/stretchr/testify/assert"
+)
+
+// A root change can be published with signatures made elsewhere by a root key
+// the repository doesn't have, once they have been attached to the root
+// prepared for offline signing.
+func TestOfflineRootSigning(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, rootKeyID := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	assert.NoError(t, repo.Publish())
+	rootRoleKeyID := repo.tufRepo.Root.Signed.Roles[data.CanonicalRootRole].KeyIDs[0]
+	snapshotKeyID := repo.tufRepo.Root.Signed.Roles[data.CanonicalSnapshotRole].KeyIDs[0]
+	rootVersion := repo.tufRepo.Root.Signed.Version
+
+	// move the root key offline
+	offlineKey, _, err := repo.CryptoService.GetPrivateKey(rootKeyID)
+	assert.NoError(t, err)
+	assert.NoError(t, repo.CryptoService.RemoveKey(rootKeyID))
+
+	err = repo.AttachRootSignature(rootRoleKeyID, []byte("sig"))
+	assert.Equal(t, ErrNoStagedRoot, err)
+
+	// rotating the snapshot key changes the root, which can't be signed here
+	assert.NoError(t, repo.RotateKey(data.CanonicalSnapshotRole, false))
+	assert.Error(t, repo.Publish())
+
+	toSign, err := repo.PrepareRootForOfflineSigning()
+	assert.NoError(t, err)
+
+	// the root can't be published without its signature
+	err = repo.Publish()
+	assert.IsType(t, signed.ErrInsufficientSignatures{}, err)
+
+	sig, err := offlineKey.Sign(rand.Reader, toSign, nil)
+	assert.NoError(t, err)
+
+	err = repo.AttachRootSignature(rootRoleKeyID, []byte("not a signature"))
+	assert.IsType(t, ErrInvalidRootSignature{}, err)
+	err = repo.AttachRootSignature(snapshotKeyID, sig)
+	assert.IsType(t, ErrInvalidRootSignature{}, err)
+
+	assert.NoError(t, repo.AttachRootSignature(rootRoleKeyID, sig))
+	assert.NoError(t, repo.Publish())
+	_, err = os.Stat(repo.stagedRootPath())
+	assert.True(t, os.IsNotExist(err))
+
+	// another client trusts the root signed offline, with the new snapshot key
+	tempBaseDir2, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir2)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	otherRepo, err := NewNotaryRepository(
+		tempBaseDir2, gun, ts.URL, http.DefaultTransport, passphraseRetriever)
+	assert.NoError(t, err)
+	_, err = otherRepo.ListTargets()
+	assert.NoError(t, err)
+	assert.Equal(t, rootVersion+1, otherRepo.tufRepo.Root.Signed.Version)
+	newSnapshotKeyIDs := otherRepo.tufRepo.Root.Signed.Roles[data.CanonicalSnapshotRole].KeyIDs
+	assert.Len(t, newSnapshotKeyIDs, 1)
+	assert.NotEqual(t, snapshotKeyID, newSnapshotKeyIDs[0])
+}
+
+// A prepared root is not published once further changes to the root have
+// been staged.
+func TestOfflineRootSigningOutdated(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, rootKeyID := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	assert.NoError(t, repo.Publish())
+	rootRoleKeyID := repo.tufRepo.Root.Signed.Roles[data.CanonicalRootRole].KeyIDs[0]
+
+	toSign, err := repo.PrepareRootForOfflineSigning()
+	assert.NoError(t, err)
+	rootKey, _, err := repo.CryptoService.GetPrivateKey(rootKeyID)
+	assert.NoError(t, err)
+	sig, err := rootKey.Sign(rand.Reader, toSign, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, repo.AttachRootSignature(rootRoleKeyID, sig))
+
+	assert.NoError(t, repo.RotateKey(data.CanonicalTargetsRole, false))
+	err = repo.Publish()
+	assert.IsType(t, ErrStagedRootOutdated{}, err)
+}
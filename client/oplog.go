@@ -0,0 +1,131 @@
+package client
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// OpLogger records the operations that modify a NotaryRepository, such as
+// AddTarget, RemoveTarget, AddDelegation, RotateKey and Publish.
+type OpLogger interface {
+	// Start is called when an operation begins, with its parameters
+	Start(op string, params map[string]string)
+
+	// End is called when an operation completes, with the same parameters
+	// and the error the operation returned, if any
+	End(op string, params map[string]string, err error)
+}
+
+// noopOpLogger is the OpLogger used when none has been configured
+type noopOpLogger struct{}
+
+func (noopOpLogger) Start(op string, params map[string]string)          {}
+func (noopOpLogger) End(op string, params map[string]string, err error) {}
+
+// OpLogEntry is a single line written by a FileOpLogger
+type OpLogEntry struct {
+	Time   time.Time         `json:"time"`
+	Actor  string            `json:"actor"`
+	Op     string            `json:"op"`
+	Phase  string            `json:"phase"`
+	Params map[string]string `json:"params,omitempty"`
+	Error  string            `json:"error,omitempty"`
+}
+
+const (
+	// OpPhaseStart marks the OpLogEntry written when an operation begins
+	OpPhaseStart = "start"
+	// OpPhaseEnd marks the OpLogEntry written when an operation completes
+	OpPhaseEnd = "end"
+)
+
+// FileOpLogger is an OpLogger that appends an OpLogEntry, as a line of JSON,
+// to a file for both the start and the end of every operation
+type FileOpLogger struct {
+	sync.Mutex
+	actor string
+	file  *os.File
+
+	// Logger, if set, is what failures to write to the log are logged to,
+	// instead of the global logrus logger.  It is usually the Logger of the
+	// repository the FileOpLogger is given to.
+	Logger Logger
+}
+
+// NewFileOpLogger opens (creating it if necessary) the operation log at path,
+// and returns an OpLogger that appends to it, attributing every operation to
+// actor.
+func NewFileOpLogger(path, actor string) (*FileOpLogger, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileOpLogger{actor: actor, file: file}, nil
+}
+
+// Start logs the start of an operation
+func (l *FileOpLogger) Start(op string, params map[string]string) {
+	l.write(OpLogEntry{Op: op, Phase: OpPhaseStart, Params: params})
+}
+
+// End logs the end of an operation, and its error if there was one
+func (l *FileOpLogger) End(op string, params map[string]string, err error) {
+	entry := OpLogEntry{Op: op, Phase: OpPhaseEnd, Params: params}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	l.write(entry)
+}
+
+// Close closes the underlying log file
+func (l *FileOpLogger) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.file.Close()
+}
+
+func (l *FileOpLogger) write(entry OpLogEntry) {
+	entry.Time = time.Now().UTC()
+	entry.Actor = l.actor
+	line, err := json.Marshal(entry)
+	if err == nil {
+		l.Lock()
+		_, err = l.file.Write(append(line, '\n'))
+		l.Unlock()
+	}
+	if err != nil {
+		l.logger().Warnf("unable to write %s of %s to the operation log: %s",
+			entry.Phase, entry.Op, err.Error())
+	}
+}
+
+// logger returns the Logger of the FileOpLogger, or the global logrus logger
+// if it hasn't been given one
+func (l *FileOpLogger) logger() Logger {
+	if l.Logger != nil {
+		return l.Logger
+	}
+	return logrus.StandardLogger()
+}
+
+// startOp logs the start of an operation on the repository, and returns the
+// function to call with the result of the operation once it has completed
+func (r *NotaryRepository) startOp(op string, params map[string]string) func(error) {
+	logger := r.OpLogger
+	if logger == nil {
+		logger = noopOpLogger{}
+	}
+	if params == nil {
+		params = make(map[string]string)
+	}
+	params["gun"] = r.gun
+
+	logger.Start(op, params)
+	return func(err error) {
+		logger.End(op, params, err)
+	}
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/notary/tuf/data"
+	"github.com/stretchr/testify/assert"
+)
+
+// Mutating operations on a repository with a FileOpLogger append a start and
+// an end entry to the log, including the parameters and any error.
+func TestFileOpLogger(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+
+	ts, _, _ := simpleTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+
+	logPath := filepath.Join(tempBaseDir, "ops.log")
+	logger, err := NewFileOpLogger(logPath, "tester")
+	assert.NoError(t, err)
+	repo.OpLogger = logger
+
+	addTarget(t, repo, "latest", "../fixtures/intermediate-ca.crt")
+	removeErr := repo.RemoveDelegation("not-a-delegation")
+	assert.Error(t, removeErr)
+	_, err = repo.PruneUnapplicableChanges()
+	assert.NoError(t, err)
+	_, err = repo.CompactCache(1)
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Close())
+
+	f, err := os.Open(logPath)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	var entries []OpLogEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry OpLogEntry
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	assert.NoError(t, scanner.Err())
+	assert.Len(t, entries, 8)
+
+	for i := range entries {
+		phase := OpPhaseStart
+		if i%2 == 1 {
+			phase = OpPhaseEnd
+		}
+		assert.Equal(t, phase, entries[i].Phase)
+		assert.Equal(t, "tester", entries[i].Actor)
+		assert.Equal(t, gun, entries[i].Params["gun"])
+		assert.False(t, entries[i].Time.IsZero())
+	}
+
+	assert.Equal(t, "AddTarget", entries[0].Op)
+	assert.Equal(t, "latest", entries[0].Params["target"])
+	assert.Empty(t, entries[1].Error)
+
+	assert.Equal(t, "RemoveDelegation", entries[3].Op)
+	assert.Equal(t, removeErr.Error(), entries[3].Error)
+
+	assert.Equal(t, "PruneUnapplicableChanges", entries[4].Op)
+	assert.Empty(t, entries[5].Error)
+
+	assert.Equal(t, "CompactCache", entries[6].Op)
+	assert.Equal(t, "1", entries[6].Params["keepVersions"])
+	assert.Empty(t, entries[7].Error)
+}
@@ -0,0 +1,48 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// healthPath is the path of the notary server's health check, relative to
+// its base URL
+const healthPath = "/_notary_server/health"
+
+// ErrServerUnhealthy is returned by Ping when the server at URL couldn't be
+// reached, in which case Err is why, or didn't report that it is healthy, in
+// which case StatusCode is the status it responded with.
+type ErrServerUnhealthy struct {
+	URL        string
+	StatusCode int
+	Err        error
+}
+
+func (e ErrServerUnhealthy) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("unable to reach the trust server at %s: %v", e.URL, e.Err)
+	}
+	return fmt.Sprintf("the trust server at %s is not healthy: %d", e.URL, e.StatusCode)
+}
+
+// Ping checks that the notary server at baseURL can be reached through rt,
+// and reports that it is healthy, without needing a repository.  It returns
+// nil if so, and ErrServerUnhealthy otherwise, e.g. so that a new environment
+// can wait for its server to be ready before initializing repositories.
+func Ping(baseURL string, rt http.RoundTripper) error {
+	url := strings.TrimSuffix(baseURL, "/") + healthPath
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	if err != nil {
+		return ErrServerUnhealthy{URL: baseURL, Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ErrServerUnhealthy{URL: baseURL, StatusCode: resp.StatusCode}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Ping succeeds against a healthy server, and otherwise says whether the
+// server was unreachable or unhealthy.
+func TestPing(t *testing.T) {
+	ts := fullTestServer(t)
+	assert.NoError(t, Ping(ts.URL, http.DefaultTransport))
+	assert.NoError(t, Ping(ts.URL+"/", nil))
+	ts.Close()
+
+	err := Ping(ts.URL, http.DefaultTransport)
+	assert.IsType(t, ErrServerUnhealthy{}, err)
+	assert.Error(t, err.(ErrServerUnhealthy).Err)
+
+	errServer := errorTestServer(t, http.StatusServiceUnavailable)
+	defer errServer.Close()
+	err = Ping(errServer.URL, http.DefaultTransport)
+	assert.IsType(t, ErrServerUnhealthy{}, err)
+	assert.Equal(t, http.StatusServiceUnavailable, err.(ErrServerUnhealthy).StatusCode)
+	assert.NoError(t, err.(ErrServerUnhealthy).Err)
+}
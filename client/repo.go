@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/docker/notary/certs"
 	"github.com/docker/notary/passphrase"
 	"github.com/docker/notary/trustmanager"
 )
@@ -17,11 +18,65 @@ func NewNotaryRepository(baseDir, gun, baseURL string, rt http.RoundTripper,
 	retriever passphrase.Retriever) (
 	*NotaryRepository, error) {
 
-	fileKeyStore, err := trustmanager.NewKeyFileStore(baseDir, retriever)
+	return NewNotaryRepositoryWithTrustPinning(baseDir, gun, baseURL, rt,
+		retriever, certs.TrustPinConfig{})
+}
+
+// NewNotaryRepositoryWithTrustPinning returns a new notary repository, like
+// NewNotaryRepository, whose root certificates are validated against the
+// trust pinned by trustPinning.
+func NewNotaryRepositoryWithTrustPinning(baseDir, gun, baseURL string,
+	rt http.RoundTripper, retriever passphrase.Retriever,
+	trustPinning certs.TrustPinConfig) (*NotaryRepository, error) {
+
+	return NewNotaryRepositoryWithDirs(baseDir, baseDir, gun, baseURL, rt,
+		retriever, trustPinning)
+}
+
+// NewNotaryRepositoryWithDirs returns a new notary repository, like
+// NewNotaryRepositoryWithTrustPinning, that keeps its private keys and
+// trusted certificates under keyDir, e.g. on an encrypted volume, and caches
+// its trust data under cacheDir.  The changelist of unpublished changes is
+// kept with the trust data.
+func NewNotaryRepositoryWithDirs(keyDir, cacheDir, gun, baseURL string,
+	rt http.RoundTripper, retriever passphrase.Retriever,
+	trustPinning certs.TrustPinConfig) (*NotaryRepository, error) {
+
+	certManager, err := certs.NewManagerWithTrustPinning(keyDir, trustPinning)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewNotaryRepositoryWithCertManager(keyDir, cacheDir, gun, baseURL, rt,
+		retriever, certManager)
+}
+
+// NewNotaryRepositoryWithCertManager returns a new notary repository, like
+// NewNotaryRepositoryWithDirs, whose root certificates are validated and
+// trusted by certManager rather than by a manager of its own under keyDir.
+// Repositories can then share one trust store, such as a system-wide one that
+// tooling has pre-populated with pinned roots.
+func NewNotaryRepositoryWithCertManager(keyDir, cacheDir, gun, baseURL string,
+	rt http.RoundTripper, retriever passphrase.Retriever,
+	certManager *certs.Manager) (*NotaryRepository, error) {
+
+	return NewNotaryRepositoryWithCacheLayout(keyDir, cacheDir, gun, baseURL, rt,
+		retriever, certManager, CacheLayout{})
+}
+
+// NewNotaryRepositoryWithCacheLayout returns a new notary repository, like
+// NewNotaryRepositoryWithCertManager, whose trust data is cached under
+// cacheDir as layout says, e.g. to follow the conventions of the tools that
+// scan the directory.
+func NewNotaryRepositoryWithCacheLayout(keyDir, cacheDir, gun, baseURL string,
+	rt http.RoundTripper, retriever passphrase.Retriever,
+	certManager *certs.Manager, layout CacheLayout) (*NotaryRepository, error) {
+
+	fileKeyStore, err := trustmanager.NewKeyFileStore(keyDir, retriever)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create private key store in directory: %s", baseDir)
+		return nil, fmt.Errorf("failed to create private key store in directory: %s", keyDir)
 	}
 
-	return repositoryFromKeystores(baseDir, gun, baseURL, rt,
-		[]trustmanager.KeyStore{fileKeyStore})
+	return repositoryFromKeystores(keyDir, cacheDir, gun, baseURL, rt,
+		[]trustmanager.KeyStore{fileKeyStore}, certManager, layout)
 }
@@ -0,0 +1,134 @@
+package client
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/signed"
+	"github.com/docker/notary/tuf/utils"
+)
+
+// SignerOverride signs msg, the canonical metadata of role, with the key with
+// the given ID, in place of the CryptoService, and returns the signature.
+type SignerOverride func(role string, msg []byte, keyID string) (*data.Signature, error)
+
+// ErrInvalidOverrideSignature is returned when a SignerOverride produces a
+// signature that doesn't verify against the key it was asked to sign with
+type ErrInvalidOverrideSignature struct {
+	Role  string
+	KeyID string
+	Err   error
+}
+
+func (e ErrInvalidOverrideSignature) Error() string {
+	return fmt.Sprintf("signer override produced an invalid %s signature for key %s: %v",
+		e.Role, e.KeyID, e.Err)
+}
+
+// signingService returns the CryptoService the tuf repo should sign with: the
+// repository's own, or one that routes the signing for the overridden roles
+// through the SignerOverride, if there is one
+func (r *NotaryRepository) signingService() signed.CryptoService {
+	if r.SignerOverride == nil {
+		return r.CryptoService
+	}
+	return &overridingCryptoService{CryptoService: r.CryptoService, repo: r, roles: r.overriddenRoles()}
+}
+
+// overriddenRoles returns the roles the SignerOverride signs, if there is one
+func (r *NotaryRepository) overriddenRoles() []string {
+	if r.SignerOverride == nil {
+		return nil
+	}
+	if len(r.SignerOverrideRoles) == 0 {
+		return []string{data.CanonicalTargetsRole, data.CanonicalSnapshotRole}
+	}
+	return r.SignerOverrideRoles
+}
+
+// overridingCryptoService is a CryptoService whose private keys for the
+// overridden roles sign through the repository's SignerOverride
+type overridingCryptoService struct {
+	signed.CryptoService
+	repo  *NotaryRepository
+	roles []string
+}
+
+// GetPrivateKey returns a private key that signs through the SignerOverride if
+// the key belongs to one of the overridden roles in the current root, and
+// the CryptoService's own private key otherwise
+func (s *overridingCryptoService) GetPrivateKey(keyID string) (data.PrivateKey, string, error) {
+	if tufRepo := s.repo.tufRepo; tufRepo != nil && tufRepo.Root != nil {
+		for _, role := range s.roles {
+			baseRole, ok := tufRepo.Root.Signed.Roles[role]
+			if !ok || !utils.StrSliceContains(baseRole.KeyIDs, keyID) {
+				continue
+			}
+			if pubKey, ok := tufRepo.Root.Signed.Keys[keyID]; ok {
+				return &overridePrivateKey{
+					PublicKey: pubKey,
+					role:      role,
+					override:  s.repo.SignerOverride,
+					logger:    s.repo.logger(),
+				}, role, nil
+			}
+		}
+	}
+	return s.CryptoService.GetPrivateKey(keyID)
+}
+
+// overridePrivateKey is a private key that signs by calling a SignerOverride,
+// and only returns signatures that verify against its public key
+type overridePrivateKey struct {
+	data.PublicKey
+	role     string
+	override SignerOverride
+	logger   Logger
+	method   data.SigAlgorithm
+}
+
+// Sign calls the SignerOverride and verifies the signature it returns
+func (k *overridePrivateKey) Sign(rand io.Reader, msg []byte, opts crypto.SignerOpts) ([]byte, error) {
+	sig, err := k.override(k.role, msg, k.ID())
+	if err == nil {
+		err = verifyOverrideSignature(k.PublicKey, sig, msg)
+	}
+	if err != nil {
+		err = ErrInvalidOverrideSignature{Role: k.role, KeyID: k.ID(), Err: err}
+		k.logger.Warn(err.Error())
+		return nil, err
+	}
+	k.method = sig.Method
+	return sig.Signature, nil
+}
+
+// Private returns nil, since the private key is never available
+func (k *overridePrivateKey) Private() []byte {
+	return nil
+}
+
+// CryptoSigner returns nil, since the key can only sign metadata
+func (k *overridePrivateKey) CryptoSigner() crypto.Signer {
+	return nil
+}
+
+// SignatureAlgorithm returns the algorithm of the last signature made
+func (k *overridePrivateKey) SignatureAlgorithm() data.SigAlgorithm {
+	return k.method
+}
+
+func verifyOverrideSignature(key data.PublicKey, sig *data.Signature, msg []byte) error {
+	if sig == nil {
+		return fmt.Errorf("no signature returned")
+	}
+	if sig.KeyID != "" && sig.KeyID != key.ID() {
+		return fmt.Errorf("signature is for key %s", sig.KeyID)
+	}
+	verifier, ok := signed.Verifiers[sig.Method]
+	if !ok {
+		return fmt.Errorf("unknown signature method: %s", sig.Method)
+	}
+	return verifier.Verify(key, sig.Signature, msg)
+}
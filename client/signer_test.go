@@ -0,0 +1,108 @@
+package client
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/docker/notary/tuf/data"
+	"github.com/stretchr/testify/assert"
+)
+
+// Publish signs the overridden roles through the SignerOverride, and fails if
+// the override produces signatures that don't verify.
+func TestSignerOverride(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+
+	signedRoles := make(map[string]int)
+	repo.SignerOverride = func(role string, msg []byte, keyID string) (*data.Signature, error) {
+		signedRoles[role]++
+		privKey, _, err := repo.CryptoService.GetPrivateKey(keyID)
+		if err != nil {
+			return nil, err
+		}
+		sig, err := privKey.Sign(rand.Reader, msg, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &data.Signature{KeyID: keyID, Method: privKey.SignatureAlgorithm(), Signature: sig}, nil
+	}
+
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+	assert.Equal(t, map[string]int{data.CanonicalTargetsRole: 1, data.CanonicalSnapshotRole: 1},
+		signedRoles)
+
+	targets, err := repo.ListTargets()
+	assert.NoError(t, err)
+	assert.Len(t, targets, 1)
+
+	// only the targets role is overridden, with signatures that don't verify
+	repo.SignerOverrideRoles = []string{data.CanonicalTargetsRole}
+	repo.SignerOverride = func(role string, msg []byte, keyID string) (*data.Signature, error) {
+		signedRoles[role]++
+		return &data.Signature{KeyID: keyID, Method: data.ECDSASignature, Signature: []byte("bad")}, nil
+	}
+
+	addTarget(t, repo, "v2", "../fixtures/intermediate-ca.crt")
+	assert.Error(t, repo.Publish())
+	assert.Equal(t, map[string]int{data.CanonicalTargetsRole: 2, data.CanonicalSnapshotRole: 1},
+		signedRoles)
+	assert.Len(t, getChanges(t, repo), 1, "changelist should not have been cleared")
+}
+
+// A repository whose only snapshot key is held by the SignerOverride signs
+// the snapshot through it, instead of leaving the snapshot to the server.
+func TestSignerOverrideHoldsOnlySnapshotKey(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+
+	// move the snapshot key out of the repository's CryptoService
+	snapshotKeyIDs := repo.tufRepo.Root.Signed.Roles[data.CanonicalSnapshotRole].KeyIDs
+	assert.Len(t, snapshotKeyIDs, 1)
+	snapshotKey, _, err := repo.CryptoService.GetPrivateKey(snapshotKeyIDs[0])
+	assert.NoError(t, err)
+	assert.NoError(t, repo.CryptoService.RemoveKey(snapshotKeyIDs[0]))
+	assert.Empty(t, repo.CryptoService.ListKeys(data.CanonicalSnapshotRole))
+
+	signedRoles := make(map[string]int)
+	repo.SignerOverrideRoles = []string{data.CanonicalSnapshotRole}
+	repo.SignerOverride = func(role string, msg []byte, keyID string) (*data.Signature, error) {
+		signedRoles[role]++
+		sig, err := snapshotKey.Sign(rand.Reader, msg, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &data.Signature{KeyID: keyID, Method: snapshotKey.SignatureAlgorithm(), Signature: sig}, nil
+	}
+
+	addTarget(t, repo, "v1", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+	assert.Equal(t, map[string]int{data.CanonicalSnapshotRole: 1}, signedRoles)
+
+	local, err := repo.SnapshotSignedLocally()
+	assert.NoError(t, err)
+	assert.True(t, local)
+
+	targets, err := repo.ListTargets()
+	assert.NoError(t, err)
+	assert.Len(t, targets, 1)
+}
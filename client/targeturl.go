@@ -0,0 +1,60 @@
+package client
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"text/template"
+
+	"github.com/docker/notary/tuf/data"
+)
+
+// ErrNoTargetURLTemplate is returned by TargetDownloadInfo when the
+// repository has no TargetURLTemplate
+var ErrNoTargetURLTemplate = errors.New("repository has no target URL template")
+
+// TargetURLFields are the fields of a target a TargetURLTemplate can refer
+// to.  The checksums are hex encoded, or empty if the target has none of that
+// algorithm.
+type TargetURLFields struct {
+	GUN    string
+	Name   string
+	Length int64
+	SHA256 string
+	SHA512 string
+}
+
+// TargetDownloadInfo looks up the verified target with the given name like
+// GetTargetByName, and returns the URL its content can be fetched from, made
+// with the repository's TargetURLTemplate, along with the checksums and
+// length the fetched content must have.  Notary doesn't fetch it: that's left
+// to the caller, who must check the content against them.
+func (r *NotaryRepository) TargetDownloadInfo(name string) (
+	url string, hashes data.Hashes, length int64, err error) {
+
+	if r.TargetURLTemplate == "" {
+		return "", nil, 0, ErrNoTargetURLTemplate
+	}
+	tmpl, err := template.New("target URL").Parse(r.TargetURLTemplate)
+	if err != nil {
+		return "", nil, 0, err
+	}
+
+	target, err := r.GetTargetByName(name)
+	if err != nil {
+		return "", nil, 0, err
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, TargetURLFields{
+		GUN:    r.gun,
+		Name:   target.Name,
+		Length: target.Length,
+		SHA256: hex.EncodeToString(target.Hashes["sha256"]),
+		SHA512: hex.EncodeToString(target.Hashes["sha512"]),
+	})
+	if err != nil {
+		return "", nil, 0, err
+	}
+	return buf.String(), target.Hashes, target.Length, nil
+}
@@ -0,0 +1,46 @@
+package client
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/docker/notary/tuf/data"
+	"github.com/stretchr/testify/assert"
+)
+
+// TargetDownloadInfo makes the URL of a target's content with the
+// repository's template, and returns what the content must match.
+func TestTargetDownloadInfo(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	target := addTarget(t, repo, "latest", "../fixtures/intermediate-ca.crt")
+	assert.NoError(t, repo.Publish())
+
+	_, _, _, err = repo.TargetDownloadInfo("latest")
+	assert.Equal(t, ErrNoTargetURLTemplate, err)
+
+	repo.TargetURLTemplate = "https://blobs.example.com/{{.GUN}}/sha256/{{.SHA256}}?name={{.Name}}&length={{.Length}}"
+	url, hashes, length, err := repo.TargetDownloadInfo("latest")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://blobs.example.com/docker.com/notary/sha256/"+
+		hex.EncodeToString(target.Hashes["sha256"])+"?name=latest&length=2213", url)
+	assert.Equal(t, target.Hashes, hashes)
+	assert.Equal(t, target.Length, length)
+
+	_, _, _, err = repo.TargetDownloadInfo("nonexistent")
+	assert.Error(t, err)
+
+	repo.TargetURLTemplate = "{{.Missing}}"
+	_, _, _, err = repo.TargetDownloadInfo("latest")
+	assert.Error(t, err)
+}
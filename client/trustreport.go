@@ -0,0 +1,248 @@
+package client
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/signed"
+	"github.com/docker/notary/tuf/utils"
+)
+
+// RoleReport describes how the metadata of one role validated
+type RoleReport struct {
+	Role      string
+	Version   int
+	Expires   time.Time
+	KeyIDs    []string // the keys trusted to sign for the role
+	Threshold int
+	// ValidSignatures is the number of the role's keys with a valid
+	// signature of the metadata
+	ValidSignatures int
+	// Err is why the metadata failed to validate, or nil if it validated, in
+	// which case it also met its threshold.  The version and expiry of metadata
+	// that failed to validate are unknown.
+	Err error
+}
+
+// TrustReport describes how the trust data of a repository validated: the
+// root, targets, snapshot and timestamp, then every delegated role that was
+// reached, breadth first.  A delegated role whose parent failed to validate
+// can't be reached.
+type TrustReport struct {
+	GUN   string
+	Roles []RoleReport
+}
+
+// Valid returns whether all the roles in the report validated
+func (t *TrustReport) Valid() bool {
+	for _, role := range t.Roles {
+		if role.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Audit updates the repository from the remote server, validating all of its
+// trust data including every delegated role, and reports how each role
+// validated.  If the root, targets, snapshot or timestamp fail to validate,
+// nothing else can be, and the error is returned; but delegated roles that
+// fail to validate are reported along with the others.
+func (r *NotaryRepository) Audit() (*TrustReport, error) {
+	c, err := r.updateTUF()
+	if err != nil {
+		return nil, err
+	}
+	failed := c.TryDownloadDelegations()
+
+	report := &TrustReport{GUN: r.gun}
+	root := r.tufRepo.Root.Signed
+	baseRoles := []struct {
+		name     string
+		toSigned func() (*data.Signed, error)
+	}{
+		{data.CanonicalRootRole, r.tufRepo.Root.ToSigned},
+		{data.CanonicalTargetsRole, r.tufRepo.Targets[data.CanonicalTargetsRole].ToSigned},
+		{data.CanonicalSnapshotRole, r.tufRepo.Snapshot.ToSigned},
+		{data.CanonicalTimestampRole, r.tufRepo.Timestamp.ToSigned},
+	}
+	for _, base := range baseRoles {
+		s, err := base.toSigned()
+		if err != nil {
+			return nil, err
+		}
+		role, ok := root.Roles[base.name]
+		if !ok {
+			return nil, data.ErrInvalidRole{Role: base.name, Reason: "role is not in the root"}
+		}
+		report.Roles = append(report.Roles,
+			roleReport(base.name, s, role.KeyIDs, role.Threshold, root.Keys))
+	}
+
+	// FIFO list of the targets roles whose delegations are to be reported
+	parents := []string{data.CanonicalTargetsRole}
+	for len(parents) > 0 {
+		parent := r.tufRepo.Targets[parents[0]]
+		parents = parents[1:]
+		for _, role := range parent.Signed.Delegations.Roles {
+			if err, ok := failed[role.Name]; ok {
+				report.Roles = append(report.Roles, RoleReport{
+					Role: role.Name, KeyIDs: role.KeyIDs, Threshold: role.Threshold, Err: err})
+				continue
+			}
+			targets, ok := r.tufRepo.Targets[role.Name]
+			if !ok {
+				// the role has not been published yet
+				continue
+			}
+			s, err := targets.ToSigned()
+			if err != nil {
+				return nil, err
+			}
+			report.Roles = append(report.Roles, roleReport(
+				role.Name, s, role.KeyIDs, role.Threshold, parent.Signed.Delegations.Keys))
+			parents = append(parents, role.Name)
+		}
+	}
+	return report, nil
+}
+
+// roleReport reports on the validated metadata s of role, signed by keyIDs
+func roleReport(role string, s *data.Signed, keyIDs []string, threshold int,
+	keys map[string]data.PublicKey) RoleReport {
+
+	report := RoleReport{Role: role, KeyIDs: keyIDs, Threshold: threshold}
+	common := data.SignedCommon{}
+	if err := json.Unmarshal(s.Signed, &common); err != nil {
+		report.Err = err
+		return report
+	}
+	report.Version = common.Version
+	report.Expires = common.Expires
+	report.ValidSignatures = countValidSignatures(s, keyIDs, keys)
+	return report
+}
+
+// countValidSignatures returns how many of keyIDs have valid signatures of s
+func countValidSignatures(s *data.Signed, keyIDs []string, keys map[string]data.PublicKey) int {
+	valid := make(map[string]bool)
+	for _, sig := range s.Signatures {
+		if !utils.StrSliceContains(keyIDs, sig.KeyID) {
+			continue
+		}
+		key, ok := keys[sig.KeyID]
+		if !ok {
+			continue
+		}
+		verifier, ok := signed.Verifiers[sig.Method]
+		if !ok {
+			continue
+		}
+		if verifier.Verify(key, sig.Signature, s.Signed) == nil {
+			valid[sig.KeyID] = true
+		}
+	}
+	return len(valid)
+}
+
+// TargetWithTrust is a target, along with the targets role that signed it,
+// and how that role's signatures of its metadata validated
+type TargetWithTrust struct {
+	TargetWithRole
+	KeyIDs    []string // the keys trusted to sign for the role
+	Threshold int
+	// ValidSignatures is the number of the role's keys with a valid
+	// signature of the role's metadata
+	ValidSignatures int
+}
+
+// ThresholdMet returns whether enough of the role's keys signed its metadata
+func (t *TargetWithTrust) ThresholdMet() bool {
+	return t.ValidSignatures >= t.Threshold
+}
+
+// ListTargetsWithTrust lists, sorted by name, the targets in the given
+// targets roles like ListTargetsByPrefix, along with the threshold of the
+// role each was listed from, and how many of the role's keys validly signed
+// it.  Metadata that doesn't meet its threshold fails to validate, but a
+// role that only just meets it may still be worth flagging.
+func (r *NotaryRepository) ListTargetsWithTrust(roles ...string) ([]*TargetWithTrust, error) {
+	c, err := r.updateTUF()
+	if err != nil {
+		return nil, err
+	}
+	if len(roles) == 0 {
+		roles = []string{data.CanonicalTargetsRole}
+	} else if err := c.DownloadDelegations(); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var targetList []*TargetWithTrust
+	for _, role := range roles {
+		role = strings.ToLower(role)
+		targets, ok := r.tufRepo.Targets[role]
+		if !ok {
+			return nil, data.ErrNoSuchRole{Role: role}
+		}
+		keyIDs, threshold, keys, err := r.signingKeys(role)
+		if err != nil {
+			return nil, err
+		}
+		s, err := targets.ToSigned()
+		if err != nil {
+			return nil, err
+		}
+		validSignatures := countValidSignatures(s, keyIDs, keys)
+		for name, meta := range targets.Signed.Targets {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			targetList = append(targetList, &TargetWithTrust{
+				TargetWithRole: TargetWithRole{
+					Target: Target{Name: name, Hashes: meta.Hashes, Length: meta.Length},
+					Role:   role,
+				},
+				KeyIDs:          keyIDs,
+				Threshold:       threshold,
+				ValidSignatures: validSignatures,
+			})
+		}
+	}
+	sort.Sort(targetsWithTrustByName(targetList))
+	return targetList, nil
+}
+
+// signingKeys returns the keys trusted to sign for the loaded targets role,
+// how many of them must sign, and the public keys: those of the root for the
+// base targets role, and those of its parent for a delegated role
+func (r *NotaryRepository) signingKeys(role string) ([]string, int, map[string]data.PublicKey, error) {
+	if role == data.CanonicalTargetsRole {
+		root := r.tufRepo.Root.Signed
+		baseRole, ok := root.Roles[role]
+		if !ok {
+			return nil, 0, nil, data.ErrInvalidRole{Role: role, Reason: "role is not in the root"}
+		}
+		return baseRole.KeyIDs, baseRole.Threshold, root.Keys, nil
+	}
+	parent, ok := r.tufRepo.Targets[path.Dir(role)]
+	if ok {
+		for _, delegation := range parent.Signed.Delegations.Roles {
+			if delegation.Name == role {
+				return delegation.KeyIDs, delegation.Threshold, parent.Signed.Delegations.Keys, nil
+			}
+		}
+	}
+	return nil, 0, nil, data.ErrNoSuchRole{Role: role}
+}
+
+type targetsWithTrustByName []*TargetWithTrust
+
+func (t targetsWithTrustByName) Len() int           { return len(t) }
+func (t targetsWithTrustByName) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t targetsWithTrustByName) Less(i, j int) bool { return t[i].Name < t[j].Name }
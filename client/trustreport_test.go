@@ -0,0 +1,142 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/docker/notary/client/changelist"
+	"github.com/docker/notary/cryptoservice"
+	"github.com/docker/notary/server/storage"
+	"github.com/docker/notary/trustmanager"
+	tufclient "github.com/docker/notary/tuf/client"
+	"github.com/docker/notary/tuf/data"
+	"github.com/stretchr/testify/assert"
+)
+
+// Audit reports on every role, including the delegated roles that fail to
+// validate.
+func TestAudit(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	gun := "docker.com/notary"
+	metaStore := storage.NewMemStorage()
+	ts := fullTestServerWithStorage(t, metaStore, cryptoservice.NewCryptoService(
+		"", trustmanager.NewKeyMemoryStore(passphraseRetriever)))
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, gun, ts.URL, false)
+	key, err := repo.CryptoService.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	for _, role := range []string{"targets/a", "targets/a/b", "targets/c"} {
+		addDelegationWithPaths(t, repo, role, key)
+	}
+	assert.NoError(t, repo.Publish())
+
+	report, err := repo.Audit()
+	assert.NoError(t, err)
+	assert.True(t, report.Valid())
+	assert.Equal(t, gun, report.GUN)
+	var roles []string
+	for _, role := range report.Roles {
+		roles = append(roles, role.Role)
+		assert.NoError(t, role.Err)
+		assert.Equal(t, 1, role.Threshold)
+		assert.Len(t, role.KeyIDs, 1)
+		assert.Equal(t, 1, role.ValidSignatures, "%s has no valid signature", role.Role)
+		assert.False(t, role.Expires.IsZero())
+		assert.True(t, role.Version > 0)
+	}
+	assert.Equal(t, []string{
+		data.CanonicalRootRole, data.CanonicalTargetsRole, data.CanonicalSnapshotRole,
+		data.CanonicalTimestampRole, "targets/a", "targets/c", "targets/a/b",
+	}, roles)
+	assert.Equal(t, key.ID(), report.Roles[4].KeyIDs[0])
+
+	// the server now serves a targets/a that isn't the one in the snapshot
+	tufRepo := repo.tufRepo
+	err = metaStore.UpdateCurrent(gun, storage.MetaUpdate{
+		Role:    "targets/a",
+		Version: tufRepo.Targets["targets/a"].Signed.Version + 1,
+		Data:    []byte("{}"),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, repo.fileStore.(interface {
+		RemoveMeta(name string) error
+	}).RemoveMeta("targets/a"))
+
+	report, err = repo.Audit()
+	assert.NoError(t, err)
+	assert.False(t, report.Valid())
+	roles = nil
+	for _, role := range report.Roles {
+		roles = append(roles, role.Role)
+	}
+	// targets/a/b can't be reached
+	assert.Equal(t, []string{
+		data.CanonicalRootRole, data.CanonicalTargetsRole, data.CanonicalSnapshotRole,
+		data.CanonicalTimestampRole, "targets/a", "targets/c",
+	}, roles)
+	assert.IsType(t, tufclient.ErrChecksumMismatch{}, report.Roles[4].Err)
+	assert.NoError(t, report.Roles[5].Err)
+}
+
+// Each target is listed with the threshold of the role it was listed from,
+// and how many of the role's keys signed it.
+func TestListTargetsWithTrust(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("/tmp", "notary-test-")
+	defer os.RemoveAll(tempBaseDir)
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+
+	ts := fullTestServer(t)
+	defer ts.Close()
+
+	repo, _ := initializeRepo(t, data.ECDSAKey, tempBaseDir, "docker.com/notary", ts.URL, false)
+	key1, err := repo.CryptoService.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	key2, err := repo.CryptoService.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	tdJSON, err := json.Marshal(&changelist.TufDelegation{
+		NewThreshold: 1,
+		AddKeys:      data.KeyList{key1, key2},
+		AddPaths:     []string{""},
+	})
+	assert.NoError(t, err)
+	cl, err := repo.GetChangelist()
+	assert.NoError(t, err)
+	assert.NoError(t, cl.Add(changelist.NewTufChange(changelist.ActionCreate,
+		"targets/a", changelist.TypeTargetsDelegation, "", tdJSON)))
+	addTarget(t, repo, "base", "../fixtures/intermediate-ca.crt")
+	addTarget(t, repo, "delegated", "../fixtures/intermediate-ca.crt", "targets/a")
+	// only one of the delegation's keys signs it
+	assert.NoError(t, repo.CryptoService.RemoveKey(key2.ID()))
+	assert.NoError(t, repo.Publish())
+
+	targets, err := repo.ListTargetsWithTrust()
+	assert.NoError(t, err)
+	assert.Len(t, targets, 1)
+	assert.Equal(t, "base", targets[0].Name)
+	assert.Equal(t, data.CanonicalTargetsRole, targets[0].Role)
+	assert.Equal(t, 1, targets[0].Threshold)
+	assert.Equal(t, 1, targets[0].ValidSignatures)
+	assert.True(t, targets[0].ThresholdMet())
+
+	targets, err = repo.ListTargetsWithTrust(data.CanonicalTargetsRole, "targets/a")
+	assert.NoError(t, err)
+	assert.Len(t, targets, 2)
+	delegated := targets[1]
+	assert.Equal(t, "delegated", delegated.Name)
+	assert.Equal(t, "targets/a", delegated.Role)
+	assert.Len(t, delegated.KeyIDs, 2)
+	assert.Equal(t, 1, delegated.Threshold)
+	assert.Equal(t, 1, delegated.ValidSignatures)
+	assert.True(t, delegated.ThresholdMet())
+
+	_, err = repo.ListTargetsWithTrust("targets/b")
+	assert.IsType(t, data.ErrNoSuchRole{}, err)
+}
@@ -117,6 +117,15 @@ func TestClientTufInteraction(t *testing.T) {
 	assert.NoError(t, err)
 	assert.False(t, strings.Contains(string(output), target))
 
+	// add and reset a target - nothing staged
+	_, err = runCommand(t, tempDir, "add", "gun", "discarded", tempFile.Name())
+	assert.NoError(t, err)
+	_, err = runCommand(t, tempDir, "reset", "gun")
+	assert.NoError(t, err)
+	output, err = runCommand(t, tempDir, "status", "gun")
+	assert.NoError(t, err)
+	assert.False(t, strings.Contains(string(output), "discarded"))
+
 	// list repo - see target
 	output, err = runCommand(t, tempDir, "-s", server.URL, "list", "gun")
 	assert.NoError(t, err)
@@ -143,6 +152,11 @@ func TestClientTufInteraction(t *testing.T) {
 	output, err = runCommand(t, tempDir, "-s", server.URL, "list", "gun")
 	assert.NoError(t, err)
 	assert.False(t, strings.Contains(string(output), target))
+
+	// list repo in full - see the (lack of) delegations
+	output, err = runCommand(t, tempDir, "-s", server.URL, "list", "--full", "gun")
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(string(output), "No delegations present"))
 }
 
 // Splits a string into lines, and returns any lines that are not empty (
@@ -110,6 +110,7 @@ type keyCommander struct {
 
 	// these are for command line parsing - no need to set
 	keysExportRootChangePassphrase bool
+	keysListFull                   bool
 	keysExportGUN                  string
 	rotateKeyRole                  string
 	rotateKeyServerManaged         bool
@@ -117,7 +118,10 @@ type keyCommander struct {
 
 func (k *keyCommander) GetCommand() *cobra.Command {
 	cmd := cmdKeyTemplate.ToCommand(nil)
-	cmd.AddCommand(cmdKeyListTemplate.ToCommand(k.keysList))
+	cmdKeyList := cmdKeyListTemplate.ToCommand(k.keysList)
+	cmdKeyList.Flags().BoolVar(&k.keysListFull, "full", false,
+		"Print every GUN and key location in full instead of truncating long ones")
+	cmd.AddCommand(cmdKeyList)
 	cmd.AddCommand(cmdKeyGenerateRootKeyTemplate.ToCommand(k.keysGenerateRootKey))
 	cmd.AddCommand(cmdKeysRestoreTemplate.ToCommand(k.keysRestore))
 	cmd.AddCommand(cmdKeyImportRootTemplate.ToCommand(k.keysImportRoot))
@@ -160,7 +164,7 @@ func (k *keyCommander) keysList(cmd *cobra.Command, args []string) error {
 	}
 
 	cmd.Println("")
-	prettyPrintKeys(ks, cmd.Out())
+	prettyPrintKeys(ks, cmd.Out(), k.keysListFull)
 	cmd.Println("")
 	return nil
 }
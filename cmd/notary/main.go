@@ -127,6 +127,7 @@ func setupCommand(notaryCmd *cobra.Command) {
 	notaryCmd.AddCommand(cmdTufAdd)
 	notaryCmd.AddCommand(cmdTufRemove)
 	notaryCmd.AddCommand(cmdTufStatus)
+	notaryCmd.AddCommand(cmdTufReset)
 	notaryCmd.AddCommand(cmdTufPublish)
 	notaryCmd.AddCommand(cmdTufLookup)
 	notaryCmd.AddCommand(cmdVerify)
@@ -6,8 +6,8 @@ import (
 	"fmt"
 	"io"
 	"math"
-	"path/filepath"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/docker/notary/client"
@@ -45,27 +45,20 @@ const (
 	maxLocWidth = 40
 )
 
-type keyInfo struct {
-	gun      string // assumption that this is "" if role is root
-	role     string
-	keyID    string
-	location string
-}
-
 // We want to sort by gun, then by role, then by keyID, then by location
 // In the case of a root role, then there is no GUN, and a root role comes
 // first.
-type keyInfoSorter []keyInfo
+type keyInfoSorter []client.KeyInfo
 
 func (k keyInfoSorter) Len() int      { return len(k) }
 func (k keyInfoSorter) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
 func (k keyInfoSorter) Less(i, j int) bool {
 	// special-case role
-	if k[i].role != k[j].role {
-		if k[i].role == data.CanonicalRootRole {
+	if k[i].Role != k[j].Role {
+		if k[i].Role == data.CanonicalRootRole {
 			return true
 		}
-		if k[j].role == data.CanonicalRootRole {
+		if k[j].Role == data.CanonicalRootRole {
 			return false
 		}
 		// otherwise, neither of them are root, they're just different, so
@@ -73,8 +66,8 @@ func (k keyInfoSorter) Less(i, j int) bool {
 	}
 
 	// sort order is GUN, role, keyID, location.
-	orderedI := []string{k[i].gun, k[i].role, k[i].keyID, k[i].location}
-	orderedJ := []string{k[j].gun, k[j].role, k[j].keyID, k[j].location}
+	orderedI := []string{k[i].GUN, k[i].Role, k[i].KeyID, k[i].Location}
+	orderedJ := []string{k[j].GUN, k[j].Role, k[j].KeyID, k[j].Location}
 
 	for x := 0; x < 4; x++ {
 		switch {
@@ -90,24 +83,10 @@ func (k keyInfoSorter) Less(i, j int) bool {
 }
 
 // Given a list of KeyStores in order of listing preference, pretty-prints the
-// root keys and then the signing keys.
-func prettyPrintKeys(keyStores []trustmanager.KeyStore, writer io.Writer) {
-	var info []keyInfo
-
-	for _, store := range keyStores {
-		for keyPath, role := range store.ListKeys() {
-			gun := ""
-			if role != data.CanonicalRootRole {
-				gun = filepath.Dir(keyPath)
-			}
-			info = append(info, keyInfo{
-				role:     role,
-				location: store.Name(),
-				gun:      gun,
-				keyID:    filepath.Base(keyPath),
-			})
-		}
-	}
+// root keys and then the signing keys.  Long GUNs and locations are truncated
+// to keep the table narrow, unless full is set.
+func prettyPrintKeys(keyStores []trustmanager.KeyStore, writer io.Writer, full bool) {
+	info := client.KeyStoresInventory(keyStores)
 	if len(info) == 0 {
 		writer.Write([]byte("No signing keys found.\n"))
 		return
@@ -118,12 +97,12 @@ func prettyPrintKeys(keyStores []trustmanager.KeyStore, writer io.Writer) {
 	table := getTable([]string{"ROLE", "GUN", "KEY ID", "LOCATION"}, writer)
 
 	for _, oneKeyInfo := range info {
-		table.Append([]string{
-			oneKeyInfo.role,
-			truncateWithEllipsis(oneKeyInfo.gun, maxGUNWidth, true),
-			oneKeyInfo.keyID,
-			truncateWithEllipsis(oneKeyInfo.location, maxLocWidth, true),
-		})
+		gun, location := oneKeyInfo.GUN, oneKeyInfo.Location
+		if !full {
+			gun = truncateWithEllipsis(gun, maxGUNWidth, true)
+			location = truncateWithEllipsis(location, maxLocWidth, true)
+		}
+		table.Append([]string{oneKeyInfo.Role, gun, oneKeyInfo.KeyID, location})
 	}
 	table.Render()
 }
@@ -160,6 +139,47 @@ func prettyPrintTargets(ts []*client.Target, writer io.Writer) {
 	table.Render()
 }
 
+// --- pretty printing delegations ---
+
+type delegationsSorter []*data.Role
+
+func (d delegationsSorter) Len() int      { return len(d) }
+func (d delegationsSorter) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d delegationsSorter) Less(i, j int) bool {
+	return d[i].Name < d[j].Name
+}
+
+// Given a list of delegation roles, pretty-prints them sorted by name, with
+// their threshold, key IDs, and the paths they may sign for.
+func prettyPrintDelegations(delegations []*data.Role, writer io.Writer) {
+	if len(delegations) == 0 {
+		writer.Write([]byte("\nNo delegations present in this repository.\n\n"))
+		return
+	}
+
+	sort.Stable(delegationsSorter(delegations))
+
+	table := getTable([]string{"Role", "Threshold", "Key IDs", "Paths"}, writer)
+
+	for _, d := range delegations {
+		paths := make([]string, len(d.Paths))
+		for i, path := range d.Paths {
+			// the empty path matches every target, so make it visible
+			if path == "" {
+				path = `""`
+			}
+			paths[i] = path
+		}
+		table.Append([]string{
+			d.Name,
+			fmt.Sprintf("%d", d.Threshold),
+			strings.Join(d.KeyIDs, ","),
+			strings.Join(paths, ","),
+		})
+	}
+	table.Render()
+}
+
 // --- pretty printing certs ---
 
 // cert by repo name then expiry time.  Don't bother sorting by fingerprint.
@@ -37,17 +37,17 @@ func TestTruncateWithEllipsis(t *testing.T) {
 }
 
 func TestKeyInfoSorter(t *testing.T) {
-	expected := []keyInfo{
-		{role: data.CanonicalRootRole, gun: "", keyID: "a", location: "i"},
-		{role: data.CanonicalRootRole, gun: "", keyID: "a", location: "j"},
-		{role: data.CanonicalRootRole, gun: "", keyID: "z", location: "z"},
-		{role: "a", gun: "a", keyID: "a", location: "y"},
-		{role: "b", gun: "a", keyID: "a", location: "y"},
-		{role: "b", gun: "a", keyID: "b", location: "y"},
-		{role: "b", gun: "a", keyID: "b", location: "z"},
-		{role: "a", gun: "b", keyID: "a", location: "z"},
+	expected := []client.KeyInfo{
+		{Role: data.CanonicalRootRole, GUN: "", KeyID: "a", Location: "i"},
+		{Role: data.CanonicalRootRole, GUN: "", KeyID: "a", Location: "j"},
+		{Role: data.CanonicalRootRole, GUN: "", KeyID: "z", Location: "z"},
+		{Role: "a", GUN: "a", KeyID: "a", Location: "y"},
+		{Role: "b", GUN: "a", KeyID: "a", Location: "y"},
+		{Role: "b", GUN: "a", KeyID: "b", Location: "y"},
+		{Role: "b", GUN: "a", KeyID: "b", Location: "z"},
+		{Role: "a", GUN: "b", KeyID: "a", Location: "z"},
 	}
-	jumbled := make([]keyInfo, len(expected))
+	jumbled := make([]client.KeyInfo, len(expected))
 	// randomish indices
 	for j, e := range []int{3, 6, 1, 4, 0, 7, 5, 2} {
 		jumbled[j] = expected[e]
@@ -73,7 +73,7 @@ func TestPrettyPrintZeroKeys(t *testing.T) {
 	emptyKeyStore := trustmanager.NewKeyMemoryStore(ret)
 
 	var b bytes.Buffer
-	prettyPrintKeys([]trustmanager.KeyStore{emptyKeyStore}, &b)
+	prettyPrintKeys([]trustmanager.KeyStore{emptyKeyStore}, &b, false)
 	text, err := ioutil.ReadAll(&b)
 	assert.NoError(t, err)
 
@@ -120,7 +120,7 @@ func TestPrettyPrintRootAndSigningKeys(t *testing.T) {
 	}
 
 	var b bytes.Buffer
-	prettyPrintKeys(keyStores, &b)
+	prettyPrintKeys(keyStores, &b, false)
 	text, err := ioutil.ReadAll(&b)
 	assert.NoError(t, err)
 
@@ -141,6 +141,29 @@ func TestPrettyPrintRootAndSigningKeys(t *testing.T) {
 	}
 }
 
+// In full mode, long GUNs and locations are printed without being truncated.
+func TestPrettyPrintKeysFull(t *testing.T) {
+	ret := passphrase.ConstantRetriever("pass")
+	keyStore := &otherMemoryStore{KeyMemoryStore: *trustmanager.NewKeyMemoryStore(ret)}
+
+	key, err := trustmanager.GenerateED25519Key(rand.Reader)
+	assert.NoError(t, err)
+
+	longGUN := strings.TrimSuffix(strings.Repeat("a/", 30), "/")
+	err = keyStore.AddKey(longGUN+"/"+key.ID(), "targets", key)
+	assert.NoError(t, err)
+
+	var b bytes.Buffer
+	prettyPrintKeys([]trustmanager.KeyStore{keyStore}, &b, true)
+	text, err := ioutil.ReadAll(&b)
+	assert.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(text)), "\n")
+	assert.Len(t, lines, 3)
+	assert.Equal(t, []string{"targets", longGUN, key.ID(), keyStore.Name()},
+		strings.Fields(lines[2]))
+}
+
 // --- tests for pretty printing targets ---
 
 // If there are no targets, no table is printed, only a line saying that there
@@ -197,6 +220,65 @@ func TestPrettyPrintSortedTargets(t *testing.T) {
 	}
 }
 
+// --- tests for pretty printing delegations ---
+
+// If there are no delegations, no table is printed, only a line saying that
+// there are no delegations.
+func TestPrettyPrintZeroDelegations(t *testing.T) {
+	var b bytes.Buffer
+	prettyPrintDelegations([]*data.Role{}, &b)
+	text, err := ioutil.ReadAll(&b)
+	assert.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(text)), "\n")
+	assert.Len(t, lines, 1)
+	assert.Equal(t, "No delegations present in this repository.", lines[0])
+}
+
+// Delegations are sorted by name, and the name, threshold, key IDs, and paths
+// are printed.
+func TestPrettyPrintSortedDelegations(t *testing.T) {
+	unsorted := make([]*data.Role, 0, 3)
+	for _, args := range []struct {
+		name      string
+		threshold int
+		keyIDs    []string
+		paths     []string
+	}{
+		{"targets/zebra", 1, []string{"key1"}, []string{"stripes/"}},
+		{"targets/abracadabra", 2, []string{"key2", "key3"}, []string{""}},
+		{"targets/bee", 1, []string{"key1"}, []string{"hive/", "honey/"}},
+	} {
+		role, err := data.NewRole(args.name, args.threshold, args.keyIDs, args.paths, nil)
+		assert.NoError(t, err)
+		unsorted = append(unsorted, role)
+	}
+
+	var b bytes.Buffer
+	prettyPrintDelegations(unsorted, &b)
+	text, err := ioutil.ReadAll(&b)
+	assert.NoError(t, err)
+
+	expected := [][]string{
+		{"targets/abracadabra", "2", "key2,key3", `""`},
+		{"targets/bee", "1", "key1", "hive/,honey/"},
+		{"targets/zebra", "1", "key1", "stripes/"},
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(text)), "\n")
+	assert.Len(t, lines, len(expected)+2)
+
+	// starts with headers
+	assert.True(t, reflect.DeepEqual(strings.Fields(lines[0]), strings.Fields(
+		"ROLE     THRESHOLD      KEY IDS      PATHS")))
+	assert.Equal(t, "----", lines[1][:4])
+
+	for i, line := range lines[2:] {
+		splitted := strings.Fields(line)
+		assert.Equal(t, expected[i], splitted)
+	}
+}
+
 // --- tests for pretty printing certs ---
 
 func generateCertificate(t *testing.T, gun string, expireInHours int64) *x509.Certificate {
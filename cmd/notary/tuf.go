@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -26,6 +27,13 @@ import (
 	"github.com/spf13/viper"
 )
 
+func init() {
+	cmdTufList.Flags().BoolVar(&tufListFull, "full", false,
+		"Also print the delegations of the trusted collection")
+}
+
+var tufListFull bool
+
 var cmdTufList = &cobra.Command{
 	Use:   "list [ GUN ]",
 	Short: "Lists targets for a remote trusted collection.",
@@ -75,6 +83,13 @@ var cmdTufStatus = &cobra.Command{
 	Run:   tufStatus,
 }
 
+var cmdTufReset = &cobra.Command{
+	Use:   "reset [ GUN ]",
+	Short: "Discards all unpublished changes to the local trusted collection.",
+	Long:  "Discards all the changes to the local trusted collection identified by the Globally Unique Name that have been staged since it was last published. This is an offline operation.",
+	Run:   tufReset,
+}
+
 var cmdVerify = &cobra.Command{
 	Use:   "verify [ GUN ] <target>",
 	Short: "Verifies if the content is included in the remote trusted collection",
@@ -170,6 +185,14 @@ func tufList(cmd *cobra.Command, args []string) {
 	}
 
 	prettyPrintTargets(targetList, cmd.Out())
+
+	if tufListFull {
+		delegations, err := nRepo.GetDelegationRoles()
+		if err != nil {
+			fatalf(err.Error())
+		}
+		prettyPrintDelegations(delegations, cmd.Out())
+	}
 }
 
 func tufLookup(cmd *cobra.Command, args []string) {
@@ -220,11 +243,38 @@ func tufStatus(cmd *cobra.Command, args []string) {
 	}
 
 	cmd.Printf("Unpublished changes for %s:\n\n", gun)
-	cmd.Printf("%-10s%-10s%-12s%s\n", "action", "scope", "type", "path")
-	cmd.Println("----------------------------------------------------")
+	cmd.Printf("%-6s%-10s%-10s%-12s%-14s%s\n", "seq", "action", "scope", "type", "staged", "path")
+	cmd.Println("--------------------------------------------------------------------------")
 	for _, ch := range cl.List() {
-		cmd.Printf("%-10s%-10s%-12s%s\n", ch.Action(), ch.Scope(), ch.Type(), ch.Path())
+		seq, staged := "-", "-"
+		if ch.Sequence() > 0 {
+			seq = strconv.Itoa(ch.Sequence())
+		}
+		if !ch.Created().IsZero() {
+			staged = (time.Since(ch.Created()) / time.Second * time.Second).String() + " ago"
+		}
+		cmd.Printf("%-6s%-10s%-10s%-12s%-14s%s\n", seq, ch.Action(), ch.Scope(), ch.Type(), staged, ch.Path())
+	}
+}
+
+func tufReset(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		cmd.Usage()
+		fatalf("Must specify a GUN")
+	}
+
+	parseConfig()
+	gun := args[0]
+
+	nRepo, err := notaryclient.NewNotaryRepository(mainViper.GetString("trust_dir"), gun, getRemoteTrustServer(mainViper), nil, retriever)
+	if err != nil {
+		fatalf(err.Error())
+	}
+
+	if err := nRepo.ClearChangelist(); err != nil {
+		fatalf(err.Error())
 	}
+	cmd.Printf("Unpublished changes for %s discarded.\n", gun)
 }
 
 func tufPublish(cmd *cobra.Command, args []string) {
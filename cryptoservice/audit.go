@@ -0,0 +1,97 @@
+package cryptoservice
+
+import (
+	"crypto"
+	"io"
+	"time"
+
+	"github.com/docker/notary/tuf/data"
+)
+
+// keyService is the signed.CryptoService interface, which can't be imported
+// here since the tests of the signed package import this package
+type keyService interface {
+	Create(role, algorithm string) (data.PublicKey, error)
+	GetKey(keyID string) data.PublicKey
+	GetPrivateKey(keyID string) (data.PrivateKey, string, error)
+	RemoveKey(keyID string) error
+	ListKeys(role string) []string
+	ListAllKeys() map[string]string
+	ImportRootKey(source io.Reader) error
+}
+
+// SigningEvent describes a signing operation made with a private key of an
+// AuditingCryptoService
+type SigningEvent struct {
+	KeyID string
+	Role  string // the role the key is held for
+	Time  time.Time
+	Err   error // nil if the signature was made
+}
+
+// AuditingCryptoService is a CryptoService that reports every signing
+// operation made with its private keys, whether of metadata or of a
+// certificate, to an audit function.  Signing is otherwise left to the
+// CryptoService it wraps, so the signatures are the same.
+type AuditingCryptoService struct {
+	keyService
+	audit func(SigningEvent)
+}
+
+// NewAuditingCryptoService returns an AuditingCryptoService that signs with
+// the keys of cs, and calls audit after each signing operation
+func NewAuditingCryptoService(cs keyService, audit func(SigningEvent)) *AuditingCryptoService {
+	return &AuditingCryptoService{keyService: cs, audit: audit}
+}
+
+// GetPrivateKey returns the private key with the given ID from the wrapped
+// CryptoService, which reports its signing operations to the audit function
+func (cs *AuditingCryptoService) GetPrivateKey(keyID string) (data.PrivateKey, string, error) {
+	privKey, role, err := cs.keyService.GetPrivateKey(keyID)
+	if err != nil {
+		return nil, "", err
+	}
+	return &auditedPrivateKey{PrivateKey: privKey, role: role, audit: cs.audit}, role, nil
+}
+
+// auditedPrivateKey is a private key that reports its signing operations
+type auditedPrivateKey struct {
+	data.PrivateKey
+	role  string
+	audit func(SigningEvent)
+}
+
+func (k *auditedPrivateKey) report(err error) {
+	k.audit(SigningEvent{KeyID: k.ID(), Role: k.role, Time: time.Now(), Err: err})
+}
+
+// Sign signs msg with the wrapped key, and reports it
+func (k *auditedPrivateKey) Sign(rand io.Reader, msg []byte, opts crypto.SignerOpts) ([]byte, error) {
+	sig, err := k.PrivateKey.Sign(rand, msg, opts)
+	k.report(err)
+	return sig, err
+}
+
+// CryptoSigner returns the wrapped key's crypto.Signer, whose signing
+// operations are reported too, or nil if it has none
+func (k *auditedPrivateKey) CryptoSigner() crypto.Signer {
+	signer := k.PrivateKey.CryptoSigner()
+	if signer == nil {
+		return nil
+	}
+	return auditedSigner{Signer: signer, key: k}
+}
+
+// auditedSigner is a crypto.Signer that reports its signing operations as
+// those of a private key
+type auditedSigner struct {
+	crypto.Signer
+	key *auditedPrivateKey
+}
+
+// Sign signs digest with the wrapped signer, and reports it
+func (s auditedSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	sig, err := s.Signer.Sign(rand, digest, opts)
+	s.key.report(err)
+	return sig, err
+}
@@ -0,0 +1,51 @@
+package cryptoservice
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/docker/notary/trustmanager"
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/signed"
+)
+
+// Every signature made through an AuditingCryptoService is reported, and is
+// the same signature the wrapped CryptoService makes.
+func TestAuditingCryptoService(t *testing.T) {
+	cs := NewCryptoService("docker.com/notary", trustmanager.NewKeyMemoryStore(passphraseRetriever))
+	// ed25519 signatures are deterministic, so they can be compared
+	targetsKey, err := cs.Create(data.CanonicalTargetsRole, data.ED25519Key)
+	assert.NoError(t, err)
+
+	var events []SigningEvent
+	audited := NewAuditingCryptoService(cs, func(e SigningEvent) {
+		events = append(events, e)
+	})
+
+	before := time.Now()
+	s := &data.Signed{Signed: []byte(`{"_type":"Targets"}`)}
+	assert.NoError(t, signed.Sign(audited, s, targetsKey))
+	assert.Len(t, events, 1)
+	assert.Equal(t, targetsKey.ID(), events[0].KeyID)
+	assert.Equal(t, data.CanonicalTargetsRole, events[0].Role)
+	assert.NoError(t, events[0].Err)
+	assert.False(t, events[0].Time.Before(before))
+
+	unaudited := &data.Signed{Signed: s.Signed}
+	assert.NoError(t, signed.Sign(cs, unaudited, targetsKey))
+	assert.Equal(t, unaudited.Signatures, s.Signatures)
+
+	// signing a certificate is reported too
+	rootKey, err := cs.Create(data.CanonicalRootRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	privKey, role, err := audited.GetPrivateKey(rootKey.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, data.CanonicalRootRole, role)
+	_, err = GenerateCertificate(privKey, "docker.com/notary", time.Now(), time.Now().AddDate(1, 0, 0))
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, rootKey.ID(), events[1].KeyID)
+	assert.Equal(t, data.CanonicalRootRole, events[1].Role)
+}
@@ -1,6 +1,7 @@
 package cryptoservice
 
 import (
+	"crypto/elliptic"
 	"crypto/rand"
 	"fmt"
 	"path/filepath"
@@ -14,8 +15,34 @@ const (
 	rsaKeySize = 2048 // Used for snapshots and targets keys
 )
 
+// KeyGenConfig sets the strength of the keys a CryptoService generates, e.g.
+// because a compliance regime mandates P-384 or RSA-4096 keys.  The zero value
+// of each field means the default: P-256 for ECDSA keys, and 2048 bits for RSA
+// keys.
+type KeyGenConfig struct {
+	// ECDSACurve is the curve of ECDSA keys: P-256, P-384 or P-521
+	ECDSACurve elliptic.Curve
+	// RSAKeySize is the size of RSA keys in bits, at least 2048
+	RSAKeySize int
+}
+
+// validate checks the keys the config generates can sign TUF metadata
+func (c KeyGenConfig) validate() error {
+	switch c.ECDSACurve {
+	case nil, elliptic.P256(), elliptic.P384(), elliptic.P521():
+	default:
+		return fmt.Errorf("ECDSA curve not supported for key generation: %s", c.ECDSACurve.Params().Name)
+	}
+	if c.RSAKeySize != 0 && c.RSAKeySize < rsaKeySize {
+		return fmt.Errorf("RSA keys must be at least %d bits, not %d", rsaKeySize, c.RSAKeySize)
+	}
+	return nil
+}
+
 // CryptoService implements Sign and Create, holding a specific GUN and keystore to
-// operate on
+// operate on.  It is safe for concurrent use if its keystores are, as the
+// trustmanager ones are, so the CryptoServices of several GUNs sharing
+// keystores can sign at the same time.
 type CryptoService struct {
 	gun       string
 	keyStores []trustmanager.KeyStore
@@ -28,17 +55,33 @@ func NewCryptoService(gun string, keyStores ...trustmanager.KeyStore) *CryptoSer
 
 // Create is used to generate keys for targets, snapshots and timestamps
 func (cs *CryptoService) Create(role, algorithm string) (data.PublicKey, error) {
+	return cs.CreateWithConfig(role, algorithm, KeyGenConfig{})
+}
+
+// CreateWithConfig generates a key like Create, of the strength config sets
+func (cs *CryptoService) CreateWithConfig(role, algorithm string, config KeyGenConfig) (data.PublicKey, error) {
 	var privKey data.PrivateKey
 	var err error
 
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
 	switch algorithm {
 	case data.RSAKey:
-		privKey, err = trustmanager.GenerateRSAKey(rand.Reader, rsaKeySize)
+		bits := rsaKeySize
+		if config.RSAKeySize != 0 {
+			bits = config.RSAKeySize
+		}
+		privKey, err = trustmanager.GenerateRSAKey(rand.Reader, bits)
 		if err != nil {
 			return nil, fmt.Errorf("failed to generate RSA key: %v", err)
 		}
 	case data.ECDSAKey:
-		privKey, err = trustmanager.GenerateECDSAKey(rand.Reader)
+		curve := config.ECDSACurve
+		if curve == nil {
+			curve = elliptic.P256()
+		}
+		privKey, err = trustmanager.GenerateECDSAKeyWithCurve(rand.Reader, curve)
 		if err != nil {
 			return nil, fmt.Errorf("failed to generate EC key: %v", err)
 		}
@@ -73,29 +116,43 @@ func (cs *CryptoService) Create(role, algorithm string) (data.PublicKey, error)
 
 }
 
-// GetPrivateKey returns a private key by ID. It tries to get the key first
-// without a GUN (in which case it's a root key).  If that fails, try to get
-// the key with the GUN (non-root key).
-// If that fails, then we don't have the key.
+// GetPrivateKey returns a private key by ID, from the first of the keystores,
+// in order of preference, that has it.  In each keystore it tries to get the
+// key first without a GUN (in which case it's a root key), and then with the
+// GUN (non-root key).  A keystore that fails for any other reason than not
+// having the key, e.g. because the key's passphrase wasn't given, doesn't stop
+// the later keystores from being tried, but if none of them returns the key,
+// the first such error is returned instead of the key not being found.
 func (cs *CryptoService) GetPrivateKey(keyID string) (k data.PrivateKey, role string, err error) {
 	keyPaths := []string{keyID, filepath.Join(cs.gun, keyID)}
+	var storeErr error
 	for _, ks := range cs.keyStores {
 		for _, keyPath := range keyPaths {
 			k, role, err = ks.GetKey(keyPath)
 			if err == nil {
 				return
 			}
-			switch err.(type) {
-			case trustmanager.ErrPasswordInvalid, trustmanager.ErrAttemptsExceeded:
-				return
-			default:
-				continue
+			if !isKeyNotFound(err) && storeErr == nil {
+				storeErr = err
 			}
 		}
 	}
+	if storeErr != nil {
+		return nil, "", storeErr
+	}
 	return // returns whatever the final values were
 }
 
+// isKeyNotFound returns whether err is a keystore's error for not having a key
+func isKeyNotFound(err error) bool {
+	switch err.(type) {
+	case trustmanager.ErrKeyNotFound, *trustmanager.ErrKeyNotFound:
+		return true
+	default:
+		return false
+	}
+}
+
 // GetKey returns a key by ID
 func (cs *CryptoService) GetKey(keyID string) data.PublicKey {
 	privKey, _, err := cs.GetPrivateKey(keyID)
@@ -116,6 +173,31 @@ func (cs *CryptoService) RemoveKey(keyID string) (err error) {
 	return // returns whatever the final values were
 }
 
+// passphraseChanger is implemented by the keystores that encrypt their keys
+// with a passphrase
+type passphraseChanger interface {
+	ChangeKeyPassphrase(name string) error
+}
+
+// ChangeKeyPassphrase re-encrypts the private key with the given ID, in the
+// keystore that holds it, with a new passphrase from that keystore's
+// passphrase retriever.  The current passphrase is needed to decrypt the key.
+func (cs *CryptoService) ChangeKeyPassphrase(keyID string) error {
+	keyPaths := []string{keyID, filepath.Join(cs.gun, keyID)}
+	for _, ks := range cs.keyStores {
+		changer, ok := ks.(passphraseChanger)
+		if !ok {
+			continue
+		}
+		for _, keyPath := range keyPaths {
+			if _, ok := ks.ListKeys()[keyPath]; ok {
+				return changer.ChangeKeyPassphrase(keyPath)
+			}
+		}
+	}
+	return &trustmanager.ErrKeyNotFound{KeyID: keyID}
+}
+
 // ListKeys returns a list of key IDs valid for the given role
 func (cs *CryptoService) ListKeys(role string) []string {
 	var res []string
@@ -129,6 +211,33 @@ func (cs *CryptoService) ListKeys(role string) []string {
 	return res
 }
 
+// gunKeyLister is implemented by the keystores that can list the keys of a
+// single GUN without listing all of their keys
+type gunKeyLister interface {
+	ListKeysByGUN(gun string) map[string]string
+}
+
+// ListKeysByGUN returns a map of the IDs of the keys of the given GUN, which
+// like those of ListAllKeys are prefixed by the GUN, to their roles.  Root
+// keys aren't stored for a GUN, so they aren't included.
+func (cs *CryptoService) ListKeysByGUN(gun string) map[string]string {
+	res := make(map[string]string)
+	for _, ks := range cs.keyStores {
+		if lister, ok := ks.(gunKeyLister); ok {
+			for k, r := range lister.ListKeysByGUN(gun) {
+				res[k] = r
+			}
+			continue
+		}
+		for k, r := range ks.ListKeys() {
+			if filepath.Dir(k) == gun {
+				res[k] = r
+			}
+		}
+	}
+	return res
+}
+
 // ListAllKeys returns a map of key IDs to role
 func (cs *CryptoService) ListAllKeys() map[string]string {
 	res := make(map[string]string)
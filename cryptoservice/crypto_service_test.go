@@ -1,7 +1,12 @@
 package cryptoservice
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -352,3 +357,178 @@ func TestCryptoServiceWithNonEmptyGUN(t *testing.T) {
 func TestCryptoServiceWithEmptyGUN(t *testing.T) {
 	testCryptoService(t, "")
 }
+
+// ListKeysByGUN lists the keys of a GUN from every keystore, whether or not
+// the keystore can list them by GUN itself.
+func TestListKeysByGUN(t *testing.T) {
+	gun := "docker.com/notary"
+	cryptoService := NewCryptoService(gun,
+		trustmanager.NewKeyMemoryStore(passphraseRetriever),
+		// hides the keystore's own ListKeysByGUN
+		struct{ trustmanager.KeyStore }{trustmanager.NewKeyMemoryStore(passphraseRetriever)})
+
+	expected := make(map[string]string)
+	for _, store := range cryptoService.keyStores {
+		privKey, err := trustmanager.GenerateECDSAKey(rand.Reader)
+		assert.NoError(t, err)
+		assert.NoError(t, store.AddKey(privKey.ID(), data.CanonicalRootRole, privKey))
+		assert.NoError(t, store.AddKey(gun+"/"+privKey.ID(), data.CanonicalTargetsRole, privKey))
+		assert.NoError(t, store.AddKey("docker.com/other/"+privKey.ID(), data.CanonicalTargetsRole, privKey))
+		expected[gun+"/"+privKey.ID()] = data.CanonicalTargetsRole
+	}
+	assert.Equal(t, expected, cryptoService.ListKeysByGUN(gun))
+}
+
+// hardwareKeyStore stands in for a keystore such as a yubikey's, which is
+// preferred to the file store, and which may fail to get keys
+type hardwareKeyStore struct {
+	trustmanager.KeyStore
+	getErr error
+}
+
+func (s hardwareKeyStore) Name() string { return "yubikey" }
+
+func (s hardwareKeyStore) GetKey(keyID string) (data.PrivateKey, string, error) {
+	if s.getErr != nil {
+		return nil, "", s.getErr
+	}
+	return s.KeyStore.GetKey(keyID)
+}
+
+// GetPrivateKey gets a key from the first keystore that has it, and only
+// returns a keystore's error if none of the keystores has the key.
+func TestGetPrivateKeyStoreOrder(t *testing.T) {
+	hardware := hardwareKeyStore{KeyStore: trustmanager.NewKeyMemoryStore(passphraseRetriever)}
+	fileStore := trustmanager.NewKeyMemoryStore(passphraseRetriever)
+	cryptoService := NewCryptoService("", hardware, fileStore)
+
+	privKey, err := trustmanager.GenerateECDSAKey(rand.Reader)
+	assert.NoError(t, err)
+	// which keystore the key came from is told apart by its role
+	assert.NoError(t, hardware.AddKey(privKey.ID(), data.CanonicalRootRole, privKey))
+	assert.NoError(t, fileStore.AddKey(privKey.ID(), data.CanonicalTargetsRole, privKey))
+
+	// the hardware key wins
+	foundKey, role, err := cryptoService.GetPrivateKey(privKey.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, data.CanonicalRootRole, role)
+	assert.Equal(t, privKey.ID(), foundKey.ID())
+
+	// the file store is used if the hardware keystore fails
+	hardwareErr := errors.New("yubikey is unplugged")
+	cryptoService = NewCryptoService("",
+		hardwareKeyStore{KeyStore: hardware.KeyStore, getErr: hardwareErr}, fileStore)
+	foundKey, role, err = cryptoService.GetPrivateKey(privKey.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, data.CanonicalTargetsRole, role)
+	assert.Equal(t, privKey.ID(), foundKey.ID())
+
+	// and the hardware keystore's error is returned if it doesn't have the key
+	assert.NoError(t, fileStore.RemoveKey(privKey.ID()))
+	_, _, err = cryptoService.GetPrivateKey(privKey.ID())
+	assert.Equal(t, hardwareErr, err)
+
+	// a key that no keystore has isn't found
+	cryptoService = NewCryptoService("", hardware, fileStore)
+	_, _, err = cryptoService.GetPrivateKey("nonexistent")
+	assert.IsType(t, &trustmanager.ErrKeyNotFound{}, err)
+}
+
+// CryptoServices for several GUNs can sign at the same time with the keys of
+// the key store they share, including while the keys are first unlocked.
+// Run with -race to check for data races.
+func TestConcurrentSigning(t *testing.T) {
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	assert.NoError(t, err, "failed to create a temporary directory: %s", err)
+	defer os.RemoveAll(tempBaseDir)
+
+	keyStore, err := trustmanager.NewKeyFileStore(tempBaseDir, passphraseRetriever)
+	assert.NoError(t, err)
+	guns := []string{"docker.com/notary", "docker.com/other", "docker.com/third"}
+	rootKey, err := NewCryptoService("", keyStore).Create(data.CanonicalRootRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	targetsKeys := make(map[string]data.PublicKey)
+	for _, gun := range guns {
+		targetsKeys[gun], err = NewCryptoService(gun, keyStore).Create(data.CanonicalTargetsRole, data.ECDSAKey)
+		assert.NoError(t, err)
+	}
+
+	// a new store over the same directory has none of the keys unlocked yet
+	keyStore, err = trustmanager.NewKeyFileStore(tempBaseDir, passphraseRetriever)
+	assert.NoError(t, err)
+
+	errs := make(chan error)
+	for _, gun := range guns {
+		cs := NewCryptoService(gun, keyStore)
+		for i := 0; i < 5; i++ {
+			go func(cs *CryptoService, targetsKey data.PublicKey) {
+				// like repositories do, each signer has its own copy of the
+				// public keys, from its own metadata
+				keys := []data.PublicKey{
+					data.NewPublicKey(rootKey.Algorithm(), rootKey.Public()),
+					data.NewPublicKey(targetsKey.Algorithm(), targetsKey.Public()),
+				}
+				s := &data.Signed{Signed: []byte(`{"_type":"Targets"}`)}
+				if err := signed.Sign(cs, s, keys...); err != nil {
+					errs <- err
+					return
+				}
+				if len(s.Signatures) != 2 {
+					errs <- fmt.Errorf("expected 2 signatures, got %d", len(s.Signatures))
+					return
+				}
+				privKey, _, err := cs.GetPrivateKey(keys[1].ID())
+				if err == nil && privKey.ID() != keys[1].ID() {
+					err = fmt.Errorf("got key %s instead of %s", privKey.ID(), keys[1].ID())
+				}
+				errs <- err
+			}(cs, targetsKeys[gun])
+		}
+	}
+	for i := 0; i < len(guns)*5; i++ {
+		assert.NoError(t, <-errs)
+	}
+}
+
+// CreateWithConfig generates keys of the configured strength, which can sign
+// and be verified, and refuses configurations too weak for TUF metadata
+func TestCreateWithConfig(t *testing.T) {
+	cryptoService := NewCryptoService("docker.com/notary", trustmanager.NewKeyMemoryStore(passphraseRetriever))
+	content := []byte("this is a secret")
+
+	for _, curve := range []elliptic.Curve{elliptic.P384(), elliptic.P521()} {
+		pubKey, err := cryptoService.CreateWithConfig(
+			data.CanonicalTargetsRole, data.ECDSAKey, KeyGenConfig{ECDSACurve: curve})
+		assert.NoError(t, err)
+		parsed, err := x509.ParsePKIXPublicKey(pubKey.Public())
+		assert.NoError(t, err)
+		assert.Equal(t, curve, parsed.(*ecdsa.PublicKey).Curve)
+
+		privKey, _, err := cryptoService.GetPrivateKey(pubKey.ID())
+		assert.NoError(t, err)
+		signature, err := privKey.Sign(rand.Reader, content, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, signed.Verifiers[data.ECDSASignature].Verify(pubKey, signature, content))
+	}
+
+	pubKey, err := cryptoService.CreateWithConfig(
+		data.CanonicalTargetsRole, data.RSAKey, KeyGenConfig{RSAKeySize: 3072})
+	assert.NoError(t, err)
+	parsed, err := x509.ParsePKIXPublicKey(pubKey.Public())
+	assert.NoError(t, err)
+	assert.Equal(t, 3072, parsed.(*rsa.PublicKey).N.BitLen())
+
+	// the defaults are those of Create
+	pubKey, err = cryptoService.CreateWithConfig(data.CanonicalTargetsRole, data.ECDSAKey, KeyGenConfig{})
+	assert.NoError(t, err)
+	parsed, err = x509.ParsePKIXPublicKey(pubKey.Public())
+	assert.NoError(t, err)
+	assert.Equal(t, elliptic.P256(), parsed.(*ecdsa.PublicKey).Curve)
+
+	_, err = cryptoService.CreateWithConfig(
+		data.CanonicalTargetsRole, data.ECDSAKey, KeyGenConfig{ECDSACurve: elliptic.P224()})
+	assert.Error(t, err)
+	_, err = cryptoService.CreateWithConfig(
+		data.CanonicalTargetsRole, data.RSAKey, KeyGenConfig{RSAKeySize: 1024})
+	assert.Error(t, err)
+}
@@ -0,0 +1,244 @@
+package cryptoservice
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"path/filepath"
+	"sync"
+
+	"github.com/docker/notary/trustmanager"
+	"github.com/docker/notary/tuf/data"
+)
+
+// ErrKMSCreateUnsupported is returned by a KMSCryptoService that can't
+// provision keys when asked to create one
+var ErrKMSCreateUnsupported = errors.New("creating keys is not supported by this KMS: provision the key in the KMS and add it")
+
+// KMSSigner signs digest, the SHA256 checksum of the data to sign, with the
+// private key of the key with the given ID held in a KMS.  Like
+// crypto.Signer, it returns an ASN.1 DER encoded signature for an ECDSA key,
+// and for an RSA key, a PSS or PKCS #1 v1.5 signature depending on opts.
+type KMSSigner func(keyID string, digest []byte, opts crypto.SignerOpts) ([]byte, error)
+
+// KMSCryptoService is a CryptoService whose private keys are held in a KMS,
+// which signs with them through a KMSSigner, so that the private keys never
+// leave it.  The service only knows the public keys of the KMS keys that were
+// added to it or created through it.  Only ECDSA and RSA keys are supported.
+type KMSCryptoService struct {
+	gun  string
+	sign KMSSigner
+
+	// Provision, if set, creates a new key of the given algorithm in the KMS
+	// for the role, and returns its public key.  If nil, Create returns
+	// ErrKMSCreateUnsupported.
+	Provision func(role, algorithm string) (data.PublicKey, error)
+
+	mu   sync.Mutex
+	keys map[string]kmsKey
+}
+
+type kmsKey struct {
+	pubKey data.PublicKey
+	role   string
+}
+
+// NewKMSCryptoService returns a KMSCryptoService for the repository with the
+// given GUN, without any keys, that signs through sign
+func NewKMSCryptoService(gun string, sign KMSSigner) *KMSCryptoService {
+	return &KMSCryptoService{gun: gun, sign: sign, keys: make(map[string]kmsKey)}
+}
+
+// AddKey makes the KMS key with the given public key available to sign for
+// the role
+func (cs *KMSCryptoService) AddKey(role string, pubKey data.PublicKey) error {
+	if algorithm := pubKey.Algorithm(); algorithm != data.ECDSAKey && algorithm != data.RSAKey {
+		return fmt.Errorf("private key type not supported for KMS signing: %s", algorithm)
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.keys[pubKey.ID()] = kmsKey{pubKey: pubKey, role: role}
+	return nil
+}
+
+// Create provisions a new key in the KMS with Provision, and adds it
+func (cs *KMSCryptoService) Create(role, algorithm string) (data.PublicKey, error) {
+	if cs.Provision == nil {
+		return nil, ErrKMSCreateUnsupported
+	}
+	pubKey, err := cs.Provision(role, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if err := cs.AddKey(role, pubKey); err != nil {
+		return nil, err
+	}
+	return pubKey, nil
+}
+
+// GetKey returns the public key with the given ID, or nil if there is none
+func (cs *KMSCryptoService) GetKey(keyID string) data.PublicKey {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	key, ok := cs.keys[keyID]
+	if !ok {
+		return nil
+	}
+	return key.pubKey
+}
+
+// GetPrivateKey returns a private key that signs with the KMS key with the
+// given ID, and the key's role.  Its private material isn't available.
+func (cs *KMSCryptoService) GetPrivateKey(keyID string) (data.PrivateKey, string, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	key, ok := cs.keys[keyID]
+	if !ok {
+		return nil, "", &trustmanager.ErrKeyNotFound{KeyID: keyID}
+	}
+	return &kmsPrivateKey{PublicKey: key.pubKey, sign: cs.sign}, key.role, nil
+}
+
+// RemoveKey forgets the key with the given ID.  The key is left in the KMS.
+func (cs *KMSCryptoService) RemoveKey(keyID string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.keys, keyID)
+	return nil
+}
+
+// ListKeys returns the IDs of the keys for the role.  Like those of a
+// CryptoService, the IDs of keys other than root keys are prefixed by the
+// GUN.
+func (cs *KMSCryptoService) ListKeys(role string) []string {
+	var res []string
+	for keyPath, keyRole := range cs.ListAllKeys() {
+		if keyRole == role {
+			res = append(res, keyPath)
+		}
+	}
+	return res
+}
+
+// ListAllKeys returns a map of the IDs of all the keys, prefixed by the GUN
+// like those of ListKeys, to their roles
+func (cs *KMSCryptoService) ListAllKeys() map[string]string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	res := make(map[string]string)
+	for keyID, key := range cs.keys {
+		if key.role != data.CanonicalRootRole {
+			keyID = filepath.Join(cs.gun, keyID)
+		}
+		res[keyID] = key.role
+	}
+	return res
+}
+
+// ImportRootKey is not supported: root keys have to be provisioned in the KMS
+func (cs *KMSCryptoService) ImportRootKey(source io.Reader) error {
+	return errors.New("importing keys is not supported by a KMS: provision the key in the KMS and add it")
+}
+
+// kmsPrivateKey is a private key held in a KMS
+type kmsPrivateKey struct {
+	data.PublicKey
+	sign KMSSigner
+}
+
+// Sign signs the SHA256 checksum of msg in the KMS, in the format of the
+// signature algorithm of the key
+func (k *kmsPrivateKey) Sign(_ io.Reader, msg []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hashed := sha256.Sum256(msg)
+	switch k.Algorithm() {
+	case data.RSAKey:
+		if opts == nil {
+			opts = &rsa.PSSOptions{
+				SaltLength: rsa.PSSSaltLengthEqualsHash,
+				Hash:       crypto.SHA256,
+			}
+		}
+		return k.sign(k.ID(), hashed[:], opts)
+	default:
+		sigASN1, err := k.sign(k.ID(), hashed[:], crypto.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		return k.rawECDSASignature(sigASN1)
+	}
+}
+
+// rawECDSASignature converts an ASN.1 DER encoded ECDSA signature to the
+// concatenation of its R and S, each padded to the size of the key's curve,
+// which is the format of ECDSA signatures in TUF metadata
+func (k *kmsPrivateKey) rawECDSASignature(sigASN1 []byte) ([]byte, error) {
+	pubKey, err := x509.ParsePKIXPublicKey(k.Public())
+	if err != nil {
+		return nil, err
+	}
+	ecdsaPubKey, ok := pubKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("KMS key is not an ECDSA key")
+	}
+	sig := struct {
+		R *big.Int
+		S *big.Int
+	}{}
+	if _, err := asn1.Unmarshal(sigASN1, &sig); err != nil {
+		return nil, err
+	}
+	rBytes, sBytes := sig.R.Bytes(), sig.S.Bytes()
+	octetLength := (ecdsaPubKey.Params().BitSize + 7) >> 3
+
+	// MUST include leading zeros in the output
+	rBuf := make([]byte, octetLength-len(rBytes), octetLength)
+	sBuf := make([]byte, octetLength-len(sBytes), octetLength)
+	rBuf = append(rBuf, rBytes...)
+	sBuf = append(sBuf, sBytes...)
+	return append(rBuf, sBuf...), nil
+}
+
+// Private returns nil, since the private key never leaves the KMS
+func (k *kmsPrivateKey) Private() []byte {
+	return nil
+}
+
+// CryptoSigner returns a crypto.Signer that signs digests in the KMS, which
+// is what certificates are signed with
+func (k *kmsPrivateKey) CryptoSigner() crypto.Signer {
+	pubKey, err := x509.ParsePKIXPublicKey(k.Public())
+	if err != nil {
+		return nil
+	}
+	return &kmsCryptoSigner{keyID: k.ID(), pubKey: pubKey, sign: k.sign}
+}
+
+// SignatureAlgorithm returns the algorithm of the signatures the key makes
+func (k *kmsPrivateKey) SignatureAlgorithm() data.SigAlgorithm {
+	if k.Algorithm() == data.RSAKey {
+		return data.RSAPSSSignature
+	}
+	return data.ECDSASignature
+}
+
+// kmsCryptoSigner is the crypto.Signer of a kmsPrivateKey
+type kmsCryptoSigner struct {
+	keyID  string
+	pubKey crypto.PublicKey
+	sign   KMSSigner
+}
+
+func (s *kmsCryptoSigner) Public() crypto.PublicKey {
+	return s.pubKey
+}
+
+func (s *kmsCryptoSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.sign(s.keyID, digest, opts)
+}
@@ -0,0 +1,101 @@
+package cryptoservice
+
+import (
+	"crypto"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/docker/notary/trustmanager"
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/signed"
+)
+
+// fakeKMS holds private keys, and signs with them like a KMS
+type fakeKMS map[string]data.PrivateKey
+
+func (kms fakeKMS) sign(keyID string, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	privKey, ok := kms[keyID]
+	if !ok {
+		return nil, errors.New("no such key in the KMS")
+	}
+	return privKey.CryptoSigner().Sign(rand.Reader, digest, opts)
+}
+
+func (kms fakeKMS) provision(role, algorithm string) (data.PublicKey, error) {
+	var privKey data.PrivateKey
+	var err error
+	switch algorithm {
+	case data.ECDSAKey:
+		privKey, err = trustmanager.GenerateECDSAKey(rand.Reader)
+	case data.RSAKey:
+		privKey, err = trustmanager.GenerateRSAKey(rand.Reader, 2048)
+	default:
+		err = errors.New("unsupported algorithm")
+	}
+	if err != nil {
+		return nil, err
+	}
+	kms[privKey.ID()] = privKey
+	return data.PublicKeyFromPrivate(privKey), nil
+}
+
+// A KMSCryptoService signs metadata and certificates through the KMS, with
+// signatures that verify against the keys' public keys.
+func TestKMSCryptoService(t *testing.T) {
+	gun := "docker.com/notary"
+	kms := fakeKMS{}
+	cs := NewKMSCryptoService(gun, kms.sign)
+
+	_, err := cs.Create(data.CanonicalTargetsRole, data.ECDSAKey)
+	assert.Equal(t, ErrKMSCreateUnsupported, err)
+	assert.Error(t, cs.ImportRootKey(nil))
+
+	cs.Provision = kms.provision
+	for _, algorithm := range []string{data.ECDSAKey, data.RSAKey} {
+		pubKey, err := cs.Create(data.CanonicalTargetsRole, algorithm)
+		assert.NoError(t, err)
+		assert.Equal(t, pubKey, cs.GetKey(pubKey.ID()))
+
+		privKey, role, err := cs.GetPrivateKey(pubKey.ID())
+		assert.NoError(t, err)
+		assert.Equal(t, data.CanonicalTargetsRole, role)
+		assert.Nil(t, privKey.Private())
+
+		s := &data.Signed{Signed: []byte(`{"_type":"Targets"}`)}
+		assert.NoError(t, signed.Sign(cs, s, pubKey))
+		assert.Len(t, s.Signatures, 1)
+		verifier := signed.Verifiers[s.Signatures[0].Method]
+		assert.NoError(t, verifier.Verify(pubKey, s.Signatures[0].Signature, s.Signed),
+			"%s signature doesn't verify", algorithm)
+
+		cert, err := GenerateCertificate(privKey, gun, time.Now(), time.Now().AddDate(1, 0, 0))
+		assert.NoError(t, err)
+		assert.NoError(t, cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature))
+	}
+
+	rootKey, err := cs.Create(data.CanonicalRootRole, data.ECDSAKey)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{rootKey.ID()}, cs.ListKeys(data.CanonicalRootRole))
+	assert.Len(t, cs.ListKeys(data.CanonicalTargetsRole), 2)
+	for keyPath, role := range cs.ListAllKeys() {
+		if role != data.CanonicalRootRole {
+			assert.Contains(t, keyPath, gun+"/")
+		}
+	}
+
+	assert.NoError(t, cs.RemoveKey(rootKey.ID()))
+	assert.Nil(t, cs.GetKey(rootKey.ID()))
+	_, _, err = cs.GetPrivateKey(rootKey.ID())
+	assert.IsType(t, &trustmanager.ErrKeyNotFound{}, err)
+	_, ok := kms[rootKey.ID()]
+	assert.True(t, ok, "the key should be left in the KMS")
+
+	// only the keys the KMS can sign with can be added
+	edKey, err := trustmanager.GenerateED25519Key(rand.Reader)
+	assert.NoError(t, err)
+	assert.Error(t, cs.AddKey(data.CanonicalTargetsRole, data.PublicKeyFromPrivate(edKey)))
+}
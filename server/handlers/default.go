@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"strings"
 
@@ -65,7 +67,7 @@ func atomicUpdateHandler(ctx context.Context, w http.ResponseWriter, r *http.Req
 		if err == io.EOF {
 			break
 		}
-		role := strings.TrimSuffix(part.FileName(), ".json")
+		role := strings.TrimSuffix(partFileName(part), ".json")
 		if role == "" {
 			return errors.ErrNoFilename.WithDetail(nil)
 		} else if !data.ValidRole(role) {
@@ -101,6 +103,16 @@ func atomicUpdateHandler(ctx context.Context, w http.ResponseWriter, r *http.Req
 	return nil
 }
 
+// partFileName returns the full filename of a multipart part. Unlike
+// part.FileName, it keeps any directories, which delegated role names have.
+func partFileName(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+	return params["filename"]
+}
+
 // GetHandler returns the json for a specified role and GUN.
 func GetHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	defer r.Body.Close()
@@ -168,7 +168,7 @@ func loadAndValidateTargets(gun string, repo *tuf.Repo, roles map[string]storage
 				continue
 			}
 			logrus.Error("ErrBadTargets: ", err.Error())
-			return nil, validation.ErrBadTargets{Msg: err.Error()}
+			return nil, validation.ErrBadTargets{Msg: err.Error(), Role: role}
 		}
 		// this will load keys and roles into the kdb
 		err = repo.SetTargets(role, t)
@@ -579,6 +579,7 @@ func TestValidateTargetsSigMissing(t *testing.T) {
 	_, err = validateUpdate(cs, "testGUN", updates, store)
 	assert.Error(t, err)
 	assert.IsType(t, validation.ErrBadTargets{}, err)
+	assert.Equal(t, data.CanonicalTargetsRole, err.(validation.ErrBadTargets).Role)
 }
 
 func TestValidateSnapshotSigMissing(t *testing.T) {
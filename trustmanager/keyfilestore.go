@@ -2,9 +2,11 @@ package trustmanager
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/docker/notary/passphrase"
 	"github.com/docker/notary/tuf/data"
@@ -16,20 +18,24 @@ const (
 	privDir           = "private"
 )
 
-// KeyFileStore persists and manages private keys on disk
+// KeyFileStore persists and manages private keys on disk.  It is safe for
+// concurrent use, so the repositories of several GUNs can share it and sign
+// with its keys at the same time; its passphrase retriever is only called by
+// one of them at a time.
 type KeyFileStore struct {
 	sync.Mutex
 	SimpleFileStore
 	passphrase.Retriever
-	cachedKeys map[string]*cachedKey
+	cachedKeys *keyCache
 }
 
-// KeyMemoryStore manages private keys in memory
+// KeyMemoryStore manages private keys in memory.  Like a KeyFileStore, it is
+// safe for concurrent use.
 type KeyMemoryStore struct {
 	sync.Mutex
 	MemoryFileStore
 	passphrase.Retriever
-	cachedKeys map[string]*cachedKey
+	cachedKeys *keyCache
 }
 
 // NewKeyFileStore returns a new KeyFileStore creating a private directory to
@@ -40,7 +46,7 @@ func NewKeyFileStore(baseDir string, passphraseRetriever passphrase.Retriever) (
 	if err != nil {
 		return nil, err
 	}
-	cachedKeys := make(map[string]*cachedKey)
+	cachedKeys := newKeyCache()
 
 	return &KeyFileStore{SimpleFileStore: *fileStore,
 		Retriever:  passphraseRetriever,
@@ -72,6 +78,29 @@ func (s *KeyFileStore) ListKeys() map[string]string {
 	return listKeys(s)
 }
 
+// ListKeysByRole returns the keys on the KeyFileStore with the given role,
+// like ListKeys.
+func (s *KeyFileStore) ListKeysByRole(role string) map[string]string {
+	return listKeysByRole(s, role)
+}
+
+// ListKeysByGUN returns the keys on the KeyFileStore for the given GUN, like
+// ListKeys, reading only the GUN's directory.  Root keys aren't stored for a
+// GUN, so they are never listed.
+func (s *KeyFileStore) ListKeysByGUN(gun string) map[string]string {
+	keyIDMap := make(map[string]string)
+	for _, f := range s.ListDir(filepath.Join(nonRootKeysSubdir, gun)) {
+		// the keys of GUNs under this one are in subdirectories
+		if filepath.Base(f) != f {
+			continue
+		}
+		if keyID, keyAlias, ok := parseKeyFileName(f); ok {
+			keyIDMap[filepath.Join(gun, keyID)] = keyAlias
+		}
+	}
+	return keyIDMap
+}
+
 // RemoveKey removes the key from the keyfilestore
 func (s *KeyFileStore) RemoveKey(name string) error {
 	s.Lock()
@@ -89,16 +118,34 @@ func (s *KeyFileStore) ExportKey(name string) ([]byte, error) {
 	return keyBytes, nil
 }
 
+// ChangeKeyPassphrase decrypts the private key with the given name using the
+// current passphrase from the retriever, and re-encrypts it in place with a new
+// one.
+func (s *KeyFileStore) ChangeKeyPassphrase(name string) error {
+	s.Lock()
+	defer s.Unlock()
+	return changeKeyPassphrase(s, s.Retriever, s.cachedKeys, name)
+}
+
+// SetKeyCacheTTL bounds how long an unlocked private key stays cached after it
+// was last used, after which its passphrase is asked for again.  Zero, the
+// default, caches a key until it is removed from the store.
+func (s *KeyFileStore) SetKeyCacheTTL(ttl time.Duration) {
+	s.cachedKeys.setTTL(ttl)
+}
+
 // ImportKey imports the private key in the encrypted bytes into the keystore
 // with the given key ID and alias.
 func (s *KeyFileStore) ImportKey(pemBytes []byte, alias string) error {
+	s.Lock()
+	defer s.Unlock()
 	return importKey(s, s.Retriever, s.cachedKeys, alias, pemBytes)
 }
 
 // NewKeyMemoryStore returns a new KeyMemoryStore which holds keys in memory
 func NewKeyMemoryStore(passphraseRetriever passphrase.Retriever) *KeyMemoryStore {
 	memStore := NewMemoryFileStore()
-	cachedKeys := make(map[string]*cachedKey)
+	cachedKeys := newKeyCache()
 
 	return &KeyMemoryStore{MemoryFileStore: *memStore,
 		Retriever:  passphraseRetriever,
@@ -130,6 +177,25 @@ func (s *KeyMemoryStore) ListKeys() map[string]string {
 	return listKeys(s)
 }
 
+// ListKeysByRole returns the keys on the KeyMemoryStore with the given role,
+// like ListKeys.
+func (s *KeyMemoryStore) ListKeysByRole(role string) map[string]string {
+	return listKeysByRole(s, role)
+}
+
+// ListKeysByGUN returns the keys on the KeyMemoryStore for the given GUN,
+// like ListKeys.  Root keys aren't stored for a GUN, so they are never
+// listed.
+func (s *KeyMemoryStore) ListKeysByGUN(gun string) map[string]string {
+	keyIDMap := make(map[string]string)
+	for keyID, keyAlias := range listKeys(s) {
+		if filepath.Dir(keyID) == gun {
+			keyIDMap[keyID] = keyAlias
+		}
+	}
+	return keyIDMap
+}
+
 // RemoveKey removes the key from the keystore
 func (s *KeyMemoryStore) RemoveKey(name string) error {
 	s.Lock()
@@ -147,13 +213,31 @@ func (s *KeyMemoryStore) ExportKey(name string) ([]byte, error) {
 	return keyBytes, nil
 }
 
+// ChangeKeyPassphrase decrypts the private key with the given name using the
+// current passphrase from the retriever, and re-encrypts it in place with a new
+// one.
+func (s *KeyMemoryStore) ChangeKeyPassphrase(name string) error {
+	s.Lock()
+	defer s.Unlock()
+	return changeKeyPassphrase(s, s.Retriever, s.cachedKeys, name)
+}
+
+// SetKeyCacheTTL bounds how long an unlocked private key stays cached after it
+// was last used, after which its passphrase is asked for again.  Zero, the
+// default, caches a key until it is removed from the store.
+func (s *KeyMemoryStore) SetKeyCacheTTL(ttl time.Duration) {
+	s.cachedKeys.setTTL(ttl)
+}
+
 // ImportKey imports the private key in the encrypted bytes into the keystore
 // with the given key ID and alias.
 func (s *KeyMemoryStore) ImportKey(pemBytes []byte, alias string) error {
+	s.Lock()
+	defer s.Unlock()
 	return importKey(s, s.Retriever, s.cachedKeys, alias, pemBytes)
 }
 
-func addKey(s LimitedFileStore, passphraseRetriever passphrase.Retriever, cachedKeys map[string]*cachedKey, name, alias string, privKey data.PrivateKey) error {
+func addKey(s LimitedFileStore, passphraseRetriever passphrase.Retriever, cachedKeys *keyCache, name, alias string, privKey data.PrivateKey) error {
 
 	var (
 		chosenPassphrase string
@@ -197,10 +281,9 @@ func getKeyAlias(s LimitedFileStore, keyID string) (string, error) {
 }
 
 // GetKey returns the PrivateKey given a KeyID
-func getKey(s LimitedFileStore, passphraseRetriever passphrase.Retriever, cachedKeys map[string]*cachedKey, name string) (data.PrivateKey, string, error) {
-	cachedKeyEntry, ok := cachedKeys[name]
-	if ok {
-		return cachedKeyEntry.key, cachedKeyEntry.alias, nil
+func getKey(s LimitedFileStore, passphraseRetriever passphrase.Retriever, cachedKeys *keyCache, name string) (data.PrivateKey, string, error) {
+	if cachedKey, cachedAlias, ok := cachedKeys.get(name); ok {
+		return cachedKey, cachedAlias, nil
 	}
 
 	keyBytes, keyAlias, err := getRawKey(s, name)
@@ -217,10 +300,28 @@ func getKey(s LimitedFileStore, passphraseRetriever passphrase.Retriever, cached
 	if retErr != nil {
 		return nil, "", retErr
 	}
-	cachedKeys[name] = &cachedKey{alias: keyAlias, key: privKey}
+	cachedKeys.set(name, keyAlias, privKey)
 	return privKey, keyAlias, nil
 }
 
+// changeKeyPassphrase always decrypts the stored key, rather than using the
+// cached one, so that the current passphrase has to be known to change it
+func changeKeyPassphrase(s LimitedFileStore, passphraseRetriever passphrase.Retriever, cachedKeys *keyCache, name string) error {
+	keyBytes, keyAlias, err := getRawKey(s, name)
+	if err != nil {
+		return err
+	}
+
+	privKey, err := ParsePEMPrivateKey(keyBytes, "")
+	if err != nil {
+		privKey, _, err = GetPasswdDecryptBytes(passphraseRetriever, keyBytes, name, keyAlias)
+		if err != nil {
+			return err
+		}
+	}
+	return addKey(s, passphraseRetriever, cachedKeys, name, keyAlias, privKey)
+}
+
 // ListKeys returns a map of unique PublicKeys present on the KeyFileStore and
 // their corresponding aliases.
 func listKeys(s LimitedFileStore) map[string]string {
@@ -234,34 +335,52 @@ func listKeys(s LimitedFileStore) map[string]string {
 			f = strings.TrimPrefix(f, nonRootKeysSubdir+"/")
 		}
 
-		// Remove the extension from the full filename
-		// abcde_root.key becomes abcde_root
-		keyIDFull := strings.TrimSpace(strings.TrimSuffix(f, filepath.Ext(f)))
-
-		// If the key does not have a _, it is malformed
-		underscoreIndex := strings.LastIndex(keyIDFull, "_")
-		if underscoreIndex == -1 {
-			continue
+		if keyID, keyAlias, ok := parseKeyFileName(f); ok {
+			keyIDMap[keyID] = keyAlias
 		}
+	}
+	return keyIDMap
+}
 
-		// The keyID is the first part of the keyname
-		// The KeyAlias is the second part of the keyname
-		// in a key named abcde_root, abcde is the keyID and root is the KeyAlias
-		keyID := keyIDFull[:underscoreIndex]
-		keyAlias := keyIDFull[underscoreIndex+1:]
-		keyIDMap[keyID] = keyAlias
+// listKeysByRole returns the keys listKeys returns whose alias is role
+func listKeysByRole(s LimitedFileStore, role string) map[string]string {
+	keyIDMap := make(map[string]string)
+	for keyID, keyAlias := range listKeys(s) {
+		if keyAlias == role {
+			keyIDMap[keyID] = keyAlias
+		}
 	}
 	return keyIDMap
 }
 
+// parseKeyFileName returns the key ID and the alias of the key in the file
+// with the given name, relative to the directory of the keys, or false if
+// the name is malformed
+func parseKeyFileName(f string) (keyID, keyAlias string, ok bool) {
+	// Remove the extension from the full filename
+	// abcde_root.key becomes abcde_root
+	keyIDFull := strings.TrimSpace(strings.TrimSuffix(f, filepath.Ext(f)))
+
+	// If the key does not have a _, it is malformed
+	underscoreIndex := strings.LastIndex(keyIDFull, "_")
+	if underscoreIndex == -1 {
+		return "", "", false
+	}
+
+	// The keyID is the first part of the keyname
+	// The KeyAlias is the second part of the keyname
+	// in a key named abcde_root, abcde is the keyID and root is the KeyAlias
+	return keyIDFull[:underscoreIndex], keyIDFull[underscoreIndex+1:], true
+}
+
 // RemoveKey removes the key from the keyfilestore
-func removeKey(s LimitedFileStore, cachedKeys map[string]*cachedKey, name string) error {
+func removeKey(s LimitedFileStore, cachedKeys *keyCache, name string) error {
 	keyAlias, err := getKeyAlias(s, name)
 	if err != nil {
 		return err
 	}
 
-	delete(cachedKeys, name)
+	cachedKeys.remove(name)
 
 	// being in a subdirectory is for backwards compatibliity
 	filename := name + "_" + keyAlias
@@ -291,7 +410,10 @@ func getRawKey(s LimitedFileStore, name string) ([]byte, string, error) {
 	filename := name + "_" + keyAlias
 	var keyBytes []byte
 	keyBytes, err = s.Get(filepath.Join(getSubdir(keyAlias), filename))
-	if err != nil {
+	if os.IsNotExist(err) || err == ErrMemFileNotFound {
+		// getKeyAlias matched the file of a key stored under another name
+		return nil, "", &ErrKeyNotFound{KeyID: name}
+	} else if err != nil {
 		return nil, "", err
 	}
 	return keyBytes, keyAlias, nil
@@ -335,7 +457,7 @@ func GetPasswdDecryptBytes(passphraseRetriever passphrase.Retriever, pemBytes []
 	return privKey, passwd, nil
 }
 
-func encryptAndAddKey(s LimitedFileStore, passwd string, cachedKeys map[string]*cachedKey, name, alias string, privKey data.PrivateKey) error {
+func encryptAndAddKey(s LimitedFileStore, passwd string, cachedKeys *keyCache, name, alias string, privKey data.PrivateKey) error {
 
 	var (
 		pemPrivKey []byte
@@ -352,11 +474,11 @@ func encryptAndAddKey(s LimitedFileStore, passwd string, cachedKeys map[string]*
 		return err
 	}
 
-	cachedKeys[name] = &cachedKey{alias: alias, key: privKey}
+	cachedKeys.set(name, alias, privKey)
 	return s.Add(filepath.Join(getSubdir(alias), name+"_"+alias), pemPrivKey)
 }
 
-func importKey(s LimitedFileStore, passphraseRetriever passphrase.Retriever, cachedKeys map[string]*cachedKey, alias string, pemBytes []byte) error {
+func importKey(s LimitedFileStore, passphraseRetriever passphrase.Retriever, cachedKeys *keyCache, alias string, pemBytes []byte) error {
 
 	if alias != data.CanonicalRootRole {
 		return s.Add(alias, pemBytes)
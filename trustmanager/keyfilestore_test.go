@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/docker/notary/passphrase"
 	"github.com/docker/notary/tuf/data"
@@ -168,6 +169,42 @@ func TestListKeys(t *testing.T) {
 	assert.Len(t, keyMap, 2)
 }
 
+// Keys can be listed by role, or by GUN without the keys of any other GUN,
+// even one under it, or the root keys.
+func TestListKeysByRoleAndGUN(t *testing.T) {
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	assert.NoError(t, err, "failed to create a temporary directory")
+	defer os.RemoveAll(tempBaseDir)
+
+	fileStore, err := NewKeyFileStore(tempBaseDir, passphraseRetriever)
+	assert.NoError(t, err, "failed to create new key filestore")
+	stores := []interface {
+		KeyStore
+		ListKeysByRole(role string) map[string]string
+		ListKeysByGUN(gun string) map[string]string
+	}{fileStore, NewKeyMemoryStore(passphraseRetriever)}
+
+	privKey, err := GenerateECDSAKey(rand.Reader)
+	assert.NoError(t, err, "could not generate private key")
+	for _, store := range stores {
+		assert.NoError(t, store.AddKey("rootkey", "root", privKey))
+		assert.NoError(t, store.AddKey("docker.com/notary/targetskey", "targets", privKey))
+		assert.NoError(t, store.AddKey("docker.com/notary/snapshotkey", "snapshot", privKey))
+		assert.NoError(t, store.AddKey("docker.com/notary/sub/targetskey", "targets", privKey))
+		assert.NoError(t, store.AddKey("docker.com/other/targetskey", "targets", privKey))
+
+		assert.Equal(t, map[string]string{
+			"docker.com/notary/targetskey":  "targets",
+			"docker.com/notary/snapshotkey": "snapshot",
+		}, store.ListKeysByGUN("docker.com/notary"), store.Name())
+		assert.Empty(t, store.ListKeysByGUN("docker.com/missing"), store.Name())
+
+		assert.Equal(t, map[string]string{"rootkey": "root"}, store.ListKeysByRole("root"), store.Name())
+		assert.Len(t, store.ListKeysByRole("targets"), 3, store.Name())
+	}
+}
+
 func TestAddGetKeyMemStore(t *testing.T) {
 	testName := "docker.com/notary/root"
 	testAlias := "root"
@@ -404,6 +441,90 @@ func TestKeysAreCached(t *testing.T) {
 	assert.Equal(t, 2, numTimesCalled, "numTimesCalled should be 2 -- no additional call to passphraseRetriever")
 }
 
+// With a key cache TTL, an unlocked key is evicted once it hasn't been used for
+// that long, and its passphrase has to be given again.
+func TestKeyCacheTTL(t *testing.T) {
+	testName := "docker.com/notary/root"
+	testAlias := "alias"
+
+	numTimesCalled := 0
+	countingPassphraseRetriever := func(keyId, alias string, createNew bool, attempts int) (string, bool, error) {
+		numTimesCalled++
+		return "password", false, nil
+	}
+
+	store := NewKeyMemoryStore(countingPassphraseRetriever)
+	store.SetKeyCacheTTL(50 * time.Millisecond)
+
+	privKey, err := GenerateECDSAKey(rand.Reader)
+	assert.NoError(t, err, "could not generate private key")
+	err = store.AddKey(testName, testAlias, privKey)
+	assert.NoError(t, err, "failed to add key to store")
+	assert.Equal(t, 1, numTimesCalled)
+
+	// using the key keeps it cached
+	for i := 0; i < 4; i++ {
+		time.Sleep(20 * time.Millisecond)
+		_, _, err := store.GetKey(testName)
+		assert.NoError(t, err, "failed to get key from store")
+	}
+	assert.Equal(t, 1, numTimesCalled)
+
+	time.Sleep(100 * time.Millisecond)
+	privKey2, _, err := store.GetKey(testName)
+	assert.NoError(t, err, "failed to get key from store")
+	assert.Equal(t, privKey.Private(), privKey2.Private())
+	assert.Equal(t, 2, numTimesCalled)
+
+	// without a TTL, keys are cached until they are removed
+	store.SetKeyCacheTTL(0)
+	time.Sleep(100 * time.Millisecond)
+	_, _, err = store.GetKey(testName)
+	assert.NoError(t, err, "failed to get key from store")
+	assert.Equal(t, 2, numTimesCalled)
+}
+
+// The key cache zeroes the private key bytes it holds when a key is removed or
+// evicted, but not those of the keys it was given or has handed out.
+func TestKeyCacheZeroesEvictedKeys(t *testing.T) {
+	testName := "docker.com/notary/root"
+	zeroes := func(key data.PrivateKey) []byte {
+		return make([]byte, len(key.Private()))
+	}
+
+	privKey, err := GenerateECDSAKey(rand.Reader)
+	assert.NoError(t, err, "could not generate private key")
+	original := append([]byte(nil), privKey.Private()...)
+
+	cache := newKeyCache()
+	cache.set(testName, "alias", privKey)
+	cached := cache.keys[testName].key
+	assert.Equal(t, original, cached.Private())
+	handedOut, _, ok := cache.get(testName)
+	assert.True(t, ok)
+
+	cache.remove(testName)
+	assert.Equal(t, zeroes(cached), cached.Private())
+	assert.Equal(t, original, privKey.Private())
+	assert.Equal(t, original, handedOut.Private())
+	_, _, ok = cache.get(testName)
+	assert.False(t, ok)
+
+	// a key evicted once its TTL has passed
+	cache.setTTL(10 * time.Millisecond)
+	cache.set(testName, "alias", privKey)
+	cache.Lock()
+	cached = cache.keys[testName].key
+	cache.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	cache.Lock()
+	assert.Equal(t, zeroes(cached), cached.Private())
+	cache.Unlock()
+	assert.Equal(t, original, privKey.Private())
+	_, _, ok = cache.get(testName)
+	assert.False(t, ok)
+}
+
 // Exporting a key is successful (it is a valid key)
 func TestKeyFileStoreExportSuccess(t *testing.T) {
 	// Generate a new Private Key
@@ -525,3 +646,60 @@ func assertImportKeySuccess(
 	assert.Equal(t, expectedKey.Private(), reimportedKey.Private())
 	assert.Equal(t, expectedKey.Public(), reimportedKey.Public())
 }
+
+// Changing the passphrase of a key decrypts it with the current passphrase and
+// re-encrypts it with the new one in the same location, so that only the new
+// passphrase decrypts it.
+func TestKeyFileStoreChangeKeyPassphrase(t *testing.T) {
+	privKey, err := GenerateECDSAKey(rand.Reader)
+	assert.NoError(t, err)
+
+	// Temporary directory where test files will be created
+	tempBaseDir, err := ioutil.TempDir("", "notary-test-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempBaseDir)
+
+	store, err := NewKeyFileStore(tempBaseDir, passphrase.ConstantRetriever("old"))
+	assert.NoError(t, err)
+	assert.NoError(t, store.AddKey(privKey.ID(), "root", privKey))
+	oldBytes, err := store.ExportKey(privKey.ID())
+	assert.NoError(t, err)
+
+	// the current passphrase is only asked for when not creating a new one
+	var changeRetriever = func(keyID, alias string, createNew bool, numAttempts int) (string, bool, error) {
+		if createNew {
+			return "new", false, nil
+		}
+		return "old", false, nil
+	}
+	changeStore, err := NewKeyFileStore(tempBaseDir, changeRetriever)
+	assert.NoError(t, err)
+	assert.NoError(t, changeStore.ChangeKeyPassphrase(privKey.ID()))
+
+	newBytes, err := changeStore.ExportKey(privKey.ID())
+	assert.NoError(t, err)
+	assert.NotEqual(t, oldBytes, newBytes)
+	assert.Len(t, changeStore.ListKeys(), 1)
+
+	_, err = ParsePEMPrivateKey(newBytes, "old")
+	assert.Error(t, err)
+	decrypted, err := ParsePEMPrivateKey(newBytes, "new")
+	assert.NoError(t, err)
+	assert.Equal(t, privKey.Private(), decrypted.Private())
+
+	// without the current passphrase, the passphrase isn't changed
+	wrongStore, err := NewKeyFileStore(tempBaseDir, passphrase.ConstantRetriever("wrong"))
+	assert.NoError(t, err)
+	err = wrongStore.ChangeKeyPassphrase(privKey.ID())
+	assert.IsType(t, ErrAttemptsExceeded{}, err)
+	unchangedBytes, err := wrongStore.ExportKey(privKey.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, newBytes, unchangedBytes)
+}
+
+// A key that doesn't exist can't have its passphrase changed
+func TestKeyMemoryStoreChangeKeyPassphraseNonExistantFailure(t *testing.T) {
+	store := NewKeyMemoryStore(passphraseRetriever)
+	err := store.ChangeKeyPassphrase("12345")
+	assert.IsType(t, &ErrKeyNotFound{}, err)
+}
@@ -2,6 +2,8 @@ package trustmanager
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/docker/notary/tuf/data"
 )
@@ -52,6 +54,122 @@ type KeyStore interface {
 }
 
 type cachedKey struct {
-	alias string
-	key   data.PrivateKey
+	alias  string
+	key    data.PrivateKey
+	expiry *time.Timer // nil if the key is cached until it's removed
+}
+
+// keyCache holds the private keys a key store has unlocked, so that their
+// passphrases aren't asked for every time they are used.  If ttl is set, a key
+// is evicted once it hasn't been used for that long.  The cache holds its own
+// copies of the keys, and hands out copies of them, so that the private key
+// bytes it holds can be zeroed when a key is evicted or removed.  It is safe
+// for concurrent use.
+type keyCache struct {
+	sync.Mutex
+	ttl  time.Duration
+	keys map[string]*cachedKey
+}
+
+func newKeyCache() *keyCache {
+	return &keyCache{keys: make(map[string]*cachedKey)}
+}
+
+func (c *keyCache) get(name string) (data.PrivateKey, string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.keys[name]
+	if !ok {
+		return nil, "", false
+	}
+	key, err := copyPrivateKey(entry.key)
+	if err != nil {
+		return nil, "", false
+	}
+	if entry.expiry != nil {
+		entry.expiry.Reset(c.ttl)
+	}
+	return key, entry.alias, true
+}
+
+func (c *keyCache) set(name, alias string, key data.PrivateKey) {
+	key, err := copyPrivateKey(key)
+	if err != nil {
+		c.remove(name)
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.removeLocked(name)
+	entry := &cachedKey{alias: alias, key: key}
+	c.keys[name] = entry
+	c.startExpiry(name, entry)
+}
+
+func (c *keyCache) remove(name string) {
+	c.Lock()
+	defer c.Unlock()
+	c.removeLocked(name)
+}
+
+// setTTL changes the ttl, which also applies to the keys already cached from
+// now on
+func (c *keyCache) setTTL(ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.ttl = ttl
+	for name, entry := range c.keys {
+		if entry.expiry != nil {
+			entry.expiry.Stop()
+			entry.expiry = nil
+		}
+		c.startExpiry(name, entry)
+	}
+}
+
+func (c *keyCache) removeLocked(name string) {
+	if entry, ok := c.keys[name]; ok {
+		if entry.expiry != nil {
+			entry.expiry.Stop()
+		}
+		delete(c.keys, name)
+		zeroPrivateKey(entry.key)
+	}
+}
+
+func (c *keyCache) startExpiry(name string, entry *cachedKey) {
+	if c.ttl <= 0 {
+		return
+	}
+	entry.expiry = time.AfterFunc(c.ttl, func() {
+		c.Lock()
+		defer c.Unlock()
+		// the key may have been replaced since
+		if c.keys[name] == entry {
+			delete(c.keys, name)
+			zeroPrivateKey(entry.key)
+		}
+	})
+}
+
+// copyPrivateKey returns a copy of key that shares no memory with it.  The
+// copy has its ID cached, so that its users, which may be concurrent, only
+// read it.
+func copyPrivateKey(key data.PrivateKey) (data.PrivateKey, error) {
+	private := make([]byte, len(key.Private()))
+	copy(private, key.Private())
+	keyCopy, err := data.NewPrivateKey(data.PublicKeyFromPrivate(key), private)
+	if err != nil {
+		return nil, err
+	}
+	keyCopy.ID()
+	return keyCopy, nil
+}
+
+// zeroPrivateKey overwrites the private key bytes of key with zeroes
+func zeroPrivateKey(key data.PrivateKey) {
+	private := key.Private()
+	for i := range private {
+		private[i] = 0
+	}
 }
@@ -330,7 +330,13 @@ func RSAToPrivateKey(rsaPrivKey *rsa.PrivateKey) (data.PrivateKey, error) {
 
 // GenerateECDSAKey generates an ECDSA Private key and returns a TUF PrivateKey
 func GenerateECDSAKey(random io.Reader) (data.PrivateKey, error) {
-	ecdsaPrivKey, err := ecdsa.GenerateKey(elliptic.P256(), random)
+	return GenerateECDSAKeyWithCurve(random, elliptic.P256())
+}
+
+// GenerateECDSAKeyWithCurve generates an ECDSA private key on the given curve,
+// rather than on P-256 like GenerateECDSAKey, and returns a TUF PrivateKey
+func GenerateECDSAKeyWithCurve(random io.Reader, curve elliptic.Curve) (data.PrivateKey, error) {
+	ecdsaPrivKey, err := ecdsa.GenerateKey(curve, random)
 	if err != nil {
 		return nil, err
 	}
@@ -410,6 +416,25 @@ func blockType(k data.PrivateKey) (string, error) {
 	}
 }
 
+// KeyAlgorithmFromPEM returns the algorithm of the private key in pemBytes
+// from its PEM block type, so the key needn't be decrypted
+func KeyAlgorithmFromPEM(pemBytes []byte) (string, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return "", errors.New("no valid private key found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return data.RSAKey, nil
+	case "EC PRIVATE KEY":
+		return data.ECDSAKey, nil
+	case "ED25519 PRIVATE KEY":
+		return data.ED25519Key, nil
+	default:
+		return "", fmt.Errorf("unsupported key type %q", block.Type)
+	}
+}
+
 // KeyToPEM returns a PEM encoded key from a Private Key
 func KeyToPEM(privKey data.PrivateKey) ([]byte, error) {
 	bt, err := blockType(privKey)
@@ -494,6 +519,21 @@ func NewCertificate(gun string, startTime, endTime time.Time) (*x509.Certificate
 	}, nil
 }
 
+// ValidateCertificate returns an error if cert can't be trusted as a root
+// certificate: if it has expired, or is signed using SHA1
+func ValidateCertificate(cert *x509.Certificate) error {
+	if time.Now().After(cert.NotAfter) {
+		return fmt.Errorf("certificate expired on %s", cert.NotAfter)
+	}
+	if cert.SignatureAlgorithm == x509.SHA1WithRSA ||
+		cert.SignatureAlgorithm == x509.DSAWithSHA1 ||
+		cert.SignatureAlgorithm == x509.ECDSAWithSHA1 {
+
+		return errors.New("certificate uses deprecated hashing algorithm (SHA1)")
+	}
+	return nil
+}
+
 // X509PublicKeyID returns a public key ID as a string, given a
 // data.PublicKey that contains an X509 Certificate
 func X509PublicKeyID(certPubKey data.PublicKey) (string, error) {
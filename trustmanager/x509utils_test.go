@@ -204,3 +204,43 @@ func TestECDSAX509PublickeyID(t *testing.T) {
 
 	assert.Equal(t, tufPrivKey.ID(), tufID)
 }
+
+// KeyAlgorithmFromPEM reads the algorithm of encrypted keys without their
+// passphrase
+func TestKeyAlgorithmFromPEM(t *testing.T) {
+	ecdsaKey, err := GenerateECDSAKey(rand.Reader)
+	assert.NoError(t, err)
+	ed25519Key, err := GenerateED25519Key(rand.Reader)
+	assert.NoError(t, err)
+
+	for _, key := range []data.PrivateKey{ecdsaKey, ed25519Key} {
+		pemBytes, err := EncryptPrivateKey(key, "passphrase")
+		assert.NoError(t, err)
+		algorithm, err := KeyAlgorithmFromPEM(pemBytes)
+		assert.NoError(t, err)
+		assert.Equal(t, key.Algorithm(), algorithm)
+	}
+
+	_, err = KeyAlgorithmFromPEM([]byte("not a key"))
+	assert.Error(t, err)
+}
+
+// ECDSA keys can be generated on curves other than P-256, and still be encoded
+// and parsed
+func TestGenerateECDSAKeyWithCurve(t *testing.T) {
+	for _, curve := range []elliptic.Curve{elliptic.P384(), elliptic.P521()} {
+		privKey, err := GenerateECDSAKeyWithCurve(rand.Reader, curve)
+		assert.NoError(t, err)
+		assert.Equal(t, data.ECDSAKey, privKey.Algorithm())
+
+		pemBytes, err := KeyToPEM(privKey)
+		assert.NoError(t, err)
+		parsed, err := ParsePEMPrivateKey(pemBytes, "")
+		assert.NoError(t, err)
+		assert.Equal(t, privKey.ID(), parsed.ID())
+
+		ecdsaKey, err := x509.ParseECPrivateKey(parsed.Private())
+		assert.NoError(t, err)
+		assert.Equal(t, curve, ecdsaKey.Curve)
+	}
+}
@@ -22,12 +22,50 @@ import (
 
 const maxSize int64 = 5 << 20
 
+// DefaultMaxDelegationDepth is the default MaxDelegationDepth of a Client
+const DefaultMaxDelegationDepth = 16
+
 // Client is a usability wrapper around a raw TUF repo
 type Client struct {
 	local  *tuf.Repo
 	remote store.RemoteStore
 	keysDB *keys.KeyDB
 	cache  store.MetadataStore
+
+	// MaxDelegationDepth is how many levels of delegations below the base
+	// targets role the client descends when it walks the delegation tree, so
+	// that a pathologically deep tree served by a malicious or buggy server
+	// can't make it download metadata without end.  A role nested deeper
+	// than that makes the walk fail with an ErrMaxDelegationDepth.  If zero,
+	// it is DefaultMaxDelegationDepth.
+	MaxDelegationDepth int
+}
+
+// delegatedRole is a targets role to walk, and how many levels of delegations
+// below the base targets role it is
+type delegatedRole struct {
+	name  string
+	depth int
+}
+
+// delegatedRoles returns the roles parent delegates to, or an
+// ErrMaxDelegationDepth if they are nested deeper than the client descends
+func (c Client) delegatedRoles(parent delegatedRole, delegations []*data.Role) ([]delegatedRole, error) {
+	if len(delegations) == 0 {
+		return nil, nil
+	}
+	maxDepth := c.MaxDelegationDepth
+	if maxDepth == 0 {
+		maxDepth = DefaultMaxDelegationDepth
+	}
+	if parent.depth >= maxDepth {
+		return nil, ErrMaxDelegationDepth{Role: delegations[0].Name, MaxDepth: maxDepth}
+	}
+	roles := make([]delegatedRole, 0, len(delegations))
+	for _, d := range delegations {
+		roles = append(roles, delegatedRole{name: d.Name, depth: parent.depth + 1})
+	}
+	return roles, nil
 }
 
 // NewClient initialized a Client with the given repo, remote source of content, key database, and cache
@@ -510,37 +548,138 @@ func (c Client) RoleTargetsPath(role string, hashSha256 string, consistent bool)
 func (c Client) TargetMeta(path string) (*data.FileMeta, error) {
 	c.Update()
 	var meta *data.FileMeta
+	err := c.WalkTargetRoles(path, func(role string) bool {
+		// we found the target!
+		meta = c.local.TargetMeta(role, path)
+		return false
+	})
+	return meta, err
+}
 
+// WalkTargetRoles walks the targets roles breadth first, from the base targets
+// role down the delegations that are valid for path, downloading each role's
+// metadata as needed, and calls visit for each role that has metadata for
+// path, in order of priority, until visit returns false.  Unlike TargetMeta,
+// it doesn't update the repo first, so it should be called after Update.
+// Roles whose metadata can't be downloaded are skipped, but the walk stops
+// with an ErrMaxDelegationDepth at delegations nested deeper than the
+// MaxDelegationDepth.
+func (c Client) WalkTargetRoles(path string, visit func(role string) bool) error {
 	pathDigest := sha256.Sum256([]byte(path))
 	pathHex := hex.EncodeToString(pathDigest[:])
 
 	// FIFO list of targets delegations to inspect for target
-	roles := []string{data.ValidRoles["targets"]}
-	var role string
+	roles := []delegatedRole{{name: data.ValidRoles["targets"]}}
+	var role delegatedRole
 	for len(roles) > 0 {
 		// have to do these lines here because of order of execution in for statement
 		role = roles[0]
 		roles = roles[1:]
 
 		// Download the target role file if necessary
-		err := c.downloadTargets(role)
+		err := c.downloadTargets(role.name)
 		if err != nil {
 			// as long as we find a valid target somewhere we're happy.
 			// continue and search other delegated roles if any
 			continue
 		}
 
-		meta = c.local.TargetMeta(role, path)
-		if meta != nil {
-			// we found the target!
-			return meta, nil
+		if c.local.TargetMeta(role.name, path) != nil && !visit(role.name) {
+			return nil
 		}
-		delegations := c.local.TargetDelegations(role, path, pathHex)
-		for _, d := range delegations {
-			roles = append(roles, d.Name)
+		delegations, err := c.delegatedRoles(role, c.local.TargetDelegations(role.name, path, pathHex))
+		if err != nil {
+			return err
 		}
+		roles = append(roles, delegations...)
 	}
-	return meta, nil
+	return nil
+}
+
+// DownloadDelegations downloads every targets file reachable from the base
+// targets role, walking the delegation tree breadth first. Delegated roles
+// that don't appear in the snapshot have not been published yet, and are
+// skipped.
+func (c Client) DownloadDelegations() error {
+	// FIFO list of targets roles to download
+	roles := []delegatedRole{{name: data.ValidRoles["targets"]}}
+	var role delegatedRole
+	for len(roles) > 0 {
+		role = roles[0]
+		roles = roles[1:]
+
+		err := c.downloadTargets(role.name)
+		if err != nil {
+			if _, ok := err.(ErrMissingMeta); ok && role.name != data.ValidRoles["targets"] {
+				logrus.Debugf("no metadata for delegated role %s, skipping", role.name)
+				continue
+			}
+			return err
+		}
+
+		delegations, err := c.delegatedRoles(role, c.local.Targets[role.name].Signed.Delegations.Roles)
+		if err != nil {
+			return err
+		}
+		roles = append(roles, delegations...)
+	}
+	return nil
+}
+
+// TryDownloadDelegations downloads every targets file reachable from the
+// base targets role, like DownloadDelegations, but doesn't stop at a role
+// whose targets file fails to download or verify.  It returns those roles,
+// mapped to why they failed; the roles they delegate to can't be reached.
+// A role whose delegations are nested too deep is mapped to an
+// ErrMaxDelegationDepth.
+func (c Client) TryDownloadDelegations() map[string]error {
+	failed := make(map[string]error)
+	// FIFO list of targets roles to download
+	roles := []delegatedRole{{name: data.ValidRoles["targets"]}}
+	var role delegatedRole
+	for len(roles) > 0 {
+		role = roles[0]
+		roles = roles[1:]
+
+		err := c.downloadTargets(role.name)
+		if err != nil {
+			if _, ok := err.(ErrMissingMeta); ok && role.name != data.ValidRoles["targets"] {
+				logrus.Debugf("no metadata for delegated role %s, skipping", role.name)
+				continue
+			}
+			failed[role.name] = err
+			continue
+		}
+
+		delegations, err := c.delegatedRoles(role, c.local.Targets[role.name].Signed.Delegations.Roles)
+		if err != nil {
+			// the roles it delegates to are too deep to be reached
+			failed[role.name] = err
+			continue
+		}
+		roles = append(roles, delegations...)
+	}
+	return failed
+}
+
+// RemoteMeta downloads the metadata for a base role from the remote, and
+// verifies it against the keys the root trusts for that role. Neither the
+// local repo nor the cache is updated.
+func (c Client) RemoteMeta(role string) (*data.Signed, error) {
+	if !data.ValidRole(role) || data.IsDelegation(role) {
+		return nil, data.ErrInvalidRole{
+			Role:   role,
+			Reason: "only the metadata of base roles can be verified against the root",
+		}
+	}
+	_, s, err := c.downloadSigned(role, maxSize, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := signed.Verify(s, role, 0, c.keysDB); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
 // DownloadTarget downloads the target to dst from the remote
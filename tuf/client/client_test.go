@@ -412,6 +412,168 @@ func TestDownloadTargetsNoSnapshot(t *testing.T) {
 	assert.IsType(t, ErrMissingMeta{}, err)
 }
 
+func TestDownloadDelegations(t *testing.T) {
+	kdb, repo, cs := testutils.EmptyRepo()
+	localStorage := store.NewMemoryStore(nil, nil)
+	remoteStorage := store.NewMemoryStore(nil, nil)
+	client := NewClient(repo, remoteStorage, kdb, localStorage)
+
+	// "targets/a" gets published, "targets/b" never does
+	for _, name := range []string{"targets/a", "targets/b"} {
+		key, err := cs.Create(name, data.ED25519Key)
+		assert.NoError(t, err)
+		role, err := data.NewRole(name, 1, []string{key.ID()}, []string{""}, nil)
+		assert.NoError(t, err)
+		err = repo.UpdateDelegations(role, []data.PublicKey{key})
+		assert.NoError(t, err)
+	}
+	hash := sha256.Sum256([]byte{})
+	_, err := repo.AddTargets("targets/a", data.Files{
+		"latest": data.FileMeta{Length: 1, Hashes: data.Hashes{"sha256": hash[:]}},
+	})
+	assert.NoError(t, err)
+
+	for _, role := range []string{"targets/a", "targets"} {
+		signedOrig, err := repo.SignTargets(role, data.DefaultExpires("targets"))
+		assert.NoError(t, err)
+		orig, err := json.Marshal(signedOrig)
+		assert.NoError(t, err)
+		err = remoteStorage.SetMeta(role, orig)
+		assert.NoError(t, err)
+	}
+	delete(repo.Targets, "targets/b")
+	_, err = repo.SignSnapshot(data.DefaultExpires("snapshot"))
+	assert.NoError(t, err)
+
+	// forget about the delegated role so it has to be downloaded again
+	delete(repo.Targets, "targets/a")
+
+	err = client.DownloadDelegations()
+	assert.NoError(t, err)
+	assert.NotNil(t, repo.TargetMeta("targets/a", "latest"))
+	_, ok := repo.Targets["targets/b"]
+	assert.False(t, ok)
+}
+
+// TryDownloadDelegations downloads the delegated roles that can be, and
+// returns why the others couldn't be.
+func TestTryDownloadDelegations(t *testing.T) {
+	kdb, repo, cs := testutils.EmptyRepo()
+	localStorage := store.NewMemoryStore(nil, nil)
+	remoteStorage := store.NewMemoryStore(nil, nil)
+	client := NewClient(repo, remoteStorage, kdb, localStorage)
+
+	for _, name := range []string{"targets/a", "targets/b"} {
+		key, err := cs.Create(name, data.ED25519Key)
+		assert.NoError(t, err)
+		role, err := data.NewRole(name, 1, []string{key.ID()}, []string{""}, nil)
+		assert.NoError(t, err)
+		err = repo.UpdateDelegations(role, []data.PublicKey{key})
+		assert.NoError(t, err)
+	}
+	for _, role := range []string{"targets/a", "targets/b", "targets"} {
+		signedOrig, err := repo.SignTargets(role, data.DefaultExpires("targets"))
+		assert.NoError(t, err)
+		orig, err := json.Marshal(signedOrig)
+		assert.NoError(t, err)
+		err = remoteStorage.SetMeta(role, orig)
+		assert.NoError(t, err)
+	}
+	_, err := repo.SignSnapshot(data.DefaultExpires("snapshot"))
+	assert.NoError(t, err)
+
+	// "targets/b" is not what the snapshot says it is
+	err = remoteStorage.SetMeta("targets/b", []byte("{}"))
+	assert.NoError(t, err)
+	delete(repo.Targets, "targets/a")
+	delete(repo.Targets, "targets/b")
+
+	failed := client.TryDownloadDelegations()
+	assert.Len(t, failed, 1)
+	assert.IsType(t, ErrChecksumMismatch{}, failed["targets/b"])
+	_, ok := repo.Targets["targets/a"]
+	assert.True(t, ok)
+	_, ok = repo.Targets["targets/b"]
+	assert.False(t, ok)
+}
+
+// Walking the delegation tree stops, with an ErrMaxDelegationDepth, at
+// delegations nested deeper than the client's MaxDelegationDepth
+func TestMaxDelegationDepth(t *testing.T) {
+	kdb, repo, cs := testutils.EmptyRepo()
+	localStorage := store.NewMemoryStore(nil, nil)
+	remoteStorage := store.NewMemoryStore(nil, nil)
+
+	roles := []string{"targets/a", "targets/a/b", "targets/a/b/c"}
+	for _, name := range roles {
+		key, err := cs.Create(name, data.ED25519Key)
+		assert.NoError(t, err)
+		role, err := data.NewRole(name, 1, []string{key.ID()}, []string{""}, nil)
+		assert.NoError(t, err)
+		err = repo.UpdateDelegations(role, []data.PublicKey{key})
+		assert.NoError(t, err)
+	}
+	hash := sha256.Sum256([]byte{})
+	_, err := repo.AddTargets("targets/a/b/c", data.Files{
+		"latest": data.FileMeta{Length: 1, Hashes: data.Hashes{"sha256": hash[:]}},
+	})
+	assert.NoError(t, err)
+	for _, role := range append(roles, "targets") {
+		signedOrig, err := repo.SignTargets(role, data.DefaultExpires("targets"))
+		assert.NoError(t, err)
+		orig, err := json.Marshal(signedOrig)
+		assert.NoError(t, err)
+		err = remoteStorage.SetMeta(role, orig)
+		assert.NoError(t, err)
+	}
+	_, err = repo.SignSnapshot(data.DefaultExpires("snapshot"))
+	assert.NoError(t, err)
+
+	forget := func() {
+		for _, role := range roles {
+			delete(repo.Targets, role)
+		}
+	}
+	depthErr := ErrMaxDelegationDepth{Role: "targets/a/b/c", MaxDepth: 2}
+
+	client := NewClient(repo, remoteStorage, kdb, localStorage)
+	client.MaxDelegationDepth = 2
+	forget()
+	assert.Equal(t, depthErr, client.DownloadDelegations())
+	_, ok := repo.Targets["targets/a/b/c"]
+	assert.False(t, ok)
+
+	forget()
+	var visited []string
+	err = client.WalkTargetRoles("latest", func(role string) bool {
+		visited = append(visited, role)
+		return true
+	})
+	assert.Equal(t, depthErr, err)
+	assert.Empty(t, visited)
+
+	forget()
+	failed := client.TryDownloadDelegations()
+	assert.Equal(t, map[string]error{"targets/a/b": depthErr}, failed)
+
+	// deep enough
+	client.MaxDelegationDepth = 3
+	forget()
+	assert.NoError(t, client.DownloadDelegations())
+	forget()
+	err = client.WalkTargetRoles("latest", func(role string) bool {
+		visited = append(visited, role)
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"targets/a/b/c"}, visited)
+
+	// the default is deep enough too
+	client.MaxDelegationDepth = 0
+	forget()
+	assert.NoError(t, client.DownloadDelegations())
+}
+
 func TestBootstrapDownloadRootHappy(t *testing.T) {
 	kdb, repo, _ := testutils.EmptyRepo()
 	localStorage := store.NewMemoryStore(nil, nil)
@@ -30,3 +30,15 @@ type ErrCorruptedCache struct {
 func (e ErrCorruptedCache) Error() string {
 	return fmt.Sprintf("cache is corrupted: %s", e.file)
 }
+
+// ErrMaxDelegationDepth - a delegated role is nested deeper than the client
+// descends the delegation tree
+type ErrMaxDelegationDepth struct {
+	Role     string
+	MaxDepth int
+}
+
+func (e ErrMaxDelegationDepth) Error() string {
+	return fmt.Sprintf("tuf: delegated role %s is nested deeper than the maximum delegation depth of %d",
+		e.Role, e.MaxDepth)
+}
@@ -47,11 +47,7 @@ func (r SignedRoot) ToSigned() (*Signed, error) {
 	if err != nil {
 		return nil, err
 	}
-	signed := json.RawMessage{}
-	err = signed.UnmarshalJSON(s)
-	if err != nil {
-		return nil, err
-	}
+	signed := json.RawMessage(s)
 	sigs := make([]Signature, len(r.Signatures))
 	copy(sigs, r.Signatures)
 	return &Signed{
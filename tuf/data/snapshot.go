@@ -69,11 +69,7 @@ func (sp SignedSnapshot) ToSigned() (*Signed, error) {
 	if err != nil {
 		return nil, err
 	}
-	signed := json.RawMessage{}
-	err = signed.UnmarshalJSON(s)
-	if err != nil {
-		return nil, err
-	}
+	signed := json.RawMessage(s)
 	sigs := make([]Signature, len(sp.Signatures))
 	copy(sigs, sp.Signatures)
 	return &Signed{
@@ -97,11 +97,8 @@ func (t SignedTargets) ToSigned() (*Signed, error) {
 	if err != nil {
 		return nil, err
 	}
-	signed := json.RawMessage{}
-	err = signed.UnmarshalJSON(s)
-	if err != nil {
-		return nil, err
-	}
+	// s is a new buffer, so it can be used as it is without being copied
+	signed := json.RawMessage(s)
 	sigs := make([]Signature, len(t.Signatures))
 	copy(sigs, t.Signatures)
 	return &Signed{
@@ -52,11 +52,7 @@ func (ts SignedTimestamp) ToSigned() (*Signed, error) {
 	if err != nil {
 		return nil, err
 	}
-	signed := json.RawMessage{}
-	err = signed.UnmarshalJSON(s)
-	if err != nil {
-		return nil, err
-	}
+	signed := json.RawMessage(s)
 	sigs := make([]Signature, len(ts.Signatures))
 	copy(sigs, ts.Signatures)
 	return &Signed{
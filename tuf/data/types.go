@@ -193,9 +193,15 @@ func SetDefaultExpiryTimes(times map[string]int) {
 
 // DefaultExpires gets the default expiry time for the given role
 func DefaultExpires(role string) time.Time {
+	return DefaultExpiresFrom(role, time.Now())
+}
+
+// DefaultExpiresFrom gets the default expiry time for the given role, counting
+// from now instead of the current time
+func DefaultExpiresFrom(role string, now time.Time) time.Time {
 	var t time.Time
 	if t, ok := defaultExpiryTimes[role]; ok {
-		return time.Now().AddDate(0, 0, t)
+		return now.AddDate(0, 0, t)
 	}
 	return t.UTC().Round(time.Second)
 }
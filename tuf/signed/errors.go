@@ -3,6 +3,7 @@ package signed
 import (
 	"fmt"
 	"strings"
+	"time"
 )
 
 // ErrInsufficientSignatures - do not have enough signatures on a piece of
@@ -19,6 +20,7 @@ func (e ErrInsufficientSignatures) Error() string {
 type ErrExpired struct {
 	Role    string
 	Expired string
+	Expires time.Time // the expiry Expired formats
 }
 
 func (e ErrExpired) Error() string {
@@ -81,7 +81,11 @@ func verifyMeta(s *data.Signed, role string, minVersion int) error {
 	}
 	if IsExpired(sm.Expires) {
 		logrus.Errorf("Metadata for %s expired", role)
-		return ErrExpired{Role: role, Expired: sm.Expires.Format("Mon Jan 2 15:04:05 MST 2006")}
+		return ErrExpired{
+			Role:    role,
+			Expired: sm.Expires.Format("Mon Jan 2 15:04:05 MST 2006"),
+			Expires: sm.Expires,
+		}
 	}
 	if sm.Version < minVersion {
 		return ErrLowVersion{sm.Version, minVersion}
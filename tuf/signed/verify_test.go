@@ -200,7 +200,7 @@ func Test(t *testing.T) {
 			role: "root",
 			name: "expired",
 			exp:  &expiredTime,
-			err:  ErrExpired{"root", expiredTime.Format("Mon Jan 2 15:04:05 MST 2006")},
+			err:  ErrExpired{Role: "root", Expired: expiredTime.Format("Mon Jan 2 15:04:05 MST 2006")},
 		},
 	}
 	for _, run := range tests {
@@ -257,4 +257,5 @@ func assertErrExpired(t *testing.T, err error, expected ErrExpired) {
 		t.Fatalf("expected err to have type ErrExpired, got %T", err)
 	}
 	assert.Equal(t, actual.Expired, expected.Expired)
+	assert.Equal(t, actual.Expired, actual.Expires.Format("Mon Jan 2 15:04:05 MST 2006"))
 }
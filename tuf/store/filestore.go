@@ -1,11 +1,14 @@
 package store
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 )
 
 // NewFilesystemStore creates a new store in a directory tree
@@ -37,6 +40,17 @@ type FilesystemStore struct {
 	metaDir       string
 	metaExtension string
 	targetsDir    string
+	indent        bool
+}
+
+// SetIndent sets whether metadata is written as indented JSON, for people and
+// tools to read, instead of exactly as it is given.  Either way, GetMeta
+// returns the metadata as it was given to SetMeta, so checksums of it and the
+// signatures in it are unaffected.  Only a store that indents its writes
+// reads indented metadata back compacted, so it should be set the same way for
+// every store of the same directory.
+func (f *FilesystemStore) SetIndent(indent bool) {
+	f.indent = indent
 }
 
 // GetMeta returns the meta for the given name (a role)
@@ -50,6 +64,9 @@ func (f *FilesystemStore) GetMeta(name string, size int64) ([]byte, error) {
 		}
 		return nil, err
 	}
+	if f.indent {
+		return unindentMeta(meta), nil
+	}
 	return meta, nil
 }
 
@@ -68,8 +85,80 @@ func (f *FilesystemStore) SetMultiMeta(metas map[string][]byte) error {
 func (f *FilesystemStore) SetMeta(name string, meta []byte) error {
 	fileName := fmt.Sprintf("%s.%s", name, f.metaExtension)
 	path := filepath.Join(f.metaDir, fileName)
+	// delegated roles are stored in subdirectories named after their parents
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if f.indent {
+		meta = indentMeta(meta)
+	}
 	if err := ioutil.WriteFile(path, meta, 0600); err != nil {
 		return err
 	}
 	return nil
 }
+
+// indentMeta returns meta as indented JSON if compacting that gives back meta,
+// so that GetMeta can, and otherwise returns meta unchanged
+func indentMeta(meta []byte) []byte {
+	var indented, compacted bytes.Buffer
+	if err := json.Indent(&indented, meta, "", "  "); err != nil {
+		return meta
+	}
+	if err := json.Compact(&compacted, indented.Bytes()); err != nil ||
+		!bytes.Equal(compacted.Bytes(), meta) {
+		return meta
+	}
+	return indented.Bytes()
+}
+
+// unindentMeta returns meta compacted if it is exactly what indentMeta would
+// have written for the compacted metadata, and otherwise returns meta unchanged
+func unindentMeta(meta []byte) []byte {
+	// compact JSON has no newlines outside of its strings, where they are
+	// escaped, so anything else was not indented by SetMeta
+	if bytes.IndexByte(meta, '\n') < 0 {
+		return meta
+	}
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, meta); err != nil ||
+		!bytes.Equal(indentMeta(compacted.Bytes()), meta) {
+		return meta
+	}
+	return compacted.Bytes()
+}
+
+// ListMeta returns the names of all the metadata in the store, including the
+// metadata of delegated roles in subdirectories
+func (f *FilesystemStore) ListMeta() ([]string, error) {
+	var names []string
+	ext := "." + f.metaExtension
+	err := filepath.Walk(f.metaDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != ext {
+			return nil
+		}
+		rel, err := filepath.Rel(f.metaDir, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(strings.TrimSuffix(rel, ext)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// RemoveMeta removes the meta for a single role, if it exists
+func (f *FilesystemStore) RemoveMeta(name string) error {
+	fileName := fmt.Sprintf("%s.%s", name, f.metaExtension)
+	path := filepath.Join(f.metaDir, fileName)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -40,6 +40,14 @@ func TestSetMeta(t *testing.T) {
 	content, err := ioutil.ReadFile(path.Join(testDir, "metadata", "testMeta.json"))
 	assert.Nil(t, err, "Error reading file: %v", err)
 	assert.Equal(t, testContent, content, "Content written to file was corrupted.")
+
+	// the metadata of delegated roles goes in subdirectories
+	err = s.SetMeta("targets/a/b", testContent)
+	assert.Nil(t, err, "SetMeta returned unexpected error: %v", err)
+
+	content, err = ioutil.ReadFile(path.Join(testDir, "metadata", "targets", "a", "b.json"))
+	assert.Nil(t, err, "Error reading file: %v", err)
+	assert.Equal(t, testContent, content, "Content written to file was corrupted.")
 }
 
 func TestGetMeta(t *testing.T) {
@@ -57,6 +65,64 @@ func TestGetMeta(t *testing.T) {
 	assert.Equal(t, testContent, content, "Content read from file was corrupted.")
 }
 
+// With indenting on, metadata is written as indented JSON, unless it can't be
+// read back exactly as it was given, and is read back as it was given.
+func TestSetMetaIndented(t *testing.T) {
+	s, err := NewFilesystemStore(testDir, "metadata", "json", "targets")
+	assert.Nil(t, err, "Initializing FilesystemStore returned unexpected error: %v", err)
+	defer os.RemoveAll(testDir)
+	s.SetIndent(true)
+
+	testContent := []byte(`{"signed":{"_type":"Targets","name":"a\nb"},"signatures":[]}`)
+	assert.NoError(t, s.SetMeta("testMeta", testContent))
+	onDisk, err := ioutil.ReadFile(path.Join(testDir, "metadata", "testMeta.json"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, testContent, onDisk)
+	assert.Contains(t, string(onDisk), "\n  \"signed\": {\n")
+	content, err := s.GetMeta("testMeta", int64(len(testContent)))
+	assert.NoError(t, err)
+	assert.Equal(t, testContent, content)
+
+	// neither of these would be read back as they were given if indented
+	for _, testContent := range [][]byte{
+		[]byte("test data"),
+		[]byte(`{"signed": {}}`),
+	} {
+		assert.NoError(t, s.SetMeta("testMeta", testContent))
+		onDisk, err := ioutil.ReadFile(path.Join(testDir, "metadata", "testMeta.json"))
+		assert.NoError(t, err)
+		assert.Equal(t, testContent, onDisk)
+		content, err := s.GetMeta("testMeta", int64(len(testContent)))
+		assert.NoError(t, err)
+		assert.Equal(t, testContent, content)
+	}
+
+	// metadata that isn't compact, and isn't what SetMeta would have indented,
+	// is read back as it was given
+	testContent = []byte("{\n\"signed\": {}, \"signatures\": []}\n")
+	assert.NoError(t, s.SetMeta("testMeta", testContent))
+	content, err = s.GetMeta("testMeta", int64(len(testContent)))
+	assert.NoError(t, err)
+	assert.Equal(t, testContent, content)
+}
+
+// A store that doesn't indent its writes reads metadata back exactly as it
+// was given, even if it isn't compact.
+func TestGetMetaNotIndented(t *testing.T) {
+	s, err := NewFilesystemStore(testDir, "metadata", "json", "targets")
+	assert.Nil(t, err, "Initializing FilesystemStore returned unexpected error: %v", err)
+	defer os.RemoveAll(testDir)
+
+	testContent := []byte("{\n  \"signed\": {},\n  \"signatures\": []\n}")
+	assert.NoError(t, s.SetMeta("testMeta", testContent))
+	onDisk, err := ioutil.ReadFile(path.Join(testDir, "metadata", "testMeta.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, testContent, onDisk)
+	content, err := s.GetMeta("testMeta", int64(len(testContent)))
+	assert.NoError(t, err)
+	assert.Equal(t, testContent, content)
+}
+
 func TestGetMetaNoSuchMetadata(t *testing.T) {
 	testDir, err := ioutil.TempDir("/tmp", "testFileSystemStore")
 	assert.NoError(t, err)
@@ -75,3 +141,30 @@ func TestGetMetaNoSuchMetadata(t *testing.T) {
 	assert.Error(t, err)
 	assert.IsType(t, ErrMetaNotFound{}, err)
 }
+
+func TestListAndRemoveMeta(t *testing.T) {
+	s, err := NewFilesystemStore(testDir, "metadata", "json", "targets")
+	assert.Nil(t, err, "Initializing FilesystemStore returned unexpected error: %v", err)
+	defer os.RemoveAll(testDir)
+
+	testContent := []byte("test data")
+
+	assert.NoError(t, s.SetMeta("testMeta", testContent))
+	assert.NoError(t, s.SetMeta("targets/testMeta", testContent))
+	ioutil.WriteFile(path.Join(testDir, "metadata", "notMeta.txt"), testContent, 0600)
+
+	names, err := s.ListMeta()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"targets/testMeta", "testMeta"}, names)
+
+	assert.NoError(t, s.RemoveMeta("targets/testMeta"))
+	_, err = s.GetMeta("targets/testMeta", int64(len(testContent)))
+	assert.IsType(t, ErrMetaNotFound{}, err)
+
+	// removing metadata that isn't there is not an error
+	assert.NoError(t, s.RemoveMeta("targets/testMeta"))
+
+	names, err = s.ListMeta()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"testMeta"}, names)
+}
@@ -131,37 +131,96 @@ func translateStatusToError(resp *http.Response) error {
 	}
 }
 
+// ErrIncompleteMeta indicates the server kept closing the connection before
+// all of a metadata file had been received, so the download couldn't be
+// completed even by resuming it
+type ErrIncompleteMeta struct {
+	Name     string
+	Received int
+}
+
+func (err ErrIncompleteMeta) Error() string {
+	return fmt.Sprintf("download of %s metadata was interrupted after %d bytes", err.Name, err.Received)
+}
+
+// maxMetaResumes is how many times GetMeta resumes an interrupted download
+const maxMetaResumes = 3
+
 // GetMeta downloads the named meta file with the given size. A short body
 // is acceptable because in the case of timestamp.json, the size is a cap,
-// not an exact length.
+// not an exact length.  A body shorter than the Content-Length the server
+// announced means the download was interrupted though: it is then resumed
+// with a range request for the rest of the file.
 func (s HTTPStore) GetMeta(name string, size int64) ([]byte, error) {
 	url, err := s.buildMetaURL(name)
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequest("GET", url.String(), nil)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := s.roundTrip.RoundTrip(req)
-	if err != nil {
-		return nil, err
+	var body []byte
+	for resumes := 0; ; resumes++ {
+		req, err := http.NewRequest("GET", url.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(body) > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(body)))
+		}
+		resp, err := s.roundTrip.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		complete, err := readMeta(name, size, resp, &body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if complete {
+			return body, nil
+		}
+		if resumes >= maxMetaResumes {
+			return nil, ErrIncompleteMeta{Name: name, Received: len(body)}
+		}
+		logrus.Debugf("download of %s was interrupted after %d bytes, resuming", name, len(body))
 	}
-	defer resp.Body.Close()
-	if err := translateStatusToError(resp); err != nil {
-		logrus.Debugf("received HTTP status %d when requesting %s.", resp.StatusCode, name)
-		return nil, err
+}
+
+// readMeta appends the metadata in resp, the response to a request for the
+// whole meta file or, if body isn't empty, the rest of it, to body.  It
+// returns whether all of the file has been received.
+func readMeta(name string, size int64, resp *http.Response, body *[]byte) (bool, error) {
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && len(*body) > 0:
+		var start int
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != len(*body) {
+			return false, ErrMaliciousServer{}
+		}
+	case resp.StatusCode == http.StatusOK:
+		// the server sent the whole file, e.g. because it doesn't support
+		// range requests
+		*body = (*body)[:0]
+	default:
+		if err := translateStatusToError(resp); err != nil {
+			logrus.Debugf("received HTTP status %d when requesting %s.", resp.StatusCode, name)
+			return false, err
+		}
 	}
-	if resp.ContentLength > size {
-		return nil, ErrMaliciousServer{}
+	remaining := size - int64(len(*body))
+	if resp.ContentLength > remaining {
+		return false, ErrMaliciousServer{}
 	}
 	logrus.Debugf("%d when retrieving metadata for %s", resp.StatusCode, name)
-	b := io.LimitReader(resp.Body, size)
-	body, err := ioutil.ReadAll(b)
+	part, err := ioutil.ReadAll(io.LimitReader(resp.Body, remaining))
+	*body = append(*body, part...)
+	if resp.ContentLength >= 0 && int64(len(part)) < resp.ContentLength {
+		return false, nil
+	}
 	if err != nil {
-		return nil, err
+		if err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
 	}
-	return body, nil
+	return true, nil
 }
 
 // SetMeta uploads a piece of TUF metadata to the server
@@ -11,6 +11,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -244,3 +245,52 @@ func TestTranslateErrorsWhenCannotParse400(t *testing.T) {
 		assert.IsType(t, ErrInvalidOperation{}, err)
 	}
 }
+
+// interruptingHandler serves testRoot, but closes the connection halfway
+// through the body of every request that isn't for a range of it, or of every
+// request if it doesn't serve ranges
+func interruptingHandler(t *testing.T, requests *int, serveRanges bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		if serveRanges && r.Header.Get("Range") != "" {
+			http.ServeContent(w, r, "root.json", time.Time{}, strings.NewReader(testRoot))
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(testRoot)))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(testRoot[:len(testRoot)/2]))
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		assert.NoError(t, err)
+		conn.Close()
+	}
+}
+
+// An interrupted download of metadata is resumed with a range request for the
+// rest of it.
+func TestHTTPStoreGetMetaResumes(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(interruptingHandler(t, &requests, true))
+	defer server.Close()
+	store, err := NewHTTPStore(server.URL, "metadata", "json", "targets", "key", &http.Transport{})
+	assert.NoError(t, err)
+
+	j, err := store.GetMeta("root", 4801)
+	assert.NoError(t, err)
+	assert.Equal(t, testRoot, string(j))
+	assert.Equal(t, 2, requests)
+}
+
+// A download that keeps getting interrupted is reported as incomplete, rather
+// than returning a truncated file.
+func TestHTTPStoreGetMetaIncomplete(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(interruptingHandler(t, &requests, false))
+	defer server.Close()
+	store, err := NewHTTPStore(server.URL, "metadata", "json", "targets", "key", &http.Transport{})
+	assert.NoError(t, err)
+
+	_, err = store.GetMeta("root", 4801)
+	assert.IsType(t, ErrIncompleteMeta{}, err)
+	assert.Equal(t, maxMetaResumes+1, requests)
+}
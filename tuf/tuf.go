@@ -214,8 +214,11 @@ func (tr *Repo) UpdateDelegations(role *data.Role, keys []data.PublicKey) error
 	// We've made a change to parent. Set it to dirty
 	p.Dirty = true
 
-	roleTargets := data.NewTargets() // NewTargets always marked Dirty
-	tr.Targets[role.Name] = roleTargets
+	// an existing delegation keeps its targets, which are signed with the
+	// updated keys the next time they are published
+	if _, ok := tr.Targets[role.Name]; !ok {
+		tr.Targets[role.Name] = data.NewTargets() // NewTargets always marked Dirty
+	}
 
 	tr.keysDB.AddRole(role)
 
@@ -34,19 +34,27 @@ func Upload(url string, body io.Reader) (*http.Response, error) {
 }
 
 // ValidateTarget ensures that the data read from reader matches
-// the known metadata
+// the known metadata.  Every hash in the metadata is checked, so it fails if
+// any of them is of an unsupported algorithm.
 func ValidateTarget(r io.Reader, m *data.FileMeta) error {
-	h := sha256.New()
-	length, err := io.Copy(h, r)
+	if len(m.Hashes) == 0 {
+		return fmt.Errorf("targets entry has no hashes to check the downloaded target against")
+	}
+	algorithms := make([]string, 0, len(m.Hashes))
+	for algorithm := range m.Hashes {
+		algorithms = append(algorithms, algorithm)
+	}
+	actual, err := data.NewFileMeta(r, algorithms...)
 	if err != nil {
 		return err
 	}
-	if length != m.Length {
-		return fmt.Errorf("Size of downloaded target did not match targets entry.\nExpected: %d\nReceived: %d\n", m.Length, length)
+	if actual.Length != m.Length {
+		return fmt.Errorf("Size of downloaded target did not match targets entry.\nExpected: %d\nReceived: %d\n", m.Length, actual.Length)
 	}
-	hashDigest := h.Sum(nil)
-	if bytes.Compare(m.Hashes["sha256"], hashDigest[:]) != 0 {
-		return fmt.Errorf("Hash of downloaded target did not match targets entry.\nExpected: %x\nReceived: %x\n", m.Hashes["sha256"], hashDigest)
+	for _, algorithm := range algorithms {
+		if !bytes.Equal(m.Hashes[algorithm], actual.Hashes[algorithm]) {
+			return fmt.Errorf("%s hash of downloaded target did not match targets entry.\nExpected: %x\nReceived: %x\n", algorithm, m.Hashes[algorithm], actual.Hashes[algorithm])
+		}
 	}
 	return nil
 }
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bytes"
 	"github.com/docker/notary/tuf/data"
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -67,3 +68,26 @@ func TestFindRoleIndexNotFound(t *testing.T) {
 		FindRoleIndex(nil, role.Name),
 	)
 }
+
+func TestValidateTargetChecksEveryHash(t *testing.T) {
+	content := []byte("target contents")
+	meta, err := data.NewFileMeta(bytes.NewReader(content), "sha256", "sha512")
+	assert.NoError(t, err)
+	assert.NoError(t, ValidateTarget(bytes.NewReader(content), &meta))
+
+	// a mismatch in any of the hashes fails validation
+	badMeta := data.FileMeta{Length: meta.Length, Hashes: data.Hashes{
+		"sha256": meta.Hashes["sha256"],
+		"sha512": make([]byte, len(meta.Hashes["sha512"])),
+	}}
+	assert.Error(t, ValidateTarget(bytes.NewReader(content), &badMeta))
+
+	// as does a different length
+	badMeta = data.FileMeta{Length: meta.Length + 1, Hashes: meta.Hashes}
+	assert.Error(t, ValidateTarget(bytes.NewReader(content), &badMeta))
+
+	// there must be some hash to check, and every one must be understood
+	assert.Error(t, ValidateTarget(bytes.NewReader(content), &data.FileMeta{Length: meta.Length}))
+	badMeta = data.FileMeta{Length: meta.Length, Hashes: data.Hashes{"md5": []byte("hash")}}
+	assert.Error(t, ValidateTarget(bytes.NewReader(content), &badMeta))
+}
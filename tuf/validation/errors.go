@@ -38,8 +38,11 @@ func (err ErrBadRoot) Error() string {
 }
 
 // ErrBadTargets represents a failure to validate a targets (incl delegations)
+// Role is the targets role that failed to validate, which servers that
+// predate it don't report.
 type ErrBadTargets struct {
-	Msg string
+	Msg  string
+	Role string `json:",omitempty"`
 }
 
 func (err ErrBadTargets) Error() string {